@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acrHostPattern matches the login server of an Azure Container Registry.
+var acrHostPattern = regexp.MustCompile(`^[a-z0-9]+\.azurecr\.(io|cn|us)$`)
+
+// acrUsername is the fixed user name ACR expects with a refresh token.
+const acrUsername = "00000000-0000-0000-0000-000000000000"
+
+// armScope is the audience of the Entra ID token ACR exchanges for a
+// registry token.
+const armScope = "https://management.azure.com/.default"
+
+// acrClient is the registryProvider for Azure Container Registry. It signs
+// in as the service principal in AZURE_TENANT_ID, AZURE_CLIENT_ID and
+// AZURE_CLIENT_SECRET, else the AKS workload identity whose token
+// AZURE_FEDERATED_TOKEN_FILE holds, else the VM's managed identity
+// (AZURE_CLIENT_ID picks a user-assigned one). The Entra ID token is
+// exchanged for an ACR refresh token, which is the registry password.
+// Repositories are created by the first push.
+type acrClient struct {
+	host string
+	http *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newACRClient(host string) *acrClient {
+	if !acrHostPattern.MatchString(host) {
+		return nil
+	}
+	return &acrClient{host: host, http: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (c *acrClient) Name() string { return "ACR" }
+
+func (c *acrClient) ensureRepository(repository string) error { return nil }
+
+// credentials returns an ACR refresh token, renewed once it might not
+// outlive a build started now. Tokens are valid for 3 hours.
+func (c *acrClient) credentials() (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Until(c.expires) > BUILD_TIMEOUT+5*time.Minute {
+		return acrUsername, c.token, nil
+	}
+	aad, err := c.entraToken()
+	if err != nil {
+		return "", "", fmt.Errorf("signing in to Entra ID: %w", err)
+	}
+	form := url.Values{"grant_type": {"access_token"}, "service": {c.host}, "access_token": {aad}}
+	if tenant := os.Getenv("AZURE_TENANT_ID"); tenant != "" {
+		form.Set("tenant", tenant)
+	}
+	var resp struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.postForm("https://"+c.host+"/oauth2/exchange", form, &resp); err != nil {
+		return "", "", fmt.Errorf("exchanging Entra ID token with %s: %w", c.host, err)
+	}
+	c.token = resp.RefreshToken
+	c.expires = jwtExpiry(c.token)
+	return acrUsername, c.token, nil
+}
+
+// entraToken gets an Entra ID access token for Azure Resource Manager.
+func (c *acrClient) entraToken() (string, error) {
+	tenant, clientID := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID")
+	authority := strings.TrimSuffix(os.Getenv("AZURE_AUTHORITY_HOST"), "/")
+	if authority == "" {
+		authority = "https://login.microsoftonline.com"
+	}
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}, "client_id": {clientID}, "scope": {armScope}}
+	if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+		form.Set("client_secret", secret)
+	} else if file := os.Getenv("AZURE_FEDERATED_TOKEN_FILE"); file != "" {
+		assertion, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("reading federated token: %w", err)
+		}
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	} else {
+		return c.managedIdentityToken(clientID)
+	}
+	if tenant == "" || clientID == "" {
+		return "", errors.New("a service principal or workload identity needs AZURE_TENANT_ID and AZURE_CLIENT_ID")
+	}
+	if err := c.postForm(authority+"/"+tenant+"/oauth2/v2.0/token", form, &resp); err != nil {
+		return "", err
+	}
+	return resp.AccessToken, nil
+}
+
+// managedIdentityToken asks the instance metadata service for a token of
+// the VM's managed identity.
+func (c *acrClient) managedIdentityToken(clientID string) (string, error) {
+	q := url.Values{"api-version": {"2018-02-01"}, "resource": {"https://management.azure.com/"}}
+	if clientID != "" {
+		q.Set("client_id", clientID)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := getJSON(c.http, req, &resp); err != nil {
+		return "", fmt.Errorf("no AZURE_CLIENT_SECRET or AZURE_FEDERATED_TOKEN_FILE and no managed identity: %w", err)
+	}
+	return resp.AccessToken, nil
+}
+
+func (c *acrClient) postForm(endpoint string, form url.Values, out interface{}) error {
+	resp, err := c.http.PostForm(endpoint, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var reply struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(body, &reply) == nil && reply.Error != "" {
+			return fmt.Errorf("%s: %s", reply.Error, reply.Description)
+		}
+		return errors.New(resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// jwtExpiry reads the exp claim of a JWT without verifying it, or returns
+// the zero time if there is none, so the token is renewed on next use.
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp json.Number `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil {
+		return time.Time{}
+	}
+	exp, err := strconv.ParseInt(claims.Exp.String(), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(exp, 0)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// agentReportInterval is how often an agent ships new output to the
+	// scheduler; it doubles as the agent's heartbeat.
+	agentReportInterval = 2 * time.Second
+
+	agentRetryDelay = 5 * time.Second
+)
+
+// The client timeout must outlast a full claim long-poll.
+var agentClient = &http.Client{Timeout: claimWait + 30*time.Second}
+
+// runAgent turns this process into a builder agent: it claims jobs from the
+// scheduler at SCHEDULER_URL, runs them against the local Docker daemon and
+// reports output and results back. It never returns.
+func runAgent() {
+	slog.Info("Builder agent pulling jobs", "instance_id", INSTANCE_ID, "scheduler_url", SCHEDULER_URL)
+	go runRetention(false)
+	for i := 0; i < MAX_CONCURRENT_BUILDS; i++ {
+		go func() {
+			for {
+				job, err := agentClaim()
+				if err != nil {
+					slog.Error("Claiming job", "error", err)
+					time.Sleep(agentRetryDelay)
+					continue
+				}
+				if job != nil {
+					agentRun(job)
+				}
+			}
+		}()
+	}
+	select {}
+}
+
+func agentPost(path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(SCHEDULER_URL, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+WORKER_TOKEN)
+	return agentClient.Do(req)
+}
+
+// agentClaim returns the next job, or nil if none arrived during the poll.
+func agentClaim() (*buildJob, error) {
+	resp, err := agentPost("/internal/jobs/claim", claimRequest{Worker: INSTANCE_ID})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var job buildJob
+		if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+			return nil, err
+		}
+		return &job, nil
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("scheduler answered %s", resp.Status)
+	}
+}
+
+// agentRun executes one job locally while a reporter goroutine forwards its
+// events and watches for cancellation.
+func agentRun(job *buildJob) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	job.ctx = ctx
+	output := newBuildLog(job.BuildID)
+	slog.Info("Running build", "build_id", job.BuildID, "image", job.Image)
+
+	done := make(chan struct{})
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		mark := 0
+		ticker := time.NewTicker(agentReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+			}
+			var events []buildEvent
+			events, mark = output.eventsSince(mark)
+			if cancelled, err := agentReport(job.BuildID, events); err != nil {
+				slog.Error("Reporting build", "build_id", job.BuildID, "error", err)
+			} else if cancelled {
+				cancel()
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}()
+
+	outcome := executeBuild(job, output, output.status)
+	close(done)
+	<-reported
+
+	for attempt := 1; ; attempt++ {
+		resp, err := agentPost("/internal/jobs/"+job.BuildID+"/result", outcome)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotFound {
+				// 404: the scheduler already gave up on us; nothing to do.
+				break
+			}
+			err = fmt.Errorf("scheduler answered %s", resp.Status)
+		}
+		slog.Error("Reporting build result", "build_id", job.BuildID, "attempt", attempt, "error", err)
+		if attempt == 5 {
+			break
+		}
+		time.Sleep(agentRetryDelay)
+	}
+	slog.Info("Build finished", "build_id", job.BuildID, "status", outcome.Status)
+}
+
+// agentReport sends events (possibly none, as a heartbeat) and reports
+// whether the scheduler wants the build cancelled.
+func agentReport(buildID string, events []buildEvent) (bool, error) {
+	if events == nil {
+		events = []buildEvent{}
+	}
+	resp, err := agentPost("/internal/jobs/"+buildID+"/events", events)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// Our lease was reaped; stop burning the build host.
+		return true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("scheduler answered %s", resp.Status)
+	}
+	var body eventsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return false, err
+	}
+	return body.Cancel, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errAPIKeyNotFound = errors.New("api key not found")
+	errAPIKeyExists   = errors.New("api key already exists")
+)
+
+// APIKey is a named credential for the API. Only a hash of the key is kept.
+type APIKey struct {
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	Static    bool      `json:"static,omitempty"` // from API_KEYS_FILE, not the database
+}
+
+// createdAPIKey is the response to creating a key, the only time the key
+// itself is shown.
+type createdAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// staticAPIKeys are the keys of API_KEYS_FILE, by hash.
+var staticAPIKeys map[string]APIKey
+
+var apiKeyNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+// loadAPIKeys reads API_KEYS_FILE, a JSON array of {"name", "key",
+// "scopes"} objects. Its keys are dated by the file.
+func loadAPIKeys(path string) (map[string]APIKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Name   string   `json:"name"`
+		Key    string   `json:"key"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]APIKey, len(entries))
+	names := make(map[string]bool)
+	for _, e := range entries {
+		if err := validateAPIKey(e.Name, e.Scopes); err != nil {
+			return nil, err
+		}
+		if len(e.Key) < 16 {
+			return nil, fmt.Errorf("key of %s must be at least 16 characters", e.Name)
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf("%s is listed twice", e.Name)
+		}
+		names[e.Name] = true
+		keys[hashAPIKey(e.Key)] = APIKey{Name: e.Name, Scopes: e.Scopes, CreatedAt: info.ModTime().UTC(), Static: true}
+	}
+	return keys, nil
+}
+
+func validateAPIKey(name string, scopes []string) error {
+	if !apiKeyNamePattern.MatchString(name) {
+		return fieldErrorf("name", codePattern, "Invalid API key name %q: use lowercase letters, digits, '.', '_' and '-'", name)
+	}
+	if len(scopes) == 0 {
+		return fieldErrorf("scopes", codeRequired, "scopes are required")
+	}
+	for i, s := range scopes {
+		if !validScope(s) {
+			return fieldErrorf(fmt.Sprintf("scopes[%d]", i), codeEnum, "Unknown scope %q", s)
+		}
+	}
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKeySecret() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return "aif_" + hex.EncodeToString(b)
+}
+
+// lookupAPIKey resolves a presented key against API_KEYS_FILE, then the
+// database.
+func lookupAPIKey(key string) (APIKey, error) {
+	hash := hashAPIKey(key)
+	if k, ok := staticAPIKeys[hash]; ok {
+		return k, nil
+	}
+	return builds.store.apiKeyByHash(hash)
+}
+
+// apiKeysHandler routes /api-keys, where admins manage the keys kept in
+// the database.
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if !authEnabled() {
+		httpError(w, "Authentication is not enabled; set API_KEYS_FILE or OIDC_ISSUER_URL", http.StatusNotFound)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api-keys"), "/")
+	switch {
+	case name == "" && r.Method == http.MethodPost:
+		createAPIKey(w, r)
+	case name == "" && r.Method == http.MethodGet:
+		listAPIKeys(w, r)
+	case name != "" && !strings.Contains(name, "/") && r.Method == http.MethodDelete:
+		deleteAPIKey(w, r, name)
+	case strings.Contains(name, "/"):
+		httpError(w, "Not found", http.StatusNotFound)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, fieldErrorf("body", codeInvalidJSON, "body is not valid JSON: %s", err))
+		return
+	}
+	if err := validateAPIKey(req.Name, req.Scopes); err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, k := range staticAPIKeys {
+		if k.Name == req.Name {
+			httpError(w, "An API key of that name is in API_KEYS_FILE", http.StatusConflict)
+			return
+		}
+	}
+
+	created := createdAPIKey{
+		APIKey: APIKey{Name: req.Name, Scopes: req.Scopes, CreatedAt: time.Now().UTC()},
+		Key:    newAPIKeySecret(),
+	}
+	err := builds.store.insertAPIKey(created.APIKey, hashAPIKey(created.Key))
+	if err == errAPIKeyExists {
+		httpError(w, "An API key of that name exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	admin, _ := principalFrom(r.Context())
+	logger(r.Context()).Info("API key created", "key", created.Name, "by", admin.Name, "scopes", created.Scopes)
+	auditRequest(r, AuditEntry{Action: auditAPIKeyCreate, Target: created.Name})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPath(r, "/api-keys/"+created.Name))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := builds.store.listAPIKeys()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, k := range staticAPIKeys {
+		keys = append(keys, k)
+	}
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func deleteAPIKey(w http.ResponseWriter, r *http.Request, name string) {
+	err := builds.store.deleteAPIKey(name)
+	if err == errAPIKeyNotFound {
+		httpError(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	admin, _ := principalFrom(r.Context())
+	logger(r.Context()).Info("API key revoked", "key", name, "by", admin.Name)
+	auditRequest(r, AuditEntry{Action: auditAPIKeyDelete, Target: name})
+	w.WriteHeader(http.StatusNoContent)
+}
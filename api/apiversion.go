@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// apiV1 prefixes the current version of the API. A breaking change gets a
+// new prefix, with the handlers for the old one kept beside it.
+const apiV1 = "/v1"
+
+// legacySuccessors maps the unversioned routes that were renamed in v1 to
+// their successors; the others keep their path under the prefix.
+var legacySuccessors = map[string]string{
+	"/build-and-push": "/builds",
+}
+
+type apiBaseKey struct{}
+
+// v1 serves handler under apiV1. The handler sees the path without the
+// prefix, like an unversioned request, and apiPath puts it back in the
+// links it returns.
+func v1(handler http.HandlerFunc) http.HandlerFunc {
+	stripped := http.StripPrefix(apiV1, handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		stripped.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiBaseKey{}, apiV1)))
+	}
+}
+
+// legacy serves handler on the unversioned route it was first published
+// on, so existing callers keep working, and points them at the v1 route.
+func legacy(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		successor, ok := legacySuccessors[r.URL.Path]
+		if !ok {
+			successor = r.URL.Path
+		}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", apiV1, successor))
+		handler(w, r)
+	}
+}
+
+// apiPath is path in the API version r was made to.
+func apiPath(r *http.Request, path string) string {
+	base, _ := r.Context().Value(apiBaseKey{}).(string)
+	return base + path
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// AptRepository is an extra apt source. Line is a one-line sources.list
+// entry, e.g. "deb https://packages.microsoft.com/debian/12/prod bookworm
+// main". KeyURL, if set, must serve the repository's ASCII-armored signing
+// key, which is installed into /etc/apt/trusted.gpg.d.
+type AptRepository struct {
+	Line   string `json:"line"`
+	KeyURL string `json:"key_url,omitempty"`
+}
+
+// aptLinePattern accepts "deb" and "deb-src" entries with optional
+// [options]. Quotes, shell metacharacters and newlines are refused because
+// the line is echoed into the image from a RUN step.
+var aptLinePattern = regexp.MustCompile(`^deb(-src)? (\[[a-zA-Z0-9=,._/:+ -]+\] )?[a-z]+://[^\s'"\\$` + "`" + `;&|<>]+( [a-zA-Z0-9._/+-]+)+$`)
+
+// validate checks r, which is at field in the request, such as
+// apt_repositories[0].
+func (r *AptRepository) validate(field string) error {
+	r.Line = strings.Join(strings.Fields(r.Line), " ")
+	if !aptLinePattern.MatchString(r.Line) {
+		return fieldErrorf(field+".line", codeInvalid, "Invalid apt repository line %q", r.Line)
+	}
+	if r.KeyURL != "" {
+		if err := validateURLField(field+".key_url", r.KeyURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audited actions, the change-management record of who built, promoted,
+// deleted or reconfigured what.
+const (
+	auditBuild          = "build.submit"
+	auditBuildCancel    = "build.cancel"
+	auditImagePromote   = "image.promote"
+	auditImageRetag     = "image.retag"
+	auditImageDelete    = "image.delete"
+	auditTemplateCreate = "template.create"
+	auditTemplateUpdate = "template.update"
+	auditTemplateDelete = "template.delete"
+	auditProjectCreate  = "project.create"
+	auditProjectUpdate  = "project.update"
+	auditProjectDelete  = "project.delete"
+	auditScheduleCreate = "schedule.create"
+	auditScheduleDelete = "schedule.delete"
+	auditAPIKeyCreate   = "api_key.create"
+	auditAPIKeyDelete   = "api_key.delete"
+)
+
+var auditActions = map[string]bool{
+	auditBuild: true, auditBuildCancel: true,
+	auditImagePromote: true, auditImageRetag: true, auditImageDelete: true,
+	auditTemplateCreate: true, auditTemplateUpdate: true, auditTemplateDelete: true,
+	auditProjectCreate: true, auditProjectUpdate: true, auditProjectDelete: true,
+	auditScheduleCreate: true, auditScheduleDelete: true,
+	auditAPIKeyCreate: true, auditAPIKeyDelete: true,
+}
+
+// AuditEntry records one action. Actor is who was authenticated, or
+// without authentication who the request said it was from; actions the
+// factory takes by itself have actors such as "schedule:<id>",
+// "tag-retention" and "vulnerability-scan". SpecHash is the content hash of the spec an image was
+// built from, its content-hash tag.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	BuildID   string    `json:"build_id,omitempty"`
+	SpecHash  string    `json:"spec_hash,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	Digest    string    `json:"digest,omitempty"`
+	Target    string    `json:"target,omitempty"`  // the template, project, schedule or API key acted on, or the image promoted to
+	Outcome   string    `json:"outcome,omitempty"` // e.g. queued, deduplicated or skipped for builds
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// auditFilter selects entries for GET /audit, newest first.
+type auditFilter struct {
+	Action string
+	Actor  string
+	After  *time.Time
+	Before *time.Time
+	Cursor int64 // only entries with a smaller ID, 0 for none
+	Limit  int
+}
+
+// auditActor is who ctx's request is authenticated as, else fallback.
+func auditActor(ctx context.Context, fallback string) string {
+	if p, ok := principalFrom(ctx); ok {
+		return p.Name
+	}
+	if fallback == "" {
+		return "anonymous"
+	}
+	return fallback
+}
+
+// audit records e, made during ctx's request if any. The action has
+// happened by then, so a failure to record it is logged rather than
+// failing the request.
+func audit(ctx context.Context, e AuditEntry) {
+	e.Time = time.Now().UTC()
+	e.RequestID = requestIDFrom(ctx)
+	if err := builds.store.insertAuditEntry(e); err != nil {
+		logger(ctx).Error("Recording audit entry", "action", e.Action, "actor", e.Actor, "error", err)
+	}
+}
+
+// auditRequest records e as done by the caller of r.
+func auditRequest(r *http.Request, e AuditEntry) {
+	e.Actor = auditActor(r.Context(), r.Header.Get("X-Requested-By"))
+	audit(r.Context(), e)
+}
+
+// auditList is one page of GET /audit. NextCursor is empty on the last
+// page.
+type auditList struct {
+	Entries    []AuditEntry `json:"entries"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// auditHandler serves GET /audit. Supported query parameters: action,
+// actor, after and before (RFC 3339), limit and cursor.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.Trim(r.URL.Path, "/") != "audit" {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// Fetch one extra row to learn whether there is another page.
+	limit := filter.Limit
+	filter.Limit++
+	entries, err := builds.store.listAuditEntries(filter)
+	if err != nil {
+		logger(r.Context()).Error("Listing audit entries", "error", err)
+		httpError(w, "Listing audit entries failed", http.StatusInternalServerError)
+		return
+	}
+	result := auditList{Entries: entries}
+	if len(entries) > limit {
+		result.Entries = entries[:limit]
+		result.NextCursor = strconv.FormatInt(result.Entries[limit-1].ID, 10)
+	}
+	if result.Entries == nil {
+		result.Entries = []AuditEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func parseAuditFilter(q url.Values) (auditFilter, error) {
+	f := auditFilter{Action: q.Get("action"), Actor: q.Get("actor"), Limit: defaultListLimit}
+	if f.Action != "" && !auditActions[f.Action] {
+		return f, fieldErrorf("action", codeEnum, "Unknown action %q", f.Action)
+	}
+	var err error
+	if f.After, err = timeParam(q, "after"); err != nil {
+		return f, err
+	}
+	if f.Before, err = timeParam(q, "before"); err != nil {
+		return f, err
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			return f, fieldErrorf("limit", codeInvalid, "limit must be between 1 and %d", maxListLimit)
+		}
+		f.Limit = n
+	}
+	if v := q.Get("cursor"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return f, fieldErrorf("cursor", codeInvalid, "Invalid cursor")
+		}
+		f.Cursor = n
+	}
+	return f, nil
+}
+
+// auditSubmission records a build request by requester and what came of
+// it: result is the build that serves it, a running one for a duplicate.
+func auditSubmission(ctx context.Context, requester string, result Build, outcome string) {
+	audit(ctx, AuditEntry{
+		Actor:    auditActor(ctx, requester),
+		Action:   auditBuild,
+		BuildID:  result.ID,
+		SpecHash: result.Tag,
+		Image:    result.Image,
+		Outcome:  outcome,
+	})
+}
+
+// auditImage records an action on the image in repo tagged tag, with the
+// build that pushed it, if the factory knows of one.
+func auditImage(r *http.Request, repo projectRepository, action, tag, digest, target string) {
+	e := AuditEntry{
+		Action: action,
+		Image:  repo.name + ":" + tag,
+		Digest: digest,
+		Target: target,
+	}
+	if known, err := builds.store.buildsForTags(repo.project, []string{tag}); err == nil && len(known) > 0 {
+		e.BuildID, e.SpecHash = known[0].ID, known[0].Tag
+	}
+	auditRequest(r, e)
+}
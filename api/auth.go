@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Scopes a caller can hold. Each route family has a read scope, for GET,
+// and a write scope for everything else, except images, where promoting
+// and retagging need images:promote and deleting images:delete, the
+// audit log, which is read-only, and a project's builds, which need the
+// builds scopes. admin grants all of them and the management of API keys.
+const (
+	scopeAdmin     = "admin"
+	scopeAudit     = "audit"
+	scopeBuilds    = "builds"
+	scopeImages    = "images"
+	scopeProjects  = "projects"
+	scopeSchedules = "schedules"
+	scopeTemplates = "templates"
+
+	scopeImagesPromote = scopeImages + ":promote"
+	scopeImagesDelete  = scopeImages + ":delete"
+)
+
+var knownScopes = map[string]bool{
+	scopeAdmin:                true,
+	scopeAudit + ":read":      true,
+	scopeBuilds + ":read":     true,
+	scopeBuilds + ":write":    true,
+	scopeImages + ":read":     true,
+	scopeImagesPromote:        true,
+	scopeImagesDelete:         true,
+	scopeProjects + ":read":   true,
+	scopeProjects + ":write":  true,
+	scopeSchedules + ":read":  true,
+	scopeSchedules + ":write": true,
+	scopeTemplates + ":read":  true,
+	scopeTemplates + ":write": true,
+}
+
+// scopeProjectPrefix starts the scopes that bind a caller to a project:
+// "project:team-a" lets it use project team-a, with the rest of its scopes
+// saying what it may do there. Only admins may use projects they are not
+// bound to.
+const scopeProjectPrefix = "project:"
+
+// roles are bundles of scopes, given to API keys and client certificates
+// by name in place of scopes, and to people by OIDC_GROUP_ROLES. Only
+// promoters may promote or retag images; deleting images and editing
+// templates and projects is left to admins.
+var roles = map[string][]string{
+	"viewer": {
+		scopeBuilds + ":read", scopeImages + ":read", scopeProjects + ":read", scopeSchedules + ":read", scopeTemplates + ":read",
+	},
+	"builder": {
+		scopeBuilds + ":read", scopeImages + ":read", scopeProjects + ":read", scopeSchedules + ":read", scopeTemplates + ":read",
+		scopeBuilds + ":write", scopeSchedules + ":write",
+	},
+	"promoter": {
+		scopeBuilds + ":read", scopeImages + ":read", scopeProjects + ":read", scopeSchedules + ":read", scopeTemplates + ":read",
+		scopeBuilds + ":write", scopeSchedules + ":write", scopeImagesPromote,
+	},
+	"admin": {scopeAdmin},
+}
+
+// impliedScopes are scopes that grant others: images:write, from before
+// images:promote and images:delete were told apart, grants both.
+var impliedScopes = map[string][]string{
+	scopeImages + ":write": {scopeImagesPromote, scopeImagesDelete},
+}
+
+// validScope reports whether s is a scope or role a caller can be given.
+func validScope(s string) bool {
+	_, role := roles[s]
+	_, implies := impliedScopes[s]
+	return knownScopes[s] || role || implies || isProjectScope(s)
+}
+
+// isProjectScope reports whether s binds a caller to a project.
+func isProjectScope(s string) bool {
+	return strings.HasPrefix(s, scopeProjectPrefix) && projectNamePattern.MatchString(strings.TrimPrefix(s, scopeProjectPrefix))
+}
+
+// mayUseProject reports whether the caller of ctx may build in, and see
+// the builds and images of, project. Everyone may when authentication is
+// off, and every caller may use the factory's own image, project "".
+func mayUseProject(ctx context.Context, project string) bool {
+	if project == "" || !authEnabled() {
+		return true
+	}
+	p, ok := principalFrom(ctx)
+	return ok && p.allows(scopeProjectPrefix+project)
+}
+
+// boundProjects lists the projects the caller of ctx is bound to, with all
+// set when it may use every project: authentication is off or it is an
+// admin.
+func boundProjects(ctx context.Context) (projects []string, all bool) {
+	if !authEnabled() {
+		return nil, true
+	}
+	p, ok := principalFrom(ctx)
+	if !ok {
+		return nil, false
+	}
+	if p.allows(scopeAdmin) {
+		return nil, true
+	}
+	for _, s := range p.Scopes {
+		if isProjectScope(s) {
+			projects = append(projects, strings.TrimPrefix(s, scopeProjectPrefix))
+		}
+	}
+	return projects, false
+}
+
+// projectAllowed answers 403 unless the caller of r may use project.
+func projectAllowed(w http.ResponseWriter, r *http.Request, project string) bool {
+	if mayUseProject(r.Context(), project) {
+		return true
+	}
+	p, _ := principalFrom(r.Context())
+	httpError(w, fmt.Sprintf("%s is not bound to project %s", p.Name, project), http.StatusForbidden)
+	return false
+}
+
+// allowedBuild looks up build id for one of the /builds/{id} routes. It
+// answers 404 when there is no such build and 403 when the build belongs
+// to a project the caller of r is not bound to.
+func allowedBuild(w http.ResponseWriter, r *http.Request, id string) (Build, bool) {
+	build, ok := builds.get(id)
+	if !ok {
+		httpError(w, "Build not found", http.StatusNotFound)
+		return Build{}, false
+	}
+	if !projectAllowed(w, r, build.Request.Project) {
+		return Build{}, false
+	}
+	return build, true
+}
+
+// principal is who a request is authenticated as: an API key, a person
+// signed in with the SSO provider, or the holder of a client certificate.
+type principal struct {
+	Name   string
+	Scopes []string
+	Method string // authAPIKey, authOIDC or authClientCert
+}
+
+const (
+	authAPIKey     = "api-key"
+	authOIDC       = "oidc"
+	authClientCert = "client-cert"
+)
+
+// allows reports whether p holds scope, directly, through a role or
+// through a scope that implies it.
+func (p principal) allows(scope string) bool {
+	for _, s := range p.Scopes {
+		granted := append([]string{s}, roles[s]...)
+		granted = append(granted, impliedScopes[s]...)
+		for _, g := range granted {
+			if g == scope || g == scopeAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// errInvalidCredentials is a credential that is unknown, expired or fails
+// verification.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// authEnabled reports whether requests need credentials. API_KEYS_FILE or
+// OIDC_ISSUER_URL turns it on.
+func authEnabled() bool {
+	return staticAPIKeys != nil || oidcEnabled()
+}
+
+// authenticate resolves a bearer credential: a JWT from the SSO provider
+// when OIDC is on and it looks like one, an API key otherwise. Errors
+// wrapping errInvalidCredentials are the caller's fault.
+func authenticate(credential string) (principal, error) {
+	if oidcEnabled() && strings.Count(credential, ".") == 2 {
+		return oidc.authenticate(credential)
+	}
+	key, err := lookupAPIKey(credential)
+	if err == errAPIKeyNotFound {
+		return principal{}, fmt.Errorf("%w: unknown API key", errInvalidCredentials)
+	}
+	if err != nil {
+		return principal{}, err
+	}
+	return principal{Name: key.Name, Scopes: key.Scopes, Method: authAPIKey}, nil
+}
+
+// presentedCredential takes the credential from "Authorization: Bearer" or
+// X-API-Key.
+func presentedCredential(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+type principalContextKey struct{}
+
+// principalFrom returns who a request was authenticated as, if anyone.
+func principalFrom(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(principal)
+	return p, ok
+}
+
+// requiredScope is the scope a request to resource needs: its read scope
+// for GET and HEAD, its write scope otherwise, for images the scope of
+// what the request does to them, or for a project's builds that of builds.
+func requiredScope(resource string, r *http.Request) string {
+	switch {
+	case resource == scopeAdmin:
+		return scopeAdmin
+	case resource == scopeProjects && isProjectBuildsPath(r.URL.Path):
+		return requiredScope(scopeBuilds, r)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return resource + ":read"
+	case resource == scopeImages && r.Method == http.MethodDelete:
+		return scopeImagesDelete
+	case resource == scopeImages:
+		return scopeImagesPromote
+	}
+	return resource + ":write"
+}
+
+// authorized lets a request through to handler if its caller holds the
+// scope resource requires, when authentication is on.
+func authorized(resource string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() {
+			handler(w, r)
+			return
+		}
+		credential := presentedCredential(r)
+		p, fromCert := clientCertPrincipal(r.TLS)
+		if credential == "" && !fromCert {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="airflow-image-factory"`)
+			httpError(w, "An API key or SSO token is required", http.StatusUnauthorized)
+			return
+		}
+		var err error
+		if credential != "" {
+			p, err = authenticate(credential)
+		}
+		if errors.Is(err, errInvalidCredentials) {
+			reason := strings.TrimPrefix(err.Error(), errInvalidCredentials.Error()+": ")
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="airflow-image-factory", error="invalid_token", error_description=%q`, reason))
+			httpError(w, "Invalid credentials: "+reason, http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			logger(r.Context()).Error("Authenticating request", "error", err)
+			httpError(w, "Authentication failed", http.StatusInternalServerError)
+			return
+		}
+		scope := requiredScope(resource, r)
+		if !p.allows(scope) {
+			httpError(w, fmt.Sprintf("%s lacks the %s scope", p.Name, scope), http.StatusForbidden)
+			return
+		}
+		annotateRequest(r.Context(), slog.String("principal", p.Name), slog.String("auth", p.Method))
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p)))
+	}
+}
+
+// requesterOf is who a request is made by. A person signed in with the SSO
+// provider is who their token says; otherwise it is X-Requested-By, or the
+// name of the API key.
+func requesterOf(r *http.Request) string {
+	p, _ := principalFrom(r.Context())
+	if p.Method == authOIDC {
+		return p.Name
+	}
+	if requester := r.Header.Get("X-Requested-By"); requester != "" {
+		return requester
+	}
+	return p.Name
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"docker-airflow-api/factorypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withProjectBuilds points the registry at a fresh store holding a finished
+// build of project a, one of project b and an unassigned one, and turns on
+// authentication with a key bound to each project and an admin key.
+func withProjectBuilds(t *testing.T) {
+	t.Helper()
+	store, err := openSQLStore(dialectSQLite, "sqlite3", filepath.Join(t.TempDir(), "factory.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedStore, savedKeys := builds.store, staticAPIKeys
+	builds.store = store
+	staticAPIKeys = map[string]APIKey{
+		hashAPIKey("team-a-key"): {Name: "team-a-ci", Scopes: []string{"builder", "project:a"}},
+		hashAPIKey("team-b-key"): {Name: "team-b-ci", Scopes: []string{"builder", "project:b"}},
+		hashAPIKey("root-key"):   {Name: "root", Scopes: []string{"admin"}},
+	}
+	t.Cleanup(func() {
+		builds.store, staticAPIKeys = savedStore, savedKeys
+		store.db.Close()
+	})
+
+	created := time.Now().UTC().Add(-time.Hour)
+	for i, project := range []string{"a", "b", ""} {
+		finished := created.Add(time.Minute)
+		b := Build{
+			ID:         "build-" + project,
+			Status:     StatusSucceeded,
+			Tag:        "tag-" + project,
+			Request:    DockerBuildRequest{AirflowVersion: "2.9.3", PythonVersion: "3.11", Project: project},
+			CreatedAt:  created.Add(time.Duration(i) * time.Second),
+			FinishedAt: &finished,
+		}
+		if err := store.insertBuild(b); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.updateBuild(b); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.saveLogs(b.ID, []string{"done"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func serveBuilds(method, path, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	authorized(scopeBuilds, buildsHandler)(w, r)
+	return w
+}
+
+func TestBuildRoutesCheckProject(t *testing.T) {
+	withProjectBuilds(t)
+	routes := []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{name: "get", method: http.MethodGet, path: "/builds/build-b"},
+		{name: "cancel", method: http.MethodDelete, path: "/builds/build-b"},
+		{name: "logs", method: http.MethodGet, path: "/builds/build-b/logs"},
+		{name: "logs stream", method: http.MethodGet, path: "/builds/build-b/logs/stream"},
+		{name: "sbom", method: http.MethodGet, path: "/builds/build-b/sbom"},
+		{name: "ws", method: http.MethodGet, path: "/builds/build-b/ws"},
+	}
+	for _, tt := range routes {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serveBuilds(tt.method, tt.path, "team-a-key"); w.Code != http.StatusForbidden {
+				t.Errorf("%s %s as project a = %d, want 403", tt.method, tt.path, w.Code)
+			}
+			if w := serveBuilds(tt.method, tt.path, "team-b-key"); w.Code == http.StatusForbidden {
+				t.Errorf("%s %s as project b = 403: %s", tt.method, tt.path, w.Body)
+			}
+		})
+	}
+}
+
+func TestListBuildsFiltersProjects(t *testing.T) {
+	withProjectBuilds(t)
+	tests := []struct {
+		name     string
+		path     string
+		key      string
+		wantCode int
+		want     []string
+	}{
+		{name: "bound projects and unassigned", path: "/builds", key: "team-a-key", wantCode: http.StatusOK, want: []string{"build-", "build-a"}},
+		{name: "own project", path: "/builds?project=a", key: "team-a-key", wantCode: http.StatusOK, want: []string{"build-a"}},
+		{name: "other project", path: "/builds?project=b", key: "team-a-key", wantCode: http.StatusForbidden},
+		{name: "admin", path: "/builds", key: "root-key", wantCode: http.StatusOK, want: []string{"build-", "build-a", "build-b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveBuilds(http.MethodGet, tt.path, tt.key)
+			if w.Code != tt.wantCode {
+				t.Fatalf("GET %s = %d, want %d: %s", tt.path, w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var list buildList
+			if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, b := range list.Builds {
+				got = append(got, b.ID)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("GET %s builds = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+// eventStream collects what StreamBuildLogs sends.
+type eventStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events []*factorypb.LogEvent
+}
+
+func (s *eventStream) Context() context.Context { return s.ctx }
+
+func (s *eventStream) Send(ev *factorypb.LogEvent) error {
+	s.events = append(s.events, ev)
+	return nil
+}
+
+func TestGRPCChecksProject(t *testing.T) {
+	withProjectBuilds(t)
+	ctx := context.WithValue(context.Background(), principalContextKey{}, principal{Name: "team-a-ci", Scopes: []string{"builder", "project:a"}})
+	var server imageFactoryServer
+
+	_, err := server.CreateBuild(ctx, &factorypb.CreateBuildRequest{Spec: &factorypb.BuildSpec{AirflowVersion: "2.9.3", PythonVersion: "3.11", Project: "b"}})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("CreateBuild() in project b error = %v, want PermissionDenied", err)
+	}
+	if _, err := server.GetBuild(ctx, &factorypb.GetBuildRequest{Id: "build-b"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("GetBuild() of project b error = %v, want PermissionDenied", err)
+	}
+	if err := server.StreamBuildLogs(&factorypb.StreamBuildLogsRequest{Id: "build-b"}, &eventStream{ctx: ctx}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("StreamBuildLogs() of project b error = %v, want PermissionDenied", err)
+	}
+	stream := &eventStream{ctx: ctx}
+	if err := server.StreamBuildLogs(&factorypb.StreamBuildLogsRequest{Id: "build-a"}, stream); err != nil || len(stream.events) == 0 {
+		t.Errorf("StreamBuildLogs() of project a = %d events, error %v", len(stream.events), err)
+	}
+}
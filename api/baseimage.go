@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// imageRefPattern accepts docker image references of the form
+// [host[:port]/]path[:tag][@sha256:digest].
+var imageRefPattern = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(:[0-9]+)?(/[a-z0-9]+([._-]+[a-z0-9]+)*)*(:[A-Za-z0-9_][A-Za-z0-9_.-]{0,127})?(@sha256:[a-f0-9]{64})?$`)
+
+// Image flavors accepted in DockerBuildRequest.ImageFlavor, matching the
+// official image tags.
+const (
+	flavorRegular = "regular"
+	flavorSlim    = "slim"
+)
+
+// baseImageName is the image a request's Dockerfile starts from: BaseImage
+// when given, otherwise the official Airflow image for its versions and
+// flavor.
+func baseImageName(req DockerBuildRequest) string {
+	if req.BaseImage != "" {
+		return req.BaseImage
+	}
+	if req.ImageFlavor == flavorSlim {
+		return fmt.Sprintf("apache/airflow:slim-%s-python%s", req.AirflowVersion, req.PythonVersion)
+	}
+	return fmt.Sprintf("apache/airflow:%s-python%s", req.AirflowVersion, req.PythonVersion)
+}
+
+// mirroredImage pulls image through BASE_IMAGE_MIRROR when it is a Docker
+// Hub image, e.g. apache/airflow:2.9.3 becomes mirror.corp/apache/airflow:2.9.3
+// and python:3.11 becomes mirror.corp/library/python:3.11. Images from any
+// other registry are left alone.
+func mirroredImage(image string) string {
+	if BASE_IMAGE_MIRROR == "" {
+		return image
+	}
+	for _, hub := range []string{"docker.io/", "index.docker.io/"} {
+		image = strings.TrimPrefix(image, hub)
+	}
+	if i := strings.Index(image, "/"); i < 0 {
+		image = "library/" + image
+	} else if host := image[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+		return image
+	}
+	return BASE_IMAGE_MIRROR + "/" + image
+}
+
+func validateImageFlavor(flavor string) error {
+	switch flavor {
+	case "", flavorRegular, flavorSlim:
+		return nil
+	}
+	return fieldErrorf("image_flavor", codeEnum, "image_flavor must be %s or %s", flavorRegular, flavorSlim)
+}
+
+// validateBaseImage checks a request's BaseImage is a well-formed image
+// reference and, when BASE_IMAGE_ALLOWLIST is set, that it comes from one
+// of the allowed repositories.
+func validateBaseImage(image string) error {
+	if image == "" {
+		return nil
+	}
+	if !imageRefPattern.MatchString(image) {
+		return fieldErrorf("base_image", codeFormat, "Invalid base_image %q", image)
+	}
+	allowlist := baseImageAllowlist()
+	if len(allowlist) == 0 {
+		return nil
+	}
+	for _, prefix := range allowlist {
+		if strings.HasPrefix(image, prefix) {
+			return nil
+		}
+	}
+	return fieldErrorf("base_image", codeInvalid, "base_image %s is not allowed; use an image from %s", image, strings.Join(allowlist, ", "))
+}
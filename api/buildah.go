@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// buildahDigestFile is where buildah or podman records the pushed image's
+// digest, inside the build's workspace.
+const buildahDigestFile = "push-digest"
+
+// buildahBuilder builds and pushes job with buildah or podman, whichever
+// BUILD_BACKEND names. Both run daemonless and rootless and take the same
+// secret, ssh and build-arg flags as docker, so buildFlags is reused.
+// Multi-platform builds are left to buildx.
+type buildahBuilder struct {
+	engine    string
+	job       *buildJob
+	workspace string
+	output    *buildLog
+	authDir   string
+}
+
+func newBuildahBuilder(job *buildJob, workspace string, output *buildLog) (builder, error) {
+	engine := BUILD_BACKEND
+	if len(job.Platforms) > 0 {
+		return nil, fmt.Errorf("Multi-platform builds are not supported by the %s build backend", engine)
+	}
+	// As with kaniko, registry credentials stay out of the build context.
+	authDir, err := os.MkdirTemp("", engine+"-auth-")
+	if err != nil {
+		return nil, fmt.Errorf("Creating registry config: %w", err)
+	}
+	if err := writeRegistryConfig(authDir); err != nil {
+		os.RemoveAll(authDir)
+		return nil, fmt.Errorf("Writing registry config: %w", err)
+	}
+	return &buildahBuilder{engine: engine, job: job, workspace: workspace, output: output, authDir: authDir}, nil
+}
+
+func (b *buildahBuilder) Name() string    { return b.engine }
+func (b *buildahBuilder) Logs() *buildLog { return b.output }
+func (b *buildahBuilder) Cancel()         { os.RemoveAll(b.authDir) }
+
+func (b *buildahBuilder) Build(ctx context.Context) error {
+	args := []string{"build", "--layers", "--authfile", filepath.Join(b.authDir, "config.json"), "-t", b.job.Image, "-f", filepath.Join(b.workspace, "Dockerfile")}
+	args = append(args, buildFlags(b.job)...)
+	args = append(args, limitFlags()...)
+	args = append(args, buildahTLSFlags(BUILD_CACHE_REPO, BASE_IMAGE_MIRROR)...)
+	if BUILD_CACHE_REPO != "" {
+		// buildah keeps one cache image per layer in the repository.
+		args = append(args, "--cache-from", BUILD_CACHE_REPO, "--cache-to", BUILD_CACHE_REPO)
+	}
+	args = append(args, b.workspace)
+	return runLogged(exec.CommandContext(ctx, b.engine, args...), b.output)
+}
+
+func (b *buildahBuilder) Push(ctx context.Context) (string, error) {
+	return b.push(ctx, b.job.Image)
+}
+
+func (b *buildahBuilder) PushAs(ctx context.Context, image string) (string, error) {
+	return b.push(ctx, image)
+}
+
+func (b *buildahBuilder) ExportImage(ctx context.Context, path string) error {
+	return runLogged(exec.CommandContext(ctx, b.engine, "push", b.job.Image, "docker-archive:"+path+":"+b.job.Image), b.output)
+}
+
+// push pushes the built image to dest, returning its digest there.
+func (b *buildahBuilder) push(ctx context.Context, dest string) (string, error) {
+	// Renew the credentials, which a cloud registry may have expired
+	// during a long build.
+	if err := writeRegistryConfig(b.authDir); err != nil {
+		return "", fmt.Errorf("Writing registry config: %w", err)
+	}
+	digestFile := filepath.Join(b.workspace, buildahDigestFile)
+	args := []string{"push", "--authfile", filepath.Join(b.authDir, "config.json"), "--digestfile", digestFile}
+	args = append(args, buildahTLSFlags(dest)...)
+	args = append(args, b.job.Image, dest)
+	if err := runLogged(exec.CommandContext(ctx, b.engine, args...), b.output); err != nil {
+		return "", err
+	}
+	digest, err := os.ReadFile(digestFile)
+	if err != nil {
+		slog.Warn("Reading digest", "engine", b.engine, "error", err)
+	}
+	return strings.TrimSpace(string(digest)), nil
+}
+
+// buildahTLSFlags trust REGISTRY_CA_FILE and, if any of refs is in a plain
+// HTTP or insecure registry, turn verification off; buildah and podman
+// have one switch for both.
+func buildahTLSFlags(refs ...string) []string {
+	var flags []string
+	if registryCertDir != "" {
+		flags = append(flags, "--cert-dir", registryCertDir)
+	}
+	for _, ref := range refs {
+		if ref != "" && (plainHTTP(ref) || insecureRegistry(ref)) {
+			return append(flags, "--tls-verify=false")
+		}
+	}
+	return flags
+}
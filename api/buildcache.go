@@ -0,0 +1,23 @@
+package main
+
+// buildCacheTag is the tag under BUILD_CACHE_REPO that BuildKit-based
+// builders export their layer cache to and import it from.
+const buildCacheTag = "buildcache"
+
+func buildCacheRef() string {
+	return BUILD_CACHE_REPO + ":" + buildCacheTag
+}
+
+// registryCacheFlags are the --cache-from and --cache-to flags that make
+// buildx and nerdctl share BUILD_CACHE_REPO as a registry cache. Exporting
+// in max mode caches the builder stage of slim builds too.
+func registryCacheFlags() []string {
+	if BUILD_CACHE_REPO == "" {
+		return nil
+	}
+	ref := "type=registry,ref=" + buildCacheRef()
+	if plainHTTP(BUILD_CACHE_REPO) || insecureRegistry(BUILD_CACHE_REPO) {
+		ref += ",registry.insecure=true"
+	}
+	return []string{"--cache-from", ref, "--cache-to", ref + ",mode=max"}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Build backends accepted in BUILD_BACKEND.
+const (
+	backendDocker  = "docker"
+	backendKaniko  = "kaniko"
+	backendBuildah = "buildah"
+	backendPodman  = "podman"
+	backendNerdctl = "nerdctl"
+
+	backendKubernetes = "kubernetes"
+)
+
+// builder is a build engine working on one job, whose context has already
+// been written to a workspace directory. The executor drives it through
+// Build and then Push, retrying and timing each step, so engines only deal
+// with their own tooling. Engines that can only build and push in one go
+// (buildx, kaniko) push in Build and just report the digest from Push.
+type builder interface {
+	// Name names the engine in step names, e.g. "Docker".
+	Name() string
+	// Build produces the job's image. It may be called again after a
+	// transient failure.
+	Build(ctx context.Context) error
+	// Push publishes the built image and returns its manifest digest, or ""
+	// if the engine cannot tell.
+	Push(ctx context.Context) (string, error)
+	// Cancel releases whatever the engine holds for the job, stopping any
+	// work still running on its side. It is called once the job ends,
+	// however it ends.
+	Cancel()
+	// Logs is where the engine streams its output.
+	Logs() *buildLog
+}
+
+// imageSizer is implemented by builders that can tell the size of the image
+// they built, before it is pushed.
+type imageSizer interface {
+	ImageSize(ctx context.Context) int64
+}
+
+// imagePusher is implemented by builders that can push the image they
+// built under another name once Push is done, so each of a job's
+// ExtraImages succeeds or fails on its own. The other builders push
+// ExtraImages along with Image.
+type imagePusher interface {
+	PushAs(ctx context.Context, image string) (string, error)
+}
+
+// imageExporter is implemented by builders that keep the image they built
+// on the build host, so it can be scanned before anything is pushed. The
+// others' images are scanned in the registry.
+type imageExporter interface {
+	// ExportImage writes the built image to path as a docker-archive.
+	ExportImage(ctx context.Context, path string) error
+}
+
+// builderBackends creates the builder for each BUILD_BACKEND. A constructor
+// refuses jobs its engine cannot build.
+var builderBackends = map[string]func(job *buildJob, workspace string, output *buildLog) (builder, error){
+	backendDocker:     newDockerBuilder,
+	backendKaniko:     newKanikoBuilder,
+	backendBuildah:    newBuildahBuilder,
+	backendPodman:     newBuildahBuilder,
+	backendNerdctl:    newNerdctlBuilder,
+	backendKubernetes: newKubernetesBuilder,
+}
+
+func newBuilder(job *buildJob, workspace string, output *buildLog) (builder, error) {
+	newFn, ok := builderBackends[BUILD_BACKEND]
+	if !ok {
+		return nil, fmt.Errorf("unknown build backend %q", BUILD_BACKEND)
+	}
+	return newFn(job, workspace, output)
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BuildStatus string
+
+const (
+	StatusQueued    BuildStatus = "queued"
+	StatusBuilding  BuildStatus = "building"
+	StatusPushing   BuildStatus = "pushing"
+	StatusSucceeded BuildStatus = "succeeded"
+	StatusFailed    BuildStatus = "failed"
+	StatusCancelled BuildStatus = "cancelled"
+	StatusTimedOut  BuildStatus = "timed_out"
+)
+
+// Build tracks the lifecycle of a single build-and-push job.
+type Build struct {
+	ID         string             `json:"id"`
+	Status     BuildStatus        `json:"status"`
+	Tag        string             `json:"tag"`
+	Image      string             `json:"image"`
+	Digest     string             `json:"digest,omitempty"`     // manifest digest in REGISTRY_URL, to pin deployments to
+	Size       int64              `json:"size_bytes,omitempty"` // compressed size in the registry
+	Tags       []string           `json:"tags,omitempty"`       // every tag the image is pushed under
+	Error      string             `json:"error,omitempty"`
+	ErrorCode  string             `json:"error_code,omitempty"` // why it failed, one of the failure codes
+	Skipped    bool               `json:"skipped,omitempty"`    // tag already existed, nothing was built
+	Request    DockerBuildRequest `json:"request"`
+	CreatedAt  time.Time          `json:"created_at"`
+	StartedAt  *time.Time         `json:"started_at,omitempty"`
+	FinishedAt *time.Time         `json:"finished_at,omitempty"`
+	Duration   float64            `json:"duration_seconds,omitempty"`
+	Dockerfile string             `json:"dockerfile"`
+	Instance   string             `json:"instance"`              // factory replica that accepted the build
+	ScheduleID string             `json:"schedule_id,omitempty"` // set for runs started by a schedule
+	Requester  string             `json:"requester,omitempty"`   // who asked for the build, from X-Requested-By
+	Pushes     []RegistryPush     `json:"pushes,omitempty"`      // one per registry the image went to
+	DeletedAt  *time.Time         `json:"deleted_at,omitempty"`  // when its image was deleted from REGISTRY_URL
+
+	Vulnerabilities *VulnerabilityReport `json:"vulnerabilities,omitempty"` // set when VULN_SCAN is on
+
+	// Files are uploaded build context files, keyed by path. They are
+	// stored separately and never echoed back in responses.
+	Files map[string][]byte `json:"-"`
+}
+
+// RegistryPush is the result of pushing a build's image under one name.
+type RegistryPush struct {
+	Image      string `json:"image"`
+	Pushed     bool   `json:"pushed"`
+	Digest     string `json:"digest,omitempty"`
+	Signature  string `json:"signature,omitempty"`  // cosign signature image, when signing is on
+	Provenance string `json:"provenance,omitempty"` // SLSA provenance attestation, when PROVENANCE_BUILDER_ID is set
+	Error      string `json:"error,omitempty"`
+}
+
+func (b *Build) setDuration() {
+	if b.StartedAt != nil && b.FinishedAt != nil {
+		b.Duration = b.FinishedAt.Sub(*b.StartedAt).Seconds()
+	}
+}
+
+// buildRegistry is the in-memory index of builds, kept until they finish
+// and are persisted. Handlers only ever see copies so the worker goroutine
+// can keep mutating its own record. Every change is written through to the
+// store so history survives restarts.
+type buildRegistry struct {
+	store buildStore
+
+	mu     sync.RWMutex
+	builds map[string]*Build
+	logs   map[string]*buildLog
+	cancel map[string]context.CancelFunc
+	active map[string]string // tag -> ID of the unfinished build producing it
+
+	// finishHooks run in their own goroutine once a build reaches a
+	// terminal status, e.g. to deliver webhooks.
+	finishHooks []func(Build)
+}
+
+var builds = &buildRegistry{
+	builds: make(map[string]*Build),
+	logs:   make(map[string]*buildLog),
+	cancel: make(map[string]context.CancelFunc),
+	active: make(map[string]string),
+}
+
+func newBuildID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// add registers a new build and returns the context its docker commands must
+// run under; the context is cancelled by cancelBuild or once the build ends.
+func (r *buildRegistry) add(b *Build) context.Context {
+	ctx := r.restore(b)
+	r.mu.RLock()
+	snapshot := *b
+	r.mu.RUnlock()
+
+	if err := r.store.insertBuild(snapshot); err != nil {
+		slog.Error("Persisting build", "build_id", b.ID, "error", err)
+	}
+	return ctx
+}
+
+// addUnlessActive is add for fresh submissions: if an unfinished build for
+// the same tag already exists, b is discarded and that build is returned
+// instead, so identical specs share one docker build.
+func (r *buildRegistry) addUnlessActive(b *Build) (context.Context, *Build) {
+	r.mu.Lock()
+	if id, ok := r.active[b.Tag]; ok {
+		existing := *r.builds[id]
+		r.mu.Unlock()
+		return nil, &existing
+	}
+	r.track(b)
+	ctx := r.trackCancel(b.ID)
+	snapshot := *b
+	r.mu.Unlock()
+
+	if err := r.store.insertBuild(snapshot); err != nil {
+		slog.Error("Persisting build", "build_id", b.ID, "error", err)
+	}
+	return ctx, nil
+}
+
+// activeBuild returns the unfinished build producing tag, if any.
+func (r *buildRegistry) activeBuild(tag string) (Build, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.active[tag]
+	if !ok {
+		return Build{}, false
+	}
+	return *r.builds[id], true
+}
+
+// restore tracks a build that already exists in the store, e.g. one that
+// was still queued when the factory last shut down.
+func (r *buildRegistry) restore(b *Build) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.track(b)
+	return r.trackCancel(b.ID)
+}
+
+// track indexes b; callers hold r.mu.
+func (r *buildRegistry) track(b *Build) {
+	r.builds[b.ID] = b
+	r.logs[b.ID] = newBuildLog(b.ID)
+	r.logs[b.ID].status(b.Status)
+	if !b.Status.terminal() {
+		r.active[b.Tag] = b.ID
+	}
+}
+
+// trackCancel creates the context for a build's docker commands; callers
+// hold r.mu.
+func (r *buildRegistry) trackCancel(id string) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel[id] = cancel
+	return ctx
+}
+
+func (r *buildRegistry) log(id string) (*buildLog, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	l, ok := r.logs[id]
+	return l, ok
+}
+
+// replayLog returns the log of build id to follow: its live one, or for a
+// build that has finished and left memory, a closed log replaying its
+// stored output and final status. It returns errBuildNotFound for unknown
+// builds.
+func (r *buildRegistry) replayLog(id string) (*buildLog, error) {
+	if l, ok := r.log(id); ok {
+		return l, nil
+	}
+	build, err := r.store.getBuild(id)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := r.store.getLogs(id)
+	if err != nil {
+		return nil, err
+	}
+	finished := build.CreatedAt
+	if build.FinishedAt != nil {
+		finished = *build.FinishedAt
+	}
+	l := newBuildLog(id)
+	for _, line := range lines {
+		l.events = append(l.events, buildEvent{Type: eventLog, Time: finished, Line: line})
+	}
+	l.events = append(l.events, buildEvent{Type: eventStatus, Time: finished, Status: build.Status})
+	l.closed = true
+	return l, nil
+}
+
+// get returns a build from memory, falling back to the store for builds
+// that finished before the last restart.
+func (r *buildRegistry) get(id string) (Build, bool) {
+	r.mu.RLock()
+	b, ok := r.builds[id]
+	if ok {
+		snapshot := *b
+		r.mu.RUnlock()
+		return snapshot, true
+	}
+	r.mu.RUnlock()
+
+	stored, err := r.store.getBuild(id)
+	if err != nil {
+		if err != errBuildNotFound {
+			slog.Error("Loading build", "build_id", id, "error", err)
+		}
+		return Build{}, false
+	}
+	return stored, true
+}
+
+func (r *buildRegistry) update(id string, fn func(b *Build)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b, ok := r.builds[id]; ok {
+		fn(b)
+	}
+}
+
+func (s BuildStatus) terminal() bool {
+	switch s {
+	case StatusSucceeded, StatusFailed, StatusCancelled, StatusTimedOut:
+		return true
+	}
+	return false
+}
+
+func (r *buildRegistry) setStatus(id string, status BuildStatus) {
+	var snapshot Build
+	r.update(id, func(b *Build) {
+		now := time.Now().UTC()
+		b.Status = status
+		if status == StatusBuilding && b.StartedAt == nil {
+			b.StartedAt = &now
+			buildsStarted.Inc()
+		}
+		if status.terminal() {
+			b.FinishedAt = &now
+			b.setDuration()
+		}
+		snapshot = *b
+	})
+	persisted := true
+	if err := r.store.updateBuild(snapshot); err != nil {
+		slog.Error("Persisting build", "build_id", id, "error", err)
+		persisted = false
+	}
+	if l, ok := r.log(id); ok {
+		l.status(status)
+		if status.terminal() {
+			l.close()
+			if err := r.store.saveLogs(id, l.linesSince(0)); err != nil {
+				slog.Error("Persisting build logs", "build_id", id, "error", err)
+				persisted = false
+			}
+		}
+	}
+	if status.terminal() {
+		r.mu.Lock()
+		if cancel, ok := r.cancel[id]; ok {
+			cancel()
+			delete(r.cancel, id)
+		}
+		if r.active[snapshot.Tag] == id {
+			delete(r.active, snapshot.Tag)
+		}
+		// Once the store has the build and its logs, get and the log
+		// endpoints serve them from there; holding on to them here would
+		// only grow memory for as long as the process runs. Subscribers
+		// still following the log keep their own reference to it.
+		if persisted {
+			delete(r.builds, id)
+			delete(r.logs, id)
+		}
+		r.mu.Unlock()
+		for _, hook := range r.finishHooks {
+			go hook(snapshot)
+		}
+	}
+}
+
+// onFinish registers a hook to run whenever a build finishes.
+func (r *buildRegistry) onFinish(hook func(Build)) {
+	r.finishHooks = append(r.finishHooks, hook)
+}
+
+// cancelBuild stops a build: a queued one is pulled out of the queue, a
+// running one has its docker process killed via its context. It reports
+// false if the build is unknown or already finished.
+func (r *buildRegistry) cancelBuild(id string) bool {
+	r.mu.Lock()
+	b, ok := r.builds[id]
+	if !ok || b.Status.terminal() {
+		r.mu.Unlock()
+		return false
+	}
+	cancel := r.cancel[id]
+	queued := b.Status == StatusQueued
+	r.mu.Unlock()
+
+	cancel()
+	if queued && queue.remove(id) {
+		r.setStatus(id, StatusCancelled)
+	}
+	// Otherwise the worker notices the cancelled context and records it.
+	return true
+}
+
+// forget drops finished builds from memory once their records have been
+// pruned from the store, for those that could not be persisted when they
+// finished.
+func (r *buildRegistry) forget(ids []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range ids {
+		if b, ok := r.builds[id]; ok && b.Status.terminal() {
+			delete(r.builds, id)
+			delete(r.logs, id)
+		}
+	}
+}
+
+// markDeleted records that the content-hash tag of the builds of project
+// with tag, or the whole manifest with digest if that is set, was deleted
+// from the registry. It returns the IDs of the builds affected.
+func (r *buildRegistry) markDeleted(project, tag, digest string) ([]string, error) {
+	now := time.Now().UTC()
+	ids, err := r.store.markDeleted(project, tag, digest, now)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range ids {
+		if b, ok := r.builds[id]; ok {
+			b.DeletedAt = &now
+		}
+	}
+	return ids, nil
+}
+
+// moveTag records that tag, in project's repository, now points at the
+// image of buildID.
+func (r *buildRegistry) moveTag(project, tag, buildID string) error {
+	if err := r.store.moveTag(project, tag, buildID); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, b := range r.builds {
+		if b.Request.Project != project {
+			continue
+		}
+		b.Tags = withoutTag(b.Tags, tag)
+		if id == buildID {
+			b.Tags = append(b.Tags, tag)
+		}
+	}
+	return nil
+}
+
+func (r *buildRegistry) fail(id, code, errMsg string) {
+	r.finish(id, StatusFailed, code, errMsg)
+}
+
+// complete records the outcome of an executed build.
+func (r *buildRegistry) complete(id string, outcome buildOutcome) {
+	recordOutcome(outcome)
+	if b, ok := r.get(id); ok && len(outcome.SBOM) > 0 {
+		if err := r.store.saveSBOM(b.Tag, id, outcome.SBOMFormat, outcome.SBOM); err != nil {
+			slog.Error("Persisting build SBOM", "build_id", id, "error", err)
+		}
+	}
+	if b, ok := r.get(id); ok && outcome.Status == StatusSucceeded {
+		b.Digest, b.Pushes = outcome.Digest, outcome.Pushes
+		describeImage(&b)
+		r.update(id, func(rec *Build) { rec.Digest, rec.Pushes, rec.Size, rec.Tags = b.Digest, b.Pushes, b.Size, b.Tags })
+	} else if len(outcome.Pushes) > 0 {
+		r.update(id, func(b *Build) { b.Digest, b.Pushes = outcome.Digest, outcome.Pushes })
+	}
+	if outcome.Vulnerabilities != nil {
+		r.update(id, func(b *Build) { b.Vulnerabilities = outcome.Vulnerabilities })
+		if !outcome.Vulnerabilities.Passed && outcome.Digest != "" {
+			discardRejectedImage(id, outcome.Digest)
+		}
+	}
+	r.finish(id, outcome.Status, outcome.ErrorCode, outcome.Error)
+}
+
+// describeImage fills in what deployment tooling needs to know about b's
+// pushed image: its digest and size as the registry reports them, and the
+// tags it now carries. Failing to ask the registry leaves the digest the
+// builder reported.
+func describeImage(b *Build) {
+	client, repository := imageRepository(*b)
+	digest, size, err := client.imageDetails(repository, b.Tag)
+	if err != nil {
+		slog.Warn("Reading image from the registry", "build_id", b.ID, "image", b.Image, "error", err)
+	} else {
+		b.Digest, b.Size = digest, size
+	}
+	b.Tags = []string{b.Tag}
+	seen := map[string]bool{b.Tag: true}
+	for _, push := range b.Pushes {
+		tag := push.Image[strings.LastIndex(push.Image, ":")+1:]
+		if push.Pushed && !seen[tag] {
+			seen[tag] = true
+			b.Tags = append(b.Tags, tag)
+		}
+	}
+}
+
+// finish records a terminal status along with the reason for it.
+func (r *buildRegistry) finish(id string, status BuildStatus, code, errMsg string) {
+	r.update(id, func(b *Build) {
+		b.Error, b.ErrorCode = errMsg, code
+	})
+	r.setStatus(id, status)
+}
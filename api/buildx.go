@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// platformPattern accepts OS/architecture[/variant] platform specifiers
+// such as linux/amd64 or linux/arm/v7.
+var platformPattern = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+
+func validatePlatforms(platforms []string) error {
+	for i, p := range platforms {
+		if !platformPattern.MatchString(p) {
+			return fieldErrorf(fmt.Sprintf("platforms[%d]", i), codeFormat, "Invalid platform %q: expected e.g. linux/amd64 or linux/arm64", p)
+		}
+	}
+	return nil
+}
+
+// buildxMetadataFile is where buildx records the result of a build, inside
+// the build's workspace.
+const buildxMetadataFile = "buildx-metadata.json"
+
+// buildxBuilder builds job for every platform it lists with docker buildx
+// and pushes the result as one multi-arch manifest list. A multi-platform
+// image cannot be loaded into the local daemon, so building and pushing are
+// a single step and no image size is recorded. This is the one path that
+// still needs the docker CLI: buildx is a CLI plugin with no Engine API
+// equivalent.
+type buildxBuilder struct {
+	output   *buildLog
+	args     []string
+	metadata string
+}
+
+func newBuildxBuilder(job *buildJob, workspace string, output *buildLog) (builder, error) {
+	metadata := filepath.Join(workspace, buildxMetadataFile)
+	args := []string{"buildx", "build", "--platform", strings.Join(job.Platforms, ","), "-t", job.Image, "--push", "--progress=plain", "--metadata-file", metadata}
+	for _, image := range job.ExtraImages {
+		args = append(args, "-t", image)
+	}
+	if BUILDX_BUILDER != "" {
+		args = append(args, "--builder", BUILDX_BUILDER)
+	}
+	if BUILD_CGROUP_PARENT != "" {
+		args = append(args, "--cgroup-parent", BUILD_CGROUP_PARENT)
+	}
+	args = append(args, buildFlags(job)...)
+	args = append(args, registryCacheFlags()...)
+	args = append(args, workspace)
+	return &buildxBuilder{output: output, args: args, metadata: metadata}, nil
+}
+
+func (b *buildxBuilder) Name() string    { return "Docker buildx" }
+func (b *buildxBuilder) Logs() *buildLog { return b.output }
+func (b *buildxBuilder) Cancel()         {}
+
+func (b *buildxBuilder) Build(ctx context.Context) error {
+	return runLogged(exec.CommandContext(ctx, "docker", b.args...), b.output)
+}
+
+func (b *buildxBuilder) Push(ctx context.Context) (string, error) {
+	return buildxDigest(b.metadata), nil
+}
+
+// buildxDigest reads the manifest list digest from a buildx metadata file,
+// returning "" if it is missing.
+func buildxDigest(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Warn("Reading buildx metadata", "error", err)
+		return ""
+	}
+	var meta struct {
+		Digest string `json:"containerimage.digest"`
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		slog.Warn("Decoding buildx metadata", "error", err)
+	}
+	return meta.Digest
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// toolBundle is a curated set of system prerequisites for a provider: the
+// apt packages, driver downloads and environment it needs to work. Setup
+// runs before the packages are installed (e.g. to add a vendor repository)
+// and Post after (e.g. to unpack a driver), all in one RUN step as root.
+type toolBundle struct {
+	Description string
+	Setup       []string
+	Packages    []string
+	Post        []string
+	Env         map[string]string
+}
+
+// osRelease reads a field of the base image's /etc/os-release, so bundles
+// follow whichever Debian release the image is built on.
+func osRelease(field string) string {
+	return "$(. /etc/os-release && echo $" + field + ")"
+}
+
+var toolBundles = map[string]toolBundle{
+	"java": {
+		Description: "Java runtime, for apache-spark, apache-beam and JDBC",
+		Packages:    []string{"default-jre-headless"},
+		Env:         map[string]string{"JAVA_HOME": "/usr/lib/jvm/default-java"},
+	},
+	"kerberos": {
+		Description: "Kerberos client libraries and tools",
+		Packages:    []string{"krb5-user", "libkrb5-dev", "libsasl2-modules-gssapi-mit"},
+		Env:         map[string]string{"KRB5_CONFIG": "/etc/krb5.conf"},
+	},
+	"mssql": {
+		Description: "Microsoft ODBC Driver 18 for SQL Server",
+		Setup: []string{
+			"apt-get update",
+			"apt-get install -y --no-install-recommends ca-certificates curl gnupg",
+			"curl -fsSL https://packages.microsoft.com/keys/microsoft.asc | gpg --dearmor --yes -o /usr/share/keyrings/microsoft-prod.gpg",
+			`echo "deb [signed-by=/usr/share/keyrings/microsoft-prod.gpg] https://packages.microsoft.com/debian/` + osRelease("VERSION_ID") + `/prod ` + osRelease("VERSION_CODENAME") + ` main" > /etc/apt/sources.list.d/mssql-release.list`,
+			"export ACCEPT_EULA=Y",
+		},
+		Packages: []string{"msodbcsql18", "unixodbc-dev"},
+	},
+	"mysql": {
+		Description: "MySQL client headers, for building mysqlclient",
+		Packages:    []string{"default-libmysqlclient-dev", "build-essential", "pkg-config"},
+	},
+	"oracle": {
+		Description: "Oracle Instant Client, for thick mode in python-oracledb",
+		Packages:    []string{"ca-certificates", "curl", "unzip", "libaio1"},
+		Post: []string{
+			"curl -fsSL -o /tmp/instantclient.zip https://download.oracle.com/otn_software/linux/instantclient/instantclient-basiclite-linuxx64.zip",
+			"mkdir -p /opt/oracle",
+			"unzip -q /tmp/instantclient.zip -d /opt/oracle",
+			"rm /tmp/instantclient.zip",
+			"mv /opt/oracle/instantclient_* /opt/oracle/instantclient",
+			"echo /opt/oracle/instantclient > /etc/ld.so.conf.d/oracle-instantclient.conf",
+			"ldconfig",
+		},
+		Env: map[string]string{"LD_LIBRARY_PATH": "/opt/oracle/instantclient"},
+	},
+	"sasl": {
+		Description: "SASL libraries, for apache-hive and other Thrift clients",
+		Packages:    []string{"libsasl2-dev", "libsasl2-modules", "build-essential"},
+	},
+}
+
+// resolveBundles looks up the named bundles in request order, ignoring
+// repeats.
+func resolveBundles(names []string) ([]toolBundle, error) {
+	var bundles []toolBundle
+	seen := make(map[string]bool)
+	for _, name := range names {
+		bundle, ok := toolBundles[name]
+		if !ok {
+			return nil, fieldErrorf("bundles", codeEnum, "Unknown bundle %q; available bundles: %s", name, strings.Join(bundleNames(), ", "))
+		}
+		if !seen[name] {
+			seen[name] = true
+			bundles = append(bundles, bundle)
+		}
+	}
+	return bundles, nil
+}
+
+func bundleNames() []string {
+	names := make([]string, 0, len(toolBundles))
+	for name := range toolBundles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,500 @@
+// Command aif is a client for the image factory API, for engineers and CI
+// pipelines:
+//
+//	aif build -f spec.yaml --wait --follow
+//	aif status <build-id>
+//	aif logs [--follow] <build-id>
+//	aif cancel <build-id>
+//
+// build prints the image reference on stdout and everything else on
+// stderr, so IMAGE=$(aif build -f spec.yaml --wait) works in a pipeline.
+// With --wait it exits non-zero unless the build succeeded. The server is
+// taken from --server or AIF_URL, and the API key, when the server wants
+// one, from --api-key or AIF_API_KEY. For a server that requires client
+// certificates, --cert and --key (AIF_CLIENT_CERT, AIF_CLIENT_KEY) name
+// the runner's, and --cacert (AIF_CA_FILE) the CA the server's is from.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// build is the part of a build record the client reads.
+type build struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Image     string `json:"image"`
+	Digest    string `json:"digest"`
+	Error     string `json:"error"`
+	ErrorCode string `json:"error_code"`
+}
+
+func (b build) finished() bool {
+	switch b.Status {
+	case "succeeded", "failed", "cancelled", "timed_out":
+		return true
+	}
+	return false
+}
+
+// reference is the image pinned to its digest when the registry reported
+// one.
+func (b build) reference() string {
+	if b.Digest == "" {
+		return b.Image
+	}
+	return b.Image[:strings.LastIndex(b.Image, ":")] + "@" + b.Digest
+}
+
+const pollInterval = 2 * time.Second
+
+var (
+	server = strings.TrimSuffix(os.Getenv("AIF_URL"), "/")
+	apiKey = os.Getenv("AIF_API_KEY")
+	client = &http.Client{Transport: &authTransport{}}
+
+	caFile   = os.Getenv("AIF_CA_FILE")
+	certFile = os.Getenv("AIF_CLIENT_CERT")
+	keyFile  = os.Getenv("AIF_CLIENT_KEY")
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage:
+  aif build -f spec.yaml [--project name] [--file field=path]... [--wait] [--follow] [--digest]
+  aif status <build-id>
+  aif logs [--follow] <build-id>
+  aif cancel <build-id>
+
+The server is taken from --server or AIF_URL (default http://localhost:8080),
+the API key from --api-key or AIF_API_KEY, and TLS client credentials from
+--cert, --key and --cacert or AIF_CLIENT_CERT, AIF_CLIENT_KEY and AIF_CA_FILE.`)
+	os.Exit(2)
+}
+
+func main() {
+	if server == "" {
+		server = "http://localhost:8080" // default value
+	}
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "build":
+		err = runBuild(os.Args[2:])
+	case "status":
+		err = runStatus(os.Args[2:])
+	case "logs":
+		err = runLogs(os.Args[2:])
+	case "cancel":
+		err = runCancel(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "aif: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&server, "server", server, "image factory `URL`")
+	fs.StringVar(&apiKey, "api-key", apiKey, "API `key`, or SSO token, to authenticate with")
+	fs.StringVar(&caFile, "cacert", caFile, "CA certificate `file` to verify the server with")
+	fs.StringVar(&certFile, "cert", certFile, "client certificate `file` for servers that require one")
+	fs.StringVar(&keyFile, "key", keyFile, "private key `file` of --cert")
+	return fs
+}
+
+// authTransport sends the API key with every request, over a transport set
+// up from the TLS flags on first use, once they have been parsed.
+type authTransport struct {
+	once      sync.Once
+	transport http.RoundTripper
+	err       error
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.once.Do(func() { t.transport, t.err = newTransport() })
+	if t.err != nil {
+		return nil, t.err
+	}
+	if apiKey == "" {
+		return t.transport.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	return t.transport.RoundTrip(req)
+}
+
+func newTransport() (http.RoundTripper, error) {
+	if caFile == "" && certFile == "" {
+		return http.DefaultTransport, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		if keyFile == "" {
+			return nil, errors.New("--cert needs --key")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return transport, nil
+}
+
+// uploads collects repeated --file field=path flags.
+type uploads map[string][]string
+
+func (u uploads) String() string { return "" }
+
+func (u uploads) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("%q is not field=path", v)
+	}
+	u[v[:i]] = append(u[v[:i]], v[i+1:])
+	return nil
+}
+
+func runBuild(args []string) error {
+	fs := newFlagSet("build")
+	specFile := fs.String("f", "", "build spec, YAML or JSON (`file`, - for stdin)")
+	wait := fs.Bool("wait", false, "wait for the build to finish")
+	follow := fs.Bool("follow", false, "stream the build output while waiting; implies --wait")
+	digest := fs.Bool("digest", false, "print the image by digest rather than tag")
+	project := fs.String("project", "", "build into `project`, under its image name, templates and quotas")
+	files := uploads{}
+	fs.Var(files, "file", "upload a file as a multipart `field=path`, such as requirements=requirements.txt; repeatable")
+	fs.Parse(args)
+	if *specFile == "" || fs.NArg() > 0 {
+		usage()
+	}
+
+	spec, err := readSpec(*specFile)
+	if err != nil {
+		return err
+	}
+	body, contentType, err := buildRequestBody(spec, files)
+	if err != nil {
+		return err
+	}
+	endpoint := server + "/v1/builds"
+	if *project != "" {
+		endpoint = server + "/v1/projects/" + url.PathEscape(*project) + "/builds"
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if user := os.Getenv("USER"); user != "" {
+		req.Header.Set("X-Requested-By", user)
+	}
+	var b build
+	resp, err := do(req, &b)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.Header.Get("X-Deduplicated") == "true":
+		fmt.Fprintf(os.Stderr, "Attached to build %s, already %s\n", b.ID, b.Status)
+	case b.finished():
+		fmt.Fprintf(os.Stderr, "Build %s %s: %s already exists\n", b.ID, b.Status, b.Image)
+	default:
+		fmt.Fprintf(os.Stderr, "Queued build %s\n", b.ID)
+	}
+
+	if *follow {
+		if b, err = followLogs(b.ID); err != nil {
+			return err
+		}
+	} else if *wait {
+		if b, err = waitFor(b.ID); err != nil {
+			return err
+		}
+	}
+	if *wait || *follow {
+		if b.ErrorCode != "" {
+			fmt.Fprintf(os.Stderr, "Build %s %s: %s\n", b.ID, b.Status, b.ErrorCode)
+		} else {
+			fmt.Fprintf(os.Stderr, "Build %s %s\n", b.ID, b.Status)
+		}
+		if b.Status != "succeeded" {
+			if b.Error != "" {
+				return errors.New(b.Error)
+			}
+			return fmt.Errorf("build %s", b.Status)
+		}
+	}
+	if *digest {
+		fmt.Println(b.reference())
+	} else {
+		fmt.Println(b.Image)
+	}
+	return nil
+}
+
+// readSpec reads a build spec as a generic value, so the client passes on
+// fields it does not know about. JSON is YAML, so either works.
+func readSpec(file string) (interface{}, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var spec interface{}
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	if _, ok := spec.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("%s is not a mapping of spec fields", file)
+	}
+	return spec, nil
+}
+
+// buildRequestBody encodes the spec as JSON, or as the "request" field of
+// a multipart body when there are files to upload.
+func buildRequestBody(spec interface{}, files uploads) (io.Reader, string, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(files) == 0 {
+		return bytes.NewReader(data), "application/json", nil
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.WriteField("request", string(data)); err != nil {
+		return nil, "", err
+	}
+	for field, paths := range files {
+		for _, path := range paths {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, "", err
+			}
+			part, err := mw.CreateFormFile(field, filepath.Base(path))
+			if err != nil {
+				return nil, "", err
+			}
+			part.Write(content)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return &body, mw.FormDataContentType(), nil
+}
+
+func runStatus(args []string) error {
+	fs := newFlagSet("status")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	req, err := http.NewRequest(http.MethodGet, server+"/v1/builds/"+fs.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+	var b json.RawMessage
+	if _, err := do(req, &b); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	json.Indent(&out, b, "", "  ")
+	fmt.Println(out.String())
+	return nil
+}
+
+func runLogs(args []string) error {
+	fs := newFlagSet("logs")
+	follow := fs.Bool("follow", false, "keep streaming until the build finishes")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	if *follow {
+		b, err := followLogs(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Build %s %s\n", b.ID, b.Status)
+		return nil
+	}
+	resp, err := client.Get(server + "/v1/builds/" + fs.Arg(0) + "/logs")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+func runCancel(args []string) error {
+	fs := newFlagSet("cancel")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	req, err := http.NewRequest(http.MethodDelete, server+"/v1/builds/"+fs.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+	var b build
+	if _, err := do(req, &b); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Cancellation requested for build %s\n", b.ID)
+	return nil
+}
+
+// followLogs copies the output of a build to stderr as it is produced and
+// returns the build once it has finished.
+func followLogs(id string) (build, error) {
+	resp, err := client.Get(server + "/v1/builds/" + id + "/logs/stream")
+	if err != nil {
+		return build{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// Finished before the last restart: there is no live stream, but
+		// the stored output is complete.
+		logs, err := client.Get(server + "/v1/builds/" + id + "/logs")
+		if err != nil {
+			return build{}, err
+		}
+		defer logs.Body.Close()
+		if logs.StatusCode != http.StatusOK {
+			return build{}, responseError(logs)
+		}
+		io.Copy(os.Stderr, logs.Body)
+		return waitFor(id)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return build{}, responseError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "event: end" {
+			break
+		}
+		if strings.HasPrefix(line, "data: ") {
+			fmt.Fprintln(os.Stderr, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return build{}, fmt.Errorf("reading log stream: %w", err)
+	}
+	return waitFor(id)
+}
+
+// waitFor polls a build until it has finished.
+func waitFor(id string) (build, error) {
+	for {
+		req, err := http.NewRequest(http.MethodGet, server+"/v1/builds/"+id, nil)
+		if err != nil {
+			return build{}, err
+		}
+		var b build
+		if _, err := do(req, &b); err != nil {
+			return build{}, err
+		}
+		if b.finished() {
+			return b, nil
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// do sends req and decodes a successful JSON response into out.
+func do(req *http.Request, out interface{}) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp, responseError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp, fmt.Errorf("decoding response: %w", err)
+	}
+	return resp, nil
+}
+
+// responseError describes a failed response by the errors of its
+// envelope, listing several, such as the fields at fault of a validation
+// error, one per line.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	message := strings.TrimSpace(string(body))
+	var failed struct {
+		Errors []struct {
+			Field   string `json:"field"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") && json.Unmarshal(body, &failed) == nil && len(failed.Errors) > 0 {
+		if len(failed.Errors) == 1 && failed.Errors[0].Field == "" {
+			message = failed.Errors[0].Message
+		} else {
+			message = "invalid request"
+			for _, e := range failed.Errors {
+				if e.Field != "" {
+					e.Message = e.Field + ": " + e.Message
+				}
+				message += "\n  " + e.Message
+			}
+		}
+	}
+	return fmt.Errorf("%s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, message)
+}
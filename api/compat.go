@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// pythonSupport is the built-in Airflow/Python compatibility matrix: the
+// Python versions official images are published for, by Airflow minor
+// release. It is used when PyPI cannot say, e.g. with PYPI_JSON_URL=off.
+var pythonSupport = map[string][]string{
+	"2.0":  {"3.6", "3.7", "3.8"},
+	"2.1":  {"3.6", "3.7", "3.8", "3.9"},
+	"2.2":  {"3.6", "3.7", "3.8", "3.9"},
+	"2.3":  {"3.7", "3.8", "3.9", "3.10"},
+	"2.4":  {"3.7", "3.8", "3.9", "3.10"},
+	"2.5":  {"3.7", "3.8", "3.9", "3.10"},
+	"2.6":  {"3.7", "3.8", "3.9", "3.10", "3.11"},
+	"2.7":  {"3.8", "3.9", "3.10", "3.11"},
+	"2.8":  {"3.8", "3.9", "3.10", "3.11"},
+	"2.9":  {"3.8", "3.9", "3.10", "3.11", "3.12"},
+	"2.10": {"3.8", "3.9", "3.10", "3.11", "3.12"},
+	"2.11": {"3.9", "3.10", "3.11", "3.12"},
+	"3.0":  {"3.9", "3.10", "3.11", "3.12"},
+	"3.1":  {"3.10", "3.11", "3.12", "3.13"},
+}
+
+// minorVersion reduces a release such as "2.7.1" to "2.7".
+func minorVersion(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// supportedPythons returns the Python versions an Airflow release supports,
+// preferring the classifiers in its PyPI metadata so new releases are
+// covered without a factory upgrade. It returns nil if nothing is known.
+func supportedPythons(ctx context.Context, airflowVersion string) ([]string, error) {
+	if PYPI_JSON_URL != "" {
+		release, err := fetchAirflowRelease(ctx, airflowVersion)
+		if err == errUnknownAirflowVersion {
+			return nil, fieldErrorf("airflow_version", codeInvalid, "Airflow version %s does not exist on PyPI", airflowVersion)
+		}
+		if err == nil && len(release.PythonVersions) > 0 {
+			return release.PythonVersions, nil
+		}
+		if err != nil {
+			logger(ctx).Warn("Using the built-in compatibility matrix", "airflow_version", airflowVersion, "error", err)
+		}
+	}
+	return pythonSupport[minorVersion(airflowVersion)], nil
+}
+
+// validatePythonVersion rejects Airflow/Python pairs no official image
+// exists for, before any time is spent pulling a base image that is not
+// there. Requests with a custom base_image are left alone.
+func validatePythonVersion(ctx context.Context, req DockerBuildRequest) error {
+	if req.BaseImage != "" {
+		return nil
+	}
+	supported, err := supportedPythons(ctx, req.AirflowVersion)
+	if err != nil || supported == nil {
+		return err
+	}
+	for _, v := range supported {
+		if v == req.PythonVersion {
+			return nil
+		}
+	}
+	return fieldErrorf("python_version", codeInvalid, "Airflow %s does not support Python %s; supported versions are %s", req.AirflowVersion, req.PythonVersion, strings.Join(supported, ", "))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configKeys are the settings a config file or flag can give, named like
+// the environment variables they stand in for.
+var configKeys = []string{
+	"AGENT_TLS_CERT_FILE", "AGENT_TLS_KEY_FILE", "API_KEYS_FILE",
+	"BASE_IMAGE_ALLOWLIST", "BASE_IMAGE_MIRROR", "BUILDX_BUILDER",
+	"BUILD_BACKEND", "BUILD_CACHE_REPO", "BUILD_CGROUP_PARENT",
+	"BUILD_CPU_LIMIT", "BUILD_MEMORY_LIMIT", "BUILD_RATE_LIMIT",
+	"BUILD_RETRY_ATTEMPTS", "BUILD_RETRY_BACKOFF_SECONDS", "BUILD_TIMEOUT_SECONDS",
+	"CORS_ALLOWED_HEADERS", "CORS_ALLOWED_METHODS", "CORS_ALLOWED_ORIGINS",
+	"COSIGN_BINARY", "COSIGN_IDENTITY_TOKEN_FILE", "COSIGN_KEY", "COSIGN_KEYLESS",
+	"DATABASE_PATH", "DATABASE_URL",
+	"DOCKER_CERT_PATH", "DOCKER_HOSTS", "DOCKER_MAX_IDLE_CONNS", "DOCKER_TLS_VERIFY",
+	"ECR_ACCOUNT_ID", "EXTRA_REGISTRIES", "FACTORY_MODE",
+	"GIT_SSH_KEY_FILE", "GIT_SSH_KNOWN_HOSTS_FILE", "GRPC_ADDR",
+	"IMAGE_NAME", "IMAGE_SOURCE_URL", "INSECURE_REGISTRIES", "INSTANCE_ID",
+	"KANIKO_CACHE_REPO", "KANIKO_EXECUTOR",
+	"KUBERNETES_API_URL", "KUBERNETES_BUILDER_IMAGE", "KUBERNETES_NAMESPACE",
+	"LOG_FORMAT", "LOG_LEVEL", "MAX_CONCURRENT_BUILDS", "NOTIFY_EMAIL_TO",
+	"OIDC_AUDIENCE", "OIDC_GROUPS_CLAIM", "OIDC_GROUP_ROLES", "OIDC_ISSUER_URL",
+	"OIDC_JWKS_URL", "OIDC_USERNAME_CLAIM", "ORAS_BINARY",
+	"PIP_EXTRA_INDEX_URL", "PIP_INDEX_URL", "PIP_NETRC_FILE",
+	"PROMOTION_REGISTRIES", "PROVENANCE_BUILDER_ID", "PYPI_JSON_URL", "RATE_LIMIT",
+	"REGISTRY_API_URL", "REGISTRY_AUTH_FILE", "REGISTRY_CA_FILE",
+	"REGISTRY_PASSWORD", "REGISTRY_URL", "REGISTRY_USERNAME",
+	"RETENTION_DAYS", "RETENTION_INTERVAL_MINUTES", "RETENTION_MAX_BUILDS",
+	"SBOM_FORMAT", "SCHEDULER_CA_FILE", "SCHEDULER_URL",
+	"SLACK_WEBHOOK_URL", "SMTP_FROM", "SMTP_HOST", "SMTP_PASSWORD", "SMTP_PORT", "SMTP_USERNAME",
+	"STORE_DRIVER", "SWAGGER_UI_URL", "SYFT_BINARY",
+	"TAG_RETENTION_DAYS", "TAG_RETENTION_DRY_RUN", "TAG_RETENTION_IN_USE", "TAG_RETENTION_KEEP_LAST",
+	"TLS_CERT_FILE", "TLS_CLIENT_CA_FILE", "TLS_CLIENT_NAMES", "TLS_CLIENT_SCOPES", "TLS_KEY_FILE",
+	"TRIVY_BINARY", "VULN_FAIL_SEVERITY", "VULN_IGNORE_UNFIXED", "VULN_SCAN",
+	"WEBHOOK_SECRET", "WEBHOOK_URL", "WORKER_TOKEN", "WORKSPACE_DIR",
+}
+
+var (
+	// CONFIG_FILE, or --config, is a YAML file of settings. A flag such as
+	// --registry-url beats REGISTRY_URL, which beats the file, which beats
+	// the default. The file nests keys, joined with "_", or gives them
+	// whole, so
+	//
+	//	registry:
+	//	  url: registry.corp:5000
+	//	max_concurrent_builds: 4
+	//	extra_registries: [harbor.corp/airflow]
+	//
+	// sets REGISTRY_URL, MAX_CONCURRENT_BUILDS and EXTRA_REGISTRIES, lists
+	// being the comma-separated ones. Unknown keys are refused. The result
+	// is validated like the environment always was; --check-config stops
+	// there. A running factory reloads some settings when the file
+	// changes, see reloadableKeys.
+	CONFIG_FILE  string
+	CHECK_CONFIG bool
+
+	// configFixed are the settings given by a flag or the environment,
+	// which CONFIG_FILE cannot change.
+	configFixed = make(map[string]bool)
+
+	configOnce sync.Once
+)
+
+// getenv returns a setting from the flags, the environment or CONFIG_FILE,
+// loading the latter two into the environment on first use.
+func getenv(name string) string {
+	configOnce.Do(loadConfig)
+	return os.Getenv(name)
+}
+
+func loadConfig() {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.StringVar(&CONFIG_FILE, "config", os.Getenv("CONFIG_FILE"), "YAML config file")
+	flags.BoolVar(&CHECK_CONFIG, "check-config", false, "validate the configuration and exit")
+	overrides := make(map[string]string)
+	for _, key := range configKeys {
+		key := key
+		flags.Func(configFlag(key), "overrides "+key, func(v string) error {
+			overrides[key] = v
+			return nil
+		})
+	}
+	// Under go test the arguments are the test binary's own.
+	if !testing.Testing() {
+		flags.Parse(os.Args[1:])
+	}
+
+	for _, key := range configKeys {
+		_, set := os.LookupEnv(key)
+		if _, given := overrides[key]; set || given {
+			configFixed[key] = true
+		}
+	}
+	if CONFIG_FILE != "" {
+		settings, err := readConfigFile(CONFIG_FILE)
+		if err != nil {
+			log.Fatalf("Invalid CONFIG_FILE %q: %s", CONFIG_FILE, err)
+		}
+		for key, v := range settings {
+			if !configFixed[key] {
+				os.Setenv(key, v)
+			}
+		}
+	}
+	for key, v := range overrides {
+		os.Setenv(key, v)
+	}
+}
+
+// configFlag is the flag for a setting, e.g. --registry-url for
+// REGISTRY_URL.
+func configFlag(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+// readConfigFile returns the settings in a config file by name.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(configKeys))
+	for _, key := range configKeys {
+		known[key] = true
+	}
+	settings := make(map[string]string)
+	if err := flattenConfig("", doc, known, settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// flattenConfig adds the settings under a mapping to settings, their keys
+// prefixed with the mapping's own.
+func flattenConfig(prefix string, doc map[string]interface{}, known map[string]bool, settings map[string]string) error {
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		key := strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		if nested, ok := doc[k].(map[string]interface{}); ok {
+			if err := flattenConfig(key, nested, known, settings); err != nil {
+				return err
+			}
+			continue
+		}
+		if !known[key] {
+			return fmt.Errorf("unknown setting %s", strings.ToLower(key))
+		}
+		if _, dup := settings[key]; dup {
+			return fmt.Errorf("%s is set twice", strings.ToLower(key))
+		}
+		v, err := configValue(doc[k])
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.ToLower(key), err)
+		}
+		settings[key] = v
+	}
+	return nil
+}
+
+// configValue renders a YAML value as the environment variable would hold
+// it.
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configValue(item)
+			if err != nil || strings.Contains(s, ",") {
+				return "", fmt.Errorf("list items must be values without commas")
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("must be a value or a list of values")
+}
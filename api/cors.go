@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers a browser lets scripts on
+// another origin read.
+var corsExposedHeaders = []string{
+	"Deprecation",
+	"Idempotent-Replayed",
+	"Link",
+	"Location",
+	"Retry-After",
+	"X-Deduplicated",
+	"X-RateLimit-Limit",
+	"X-RateLimit-Remaining",
+	"X-Request-ID",
+	"X-Total-Lines",
+}
+
+// corsMaxAge is how long, in seconds, a browser may cache a preflight.
+const corsMaxAge = "600"
+
+// validateCORSOrigin checks an entry of CORS_ALLOWED_ORIGINS is "*" or an
+// origin as browsers send it, a scheme and host without a path.
+func validateCORSOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+		return fmt.Errorf("%q must be * or an origin such as https://factory.example.com", origin)
+	}
+	return nil
+}
+
+func corsAllowed(origin string) bool {
+	for _, allowed := range CORS_ALLOWED_ORIGINS {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS lets browser pages from CORS_ALLOWED_ORIGINS call the API. It
+// answers preflight requests itself, before authentication, since browsers
+// send them without credentials. Requests from other origins are served
+// without CORS headers, so the browser keeps their responses from the page.
+func withCORS(handler http.Handler) http.Handler {
+	if len(CORS_ALLOWED_ORIGINS) == 0 {
+		return handler
+	}
+	methods := strings.Join(CORS_ALLOWED_METHODS, ", ")
+	headers := strings.Join(CORS_ALLOWED_HEADERS, ", ")
+	exposed := strings.Join(corsExposedHeaders, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !corsAllowed(origin) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", exposed)
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// dockerDaemon is one Docker Engine the factory builds on, with the number
+// of builds this process is currently running there.
+type dockerDaemon struct {
+	host   string
+	cli    *client.Client
+	active int
+}
+
+// daemonPool spreads builds over the daemons in DOCKER_HOSTS. Each build
+// stays on the daemon it was given for build, inspect and push, since the
+// image only exists there.
+type daemonPool struct {
+	once    sync.Once
+	err     error
+	mu      sync.Mutex
+	daemons []*dockerDaemon
+}
+
+var daemons daemonPool
+
+// connect creates a client for each daemon, once.
+func (p *daemonPool) connect() {
+	p.once.Do(func() {
+		for _, host := range DOCKER_HOSTS {
+			cli, err := newDockerClient(host)
+			if err != nil {
+				p.err = fmt.Errorf("connecting to Docker daemon %s: %w", host, err)
+				return
+			}
+			p.daemons = append(p.daemons, &dockerDaemon{host: host, cli: cli})
+		}
+	})
+}
+
+// acquire returns the daemon with the fewest builds in flight, connecting
+// to all of them on first use. Callers release it once the build is done.
+func (p *daemonPool) acquire() (*dockerDaemon, error) {
+	p.connect()
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best := p.daemons[0]
+	for _, d := range p.daemons[1:] {
+		if d.active < best.active {
+			best = d
+		}
+	}
+	best.active++
+	return best, nil
+}
+
+// ping checks every daemon is reachable, connecting on first use like
+// acquire. Builds are spread over all of them, so one being down breaks
+// some of them.
+func (p *daemonPool) ping(ctx context.Context) error {
+	p.connect()
+	if p.err != nil {
+		return p.err
+	}
+	for _, d := range p.daemons {
+		if _, err := d.cli.Ping(ctx); err != nil {
+			return fmt.Errorf("Docker daemon %s: %w", d.host, err)
+		}
+	}
+	return nil
+}
+
+func (p *daemonPool) release(d *dockerDaemon) {
+	p.mu.Lock()
+	d.active--
+	p.mu.Unlock()
+}
+
+// newDockerClient connects to the daemon at host, over TLS with the client
+// certificate in DOCKER_CERT_PATH if set. Each daemon gets its own
+// transport, keeping up to DOCKER_MAX_IDLE_CONNS connections open between
+// requests.
+func newDockerClient(host string) (*client.Client, error) {
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: DOCKER_MAX_IDLE_CONNS,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	opts := []client.Opt{
+		client.WithHTTPClient(&http.Client{Transport: transport, CheckRedirect: client.CheckRedirect}),
+		client.WithHost(host),
+		client.WithAPIVersionNegotiation(),
+	}
+	if DOCKER_CERT_PATH != "" {
+		opts = append(opts, client.WithTLSClientConfig(
+			filepath.Join(DOCKER_CERT_PATH, "ca.pem"),
+			filepath.Join(DOCKER_CERT_PATH, "cert.pem"),
+			filepath.Join(DOCKER_CERT_PATH, "key.pem"),
+		))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if DOCKER_CERT_PATH != "" && !DOCKER_TLS_VERIFY {
+		// Matches the docker CLI: the client certificate is still presented,
+		// but the daemon's own certificate is not checked.
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return cli, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// claimWait is how long a claim request long-polls for a job.
+	claimWait = 30 * time.Second
+
+	// workerLease is how long a remote job may go without a report from
+	// its agent before the build is failed as lost.
+	workerLease = 2 * time.Minute
+)
+
+// remoteJob is a job handed to a builder agent that has not reported a
+// result yet.
+type remoteJob struct {
+	job      *buildJob
+	worker   string
+	lastSeen time.Time
+}
+
+// dispatcher tracks jobs leased to remote builder agents.
+type dispatcher struct {
+	mu   sync.Mutex
+	jobs map[string]*remoteJob
+}
+
+var remote = &dispatcher{jobs: make(map[string]*remoteJob)}
+
+// claimRequest and eventsResponse are the wire format shared with agent.go.
+type claimRequest struct {
+	Worker string `json:"worker"`
+}
+
+type eventsResponse struct {
+	Cancel bool `json:"cancel"`
+}
+
+// authorizeWorker checks the shared WORKER_TOKEN. Remote workers are only
+// enabled when a token is configured.
+func authorizeWorker(w http.ResponseWriter, r *http.Request) bool {
+	if WORKER_TOKEN == "" {
+		httpError(w, "Not found", http.StatusNotFound)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(WORKER_TOKEN)) != 1 {
+		httpError(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// internalJobsHandler routes the builder agent API under /internal/jobs.
+func internalJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeWorker(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/internal/jobs"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "claim":
+		claimJob(w, r)
+	case len(parts) == 2 && parts[1] == "events":
+		jobEvents(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "result":
+		jobResult(w, r, parts[0])
+	default:
+		httpError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// claimJob long-polls the queue and leases the next job to the caller.
+// 204 means nothing became available within claimWait.
+func claimJob(w http.ResponseWriter, r *http.Request) {
+	var req claimRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Worker == "" {
+		httpError(w, "worker is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), claimWait)
+	defer cancel()
+	for {
+		job := queue.popContext(ctx)
+		if job == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Context().Err() != nil {
+			// The agent hung up after we dequeued; don't lose the job.
+			queue.push(job)
+			return
+		}
+		if job.ctx.Err() != nil {
+			builds.setStatus(job.BuildID, StatusCancelled)
+			continue
+		}
+
+		remote.mu.Lock()
+		remote.jobs[job.BuildID] = &remoteJob{job: job, worker: req.Worker, lastSeen: time.Now()}
+		remote.mu.Unlock()
+		logger(r.Context()).Info("Leased build", "build_id", job.BuildID, "worker", req.Worker)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+}
+
+func (d *dispatcher) touch(id string) (*remoteJob, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rj, ok := d.jobs[id]
+	if ok {
+		rj.lastSeen = time.Now()
+	}
+	return rj, ok
+}
+
+// jobEvents ingests a batch of log lines and phase changes from an agent.
+// The reply tells the agent whether the build has been cancelled.
+func jobEvents(w http.ResponseWriter, r *http.Request, id string) {
+	rj, ok := remote.touch(id)
+	if !ok {
+		httpError(w, "Job not leased", http.StatusNotFound)
+		return
+	}
+	var events []buildEvent
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	output, ok := builds.log(id)
+	if !ok {
+		// The result got in first and the build is already finished.
+		httpError(w, "Job not leased", http.StatusNotFound)
+		return
+	}
+	for _, ev := range events {
+		switch {
+		case ev.Type == eventLog:
+			output.append(ev.Line)
+		case ev.Type == eventStatus && !ev.Status.terminal():
+			// Terminal statuses only arrive via jobResult.
+			builds.setStatus(id, ev.Status)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(eventsResponse{Cancel: rj.job.ctx.Err() != nil})
+}
+
+func jobResult(w http.ResponseWriter, r *http.Request, id string) {
+	var outcome buildOutcome
+	if err := json.NewDecoder(r.Body).Decode(&outcome); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !outcome.Status.terminal() {
+		httpError(w, "status must be terminal", http.StatusBadRequest)
+		return
+	}
+
+	remote.mu.Lock()
+	rj, ok := remote.jobs[id]
+	delete(remote.jobs, id)
+	remote.mu.Unlock()
+	if !ok {
+		httpError(w, "Job not leased", http.StatusNotFound)
+		return
+	}
+
+	logger(r.Context()).Info("Worker finished build", "build_id", id, "worker", rj.worker, "status", outcome.Status)
+	builds.complete(id, outcome)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reapLostJobs fails remote builds whose agent stopped reporting, so a
+// crashed builder host doesn't leave builds "building" forever.
+func reapLostJobs() {
+	ticker := time.NewTicker(workerLease / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		var lost []*remoteJob
+		remote.mu.Lock()
+		for id, rj := range remote.jobs {
+			if time.Since(rj.lastSeen) > workerLease {
+				lost = append(lost, rj)
+				delete(remote.jobs, id)
+			}
+		}
+		remote.mu.Unlock()
+
+		for _, rj := range lost {
+			errMsg := fmt.Sprintf("Lost contact with builder worker %s", rj.worker)
+			slog.Warn("Lost contact with builder worker", "build_id", rj.job.BuildID, "worker", rj.worker)
+			builds.fail(rj.job.BuildID, failureInterrupted, errMsg)
+		}
+	}
+}
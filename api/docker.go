@@ -0,0 +1,363 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/moby/buildkit/session/sshforward/sshprovider"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// dockerBuilder builds on a Docker daemon through the Engine API rather
+// than the docker CLI; see daemonPool for how the daemon is picked.
+// Multi-platform jobs go to buildx instead.
+type dockerBuilder struct {
+	job       *buildJob
+	workspace string
+	output    *buildLog
+	daemon    *dockerDaemon
+	pushMark  int
+}
+
+func newDockerBuilder(job *buildJob, workspace string, output *buildLog) (builder, error) {
+	if len(job.Platforms) > 0 {
+		return newBuildxBuilder(job, workspace, output)
+	}
+	daemon, err := daemons.acquire()
+	if err != nil {
+		return nil, err
+	}
+	if len(DOCKER_HOSTS) > 1 {
+		logLine(output, "Building on Docker daemon "+daemon.host)
+	}
+	return &dockerBuilder{job: job, workspace: workspace, output: output, daemon: daemon}, nil
+}
+
+func (b *dockerBuilder) Name() string    { return "Docker" }
+func (b *dockerBuilder) Logs() *buildLog { return b.output }
+func (b *dockerBuilder) Cancel()         { daemons.release(b.daemon) }
+
+func (b *dockerBuilder) Build(ctx context.Context) error {
+	return dockerBuild(ctx, b.daemon.cli, b.job, b.workspace, b.output)
+}
+
+func (b *dockerBuilder) ImageSize(ctx context.Context) int64 {
+	return imageSizeBytes(ctx, b.daemon.cli, b.job.Image)
+}
+
+func (b *dockerBuilder) Push(ctx context.Context) (string, error) {
+	mark := b.output.len()
+	if err := dockerPush(ctx, b.daemon.cli, b.job.Image, b.output); err != nil {
+		return "", err
+	}
+	digest := pushedDigest(b.output.linesSince(mark))
+	if BUILD_CACHE_REPO != "" {
+		// Failing to refresh the cache slows the next build down but does
+		// not fail this one.
+		err := b.daemon.cli.ImageTag(ctx, b.job.Image, buildCacheRef())
+		if err == nil {
+			err = dockerPush(ctx, b.daemon.cli, buildCacheRef(), b.output)
+		}
+		if err != nil {
+			logLine(b.output, fmt.Sprintf("Exporting build cache to %s: %s", buildCacheRef(), err))
+		}
+	}
+	return digest, nil
+}
+
+func (b *dockerBuilder) ExportImage(ctx context.Context, path string) error {
+	archive, err := b.daemon.cli.ImageSave(ctx, []string{b.job.Image})
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, archive); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (b *dockerBuilder) PushAs(ctx context.Context, image string) (string, error) {
+	if err := b.daemon.cli.ImageTag(ctx, b.job.Image, image); err != nil {
+		return "", err
+	}
+	mark := b.output.len()
+	if err := dockerPush(ctx, b.daemon.cli, image, b.output); err != nil {
+		return "", err
+	}
+	return pushedDigest(b.output.linesSince(mark)), nil
+}
+
+// dockerBuild builds the Dockerfile in workspace with BuildKit and tags the
+// result as job.Image. BuildKit's cache mounts keep pip and apt downloads
+// between builds; the attached session serves the job's secrets and SSH
+// key from this host.
+func dockerBuild(ctx context.Context, cli *client.Client, job *buildJob, workspace string, output *buildLog) error {
+	sess, err := buildSession(ctx, job)
+	if err != nil {
+		return fmt.Errorf("starting BuildKit session: %w", err)
+	}
+	defer sess.Close()
+	go sess.Run(ctx, func(ctx context.Context, proto string, meta map[string][]string) (net.Conn, error) {
+		return cli.DialHijack(ctx, "/session", proto, meta)
+	})
+
+	opts := types.ImageBuildOptions{
+		Tags:       []string{job.Image},
+		Dockerfile: "Dockerfile",
+		PullParent: job.Pull,
+		Remove:     true,
+		BuildArgs:  make(map[string]*string, len(job.BuildArgs)),
+		Version:    types.BuilderBuildKit,
+		SessionID:  sess.ID(),
+		// BuildKit ignores the classic builder's memory and CPU options
+		// but runs RUN steps inside the cgroup parent.
+		CgroupParent: BUILD_CGROUP_PARENT,
+	}
+	for name := range job.BuildArgs {
+		value := job.BuildArgs[name]
+		opts.BuildArgs[name] = &value
+	}
+	if BUILD_CACHE_REPO != "" {
+		// The Engine API cannot export a cache on its own, so the cache
+		// metadata goes inline into the image, which Push also publishes
+		// as the cache.
+		inline := "1"
+		opts.BuildArgs["BUILDKIT_INLINE_CACHE"] = &inline
+		opts.CacheFrom = []string{buildCacheRef()}
+	}
+
+	buildContext := tarDirectory(workspace)
+	defer buildContext.Close()
+	resp, err := cli.ImageBuild(ctx, buildContext, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return streamMessages(resp.Body, output)
+}
+
+// buildSession exposes the job's build secrets and SSH key to BuildKit.
+// Secrets that are not configured on this host are left out, as with the
+// CLI flags in secretArgs.
+func buildSession(ctx context.Context, job *buildJob) (*session.Session, error) {
+	sess, err := session.NewSession(ctx, "airflow-image-factory", job.BuildID)
+	if err != nil {
+		return nil, err
+	}
+	var sources []secretsprovider.Source
+	for _, id := range job.Secrets {
+		src, ok := buildSecretSources[id]
+		if !ok || *src == "" {
+			slog.Warn("Build secret is not configured on this builder", "build_id", job.BuildID, "secret", id)
+			continue
+		}
+		sources = append(sources, secretsprovider.Source{ID: id, FilePath: *src})
+	}
+	store, err := secretsprovider.NewStore(sources)
+	if err != nil {
+		return nil, err
+	}
+	sess.Allow(secretsprovider.NewSecretProvider(store))
+
+	if job.SSH {
+		agent := sshprovider.AgentConfig{ID: "default"}
+		if GIT_SSH_KEY_FILE != "" {
+			agent.Paths = []string{GIT_SSH_KEY_FILE}
+		}
+		ssh, err := sshprovider.NewSSHAgentProvider([]sshprovider.AgentConfig{agent})
+		if err != nil {
+			return nil, err
+		}
+		sess.Allow(ssh)
+	}
+	return sess, nil
+}
+
+// dockerPush pushes image to the registry with the factory's credentials.
+func dockerPush(ctx context.Context, cli *client.Client, image string, output *buildLog) error {
+	auth, err := registryAuth(image)
+	if err != nil {
+		return err
+	}
+	resp, err := cli.ImagePush(ctx, image, types.ImagePushOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	return streamMessages(resp, output)
+}
+
+// registryAuth encodes the credentials for pushing ref the way the Engine
+// API expects them in X-Registry-Auth.
+func registryAuth(ref string) (string, error) {
+	username, password, err := credentialsFor(ref)
+	if err != nil {
+		return "", err
+	}
+	if username == "" {
+		return base64.URLEncoding.EncodeToString([]byte("{}")), nil
+	}
+	encoded, _ := json.Marshal(types.AuthConfig{
+		Username:      username,
+		Password:      password,
+		ServerAddress: registryHost(ref),
+	})
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
+// imageSizeBytes asks the daemon for the size of a freshly built image. It
+// returns 0 if that fails; the size is informational only.
+func imageSizeBytes(ctx context.Context, cli *client.Client, imageName string) int64 {
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+	if err == nil {
+		return inspect.Size
+	}
+	slog.Warn("Inspecting image", "image", imageName, "error", err)
+	return 0
+}
+
+// streamMessages feeds a daemon's JSON progress stream into the build log
+// line by line, as runLogged does for CLI output. Per-layer progress bars
+// are dropped; an error message in the stream ends it with that error.
+func streamMessages(stream io.Reader, output *buildLog) error {
+	trace := newTraceLogger(output)
+	dec := json.NewDecoder(stream)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch {
+		case msg.Error != nil:
+			logLine(output, msg.Error.Message)
+			return errors.New(msg.Error.Message)
+		case msg.ID == "moby.buildkit.trace":
+			trace.log(msg.Aux)
+		case msg.Stream != "":
+			for _, line := range strings.Split(strings.TrimRight(msg.Stream, "\n"), "\n") {
+				logLine(output, line)
+			}
+		case msg.Status != "" && msg.Progress == nil:
+			line := msg.Status
+			if msg.ID != "" {
+				line = msg.ID + ": " + line
+			}
+			logLine(output, line)
+		}
+	}
+}
+
+func logLine(output *buildLog, line string) {
+	output.append(line)
+}
+
+// traceLogger renders BuildKit status updates like `--progress=plain`:
+// each step is announced once as "#N name" and its output is prefixed
+// with the step number.
+type traceLogger struct {
+	output *buildLog
+	steps  map[digest.Digest]int
+}
+
+func newTraceLogger(output *buildLog) *traceLogger {
+	return &traceLogger{output: output, steps: make(map[digest.Digest]int)}
+}
+
+func (t *traceLogger) log(aux *json.RawMessage) {
+	if aux == nil {
+		return
+	}
+	var raw []byte
+	if err := json.Unmarshal(*aux, &raw); err != nil {
+		return
+	}
+	var status controlapi.StatusResponse
+	if err := status.Unmarshal(raw); err != nil {
+		return
+	}
+	for _, v := range status.Vertexes {
+		n, seen := t.steps[v.Digest]
+		if !seen {
+			n = len(t.steps) + 1
+			t.steps[v.Digest] = n
+			logLine(t.output, fmt.Sprintf("#%d %s", n, v.Name))
+		}
+		if v.Error != "" {
+			logLine(t.output, fmt.Sprintf("#%d ERROR: %s", n, v.Error))
+		} else if v.Cached && !seen {
+			logLine(t.output, fmt.Sprintf("#%d CACHED", n))
+		}
+	}
+	for _, l := range status.Logs {
+		n := t.steps[l.Vertex]
+		for _, line := range strings.Split(strings.TrimRight(string(l.Msg), "\n"), "\n") {
+			logLine(t.output, fmt.Sprintf("#%d %s", n, line))
+		}
+	}
+}
+
+// tarDirectory streams dir as an uncompressed tar archive, the form the
+// Engine API takes a build context in.
+func tarDirectory(dir string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil || rel == "." {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(rel)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ecrHostPattern matches the registry host of an Amazon ECR private
+// registry, capturing its account and region.
+var ecrHostPattern = regexp.MustCompile(`^([0-9]{12})\.dkr\.ecr\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// awsCredentials are AWS access keys, with a session token for temporary
+// ones.
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// ecrClient is the registryProvider for Amazon ECR. It signs in with the
+// factory's AWS credentials: the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN environment variables, else the ECS or EKS Pod
+// Identity container role, else the EC2 instance role. Registry passwords
+// are ECR authorization tokens, fetched when needed and renewed before they
+// expire.
+type ecrClient struct {
+	region string
+	http   *http.Client
+
+	mu       sync.Mutex
+	password string
+	expires  time.Time
+	repos    map[string]bool // repositories known to exist
+}
+
+func newECRClient(host string) *ecrClient {
+	m := ecrHostPattern.FindStringSubmatch(host)
+	if m == nil {
+		return nil
+	}
+	return &ecrClient{region: m[2], http: &http.Client{Timeout: 30 * time.Second}, repos: make(map[string]bool)}
+}
+
+func (c *ecrClient) Name() string { return "ECR" }
+
+// credentials returns an authorization token, renewed once it might not
+// outlive a build started now. Tokens are valid for 12 hours.
+func (c *ecrClient) credentials() (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Until(c.expires) > BUILD_TIMEOUT+5*time.Minute {
+		return "AWS", c.password, nil
+	}
+	var resp struct {
+		AuthorizationData []struct {
+			AuthorizationToken string  `json:"authorizationToken"`
+			ExpiresAt          float64 `json:"expiresAt"`
+		} `json:"authorizationData"`
+	}
+	if err := c.call("GetAuthorizationToken", map[string]interface{}{}, &resp); err != nil {
+		return "", "", fmt.Errorf("getting ECR authorization token: %w", err)
+	}
+	if len(resp.AuthorizationData) == 0 {
+		return "", "", errors.New("getting ECR authorization token: empty response")
+	}
+	data := resp.AuthorizationData[0]
+	decoded, err := base64.StdEncoding.DecodeString(data.AuthorizationToken)
+	if err != nil {
+		return "", "", fmt.Errorf("decoding ECR authorization token: %w", err)
+	}
+	c.password = strings.TrimPrefix(string(decoded), "AWS:")
+	c.expires = time.Unix(int64(data.ExpiresAt), 0)
+	return "AWS", c.password, nil
+}
+
+// ensureRepository creates repository in the registry unless it exists,
+// since ECR refuses pushes to repositories nobody created.
+func (c *ecrClient) ensureRepository(repository string) error {
+	c.mu.Lock()
+	known := c.repos[repository]
+	c.mu.Unlock()
+	if known {
+		return nil
+	}
+	err := c.call("CreateRepository", map[string]interface{}{"repositoryName": repository}, nil)
+	var apiErr *awsError
+	if errors.As(err, &apiErr) && apiErr.Type == "RepositoryAlreadyExistsException" {
+		err = nil
+	} else if err == nil {
+		slog.Info("Created ECR repository", "repository", repository)
+	}
+	if err != nil {
+		return fmt.Errorf("creating ECR repository %s: %w", repository, err)
+	}
+	c.mu.Lock()
+	c.repos[repository] = true
+	c.mu.Unlock()
+	return nil
+}
+
+// awsError is an error reply from an AWS JSON API.
+type awsError struct {
+	Type    string
+	Message string
+}
+
+func (e *awsError) Error() string { return e.Type + ": " + e.Message }
+
+// call invokes an ECR API action with a SigV4-signed JSON request.
+func (c *ecrClient) call(action string, input, output interface{}) error {
+	creds, err := awsCredentialsFor(c.http)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	endpoint := "api.ecr." + c.region + ".amazonaws.com"
+	if strings.HasPrefix(c.region, "cn-") {
+		endpoint += ".cn"
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://"+endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonEC2ContainerRegistry_V20150921."+action)
+	signAWSRequest(req, body, creds, c.region, "ecr", time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var reply struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&reply)
+		if reply.Type == "" {
+			return fmt.Errorf("%s: %s", action, resp.Status)
+		}
+		return &awsError{Type: reply.Type[strings.LastIndex(reply.Type, "#")+1:], Message: reply.Message}
+	}
+	if output == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(output)
+}
+
+// awsCredentialsFor finds the factory's AWS credentials, looking where the
+// AWS SDKs do for a process on a server: environment, container role,
+// instance role.
+func awsCredentialsFor(hc *http.Client) (awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	containerURL := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		containerURL = "http://169.254.170.2" + uri
+	}
+	if containerURL != "" {
+		req, err := http.NewRequest(http.MethodGet, containerURL, nil)
+		if err != nil {
+			return awsCredentials{}, err
+		}
+		token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+		if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return awsCredentials{}, fmt.Errorf("reading container authorization token: %w", err)
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		var creds awsCredentials
+		if err := getJSON(hc, req, &creds); err != nil {
+			return awsCredentials{}, fmt.Errorf("getting container credentials: %w", err)
+		}
+		return creds, nil
+	}
+
+	// EC2 instance metadata, with an IMDSv2 session token.
+	const imds = "http://169.254.169.254/latest"
+	req, err := http.NewRequest(http.MethodPut, imds+"/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials in the environment and no instance metadata service: %w", err)
+	}
+	token, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, imds+"/meta-data/iam/security-credentials/"+path, nil)
+		if err == nil {
+			req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		}
+		return req, err
+	}
+	req, err = get("")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	resp, err = hc.Do(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("getting instance role: %w", err)
+	}
+	role, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("getting instance role: %s", resp.Status)
+	}
+	req, err = get(strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0]))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var creds awsCredentials
+	if err := getJSON(hc, req, &creds); err != nil {
+		return awsCredentials{}, fmt.Errorf("getting instance credentials: %w", err)
+	}
+	return creds, nil
+}
+
+func getJSON(hc *http.Client, req *http.Request, out interface{}) error {
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// signAWSRequest adds an AWS Signature Version 4 to req, whose body is
+// body, signing every header it carries.
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+	payloadHash := sha256.Sum256(body)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
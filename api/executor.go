@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// buildOutcome is the terminal result of executing a build job.
+type buildOutcome struct {
+	Status    BuildStatus `json:"status"`
+	Error     string      `json:"error,omitempty"`
+	ErrorCode string      `json:"error_code,omitempty"` // one of the failure codes
+	Digest    string      `json:"digest,omitempty"`
+
+	// Pushes has a result for Image and each of the job's ExtraImages.
+	// Failing to push an extra image does not fail the build.
+	Pushes []RegistryPush `json:"pushes,omitempty"`
+
+	// SBOM is the SBOM_FORMAT document of the pushed image, if one was made.
+	SBOM       []byte `json:"sbom,omitempty"`
+	SBOMFormat string `json:"sbom_format,omitempty"`
+
+	Vulnerabilities *VulnerabilityReport `json:"vulnerabilities,omitempty"`
+
+	// Measurements for metrics, only filled in for successful builds.
+	BuildSeconds float64 `json:"build_seconds,omitempty"`
+	PushSeconds  float64 `json:"push_seconds,omitempty"`
+	ImageSize    int64   `json:"image_size,omitempty"`
+}
+
+// runBuild executes a job on this host, recording each state transition so
+// clients polling GET /builds/{id} can follow along.
+func runBuild(job *buildJob) {
+	output, _ := builds.log(job.BuildID)
+	outcome := executeBuild(job, output, func(status BuildStatus) {
+		builds.setStatus(job.BuildID, status)
+	})
+	builds.complete(job.BuildID, outcome)
+}
+
+// executeBuild performs the docker build and push for job, streaming docker
+// output into output and announcing the building and pushing phases via
+// setPhase. It is shared by in-process workers and remote builder agents.
+func executeBuild(job *buildJob, output *buildLog, setPhase func(BuildStatus)) buildOutcome {
+	traceCtx, span := tracer.Start(traceContext(job.TraceContext), "build",
+		trace.WithAttributes(buildAttr(job.BuildID), attribute.String("image", job.Image)))
+	outcome := runSteps(traceCtx, job, output, setPhase)
+	span.SetAttributes(attribute.String("build.status", string(outcome.Status)))
+	if outcome.Status != StatusSucceeded {
+		span.SetStatus(codes.Error, string(outcome.Status))
+	}
+	span.End()
+	return outcome
+}
+
+func runSteps(traceCtx context.Context, job *buildJob, output *buildLog, setPhase func(BuildStatus)) buildOutcome {
+	id, imageName := job.BuildID, job.Image
+	if job.ctx.Err() != nil {
+		return buildOutcome{Status: StatusCancelled}
+	}
+
+	ctx, cancel := context.WithTimeout(job.ctx, job.Timeout)
+	defer cancel()
+
+	setPhase(StatusBuilding)
+
+	// Each build gets its own context directory so concurrent builds never
+	// see each other's Dockerfile.
+	workspace, err := os.MkdirTemp(WORKSPACE_DIR, workspacePrefix+id+"-")
+	if err != nil {
+		return buildOutcome{Status: StatusFailed, ErrorCode: failureInternal, Error: fmt.Sprintf("Creating build workspace: %s", err)}
+	}
+	activeWorkspaces.Store(workspace, id)
+	defer activeWorkspaces.Delete(workspace)
+	defer os.RemoveAll(workspace)
+
+	// Write Dockerfile
+	err = os.WriteFile(filepath.Join(workspace, "Dockerfile"), job.Dockerfile, 0644)
+	if err != nil {
+		return buildOutcome{Status: StatusFailed, ErrorCode: failureInternal, Error: err.Error()}
+	}
+	if err := writeContextFiles(workspace, job.Files); err != nil {
+		return buildOutcome{Status: StatusFailed, ErrorCode: failureInternal, Error: fmt.Sprintf("Writing build context: %s", err)}
+	}
+
+	if err := prepareRegistry(append([]string{imageName, BUILD_CACHE_REPO, KANIKO_CACHE_REPO}, job.ExtraImages...)...); err != nil {
+		return buildOutcome{Status: StatusFailed, ErrorCode: failureInternal, Error: fmt.Sprintf("Preparing registry: %s", err)}
+	}
+	b, err := newBuilder(job, workspace, output)
+	if err != nil {
+		return buildOutcome{Status: StatusFailed, ErrorCode: failureInternal, Error: err.Error()}
+	}
+	defer b.Cancel()
+	name := b.Name()
+
+	// Build image
+	buildStart := time.Now()
+	err = runStep(ctx, traceCtx, job, name+" build", b.Logs(), func() error {
+		return b.Build(ctx)
+	})
+	if err != nil {
+		return stepFailure(ctx, job, name+" build", err, b.Logs())
+	}
+	buildSeconds := time.Since(buildStart).Seconds()
+	var size int64
+	if sizer, ok := b.(imageSizer); ok {
+		size = sizer.ImageSize(ctx)
+	}
+
+	var report *VulnerabilityReport
+	_, local := b.(imageExporter)
+	if VULN_SCAN && local {
+		var stop *buildOutcome
+		if report, stop = scanStep(ctx, traceCtx, job, b, workspace, ""); stop != nil {
+			return *stop
+		}
+	}
+
+	setPhase(StatusPushing)
+
+	// Push image
+	var digest string
+	pushStart := time.Now()
+	err = runStep(ctx, traceCtx, job, name+" push", b.Logs(), func() error {
+		var err error
+		digest, err = b.Push(ctx)
+		return err
+	})
+	if err != nil {
+		return stepFailure(ctx, job, name+" push", err, b.Logs())
+	}
+	pushSeconds := time.Since(pushStart).Seconds()
+
+	// Images only the registry has are scanned there. One that fails the
+	// gate is deleted again once the build is recorded; see complete.
+	if VULN_SCAN && !local {
+		ref := imageName
+		if digest != "" {
+			ref = imageName[:strings.LastIndex(imageName, ":")] + "@" + digest
+		}
+		var stop *buildOutcome
+		if report, stop = scanStep(ctx, traceCtx, job, b, workspace, ref); stop != nil {
+			stop.Digest = digest
+			return *stop
+		}
+	}
+
+	pushes := []RegistryPush{{Image: imageName, Pushed: true, Digest: digest}}
+	pusher, separate := b.(imagePusher)
+	for _, image := range job.ExtraImages {
+		if !separate {
+			// Pushed along with imageName.
+			pushes = append(pushes, RegistryPush{Image: image, Pushed: true, Digest: digest})
+			continue
+		}
+		step := name + " push to " + registryHost(image)
+		var extraDigest string
+		err := runStep(ctx, traceCtx, job, step, b.Logs(), func() error {
+			var err error
+			extraDigest, err = pusher.PushAs(ctx, image)
+			return err
+		})
+		if ctx.Err() != nil {
+			return stoppedOutcome(ctx, id, strings.ToLower(step), job.Timeout)
+		}
+		if err != nil {
+			logLine(b.Logs(), fmt.Sprintf("%s failed: %s", step, err))
+			pushes = append(pushes, RegistryPush{Image: image, Error: err.Error()})
+			continue
+		}
+		pushes = append(pushes, RegistryPush{Image: image, Pushed: true, Digest: extraDigest})
+	}
+
+	// An SBOM is informational: a build without one still succeeds.
+	var sbom []byte
+	if SBOM_FORMAT != "" {
+		err := runStep(ctx, traceCtx, job, "sbom", b.Logs(), func() error {
+			var err error
+			sbom, err = generateSBOM(ctx, imageName, digest, workspace, b.Logs())
+			return err
+		})
+		if ctx.Err() != nil {
+			return stoppedOutcome(ctx, id, "sbom", job.Timeout)
+		}
+		if err != nil {
+			logLine(b.Logs(), fmt.Sprintf("SBOM failed: %s", err))
+		}
+	}
+
+	// An unsigned image would be turned away at admission, so failing to
+	// sign the primary image fails the build.
+	for i := range pushes {
+		if !signingEnabled() || !pushes[i].Pushed {
+			continue
+		}
+		step := "cosign sign"
+		if i > 0 {
+			step += " in " + registryHost(pushes[i].Image)
+		}
+		var signature string
+		err := runStep(ctx, traceCtx, job, step, b.Logs(), func() error {
+			var err error
+			signature, err = signImage(ctx, pushes[i].Image, pushes[i].Digest, b.Logs())
+			return err
+		})
+		if err != nil && i == 0 {
+			return stepFailure(ctx, job, step, err, b.Logs())
+		}
+		if ctx.Err() != nil {
+			return stoppedOutcome(ctx, id, step, job.Timeout)
+		}
+		if err != nil {
+			logLine(b.Logs(), fmt.Sprintf("%s failed: %s", step, err))
+			pushes[i].Error = "signing: " + err.Error()
+			continue
+		}
+		pushes[i].Signature = signature
+	}
+
+	// Provenance is what admission policies verify the factory's inputs
+	// against, so like the signature it is required for the primary image.
+	if PROVENANCE_BUILDER_ID != "" {
+		finished := time.Now()
+		for i := range pushes {
+			if !pushes[i].Pushed || pushes[i].Error != "" {
+				continue
+			}
+			step := "provenance"
+			if i > 0 {
+				step += " in " + registryHost(pushes[i].Image)
+			}
+			statement := newProvenance(job, pushes[i].Digest, buildStart, finished)
+			var attestation string
+			err := runStep(ctx, traceCtx, job, step, b.Logs(), func() error {
+				var err error
+				attestation, err = attachProvenance(ctx, pushes[i].Image, pushes[i].Digest, workspace, statement, b.Logs())
+				return err
+			})
+			if err != nil && i == 0 {
+				return stepFailure(ctx, job, step, err, b.Logs())
+			}
+			if ctx.Err() != nil {
+				return stoppedOutcome(ctx, id, step, job.Timeout)
+			}
+			if err != nil {
+				logLine(b.Logs(), fmt.Sprintf("%s failed: %s", step, err))
+				pushes[i].Error = "provenance: " + err.Error()
+				continue
+			}
+			logLine(b.Logs(), fmt.Sprintf("Attached provenance to %s as %s", pushes[i].Image, attestation))
+			pushes[i].Provenance = attestation
+		}
+	}
+
+	slog.Info("Image built and pushed", "build_id", job.BuildID, "builder", name, "image", imageName)
+	return buildOutcome{
+		Status:          StatusSucceeded,
+		Digest:          digest,
+		Pushes:          pushes,
+		SBOM:            sbom,
+		SBOMFormat:      SBOM_FORMAT,
+		Vulnerabilities: report,
+		BuildSeconds:    buildSeconds,
+		PushSeconds:     pushSeconds,
+		ImageSize:       size,
+	}
+}
+
+// runStep runs one builder step in its own span, retrying transient
+// failures.
+func runStep(ctx, traceCtx context.Context, job *buildJob, step string, output *buildLog, run func() error) error {
+	_, span := tracer.Start(traceCtx, strings.ToLower(step), trace.WithAttributes(buildAttr(job.BuildID)))
+	err := runWithRetry(ctx, step, output, run)
+	endSpan(span, err)
+	return err
+}
+
+// stepFailure is the outcome of a builder step that failed with err.
+func stepFailure(ctx context.Context, job *buildJob, step string, err error, output *buildLog) buildOutcome {
+	if ctx.Err() != nil {
+		return stoppedOutcome(ctx, job.BuildID, strings.ToLower(step), job.Timeout)
+	}
+	errMsg := failureMessage(step, err, output)
+	code := classifyFailure(strings.ToLower(step), append(output.tail(failureContextLines), err.Error()))
+	slog.Warn("Build step failed", "build_id", job.BuildID, "step", step, "code", code, "error", errMsg)
+	return buildOutcome{Status: StatusFailed, ErrorCode: code, Error: errMsg}
+}
+
+// buildFlags are the build options for a job accepted alike by docker
+// buildx, buildah, podman and nerdctl.
+func buildFlags(job *buildJob) []string {
+	var flags []string
+	if job.Pull {
+		flags = append(flags, "--pull")
+	}
+	flags = append(flags, secretArgs(job.Secrets)...)
+	flags = append(flags, sshArgs(job)...)
+	for _, name := range sortedKeys(job.BuildArgs) {
+		flags = append(flags, "--build-arg", name+"="+job.BuildArgs[name])
+	}
+	return flags
+}
+
+// pushDigestPattern matches the summary line of `docker push`, e.g.
+// "3351ed6ccd54b9d0: digest: sha256:... size: 4537".
+var pushDigestPattern = regexp.MustCompile(`digest: (sha256:[0-9a-f]{64})`)
+
+func pushedDigest(lines []string) string {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if m := pushDigestPattern.FindStringSubmatch(lines[i]); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// stoppedOutcome explains why a build's context ended while step was
+// running: either its timeout elapsed or someone cancelled it.
+func stoppedOutcome(ctx context.Context, id, step string, timeout time.Duration) buildOutcome {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		errMsg := fmt.Sprintf("Build timed out after %s during %s", timeout, step)
+		slog.Warn("Build timed out", "build_id", id, "step", step, "timeout", timeout.String())
+		return buildOutcome{Status: StatusTimedOut, ErrorCode: failureTimeout, Error: errMsg}
+	}
+	slog.Info("Build cancelled", "build_id", id, "step", step)
+	return buildOutcome{Status: StatusCancelled}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+var extraSeparators = regexp.MustCompile(`[-_.]+`)
+
+// normalizeExtra folds an extra name as pip compares them (PEP 685), so
+// "cncf.kubernetes" matches metadata listing "cncf-kubernetes".
+func normalizeExtra(name string) string {
+	return extraSeparators.ReplaceAllString(strings.ToLower(name), "-")
+}
+
+// validateExtras rejects extras the requested Airflow release does not
+// declare, which pip would otherwise only warn about. If PyPI cannot be
+// reached the check is skipped rather than blocking builds.
+func validateExtras(ctx context.Context, req DockerBuildRequest) error {
+	if len(req.Extras) == 0 || PYPI_JSON_URL == "" {
+		return nil
+	}
+	release, err := fetchAirflowRelease(ctx, req.AirflowVersion)
+	if err == errUnknownAirflowVersion {
+		return fieldErrorf("airflow_version", codeInvalid, "Airflow version %s does not exist on PyPI", req.AirflowVersion)
+	}
+	if err != nil {
+		logger(ctx).Warn("Skipping extras validation", "airflow_version", req.AirflowVersion, "error", err)
+		return nil
+	}
+	known := release.Extras
+	valid := make(map[string]bool, len(known))
+	for _, extra := range known {
+		valid[normalizeExtra(extra)] = true
+	}
+	var unknown []string
+	for _, extra := range req.Extras {
+		if !valid[normalizeExtra(extra)] {
+			unknown = append(unknown, extra)
+		}
+	}
+	if len(unknown) > 0 {
+		return fieldErrorf("extras", codeEnum, "Unknown extras for Airflow %s: %s. Valid extras: %s", req.AirflowVersion, strings.Join(unknown, ", "), strings.Join(known, ", "))
+	}
+	return nil
+}
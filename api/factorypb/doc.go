@@ -0,0 +1,5 @@
+// Package factorypb holds the protobuf messages and gRPC service of the
+// image factory, generated from factory.proto.
+package factorypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative factory.proto
@@ -0,0 +1,213 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.21.12
+// source: factory.proto
+
+package factorypb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ImageFactoryClient is the client API for ImageFactory service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ImageFactoryClient interface {
+	// CreateBuild queues a build, like POST /v1/builds.
+	CreateBuild(ctx context.Context, in *CreateBuildRequest, opts ...grpc.CallOption) (*CreateBuildResponse, error)
+	// GetBuild returns a build, like GET /v1/builds/{id}.
+	GetBuild(ctx context.Context, in *GetBuildRequest, opts ...grpc.CallOption) (*Build, error)
+	// StreamBuildLogs sends the output of a build so far, then follows it
+	// until the build finishes, ending with its final status.
+	StreamBuildLogs(ctx context.Context, in *StreamBuildLogsRequest, opts ...grpc.CallOption) (ImageFactory_StreamBuildLogsClient, error)
+}
+
+type imageFactoryClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewImageFactoryClient(cc grpc.ClientConnInterface) ImageFactoryClient {
+	return &imageFactoryClient{cc}
+}
+
+func (c *imageFactoryClient) CreateBuild(ctx context.Context, in *CreateBuildRequest, opts ...grpc.CallOption) (*CreateBuildResponse, error) {
+	out := new(CreateBuildResponse)
+	err := c.cc.Invoke(ctx, "/imagefactory.v1.ImageFactory/CreateBuild", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *imageFactoryClient) GetBuild(ctx context.Context, in *GetBuildRequest, opts ...grpc.CallOption) (*Build, error) {
+	out := new(Build)
+	err := c.cc.Invoke(ctx, "/imagefactory.v1.ImageFactory/GetBuild", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *imageFactoryClient) StreamBuildLogs(ctx context.Context, in *StreamBuildLogsRequest, opts ...grpc.CallOption) (ImageFactory_StreamBuildLogsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ImageFactory_ServiceDesc.Streams[0], "/imagefactory.v1.ImageFactory/StreamBuildLogs", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &imageFactoryStreamBuildLogsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ImageFactory_StreamBuildLogsClient interface {
+	Recv() (*LogEvent, error)
+	grpc.ClientStream
+}
+
+type imageFactoryStreamBuildLogsClient struct {
+	grpc.ClientStream
+}
+
+func (x *imageFactoryStreamBuildLogsClient) Recv() (*LogEvent, error) {
+	m := new(LogEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ImageFactoryServer is the server API for ImageFactory service.
+// All implementations must embed UnimplementedImageFactoryServer
+// for forward compatibility
+type ImageFactoryServer interface {
+	// CreateBuild queues a build, like POST /v1/builds.
+	CreateBuild(context.Context, *CreateBuildRequest) (*CreateBuildResponse, error)
+	// GetBuild returns a build, like GET /v1/builds/{id}.
+	GetBuild(context.Context, *GetBuildRequest) (*Build, error)
+	// StreamBuildLogs sends the output of a build so far, then follows it
+	// until the build finishes, ending with its final status.
+	StreamBuildLogs(*StreamBuildLogsRequest, ImageFactory_StreamBuildLogsServer) error
+	mustEmbedUnimplementedImageFactoryServer()
+}
+
+// UnimplementedImageFactoryServer must be embedded to have forward compatible implementations.
+type UnimplementedImageFactoryServer struct {
+}
+
+func (UnimplementedImageFactoryServer) CreateBuild(context.Context, *CreateBuildRequest) (*CreateBuildResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateBuild not implemented")
+}
+func (UnimplementedImageFactoryServer) GetBuild(context.Context, *GetBuildRequest) (*Build, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBuild not implemented")
+}
+func (UnimplementedImageFactoryServer) StreamBuildLogs(*StreamBuildLogsRequest, ImageFactory_StreamBuildLogsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamBuildLogs not implemented")
+}
+func (UnimplementedImageFactoryServer) mustEmbedUnimplementedImageFactoryServer() {}
+
+// UnsafeImageFactoryServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ImageFactoryServer will
+// result in compilation errors.
+type UnsafeImageFactoryServer interface {
+	mustEmbedUnimplementedImageFactoryServer()
+}
+
+func RegisterImageFactoryServer(s grpc.ServiceRegistrar, srv ImageFactoryServer) {
+	s.RegisterService(&ImageFactory_ServiceDesc, srv)
+}
+
+func _ImageFactory_CreateBuild_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateBuildRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ImageFactoryServer).CreateBuild(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/imagefactory.v1.ImageFactory/CreateBuild",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ImageFactoryServer).CreateBuild(ctx, req.(*CreateBuildRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ImageFactory_GetBuild_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBuildRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ImageFactoryServer).GetBuild(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/imagefactory.v1.ImageFactory/GetBuild",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ImageFactoryServer).GetBuild(ctx, req.(*GetBuildRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ImageFactory_StreamBuildLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamBuildLogsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ImageFactoryServer).StreamBuildLogs(m, &imageFactoryStreamBuildLogsServer{stream})
+}
+
+type ImageFactory_StreamBuildLogsServer interface {
+	Send(*LogEvent) error
+	grpc.ServerStream
+}
+
+type imageFactoryStreamBuildLogsServer struct {
+	grpc.ServerStream
+}
+
+func (x *imageFactoryStreamBuildLogsServer) Send(m *LogEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// ImageFactory_ServiceDesc is the grpc.ServiceDesc for ImageFactory service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ImageFactory_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "imagefactory.v1.ImageFactory",
+	HandlerType: (*ImageFactoryServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateBuild",
+			Handler:    _ImageFactory_CreateBuild_Handler,
+		},
+		{
+			MethodName: "GetBuild",
+			Handler:    _ImageFactory_GetBuild_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamBuildLogs",
+			Handler:       _ImageFactory_StreamBuildLogs_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "factory.proto",
+}
@@ -0,0 +1,100 @@
+package main
+
+import "strings"
+
+// Failure codes say why a build, or a build request, failed. Unlike the
+// messages they are stable, for callers and alerting to branch on.
+const (
+	failureInvalidSpec     = "INVALID_SPEC"          // the spec was refused before building
+	failureBasePull        = "BASE_PULL_FAILED"      // the base image could not be pulled
+	failurePipResolution   = "PIP_RESOLUTION_FAILED" // pip could not find or reconcile the packages
+	failureBuild           = "BUILD_FAILED"          // the build failed for any other reason
+	failurePushAuth        = "PUSH_AUTH_FAILED"      // the registry refused the push's credentials
+	failurePush            = "PUSH_FAILED"           // the push failed for any other reason
+	failureSigning         = "SIGNING_FAILED"        // signing or attesting the pushed image failed
+	failureVulnerabilities = "VULNERABILITIES_FOUND" // the image failed the vulnerability scan
+	failureTimeout         = "TIMEOUT"               // the build outlasted its timeout
+	failureInterrupted     = "INTERRUPTED"           // the factory or worker running it went away
+	failureInternal        = "INTERNAL_ERROR"        // the factory could not set the build up
+)
+
+// basePullMarkers are output fragments of a FROM that could not be pulled,
+// whether the image does not exist or the registry would not give it.
+var basePullMarkers = []string{
+	"pull access denied",
+	"manifest unknown",
+	"failed to resolve source metadata",
+	"error pulling image",
+	"failed to pull image",
+	"repository does not exist",
+	"failed to get filesystem from image", // kaniko
+}
+
+// pipResolutionMarkers are output fragments of pip failing to find or
+// reconcile the requested packages.
+var pipResolutionMarkers = []string{
+	"resolutionimpossible",
+	"could not find a version that satisfies",
+	"no matching distribution found",
+	"conflicting dependencies",
+	"cannot install -r",
+}
+
+// pushMarkers are output fragments of a failed push, from builders such as
+// kaniko that push as part of building.
+var pushMarkers = []string{
+	"error pushing image",
+	"failed to push",
+	"push access denied",
+}
+
+// pushAuthMarkers are output fragments of a registry refusing credentials.
+// Status codes are matched with their phrase, as bare 401 and 403 turn up
+// in digests and layer IDs.
+var pushAuthMarkers = []string{
+	"unauthorized",
+	"authentication required",
+	"no basic auth credentials",
+	"insufficient_scope",
+	"access denied",
+	"denied:",
+	"401 unauthorized",
+	"403 forbidden",
+	"status code 401",
+	"status code 403",
+	"status: 401",
+	"status: 403",
+}
+
+// failureContextLines is how much of a failed step's output is searched
+// for the cause; the step stops soon after failing.
+const failureContextLines = 50
+
+// classifyFailure is the failure code of builder step failing with the
+// output lines, the step's error among them.
+func classifyFailure(step string, lines []string) string {
+	text := strings.ToLower(strings.Join(lines, "\n"))
+	switch {
+	case strings.HasPrefix(step, "cosign") || strings.HasPrefix(step, "provenance"):
+		return failureSigning
+	case strings.Contains(step, " push") || containsAny(text, pushMarkers):
+		if containsAny(text, pushAuthMarkers) {
+			return failurePushAuth
+		}
+		return failurePush
+	case containsAny(text, basePullMarkers):
+		return failureBasePull
+	case containsAny(text, pipResolutionMarkers):
+		return failurePipResolution
+	}
+	return failureBuild
+}
+
+func containsAny(text string, markers []string) bool {
+	for _, marker := range markers {
+		if strings.Contains(text, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		name  string
+		step  string
+		lines []string
+		want  string
+	}{
+		{
+			name:  "push refused credentials",
+			step:  "docker push",
+			lines: []string{"unauthorized: authentication required"},
+			want:  failurePushAuth,
+		},
+		{
+			name:  "push status code 403",
+			step:  "docker push",
+			lines: []string{"failed to push: unexpected status code 403"},
+			want:  failurePushAuth,
+		},
+		{
+			name:  "push 401 phrase",
+			step:  "docker push",
+			lines: []string{"error pushing image: 401 Unauthorized"},
+			want:  failurePushAuth,
+		},
+		{
+			name: "push timeout after digest with 401",
+			step: "docker push",
+			lines: []string{
+				"4038ab2c1f40: Pushed",
+				"latest: digest: sha256:9f4034031a2b7c0e5d4403e2f1b6a9c8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2 size: 2412",
+				"error pushing image: net/http: TLS handshake timeout",
+			},
+			want: failurePush,
+		},
+		{
+			name: "push server error after layer with 403",
+			step: "docker push",
+			lines: []string{
+				"a4039f403de1: Layer already exists",
+				"received unexpected HTTP status: 500 Internal Server Error",
+			},
+			want: failurePush,
+		},
+		{
+			name:  "kaniko push without push step",
+			step:  "kaniko",
+			lines: []string{"error pushing image: failed to push to destination: sha256:401403"},
+			want:  failurePush,
+		},
+		{
+			name:  "signing",
+			step:  "cosign sign",
+			lines: []string{"unauthorized"},
+			want:  failureSigning,
+		},
+		{
+			name:  "base pull",
+			step:  "docker build",
+			lines: []string{"pull access denied for apache/airflow:9.9.9, repository does not exist"},
+			want:  failureBasePull,
+		},
+		{
+			name:  "pip resolution",
+			step:  "docker build",
+			lines: []string{"ERROR: ResolutionImpossible: for help visit https://pip.pypa.io"},
+			want:  failurePipResolution,
+		},
+		{
+			name:  "other build failure with digest",
+			step:  "docker build",
+			lines: []string{"sha256:40134034", "exit code: 1"},
+			want:  failureBuild,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyFailure(tt.step, tt.lines); got != tt.want {
+				t.Errorf("classifyFailure(%q, %q) = %s, want %s", tt.step, tt.lines, got, tt.want)
+			}
+		})
+	}
+}
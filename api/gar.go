@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// garHostPattern matches the Docker host of a Google Artifact Registry
+// location, e.g. europe-west1-docker.pkg.dev, capturing the location.
+var garHostPattern = regexp.MustCompile(`^([a-z0-9-]+)-docker\.pkg\.dev$`)
+
+// garPushPermissions are what pushing, and pulling the layer cache, need on
+// an Artifact Registry repository; roles/artifactregistry.writer has both.
+var garPushPermissions = []string{
+	"artifactregistry.repositories.downloadArtifacts",
+	"artifactregistry.repositories.uploadArtifacts",
+}
+
+// metadataURL is the GCE and GKE metadata server's service account API.
+const metadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/"
+
+// garClient is the registryProvider for Google Artifact Registry. It signs
+// in as the service account whose JSON key GOOGLE_APPLICATION_CREDENTIALS
+// names, else as the workload identity or instance service account the
+// metadata server vouches for. Images are named
+// LOCATION-docker.pkg.dev/PROJECT/REPOSITORY/IMAGE; repositories are
+// checked to exist and grant the account push access, but not created.
+type garClient struct {
+	location string
+	http     *http.Client
+
+	mu      sync.Mutex
+	account string // service account email, for error messages
+	token   string
+	expires time.Time
+	repos   map[string]bool // repositories known to accept pushes
+}
+
+func newGARClient(host string) *garClient {
+	m := garHostPattern.FindStringSubmatch(host)
+	if m == nil {
+		return nil
+	}
+	return &garClient{location: m[1], http: &http.Client{Timeout: 30 * time.Second}, repos: make(map[string]bool)}
+}
+
+func (c *garClient) Name() string { return "Artifact Registry" }
+
+// credentials returns an OAuth access token as the registry password.
+// Tokens last an hour, so they are renewed once under five minutes remain.
+func (c *garClient) credentials() (string, string, error) {
+	token, err := c.accessToken()
+	return "oauth2accesstoken", token, err
+}
+
+func (c *garClient) accessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Until(c.expires) > 5*time.Minute {
+		return c.token, nil
+	}
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	var err error
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		err = c.serviceAccountToken(path, &resp)
+	} else {
+		err = c.metadataToken(&resp)
+	}
+	if err != nil {
+		return "", fmt.Errorf("getting Google access token: %w", err)
+	}
+	c.token = resp.AccessToken
+	c.expires = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// serviceAccountToken exchanges a JWT signed with a service account key
+// for an access token.
+func (c *garClient) serviceAccountToken(path string, out interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var key struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	if key.Type != "service_account" {
+		return fmt.Errorf("%s holds %q credentials; only service account keys are supported", path, key.Type)
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return fmt.Errorf("%s has no PEM private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("parsing private key in %s: %w", path, err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("private key in %s is not an RSA key", path)
+	}
+	c.account = key.ClientEmail
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/cloud-platform",
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	resp, err := c.http.PostForm(key.TokenURI, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("token exchange for %s: %s: %s", key.ClientEmail, resp.Status, bytes.TrimSpace(body))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// metadataToken asks the metadata server for the token of the pod's
+// workload identity or the instance's service account.
+func (c *garClient) metadataToken(out interface{}) error {
+	get := func(path string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, metadataURL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("no GOOGLE_APPLICATION_CREDENTIALS and no metadata server: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("metadata server: %s", resp.Status)
+		}
+		return resp, nil
+	}
+	if c.account == "" {
+		resp, err := get("email")
+		if err != nil {
+			return err
+		}
+		email, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.account = strings.TrimSpace(string(email))
+	}
+	resp, err := get("token")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ensureRepository checks that the Artifact Registry repository holding
+// path, PROJECT/REPOSITORY/IMAGE, exists and lets the factory's service
+// account push, explaining what to create or grant if not.
+func (c *garClient) ensureRepository(path string) error {
+	parts := strings.SplitN(path, "/", 3)
+	if len(parts) < 3 {
+		return fmt.Errorf("Artifact Registry images are named %s-docker.pkg.dev/PROJECT/REPOSITORY/IMAGE, not %s", c.location, path)
+	}
+	project, repository := parts[0], parts[1]
+	resource := fmt.Sprintf("projects/%s/locations/%s/repositories/%s", project, c.location, repository)
+	c.mu.Lock()
+	known := c.repos[resource]
+	c.mu.Unlock()
+	if known {
+		return nil
+	}
+
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	account := c.account
+	c.mu.Unlock()
+	call := func(method, path string, body, out interface{}) (int, error) {
+		var reader io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		}
+		req, err := http.NewRequest(method, "https://artifactregistry.googleapis.com/v1/"+path, reader)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && out != nil {
+			return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode, nil
+	}
+
+	var repo struct {
+		Format string `json:"format"`
+	}
+	status, err := call(http.MethodGet, resource, nil, &repo)
+	switch {
+	case err != nil:
+		return fmt.Errorf("checking Artifact Registry repository %s: %w", resource, err)
+	case status == http.StatusNotFound:
+		return fmt.Errorf("Artifact Registry repository %s does not exist; create it with `gcloud artifacts repositories create %s --repository-format=docker --location=%s --project=%s`",
+			resource, repository, c.location, project)
+	case status == http.StatusForbidden:
+		return fmt.Errorf("%s may not read Artifact Registry repository %s, or it does not exist; grant it roles/artifactregistry.writer on the repository", account, resource)
+	case status != http.StatusOK:
+		return fmt.Errorf("checking Artifact Registry repository %s: %s", resource, http.StatusText(status))
+	case repo.Format != "DOCKER":
+		return fmt.Errorf("Artifact Registry repository %s holds %s packages, not Docker images", resource, repo.Format)
+	}
+
+	var granted struct {
+		Permissions []string `json:"permissions"`
+	}
+	status, err = call(http.MethodPost, resource+":testIamPermissions", map[string]interface{}{"permissions": garPushPermissions}, &granted)
+	if err == nil && status != http.StatusOK {
+		err = errors.New(http.StatusText(status))
+	}
+	if err != nil {
+		return fmt.Errorf("checking permissions on Artifact Registry repository %s: %w", resource, err)
+	}
+	has := make(map[string]bool, len(granted.Permissions))
+	for _, perm := range granted.Permissions {
+		has[perm] = true
+	}
+	var missing []string
+	for _, perm := range garPushPermissions {
+		if !has[perm] {
+			missing = append(missing, perm)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s lacks %s on Artifact Registry repository %s; grant it roles/artifactregistry.writer on the repository",
+			account, strings.Join(missing, " and "), resource)
+	}
+
+	c.mu.Lock()
+	c.repos[resource] = true
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"docker-airflow-api/factorypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// serveGRPC serves the ImageFactory service of factorypb on GRPC_ADDR.
+func serveGRPC() {
+	listener, err := net.Listen("tcp", GRPC_ADDR)
+	if err != nil {
+		log.Fatalf("Listening for gRPC on %s: %s", GRPC_ADDR, err)
+	}
+	options := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(logUnary, authorizeUnary),
+		grpc.ChainStreamInterceptor(logStream, authorizeStream),
+	}
+	if serverTLS != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(serverTLS)))
+	}
+	server := grpc.NewServer(options...)
+	factorypb.RegisterImageFactoryServer(server, imageFactoryServer{})
+	slog.Info("gRPC server starting", "address", GRPC_ADDR, "tls", serverTLS != nil)
+	log.Fatal(server.Serve(listener))
+}
+
+// grpcScopes are the scopes the methods of the service need, as
+// authorized checks them for the HTTP routes.
+var grpcScopes = map[string]string{
+	"/imagefactory.v1.ImageFactory/CreateBuild":     scopeBuilds + ":write",
+	"/imagefactory.v1.ImageFactory/GetBuild":        scopeBuilds + ":read",
+	"/imagefactory.v1.ImageFactory/StreamBuildLogs": scopeBuilds + ":read",
+}
+
+// authorizeCall checks the credential in the "authorization" (Bearer) or
+// "x-api-key" metadata of a call, when authentication is on.
+func authorizeCall(ctx context.Context, method string) (context.Context, error) {
+	if !authEnabled() {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var credential string
+	if v := md.Get("authorization"); len(v) > 0 && strings.HasPrefix(v[0], "Bearer ") {
+		credential = strings.TrimPrefix(v[0], "Bearer ")
+	} else if v := md.Get("x-api-key"); len(v) > 0 {
+		credential = v[0]
+	}
+	var state *tls.ConnectionState
+	if pr, ok := peer.FromContext(ctx); ok {
+		if info, ok := pr.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	p, fromCert := clientCertPrincipal(state)
+	if credential == "" && !fromCert {
+		return nil, status.Error(codes.Unauthenticated, "An API key or SSO token is required")
+	}
+	var err error
+	if credential != "" {
+		p, err = authenticate(credential)
+	}
+	if errors.Is(err, errInvalidCredentials) {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err != nil {
+		slog.Error("Authenticating call", "method", method, "error", err)
+		return nil, status.Error(codes.Internal, "Authentication failed")
+	}
+	scope, ok := grpcScopes[method]
+	if !ok {
+		scope = scopeAdmin
+	}
+	if !p.allows(scope) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s lacks the %s scope", p.Name, scope)
+	}
+	annotateRequest(ctx, slog.String("principal", p.Name), slog.String("auth", p.Method))
+	return context.WithValue(ctx, principalContextKey{}, p), nil
+}
+
+// limitCall applies RATE_LIMIT to every call, and BUILD_RATE_LIMIT to
+// CreateBuild, as rateLimited does to HTTP requests.
+func limitCall(ctx context.Context, method string) error {
+	client := "ip:"
+	if p, ok := principalFrom(ctx); ok {
+		client = p.Method + ":" + p.Name
+	} else if pr, ok := peer.FromContext(ctx); ok {
+		host, _, err := net.SplitHostPort(pr.Addr.String())
+		if err != nil {
+			host = pr.Addr.String()
+		}
+		client += host
+	}
+	limiters := []*rateLimiter{requestLimiter}
+	if method == "/imagefactory.v1.ImageFactory/CreateBuild" {
+		limiters = append(limiters, buildLimiter)
+	}
+	for i, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+		what := []string{"requests", "builds"}[i]
+		if ok, _, wait := limiter.take(client, time.Now()); !ok {
+			rateLimitedRequests.WithLabelValues(what).Inc()
+			return status.Errorf(codes.ResourceExhausted, "Too many %s: the limit is %s, retry in %ds", what, limiter.rate, int(math.Ceil(wait.Seconds())))
+		}
+	}
+	return nil
+}
+
+func authorizeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := authorizeCall(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err := limitCall(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func authorizeStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := authorizeCall(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	if err := limitCall(ctx, info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+// imageFactoryServer implements the gRPC service with the same functions
+// as the HTTP handlers.
+type imageFactoryServer struct {
+	factorypb.UnimplementedImageFactoryServer
+}
+
+func (imageFactoryServer) CreateBuild(ctx context.Context, in *factorypb.CreateBuildRequest) (*factorypb.CreateBuildResponse, error) {
+	if in.Spec == nil {
+		return nil, status.Error(codes.InvalidArgument, "spec is required")
+	}
+	requester := in.Requester
+	if p, ok := principalFrom(ctx); ok && (requester == "" || p.Method == authOIDC) {
+		requester = p.Name
+	}
+	if !mayUseProject(ctx, in.Spec.Project) {
+		return nil, status.Errorf(codes.PermissionDenied, "Not bound to project %s", in.Spec.Project)
+	}
+	build, err := prepareBuild(ctx, specFromProto(in.Spec), nil, requester)
+	if err != nil {
+		return nil, grpcStatus(err)
+	}
+	result, deduplicated, err := submitBuild(ctx, build)
+	if err != nil {
+		return nil, grpcStatus(err)
+	}
+	annotateRequest(ctx, slog.String("build_id", result.ID))
+	return &factorypb.CreateBuildResponse{Build: buildToProto(result), Deduplicated: deduplicated}, nil
+}
+
+func (imageFactoryServer) GetBuild(ctx context.Context, in *factorypb.GetBuildRequest) (*factorypb.Build, error) {
+	build, ok := builds.get(in.Id)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "Build not found")
+	}
+	if !mayUseProject(ctx, build.Request.Project) {
+		return nil, status.Errorf(codes.PermissionDenied, "Not bound to project %s", build.Request.Project)
+	}
+	return buildToProto(build), nil
+}
+
+// StreamBuildLogs follows a running build's event stream, like
+// /builds/{id}/ws, and replays the stored output of a finished one.
+func (imageFactoryServer) StreamBuildLogs(in *factorypb.StreamBuildLogsRequest, stream factorypb.ImageFactory_StreamBuildLogsServer) error {
+	build, ok := builds.get(in.Id)
+	if !ok {
+		return status.Error(codes.NotFound, "Build not found")
+	}
+	if !mayUseProject(stream.Context(), build.Request.Project) {
+		return status.Errorf(codes.PermissionDenied, "Not bound to project %s", build.Request.Project)
+	}
+	output, err := builds.replayLog(in.Id)
+	if err != nil {
+		return grpcStatus(err)
+	}
+
+	// The stream ends on the final status, which the build usually
+	// published as its last event.
+	var last BuildStatus
+	send := func(ev buildEvent) error {
+		if ev.Type == eventStatus {
+			last = ev.Status
+		}
+		return stream.Send(logEventToProto(ev))
+	}
+	backlog, events := output.subscribe()
+	defer func() { output.unsubscribe(events) }()
+	for _, ev := range backlog {
+		if err := send(ev); err != nil {
+			return err
+		}
+	}
+	seen := len(backlog)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case ev, ok := <-events:
+			if !ok {
+				// Either the build finished or this client fell behind and
+				// was dropped; catch up, and follow on unless it finished.
+				var missed []buildEvent
+				var open bool
+				missed, events, open = output.resubscribe(seen)
+				seen += len(missed)
+				for _, ev := range missed {
+					if err := send(ev); err != nil {
+						return err
+					}
+				}
+				if open {
+					continue
+				}
+				build, _ := builds.get(in.Id)
+				if build.Status == last {
+					return nil
+				}
+				return send(buildEvent{Type: eventStatus, Time: time.Now().UTC(), Status: build.Status})
+			}
+			seen++
+			if err := send(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// grpcStatus maps a prepare/submit error to a gRPC status, as writeError
+// does to a response, with the fields at fault of a bad request as
+// BadRequest details.
+func grpcStatus(err error) error {
+	var br badRequest
+	if errors.As(err, &br) {
+		st := status.New(codes.InvalidArgument, err.Error())
+		if len(br.fields) == 0 {
+			return st.Err()
+		}
+		details := &errdetails.BadRequest{}
+		for _, f := range br.fields {
+			details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{
+				Field:       f.Field,
+				Description: f.Code + ": " + f.Message,
+			})
+		}
+		if withDetails, err := st.WithDetails(details); err == nil {
+			st = withDetails
+		}
+		return st.Err()
+	}
+	if err == errBuildNotFound {
+		return status.Error(codes.NotFound, "Build not found")
+	}
+	var quota quotaExceeded
+	if errors.As(err, &quota) {
+		return status.Error(codes.ResourceExhausted, quota.msg)
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+var statusToProto = map[BuildStatus]factorypb.BuildStatus{
+	StatusQueued:    factorypb.BuildStatus_BUILD_STATUS_QUEUED,
+	StatusBuilding:  factorypb.BuildStatus_BUILD_STATUS_BUILDING,
+	StatusPushing:   factorypb.BuildStatus_BUILD_STATUS_PUSHING,
+	StatusSucceeded: factorypb.BuildStatus_BUILD_STATUS_SUCCEEDED,
+	StatusFailed:    factorypb.BuildStatus_BUILD_STATUS_FAILED,
+	StatusCancelled: factorypb.BuildStatus_BUILD_STATUS_CANCELLED,
+	StatusTimedOut:  factorypb.BuildStatus_BUILD_STATUS_TIMED_OUT,
+}
+
+func logEventToProto(ev buildEvent) *factorypb.LogEvent {
+	event := &factorypb.LogEvent{Time: timestamppb.New(ev.Time)}
+	if ev.Type == eventStatus {
+		event.Event = &factorypb.LogEvent_Status{Status: statusToProto[ev.Status]}
+	} else {
+		event.Event = &factorypb.LogEvent_Line{Line: ev.Line}
+	}
+	return event
+}
+
+func buildToProto(b Build) *factorypb.Build {
+	out := &factorypb.Build{
+		Id:              b.ID,
+		Status:          statusToProto[b.Status],
+		Tag:             b.Tag,
+		Image:           b.Image,
+		Digest:          b.Digest,
+		SizeBytes:       b.Size,
+		Tags:            b.Tags,
+		Error:           b.Error,
+		Skipped:         b.Skipped,
+		Spec:            specToProto(b.Request),
+		CreatedAt:       timestamppb.New(b.CreatedAt),
+		StartedAt:       optionalTimestamp(b.StartedAt),
+		FinishedAt:      optionalTimestamp(b.FinishedAt),
+		DurationSeconds: b.Duration,
+		Dockerfile:      b.Dockerfile,
+		Instance:        b.Instance,
+		ScheduleId:      b.ScheduleID,
+		Requester:       b.Requester,
+		DeletedAt:       optionalTimestamp(b.DeletedAt),
+	}
+	for _, p := range b.Pushes {
+		out.Pushes = append(out.Pushes, &factorypb.RegistryPush{
+			Image:      p.Image,
+			Pushed:     p.Pushed,
+			Digest:     p.Digest,
+			Signature:  p.Signature,
+			Provenance: p.Provenance,
+			Error:      p.Error,
+		})
+	}
+	if v := b.Vulnerabilities; v != nil {
+		out.Vulnerabilities = &factorypb.VulnerabilityReport{Counts: make(map[string]int32), Threshold: v.Threshold, Passed: v.Passed}
+		for severity, n := range v.Counts {
+			out.Vulnerabilities.Counts[severity] = int32(n)
+		}
+		for _, f := range v.Findings {
+			out.Vulnerabilities.Findings = append(out.Vulnerabilities.Findings, &factorypb.Vulnerability{
+				Id:               f.ID,
+				Severity:         f.Severity,
+				Package:          f.Package,
+				InstalledVersion: f.InstalledVersion,
+				FixedVersion:     f.FixedVersion,
+			})
+		}
+	}
+	return out
+}
+
+func optionalTimestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func specFromProto(s *factorypb.BuildSpec) DockerBuildRequest {
+	req := DockerBuildRequest{
+		AirflowVersion: s.AirflowVersion,
+		PythonVersion:  s.PythonVersion,
+		BaseImage:      s.BaseImage,
+		Extras:         s.Extras,
+		AptDeps:        s.AptDeps,
+		PipDeps:        s.PipDeps,
+		TimeoutSeconds: int(s.TimeoutSeconds),
+		Priority:       s.Priority,
+		Force:          s.Force,
+		CallbackURL:    s.CallbackUrl,
+		UseConstraints: s.UseConstraints,
+		ConstraintsURL: s.ConstraintsUrl,
+		Bundles:        s.Bundles,
+		Providers:      s.Providers,
+		ImageFlavor:    s.ImageFlavor,
+		SlimBuild:      s.SlimBuild,
+		Platforms:      s.Platforms,
+		AirflowUID:     int(s.AirflowUid),
+		AirflowGID:     int(s.AirflowGid),
+		Locales:        s.Locales,
+		Timezone:       s.Timezone,
+		BuildArgs:      s.BuildArgs,
+		Labels:         s.Labels,
+		Env:            s.Env,
+		Verify:         s.Verify,
+		Entrypoint:     s.Entrypoint,
+		Cmd:            s.Cmd,
+		IndexURL:       s.IndexUrl,
+		ExtraIndexURLs: s.ExtraIndexUrls,
+		Installer:      s.Installer,
+		Template:       s.Template,
+		TemplateName:   s.TemplateName,
+		Tags:           s.Tags,
+		TagTemplate:    s.TagTemplate,
+		Project:        s.Project,
+	}
+	if n := s.Notify; n != nil {
+		req.Notify = &NotifySettings{Slack: n.Slack, Email: n.Email, EmailTo: n.EmailTo}
+	}
+	for _, r := range s.AptRepositories {
+		req.AptRepositories = append(req.AptRepositories, AptRepository{Line: r.Line, KeyURL: r.KeyUrl})
+	}
+	if len(s.Snippets) > 0 {
+		req.Snippets = make(map[string][]string)
+		for stage, lines := range s.Snippets {
+			req.Snippets[stage] = lines.GetLines()
+		}
+	}
+	if h := s.Healthcheck; h != nil {
+		req.Healthcheck = &Healthcheck{Command: h.Command, Interval: h.Interval, Timeout: h.Timeout, StartPeriod: h.StartPeriod, Retries: int(h.Retries)}
+	}
+	return req
+}
+
+func specToProto(req DockerBuildRequest) *factorypb.BuildSpec {
+	s := &factorypb.BuildSpec{
+		AirflowVersion: req.AirflowVersion,
+		PythonVersion:  req.PythonVersion,
+		BaseImage:      req.BaseImage,
+		Extras:         req.Extras,
+		AptDeps:        req.AptDeps,
+		PipDeps:        req.PipDeps,
+		TimeoutSeconds: int32(req.TimeoutSeconds),
+		Priority:       req.Priority,
+		Force:          req.Force,
+		CallbackUrl:    req.CallbackURL,
+		UseConstraints: req.UseConstraints,
+		ConstraintsUrl: req.ConstraintsURL,
+		Bundles:        req.Bundles,
+		Providers:      req.Providers,
+		ImageFlavor:    req.ImageFlavor,
+		SlimBuild:      req.SlimBuild,
+		Platforms:      req.Platforms,
+		AirflowUid:     int32(req.AirflowUID),
+		AirflowGid:     int32(req.AirflowGID),
+		Locales:        req.Locales,
+		Timezone:       req.Timezone,
+		BuildArgs:      req.BuildArgs,
+		Labels:         req.Labels,
+		Env:            req.Env,
+		Verify:         req.Verify,
+		Entrypoint:     req.Entrypoint,
+		Cmd:            req.Cmd,
+		IndexUrl:       req.IndexURL,
+		ExtraIndexUrls: req.ExtraIndexURLs,
+		Installer:      req.Installer,
+		Template:       req.Template,
+		TemplateName:   req.TemplateName,
+		Tags:           req.Tags,
+		TagTemplate:    req.TagTemplate,
+		Project:        req.Project,
+	}
+	if n := req.Notify; n != nil {
+		s.Notify = &factorypb.NotifySettings{Slack: n.Slack, Email: n.Email, EmailTo: n.EmailTo}
+	}
+	for _, r := range req.AptRepositories {
+		s.AptRepositories = append(s.AptRepositories, &factorypb.AptRepository{Line: r.Line, KeyUrl: r.KeyURL})
+	}
+	if len(req.Snippets) > 0 {
+		s.Snippets = make(map[string]*factorypb.Lines)
+		for stage, lines := range req.Snippets {
+			s.Snippets[stage] = &factorypb.Lines{Lines: lines}
+		}
+	}
+	if h := req.Healthcheck; h != nil {
+		s.Healthcheck = &factorypb.Healthcheck{Command: h.Command, Interval: h.Interval, Timeout: h.Timeout, StartPeriod: h.StartPeriod, Retries: int32(h.Retries)}
+	}
+	return s
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// readinessTimeout bounds each readiness check, so a hung dependency fails
+// the probe instead of outlasting it.
+const readinessTimeout = 5 * time.Second
+
+// healthzHandler answers liveness probes: the process is up and serving.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeEnvelope(w, http.StatusOK, envelope{Status: "ok"})
+}
+
+// readyzHandler answers readiness probes by checking everything a build
+// needs: the build store, the build backend and the target registry. It
+// answers 503 if any of them fails, with an error per failed check named
+// for it, so Kubernetes stops routing builds to an instance that cannot run
+// them.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(context.Context) error{
+		"store":    builds.store.ping,
+		"registry": registry.ping,
+	}
+	// In api mode builds run on worker agents, not on this instance.
+	if FACTORY_MODE == modeStandalone {
+		checks["backend"] = pingBackend
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []fieldError
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+			defer cancel()
+			err := check(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logger(r.Context()).Warn("Readiness check failed", "check", name, "error", err)
+				failed = append(failed, fieldError{Field: name, Code: codeUnavailable, Message: err.Error()})
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Field < failed[j].Field })
+		writeEnvelope(w, http.StatusServiceUnavailable, envelope{Status: "unavailable", Errors: failed})
+		return
+	}
+	writeEnvelope(w, http.StatusOK, envelope{Status: "ready"})
+}
+
+// pingBackend checks the BUILD_BACKEND can take a build: the Docker daemons
+// and the Kubernetes API answer, and the daemonless engines' binaries are
+// installed.
+func pingBackend(ctx context.Context) error {
+	switch BUILD_BACKEND {
+	case backendDocker:
+		return daemons.ping(ctx)
+	case backendKubernetes:
+		k, err := kubernetesClient()
+		if err != nil {
+			return err
+		}
+		return k.do(ctx, http.MethodGet, "/version", nil, nil)
+	case backendKaniko:
+		_, err := exec.LookPath(KANIKO_EXECUTOR)
+		return err
+	default:
+		_, err := exec.LookPath(BUILD_BACKEND)
+		return err
+	}
+}
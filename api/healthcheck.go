@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Healthcheck is rendered as the image's HEALTHCHECK. Command is run by a
+// shell inside the container, e.g. "curl -f http://localhost:8080/health";
+// durations use Go syntax such as "30s" or "1m30s" and, like Retries,
+// default to Docker's own values when omitted.
+type Healthcheck struct {
+	Command     string `json:"command"`
+	Interval    string `json:"interval,omitempty"`
+	Timeout     string `json:"timeout,omitempty"`
+	StartPeriod string `json:"start_period,omitempty"`
+	Retries     int    `json:"retries,omitempty"`
+}
+
+func (h *Healthcheck) validate() error {
+	if strings.TrimSpace(h.Command) == "" {
+		return fieldErrorf("healthcheck.command", codeRequired, "healthcheck.command is required")
+	}
+	if strings.ContainsAny(h.Command, "\r\n") || strings.HasSuffix(h.Command, "\\") {
+		return fieldErrorf("healthcheck.command", codeInvalid, "healthcheck.command must be a single line")
+	}
+	for field, value := range map[string]string{"interval": h.Interval, "timeout": h.Timeout, "start_period": h.StartPeriod} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fieldErrorf("healthcheck."+field, codeFormat, "healthcheck.%s must be a positive duration such as 30s", field)
+		}
+	}
+	if h.Retries < 0 {
+		return fieldErrorf("healthcheck.retries", codeMinimum, "healthcheck.retries must not be negative")
+	}
+	return nil
+}
+
+// Instruction renders the HEALTHCHECK line; templates call it as
+// {{.Healthcheck.Instruction}}.
+func (h Healthcheck) Instruction() string {
+	var b strings.Builder
+	b.WriteString("HEALTHCHECK")
+	for _, opt := range []struct{ flag, value string }{{"interval", h.Interval}, {"timeout", h.Timeout}, {"start-period", h.StartPeriod}} {
+		if opt.value != "" {
+			d, _ := time.ParseDuration(opt.value)
+			fmt.Fprintf(&b, " --%s=%s", opt.flag, d)
+		}
+	}
+	if h.Retries > 0 {
+		fmt.Fprintf(&b, " --retries=%d", h.Retries)
+	}
+	b.WriteString(" CMD " + h.Command)
+	return b.String()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const (
+	// idempotencyTTL is how long an Idempotency-Key is remembered, long
+	// enough for any CI retry.
+	idempotencyTTL = 24 * time.Hour
+	// idempotencyClaimTimeout frees a key whose first request never got as
+	// far as recording its build, because the factory died serving it.
+	idempotencyClaimTimeout = time.Minute
+)
+
+// idempotencyKeyPattern is what an Idempotency-Key may look like: printable
+// ASCII without spaces, such as a UUID or a CI job and attempt ID.
+var idempotencyKeyPattern = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+
+// idempotencyKey records the build request a client sent with an
+// Idempotency-Key, so a retry of it gets the same build back.
+type idempotencyKey struct {
+	Scope     string // the principal that used the key, or "" without authentication
+	Key       string
+	SpecHash  string // the content hash of the spec, to tell a retry from a different request
+	BuildID   string // empty while the first request is being served
+	CreatedAt time.Time
+}
+
+// claimIdempotencyKey handles the Idempotency-Key of a request to build. It
+// returns nil and true without one, and the claimed key and true when the
+// request is the first with it, to be given the build it submits. Otherwise
+// the response is written: the build the key first got, or why not.
+func claimIdempotencyKey(w http.ResponseWriter, r *http.Request, build *Build) (*idempotencyKey, bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return nil, true
+	}
+	if !idempotencyKeyPattern.MatchString(key) {
+		writeError(w, fieldErrorf("Idempotency-Key", codePattern, "Idempotency-Key must be 1 to 255 printable characters without spaces"))
+		return nil, false
+	}
+	p, _ := principalFrom(r.Context())
+	now := time.Now().UTC()
+	claim := idempotencyKey{Scope: p.Name, Key: key, SpecHash: build.Tag, CreatedAt: now}
+	existing, claimed, err := builds.store.claimIdempotencyKey(claim, now.Add(-idempotencyClaimTimeout))
+	if err != nil {
+		logger(r.Context()).Error("Claiming idempotency key", "error", err)
+		httpError(w, "Checking Idempotency-Key failed", http.StatusInternalServerError)
+		return nil, false
+	}
+	if claimed {
+		return &claim, true
+	}
+
+	switch {
+	case existing.SpecHash != build.Tag:
+		httpError(w, "Idempotency-Key was used for a different build spec", http.StatusUnprocessableEntity)
+	case existing.BuildID == "":
+		w.Header().Set("Retry-After", "1")
+		httpError(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+	default:
+		original, ok := builds.get(existing.BuildID)
+		if !ok {
+			httpError(w, "The build of this Idempotency-Key is no longer on record", http.StatusNotFound)
+			break
+		}
+		logger(r.Context()).Info("Replaying build request", "build_id", original.ID, "idempotency_key", key)
+		annotateRequest(r.Context(), slog.String("build_id", original.ID))
+		w.Header().Set("Idempotent-Replayed", "true")
+		writeSubmittedBuild(w, r, original)
+	}
+	return nil, false
+}
+
+// recordIdempotentBuild gives a claimed key the build its request got. If
+// that fails, a retry waits out idempotencyClaimTimeout and builds again,
+// so it is logged rather than failing the request.
+func recordIdempotentBuild(ctx context.Context, k *idempotencyKey, buildID string) {
+	if k == nil {
+		return
+	}
+	if err := builds.store.setIdempotencyKeyBuild(k.Scope, k.Key, buildID); err != nil {
+		logger(ctx).Error("Recording idempotency key", "build_id", buildID, "error", err)
+	}
+}
+
+// releaseIdempotencyKey forgets a claimed key whose request was refused
+// without a build, so a retry is served afresh. If that fails, the retry
+// waits out idempotencyClaimTimeout instead.
+func releaseIdempotencyKey(ctx context.Context, k *idempotencyKey) {
+	if k == nil {
+		return
+	}
+	if err := builds.store.deleteIdempotencyKey(k.Scope, k.Key); err != nil {
+		logger(ctx).Error("Releasing idempotency key", "error", err)
+	}
+}
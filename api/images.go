@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ImageTag is a tag of the factory's image in REGISTRY_URL, or of a
+// project's image, with the build that last pushed it when the factory has
+// a record of one.
+type ImageTag struct {
+	Tag     string              `json:"tag"`
+	Image   string              `json:"image"`
+	BuildID string              `json:"build_id,omitempty"`
+	Digest  string              `json:"digest,omitempty"`
+	BuiltAt *time.Time          `json:"built_at,omitempty"`
+	Spec    *DockerBuildRequest `json:"spec,omitempty"`
+}
+
+// imageDeletion reports what DELETE /images/{tag} removed.
+type imageDeletion struct {
+	Tag             string   `json:"tag"`
+	Digest          string   `json:"digest"`
+	ManifestDeleted bool     `json:"manifest_deleted"` // false if other tags still point at it
+	Builds          []string `json:"builds,omitempty"` // IDs of the builds marked deleted
+}
+
+// imageRetag reports what POST /images/{tag}/retag changed.
+type imageRetag struct {
+	Tag            string `json:"tag"`
+	Source         string `json:"source"`
+	Digest         string `json:"digest"`
+	PreviousDigest string `json:"previous_digest,omitempty"` // where Tag pointed before it moved
+	BuildID        string `json:"build_id,omitempty"`
+}
+
+type imageList struct {
+	Repository string     `json:"repository"`
+	Tags       []ImageTag `json:"tags"`
+}
+
+// imagesHandler routes /images and everything under it. The project query
+// parameter selects a project's images in place of the factory's own.
+func imagesHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/images"), "/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		listImages(w, r)
+	case path == "":
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case !strings.Contains(path, "/") && r.Method == http.MethodDelete:
+		deleteImage(w, r, path)
+	case !strings.Contains(path, "/"):
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case strings.HasSuffix(path, "/retag") && r.Method == http.MethodPost:
+		retagImage(w, r, strings.TrimSuffix(path, "/retag"))
+	case strings.HasSuffix(path, "/retag"):
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case strings.HasSuffix(path, "/promote") && r.Method == http.MethodPost:
+		promoteImage(w, r, strings.TrimSuffix(path, "/promote"))
+	case strings.HasSuffix(path, "/promote"):
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		httpError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// listImages lists the tags in the registry, so images pushed by earlier
+// deployments or by hand show up too, and fills in the spec of each one
+// the factory built.
+func listImages(w http.ResponseWriter, r *http.Request) {
+	repo, ok := requestedRepository(w, r)
+	if !ok {
+		return
+	}
+	tags, err := repo.client.listTags(repo.path)
+	if err != nil {
+		logger(r.Context()).Error("Listing registry tags", "error", err)
+		httpError(w, "Listing registry tags failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	sort.Strings(tags)
+	known, err := builds.store.buildsForTags(repo.project, tags)
+	if err != nil {
+		logger(r.Context()).Error("Looking up builds for tags", "error", err)
+		httpError(w, "Looking up builds failed", http.StatusInternalServerError)
+		return
+	}
+
+	// A custom tag like "latest" moves between builds; the newest one
+	// that pushed it is what it points at.
+	byTag := make(map[string]Build)
+	for _, b := range known {
+		for _, tag := range append([]string{b.Tag}, b.Tags...) {
+			if prev, ok := byTag[tag]; !ok || b.CreatedAt.After(prev.CreatedAt) {
+				byTag[tag] = b
+			}
+		}
+	}
+
+	result := imageList{Repository: repo.name, Tags: make([]ImageTag, 0, len(tags))}
+	for _, tag := range tags {
+		entry := ImageTag{Tag: tag, Image: result.Repository + ":" + tag}
+		if b, ok := byTag[tag]; ok {
+			spec := b.Request
+			created := b.CreatedAt
+			entry.BuildID, entry.Digest, entry.BuiltAt, entry.Spec = b.ID, b.Digest, &created, &spec
+		}
+		result.Tags = append(result.Tags, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// deleteImage removes tag from the registry, and the manifest behind it
+// unless other tags still point there, then marks the builds that produced
+// it deleted so the next identical request builds it again.
+func deleteImage(w http.ResponseWriter, r *http.Request, tag string) {
+	if !tagPattern.MatchString(tag) {
+		writeError(w, fieldErrorf("tag", codePattern, "Invalid tag %q", tag))
+		return
+	}
+	repo, ok := requestedRepository(w, r)
+	if !ok {
+		return
+	}
+	repository := repo.path
+	digest, err := repo.client.digestOf(repository, tag)
+	if err != nil {
+		httpError(w, "Looking up tag failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if digest == "" {
+		httpError(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	// Deleting by digest takes every tag on the manifest with it, so find
+	// out first whether any other tag needs it.
+	tags, err := repo.client.listTags(repository)
+	if err != nil {
+		httpError(w, "Listing registry tags failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	var sharedWith string
+	for _, other := range tags {
+		if other == tag {
+			continue
+		}
+		d, err := repo.client.digestOf(repository, other)
+		if err != nil {
+			httpError(w, "Looking up tag failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		if d == digest {
+			sharedWith = other
+			break
+		}
+	}
+
+	result := imageDeletion{Tag: tag, Digest: digest, ManifestDeleted: sharedWith == ""}
+	reference := digest
+	if sharedWith != "" {
+		reference = tag
+	}
+	deleted, err := repo.client.deleteManifest(repository, reference)
+	if err == nil && !deleted {
+		if sharedWith != "" {
+			httpError(w, fmt.Sprintf("The registry cannot delete a tag on its own, and %s shares its manifest", sharedWith), http.StatusConflict)
+			return
+		}
+		err = fmt.Errorf("the registry refused to delete %s", digest)
+	}
+	if err != nil {
+		logger(r.Context()).Error("Deleting image", "repository", repository, "tag", tag, "error", err)
+		httpError(w, "Deleting image failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	manifestDigest := ""
+	if result.ManifestDeleted {
+		manifestDigest = digest
+	}
+	if result.Builds, err = builds.markDeleted(repo.project, tag, manifestDigest); err != nil {
+		// The image is gone either way; say so rather than fail.
+		logger(r.Context()).Error("Marking builds deleted", "tag", tag, "error", err)
+	}
+	logger(r.Context()).Info("Deleted image", "repository", repository, "tag", tag, "manifest_deleted", result.ManifestDeleted)
+	auditImage(r, repo, auditImageDelete, tag, digest, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// retagImage points the tag given in the body, such as "prod-current", at
+// the manifest of source, adding it or moving it from another image, by
+// copying the manifest within the registry rather than building again.
+func retagImage(w http.ResponseWriter, r *http.Request, source string) {
+	var req struct {
+		Tag string `json:"tag"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, fieldErrorf("body", codeInvalidJSON, "body is not valid JSON: %s", err))
+		return
+	}
+	for _, tag := range []string{source, req.Tag} {
+		if !tagPattern.MatchString(tag) {
+			writeError(w, fieldErrorf("tag", codePattern, "Invalid tag %q", tag))
+			return
+		}
+	}
+	if req.Tag == source {
+		writeError(w, fieldErrorf("tag", codeInvalid, "tag must differ from the image's own tag"))
+		return
+	}
+	repo, ok := requestedRepository(w, r)
+	if !ok {
+		return
+	}
+
+	known, err := builds.store.buildsForTags(repo.project, []string{source, req.Tag})
+	if err != nil {
+		logger(r.Context()).Error("Looking up builds for tags", "error", err)
+		httpError(w, "Looking up builds failed", http.StatusInternalServerError)
+		return
+	}
+	// Moving a content-hash tag would hand later identical requests an
+	// image that does not match their spec.
+	var from *Build
+	for i, b := range known {
+		if b.Tag == req.Tag {
+			httpError(w, fmt.Sprintf("%s is the content-hash tag of build %s and cannot be moved", req.Tag, b.ID), http.StatusConflict)
+			return
+		}
+		if from == nil && (b.Tag == source || hasTag(b.Tags, source)) {
+			from = &known[i]
+		}
+	}
+
+	repository := repo.path
+	digest, err := repo.client.digestOf(repository, source)
+	if err != nil {
+		httpError(w, "Looking up tag failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if digest == "" {
+		httpError(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+	result := imageRetag{Tag: req.Tag, Source: source, Digest: digest}
+	if result.PreviousDigest, err = repo.client.digestOf(repository, req.Tag); err != nil {
+		httpError(w, "Looking up tag failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if err := repo.client.copyTag(repository, source, req.Tag); err != nil {
+		logger(r.Context()).Error("Tagging image", "repository", repository, "source", source, "tag", req.Tag, "error", err)
+		httpError(w, "Tagging image failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if from != nil {
+		result.BuildID = from.ID
+		if err := builds.moveTag(repo.project, req.Tag, from.ID); err != nil {
+			// The registry is what matters; say so rather than fail.
+			logger(r.Context()).Error("Recording tag", "build_id", from.ID, "tag", req.Tag, "error", err)
+		}
+	}
+	logger(r.Context()).Info("Tagged image", "repository", repository, "source", source, "tag", req.Tag, "digest", digest)
+	auditImage(r, repo, auditImageRetag, source, digest, req.Tag)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// requestedRepository is the repository of the images an images request
+// is about: the project query parameter's, or the factory's own. It
+// answers 403 for a project the caller is not bound to and 404 for an
+// unknown one.
+func requestedRepository(w http.ResponseWriter, r *http.Request) (projectRepository, bool) {
+	project := r.URL.Query().Get("project")
+	if !projectAllowed(w, r, project) {
+		return projectRepository{}, false
+	}
+	repo, err := repositoryOf(project)
+	if errors.Is(err, errProjectNotFound) {
+		httpError(w, "Project not found", http.StatusNotFound)
+		return projectRepository{}, false
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return projectRepository{}, false
+	}
+	return repo, true
+}
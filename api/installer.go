@@ -0,0 +1,43 @@
+package main
+
+// Installers accepted in DockerBuildRequest.Installer.
+const (
+	installerPip = "pip"
+	installerUV  = "uv"
+)
+
+// installCommands is the command line each installer's RUN step starts
+// with. Both install into the airflow user's ~/.local, where the official
+// image keeps Airflow itself; uv is bootstrapped with pip first. uv copies
+// rather than hardlinks since its cache is a separate mount.
+var installCommands = map[string]string{
+	installerPip: "pip install",
+	installerUV:  "pip install uv && UV_LINK_MODE=copy uv pip install --prefix /home/airflow/.local",
+}
+
+// installCaches are the download caches each installer keeps in BuildKit
+// cache mounts, so a rebuild only fetches the packages that changed.
+var installCaches = map[string][]string{
+	installerPip: {"/home/airflow/.cache/pip"},
+	installerUV:  {"/home/airflow/.cache/pip", "/home/airflow/.cache/uv"},
+}
+
+func validateInstaller(installer string) error {
+	if installer == "" {
+		return nil
+	}
+	if _, ok := installCommands[installer]; !ok {
+		return fieldErrorf("installer", codeEnum, "installer must be %s or %s", installerPip, installerUV)
+	}
+	return nil
+}
+
+// installCommand returns the install command for req's installer and the
+// cache directories it uses.
+func installCommand(req DockerBuildRequest) (string, []string) {
+	installer := req.Installer
+	if installer == "" {
+		installer = installerPip
+	}
+	return installCommands[installer], installCaches[installer]
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// kanikoDigestFile is where the Kaniko executor records the pushed image's
+// digest, inside the build's workspace.
+const kanikoDigestFile = "kaniko-digest"
+
+// kanikoBuilder builds and pushes job with the Kaniko executor, which needs
+// no Docker daemon. Kaniko unpacks the base image over its own root
+// filesystem, so the factory must run in the Kaniko executor image with one
+// build at a time. It has no session for mounting secrets or SSH agents and
+// builds for its own platform only, so jobs needing those are refused.
+type kanikoBuilder struct {
+	output       *buildLog
+	args         []string
+	digestFile   string
+	dockerConfig string
+}
+
+func newKanikoBuilder(job *buildJob, workspace string, output *buildLog) (builder, error) {
+	if err := checkKanikoJob(job, backendKaniko); err != nil {
+		return nil, err
+	}
+	// Registry credentials are kept out of the build context, where a
+	// custom template could COPY them into the image.
+	dockerConfig, err := os.MkdirTemp("", "kaniko-auth-")
+	if err != nil {
+		return nil, fmt.Errorf("Creating registry config: %w", err)
+	}
+	if err := writeRegistryConfig(dockerConfig); err != nil {
+		os.RemoveAll(dockerConfig)
+		return nil, fmt.Errorf("Writing registry config: %w", err)
+	}
+
+	digestFile := filepath.Join(workspace, kanikoDigestFile)
+	args := append([]string{
+		"--context", "dir://" + workspace,
+		"--dockerfile", filepath.Join(workspace, "Dockerfile"),
+		"--digest-file", digestFile,
+		"--cleanup",
+	}, kanikoArgs(job, REGISTRY_CA_FILE)...)
+	return &kanikoBuilder{output: output, args: args, digestFile: digestFile, dockerConfig: dockerConfig}, nil
+}
+
+func (b *kanikoBuilder) Name() string    { return "Kaniko" }
+func (b *kanikoBuilder) Logs() *buildLog { return b.output }
+func (b *kanikoBuilder) Cancel()         { os.RemoveAll(b.dockerConfig) }
+
+func (b *kanikoBuilder) Build(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, KANIKO_EXECUTOR, b.args...)
+	cmd.Env = append(os.Environ(), "DOCKER_CONFIG="+b.dockerConfig)
+	return runLogged(cmd, b.output)
+}
+
+func (b *kanikoBuilder) Push(ctx context.Context) (string, error) {
+	digest, err := os.ReadFile(b.digestFile)
+	if err != nil {
+		slog.Warn("Reading kaniko digest", "build_id", b.output.buildID, "error", err)
+	}
+	return strings.TrimSpace(string(digest)), nil
+}
+
+// checkKanikoJob refuses jobs a Kaniko-based backend cannot build.
+func checkKanikoJob(job *buildJob, backend string) error {
+	if len(job.Platforms) > 0 {
+		return fmt.Errorf("Multi-platform builds are not supported by the %s build backend", backend)
+	}
+	if len(job.Secrets) > 0 || job.SSH {
+		return fmt.Errorf("Builds using private index credentials or Git over ssh are not supported by the %s build backend", backend)
+	}
+	return nil
+}
+
+// kanikoArgs are the executor flags for job that do not depend on where the
+// executor runs, apart from caFile, where it finds REGISTRY_CA_FILE.
+func kanikoArgs(job *buildJob, caFile string) []string {
+	args := []string{"--destination", job.Image}
+	for _, image := range job.ExtraImages {
+		args = append(args, "--destination", image)
+		if plainHTTP(image) {
+			args = append(args, "--insecure-registry", registryHost(image))
+		}
+	}
+	if KANIKO_CACHE_REPO != "" {
+		args = append(args, "--cache=true", "--cache-repo", KANIKO_CACHE_REPO)
+	}
+	if plainHTTP(REGISTRY_URL) {
+		args = append(args, "--insecure")
+	}
+	for _, host := range INSECURE_REGISTRIES {
+		args = append(args, "--skip-tls-verify-registry", host)
+	}
+	if REGISTRY_CA_FILE != "" {
+		for _, host := range registryHosts() {
+			args = append(args, "--registry-certificate", host+"="+caFile)
+		}
+	}
+	for _, name := range sortedKeys(job.BuildArgs) {
+		args = append(args, "--build-arg", name+"="+job.BuildArgs[name])
+	}
+	return args
+}
+
+// registryConfig is a docker config.json holding the factory's logins to
+// the registries it pushes to, where it has any.
+func registryConfig() ([]byte, error) {
+	return registryConfigFor(registries)
+}
+
+// registryConfigFor is registryConfig for targets instead of the push
+// targets. Failing to sign in to the first one is an error.
+func registryConfigFor(targets []*targetRegistry) ([]byte, error) {
+	auths := map[string]map[string]string{}
+	for i, r := range targets {
+		username, password, err := r.credentials()
+		if err != nil && i == 0 {
+			return nil, err
+		}
+		if err != nil {
+			// Pushes there will fail and be reported, not the build.
+			slog.Warn("Signing in to registry", "registry", r.host, "error", err)
+			continue
+		}
+		if username != "" {
+			auths[r.host] = map[string]string{
+				"auth": base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+			}
+		}
+	}
+	return json.Marshal(map[string]interface{}{"auths": auths})
+}
+
+// writeRegistryConfig writes registryConfig into dir as config.json.
+func writeRegistryConfig(dir string) error {
+	data, err := registryConfig()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "config.json"), data, 0600)
+}
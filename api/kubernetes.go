@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into every pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// maxKubernetesContext bounds the compressed build context shipped in a
+// ConfigMap, which the API server caps at 1MiB including metadata.
+const maxKubernetesContext = 1000 * 1024
+
+// kubeClient is a minimal client for the few core and batch API calls the
+// kubernetes backend makes, authenticated with the factory pod's service
+// account.
+type kubeClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+var (
+	kubeOnce  sync.Once
+	kube      *kubeClient
+	kubeErr   error
+	errNotPod = errors.New("pod not found")
+)
+
+func kubernetesClient() (*kubeClient, error) {
+	kubeOnce.Do(func() {
+		ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+		if err != nil {
+			kubeErr = fmt.Errorf("reading service account CA: %w", err)
+			return
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		kube = &kubeClient{
+			baseURL: KUBERNETES_API_URL,
+			http:    &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}},
+		}
+	})
+	return kube, kubeErr
+}
+
+// request sends a JSON API request. The token is read for every request
+// since projected service account tokens are rotated on disk.
+func (k *kubeClient) request(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("reading service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, status.Message)
+	}
+	return resp, nil
+}
+
+// do sends a request and decodes the response into out, if given.
+func (k *kubeClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	resp, err := k.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (k *kubeClient) namespaced(kind, name string) string {
+	path := "/api/v1/namespaces/" + KUBERNETES_NAMESPACE + "/" + kind
+	if kind == "jobs" {
+		path = "/apis/batch/v1/namespaces/" + KUBERNETES_NAMESPACE + "/jobs"
+	}
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+// kubePod is the part of a pod's status the backend looks at.
+type kubePod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status struct {
+		Phase             string `json:"phase"`
+		ContainerStatuses []struct {
+			State struct {
+				Waiting *struct {
+					Reason  string `json:"reason"`
+					Message string `json:"message"`
+				} `json:"waiting"`
+				Terminated *struct {
+					ExitCode int    `json:"exitCode"`
+					Reason   string `json:"reason"`
+					Message  string `json:"message"`
+				} `json:"terminated"`
+			} `json:"state"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// jobPod returns the pod the build Job started.
+func (k *kubeClient) jobPod(ctx context.Context, name string) (kubePod, error) {
+	var pods struct {
+		Items []kubePod `json:"items"`
+	}
+	path := k.namespaced("pods", "") + "?labelSelector=" + url.QueryEscape("job-name="+name)
+	if err := k.do(ctx, http.MethodGet, path, nil, &pods); err != nil {
+		return kubePod{}, err
+	}
+	if len(pods.Items) == 0 {
+		return kubePod{}, errNotPod
+	}
+	return pods.Items[0], nil
+}
+
+// kubernetesBuilder builds and pushes job in a Kubernetes Job running the
+// Kaniko executor, so builds scale with the cluster rather than this host.
+// The build context travels in a ConfigMap and the registry credentials in
+// a Secret, both deleted with the Job once the build ends. The Job's pod
+// logs are streamed into the build log and Kaniko writes the pushed digest
+// to the container's termination message.
+type kubernetesBuilder struct {
+	k            *kubeClient
+	job          *buildJob
+	output       *buildLog
+	name         string
+	context      []byte
+	dockerConfig []byte
+	created      bool
+	digest       string
+}
+
+func newKubernetesBuilder(job *buildJob, workspace string, output *buildLog) (builder, error) {
+	if err := checkKanikoJob(job, backendKubernetes); err != nil {
+		return nil, err
+	}
+	k, err := kubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var buildContext bytes.Buffer
+	gz := gzip.NewWriter(&buildContext)
+	tarball := tarDirectory(workspace)
+	_, err = io.Copy(gz, tarball)
+	tarball.Close()
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Packing build context: %w", err)
+	}
+	if buildContext.Len() > maxKubernetesContext {
+		return nil, fmt.Errorf("Build context is %d bytes compressed; the kubernetes build backend ships at most %d", buildContext.Len(), maxKubernetesContext)
+	}
+	dockerConfig, err := registryConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Writing registry config: %w", err)
+	}
+	return &kubernetesBuilder{
+		k:            k,
+		job:          job,
+		output:       output,
+		name:         workspacePrefix + job.BuildID,
+		context:      buildContext.Bytes(),
+		dockerConfig: dockerConfig,
+	}, nil
+}
+
+func (b *kubernetesBuilder) Name() string    { return "Kubernetes" }
+func (b *kubernetesBuilder) Logs() *buildLog { return b.output }
+
+// Cancel deletes the build's resources, stopping its pod if it still runs.
+func (b *kubernetesBuilder) Cancel() {
+	if !b.created {
+		return
+	}
+	// Use a fresh context: the build's may be what ended it.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	orphans := map[string]interface{}{"propagationPolicy": "Background"}
+	for _, kind := range []string{"jobs", "configmaps", "secrets"} {
+		if err := b.k.do(ctx, http.MethodDelete, b.k.namespaced(kind, b.name), orphans, nil); err != nil {
+			slog.Warn("Cleaning up build", "build_id", b.job.BuildID, "error", err)
+		}
+	}
+	b.created = false
+}
+
+func (b *kubernetesBuilder) Build(ctx context.Context) error {
+	// A retried build starts over with fresh resources.
+	b.Cancel()
+	b.created = true
+
+	k, job, name := b.k, b.job, b.name
+	labels := map[string]string{
+		"app.kubernetes.io/managed-by":   "airflow-image-factory",
+		"airflow-image-factory/build-id": job.BuildID,
+	}
+	metadata := map[string]interface{}{"name": name, "labels": labels}
+	// The registry CA rides along with the logins, mounted beside them.
+	secretData := map[string][]byte{"config.json": b.dockerConfig}
+	if REGISTRY_CA_FILE != "" {
+		ca, err := os.ReadFile(REGISTRY_CA_FILE)
+		if err != nil {
+			return fmt.Errorf("reading REGISTRY_CA_FILE: %w", err)
+		}
+		secretData["registry-ca.crt"] = ca
+	}
+	err := k.do(ctx, http.MethodPost, k.namespaced("configmaps", ""), map[string]interface{}{
+		"apiVersion": "v1", "kind": "ConfigMap", "metadata": metadata,
+		"binaryData": map[string][]byte{"context.tar.gz": b.context},
+	}, nil)
+	if err == nil {
+		err = k.do(ctx, http.MethodPost, k.namespaced("secrets", ""), map[string]interface{}{
+			"apiVersion": "v1", "kind": "Secret", "metadata": metadata,
+			"data": secretData,
+		}, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("creating build resources: %w", err)
+	}
+
+	args := append([]string{
+		"--context", "tar:///workspace/context.tar.gz",
+		"--dockerfile", "Dockerfile",
+		"--digest-file", "/dev/termination-log",
+	}, kanikoArgs(job, "/kaniko/.docker/registry-ca.crt")...)
+	err = k.do(ctx, http.MethodPost, k.namespaced("jobs", ""), map[string]interface{}{
+		"apiVersion": "batch/v1", "kind": "Job", "metadata": metadata,
+		"spec": map[string]interface{}{
+			"backoffLimit":            0,
+			"activeDeadlineSeconds":   int64(job.Timeout.Seconds()),
+			"ttlSecondsAfterFinished": 600,
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": labels},
+				"spec": map[string]interface{}{
+					"restartPolicy": "Never",
+					"containers": []interface{}{map[string]interface{}{
+						"name":      "build",
+						"image":     KUBERNETES_BUILDER_IMAGE,
+						"args":      args,
+						"resources": kubernetesResources(),
+						"volumeMounts": []interface{}{
+							map[string]interface{}{"name": "context", "mountPath": "/workspace"},
+							map[string]interface{}{"name": "docker-config", "mountPath": "/kaniko/.docker"},
+						},
+					}},
+					"volumes": []interface{}{
+						map[string]interface{}{"name": "context", "configMap": map[string]interface{}{"name": name}},
+						map[string]interface{}{"name": "docker-config", "secret": map[string]interface{}{"secretName": name}},
+					},
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("creating build Job: %w", err)
+	}
+	logLine(b.output, fmt.Sprintf("Created Kubernetes Job %s/%s", KUBERNETES_NAMESPACE, name))
+
+	pod, err := k.followJob(ctx, name, b.output)
+	if err != nil {
+		return err
+	}
+	b.digest = strings.TrimSpace(pod.Status.ContainerStatuses[0].State.Terminated.Message)
+	return nil
+}
+
+func (b *kubernetesBuilder) Push(ctx context.Context) (string, error) {
+	return b.digest, nil
+}
+
+// followJob waits for the Job's pod to start, streams its logs into output
+// and returns the pod once its container has exited successfully.
+func (k *kubeClient) followJob(ctx context.Context, name string, output *buildLog) (kubePod, error) {
+	streamed := false
+	for {
+		pod, err := k.jobPod(ctx, name)
+		if err != nil && err != errNotPod {
+			return kubePod{}, err
+		}
+		if err == nil && len(pod.Status.ContainerStatuses) > 0 {
+			state := pod.Status.ContainerStatuses[0].State
+			if w := state.Waiting; w != nil && w.Reason != "ContainerCreating" && w.Reason != "PodInitializing" {
+				return kubePod{}, fmt.Errorf("build pod is waiting: %s: %s", w.Reason, w.Message)
+			}
+			if state.Waiting == nil && !streamed {
+				streamed = true
+				if err := k.streamLogs(ctx, pod.Metadata.Name, output); err != nil {
+					logLine(output, fmt.Sprintf("Streaming build pod logs: %s", err))
+				}
+				continue
+			}
+			if t := state.Terminated; t != nil {
+				if t.ExitCode != 0 {
+					return kubePod{}, fmt.Errorf("build pod exited with code %d (%s)", t.ExitCode, t.Reason)
+				}
+				return pod, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return kubePod{}, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// streamLogs follows a pod's log until its container exits.
+func (k *kubeClient) streamLogs(ctx context.Context, pod string, output *buildLog) error {
+	resp, err := k.request(ctx, http.MethodGet, k.namespaced("pods", pod)+"/log?follow=true&container=build", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		logLine(output, scanner.Text())
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// labelPrefix namespaces the labels the factory adds beyond the OCI ones.
+const labelPrefix = "io.github.airflow-image-factory."
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !labelKeyPattern.MatchString(key) {
+			return fieldErrorf("labels."+key, codeFormat, "Invalid label key %q", key)
+		}
+		if strings.HasPrefix(key, labelPrefix) {
+			return fieldErrorf("labels."+key, codeInvalid, "Label %s is reserved for the factory", key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fieldErrorf("labels."+key, codeInvalid, "Label %s must not contain newlines", key)
+		}
+	}
+	return nil
+}
+
+// imageLabels returns the labels stamped on every image: OCI annotations
+// describing the build, factory metadata tracing the image back to its
+// request, and the caller's labels, which may override the OCI ones (e.g.
+// source and revision from a CI pipeline).
+func imageLabels(b *Build) map[string]string {
+	labels := map[string]string{
+		"org.opencontainers.image.created":   b.CreatedAt.Format(time.RFC3339),
+		"org.opencontainers.image.version":   b.Request.AirflowVersion,
+		"org.opencontainers.image.base.name": baseImageName(b.Request),
+		labelPrefix + "build-id":             b.ID,
+		labelPrefix + "tag":                  b.Tag,
+	}
+	if IMAGE_SOURCE_URL != "" {
+		labels["org.opencontainers.image.source"] = IMAGE_SOURCE_URL
+	}
+	if b.Requester != "" {
+		labels[labelPrefix+"requester"] = b.Requester
+	}
+	for key, value := range b.Request.Labels {
+		labels[key] = value
+	}
+	return labels
+}
+
+// labelInstruction renders labels as a single LABEL instruction. It is
+// appended to the rendered Dockerfile, so custom templates get labels too
+// and they land on the final stage.
+func labelInstruction(labels map[string]string) string {
+	var b strings.Builder
+	b.WriteString("\nLABEL")
+	for _, key := range sortedKeys(labels) {
+		b.WriteString(" \\\n    " + key + "=" + dockerQuote(labels[key]))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
@@ -0,0 +1,42 @@
+package main
+
+import "strconv"
+
+// cpuPeriod is the CFS scheduling period, in microseconds, that
+// BUILD_CPU_LIMIT is converted against.
+const cpuPeriod = 100000
+
+// limitFlags are the flags that hold a buildah or podman build's RUN
+// containers to BUILD_MEMORY_LIMIT and BUILD_CPU_LIMIT, or inside
+// BUILD_CGROUP_PARENT. Swap is capped at the memory limit so a runaway
+// install fails instead of paging the host to a halt.
+func limitFlags() []string {
+	var flags []string
+	if BUILD_MEMORY_LIMIT > 0 {
+		memory := strconv.FormatInt(BUILD_MEMORY_LIMIT, 10)
+		flags = append(flags, "--memory", memory, "--memory-swap", memory)
+	}
+	if BUILD_CPU_LIMIT > 0 {
+		flags = append(flags, "--cpu-period", strconv.Itoa(cpuPeriod), "--cpu-quota", strconv.FormatInt(int64(BUILD_CPU_LIMIT*cpuPeriod), 10))
+	}
+	if BUILD_CGROUP_PARENT != "" {
+		flags = append(flags, "--cgroup-parent", BUILD_CGROUP_PARENT)
+	}
+	return flags
+}
+
+// kubernetesResources are the container limits for a build pod. The
+// scheduler reserves the same amount, since requests default to limits.
+func kubernetesResources() map[string]interface{} {
+	limits := map[string]string{}
+	if BUILD_MEMORY_LIMIT > 0 {
+		limits["memory"] = strconv.FormatInt(BUILD_MEMORY_LIMIT, 10)
+	}
+	if BUILD_CPU_LIMIT > 0 {
+		limits["cpu"] = strconv.FormatInt(int64(BUILD_CPU_LIMIT*1000), 10) + "m"
+	}
+	if len(limits) == 0 {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{"limits": limits}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// localePattern accepts glibc locale names with an explicit charset,
+	// e.g. de_DE.UTF-8 or sr_RS.UTF-8@latin.
+	localePattern   = regexp.MustCompile(`^[a-z]{2,3}_[A-Z]{2}\.[A-Za-z0-9-]+(@[a-z]+)?$`)
+	timezonePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z_]*(/[A-Za-z0-9_+-]+)*$`)
+)
+
+func validateLocales(locales []string, timezone string) error {
+	for i, l := range locales {
+		if !localePattern.MatchString(l) {
+			return fieldErrorf(fmt.Sprintf("locales[%d]", i), codeFormat, "Invalid locale %q: expected e.g. de_DE.UTF-8", l)
+		}
+	}
+	if timezone != "" && !timezonePattern.MatchString(timezone) {
+		return fieldErrorf("timezone", codeFormat, "Invalid timezone %q: expected an IANA name such as Europe/Berlin", timezone)
+	}
+	return nil
+}
+
+// localeGenLines renders locales as /etc/locale.gen entries, e.g.
+// "de_DE.UTF-8 UTF-8".
+func localeGenLines(locales []string) []string {
+	var lines []string
+	for _, l := range locales {
+		charset := l[strings.Index(l, ".")+1:]
+		if i := strings.Index(charset, "@"); i >= 0 {
+			charset = charset[:i]
+		}
+		lines = append(lines, l+" "+charset)
+	}
+	return lines
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// lockfileName is where an uploaded lock file lands in the build context.
+// It is a fully pinned requirements file with hashes, as written by
+// pip-compile --generate-hashes, uv pip compile --generate-hashes or
+// poetry export --with-hashes.
+const lockfileName = "requirements.lock"
+
+var lockedAirflowPattern = regexp.MustCompile(`^apache-airflow(\[[^\]]*\])?==([^\s;\\]+)`)
+
+// validateLockfile checks that an uploaded lock file can be installed verbatim with
+// pip --require-hashes: every requirement carries a hash, Airflow itself is
+// pinned to the requested version, and nothing else in the request adds
+// unhashed requirements on top.
+func validateLockfile(req DockerBuildRequest, files map[string][]byte) error {
+	lock, ok := files[lockfileName]
+	if !ok {
+		return nil
+	}
+	_, hasRequirements := files["requirements.txt"]
+	if hasRequirements || len(req.Extras) > 0 || len(req.PipDeps) > 0 || len(req.Providers) > 0 || req.UseConstraints {
+		return fieldErrorf(lockfileName, codeInvalid, "A lock file must list every Python dependency; drop extras, pip_deps, providers, constraints and requirements.txt from the request")
+	}
+
+	// Join continuation lines so each requirement is checked with its hashes.
+	var entries []string
+	var current strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(lock))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\") + " ")
+			continue
+		}
+		current.WriteString(line)
+		if entry := strings.TrimSpace(current.String()); entry != "" {
+			entries = append(entries, entry)
+		}
+		current.Reset()
+	}
+
+	airflowPinned := false
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, "-") {
+			continue // options such as --index-url
+		}
+		if !strings.Contains(entry, "--hash=") {
+			return fieldErrorf(lockfileName, codeInvalid, "Lock file requirement %q has no --hash; generate it with hashes", strings.Fields(entry)[0])
+		}
+		if m := lockedAirflowPattern.FindStringSubmatch(entry); m != nil {
+			if m[2] != req.AirflowVersion {
+				return fieldErrorf(lockfileName, codeInvalid, "Lock file pins apache-airflow %s but the request asks for %s", m[2], req.AirflowVersion)
+			}
+			airflowPinned = true
+		}
+	}
+	if !airflowPinned {
+		return fieldErrorf(lockfileName, codeInvalid, "Lock file must pin apache-airflow==%s", req.AirflowVersion)
+	}
+	return nil
+}
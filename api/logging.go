@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newLogHandler writes records of level and above to stdout, as json or
+// text.
+func newLogHandler(format string, level slog.Level) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "json":
+		return slog.NewJSONHandler(os.Stdout, options), nil
+	case "text":
+		return slog.NewTextHandler(os.Stdout, options), nil
+	}
+	return nil, fmt.Errorf("format must be json or text")
+}
+
+// requestIDPattern is what a caller's X-Request-ID must look like to be
+// kept; anything else is replaced by an ID of our own.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestEntry collects what the handlers learn about a request, such as
+// who made it and the build it created, for its access log line.
+type requestEntry struct {
+	id string
+
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+type requestEntryContextKey struct{}
+
+func requestEntryFrom(ctx context.Context) *requestEntry {
+	e, _ := ctx.Value(requestEntryContextKey{}).(*requestEntry)
+	return e
+}
+
+// requestIDFrom is the ID of the request ctx belongs to, if any.
+func requestIDFrom(ctx context.Context) string {
+	if e := requestEntryFrom(ctx); e != nil {
+		return e.id
+	}
+	return ""
+}
+
+// annotateRequest adds attributes to the access log line of the request
+// ctx belongs to.
+func annotateRequest(ctx context.Context, attrs ...slog.Attr) {
+	e := requestEntryFrom(ctx)
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.attrs = append(e.attrs, attrs...)
+	e.mu.Unlock()
+}
+
+// logger is the default logger with the request ID of ctx, so the lines a
+// request causes can be joined to its access log line.
+func logger(ctx context.Context) *slog.Logger {
+	if id := requestIDFrom(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// loggedResponse records the status and size of a response. It passes
+// flushes and hijacks through for log streams and WebSockets.
+type loggedResponse struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *loggedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggedResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *loggedResponse) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *loggedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// logRequests gives every request an ID, the caller's X-Request-ID when it
+// sent a usable one, echoes it in the response and logs the request once
+// answered. Prometheus scrapes are logged at debug only.
+func logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &requestEntry{id: r.Header.Get("X-Request-ID")}
+		if !requestIDPattern.MatchString(entry.id) {
+			entry.id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", entry.id)
+		ctx := context.WithValue(r.Context(), requestEntryContextKey{}, entry)
+		response := &loggedResponse{ResponseWriter: w}
+		start := time.Now()
+		handler.ServeHTTP(response, r.WithContext(ctx))
+		if response.status == 0 {
+			response.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case r.URL.Path == "/metrics":
+			level = slog.LevelDebug
+		case response.status >= 500:
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", entry.id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", response.status),
+			slog.Int("bytes", response.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote_addr", r.RemoteAddr),
+		}
+		entry.mu.Lock()
+		attrs = append(attrs, entry.attrs...)
+		entry.mu.Unlock()
+		slog.LogAttrs(ctx, level, "request", attrs...)
+	})
+}
+
+// logFinished logs the outcome of every build once it is finished.
+func logFinished(b Build) {
+	attrs := []slog.Attr{
+		slog.String("build_id", b.ID),
+		slog.String("status", string(b.Status)),
+		slog.String("image", b.Image),
+		slog.Bool("skipped", b.Skipped),
+	}
+	if b.StartedAt != nil {
+		attrs = append(attrs, slog.Float64("duration_ms", b.Duration*1000))
+	}
+	if b.Requester != "" {
+		attrs = append(attrs, slog.String("requester", b.Requester))
+	}
+	level := slog.LevelInfo
+	if b.Error != "" {
+		attrs = append(attrs, slog.String("error", b.Error))
+		level = slog.LevelWarn
+	}
+	slog.LogAttrs(context.Background(), level, "build finished", attrs...)
+}
+
+// logUnary logs every unary gRPC call once answered, as logRequests does
+// HTTP requests, taking the request ID from x-request-id metadata.
+func logUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, entry := grpcEntry(ctx)
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logCall(ctx, entry, info.FullMethod, start, err)
+	return resp, err
+}
+
+func logStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, entry := grpcEntry(stream.Context())
+	start := time.Now()
+	err := handler(srv, &loggedStream{ServerStream: stream, ctx: ctx})
+	logCall(ctx, entry, info.FullMethod, start, err)
+	return err
+}
+
+// loggedStream is a stream whose context carries its request entry.
+type loggedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *loggedStream) Context() context.Context { return s.ctx }
+
+func grpcEntry(ctx context.Context) (context.Context, *requestEntry) {
+	entry := &requestEntry{}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("x-request-id"); len(v) > 0 {
+			entry.id = v[0]
+		}
+	}
+	if !requestIDPattern.MatchString(entry.id) {
+		entry.id = newRequestID()
+	}
+	return context.WithValue(ctx, requestEntryContextKey{}, entry), entry
+}
+
+func logCall(ctx context.Context, entry *requestEntry, method string, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	if code == codes.Internal || code == codes.Unknown {
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", entry.id),
+		slog.String("method", method),
+		slog.String("code", code.String()),
+		slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+	}
+	entry.mu.Lock()
+	attrs = append(attrs, entry.attrs...)
+	entry.mu.Unlock()
+	slog.LogAttrs(ctx, level, "grpc call", attrs...)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventLog    = "log"
+	eventStatus = "status"
+)
+
+// buildEvent is one entry in a build's event stream: either a line of docker
+// output or a status transition.
+type buildEvent struct {
+	Type   string      `json:"type"`
+	Time   time.Time   `json:"time"`
+	Line   string      `json:"line,omitempty"`
+	Status BuildStatus `json:"status,omitempty"`
+}
+
+// buildLog accumulates the events of one build and fans new ones out to any
+// live subscribers (SSE and WebSocket clients).
+type buildLog struct {
+	buildID string // for log lines; empty for output that is not a build's
+
+	mu          sync.Mutex
+	events      []buildEvent
+	subscribers map[chan buildEvent]struct{}
+	closed      bool
+}
+
+func newBuildLog(buildID string) *buildLog {
+	return &buildLog{buildID: buildID, subscribers: make(map[chan buildEvent]struct{})}
+}
+
+// append adds a line of output, which is also logged at debug.
+func (l *buildLog) append(line string) {
+	slog.Debug("Build output", "build_id", l.buildID, "line", line)
+	l.publish(buildEvent{Type: eventLog, Time: time.Now().UTC(), Line: line})
+}
+
+func (l *buildLog) status(status BuildStatus) {
+	l.publish(buildEvent{Type: eventStatus, Time: time.Now().UTC(), Status: status})
+}
+
+func (l *buildLog) publish(ev buildEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.events = append(l.events, ev)
+	for ch := range l.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			// Slow consumer: drop it rather than stall the build. It can
+			// catch up with resubscribe.
+			delete(l.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the events recorded so far and a channel that receives
+// every subsequent event. The channel is closed when the log is closed.
+func (l *buildLog) subscribe() ([]buildEvent, chan buildEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	backlog := make([]buildEvent, len(l.events))
+	copy(backlog, l.events)
+	ch := make(chan buildEvent, 256)
+	if l.closed {
+		close(ch)
+		return backlog, ch
+	}
+	l.subscribers[ch] = struct{}{}
+	return backlog, ch
+}
+
+// resubscribe is subscribe for a subscriber whose channel was closed after
+// it had the first mark events: it returns the events since, a channel for
+// the ones after, and false once the log is closed, when the build has
+// finished and there is nothing more to follow.
+func (l *buildLog) resubscribe(mark int) ([]buildEvent, chan buildEvent, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	missed := append([]buildEvent(nil), l.events[mark:]...)
+	ch := make(chan buildEvent, 256)
+	if l.closed {
+		close(ch)
+		return missed, ch, false
+	}
+	l.subscribers[ch] = struct{}{}
+	return missed, ch, true
+}
+
+func (l *buildLog) unsubscribe(ch chan buildEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.subscribers[ch]; ok {
+		delete(l.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (l *buildLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	for ch := range l.subscribers {
+		delete(l.subscribers, ch)
+		close(ch)
+	}
+}
+
+// len returns the number of events recorded so far, for use with linesSince.
+func (l *buildLog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.events)
+}
+
+// eventsSince returns the events recorded after the first mark events and
+// the mark to pass next time.
+func (l *buildLog) eventsSince(mark int) ([]buildEvent, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := append([]buildEvent(nil), l.events[mark:]...)
+	return events, len(l.events)
+}
+
+// linesSince returns the output lines recorded after the first mark events.
+func (l *buildLog) linesSince(mark int) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var lines []string
+	for _, ev := range l.events[mark:] {
+		if ev.Type == eventLog {
+			lines = append(lines, ev.Line)
+		}
+	}
+	return lines
+}
+
+// tail returns up to the last n output lines.
+func (l *buildLog) tail(n int) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var lines []string
+	for i := len(l.events) - 1; i >= 0 && len(lines) < n; i-- {
+		if l.events[i].Type == eventLog {
+			lines = append(lines, l.events[i].Line)
+		}
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+// runLogged runs cmd with stdout and stderr merged, feeding each output line
+// into the build log as it is produced.
+func runLogged(cmd *exec.Cmd, log *buildLog) error {
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(pr)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			log.append(scanner.Text())
+		}
+		// Keep draining so the command never blocks on a full pipe.
+		io.Copy(io.Discard, pr)
+	}()
+
+	err := cmd.Run()
+	pw.Close()
+	<-done
+	return err
+}
+
+// failureMessage summarises a failed command with the tail of its output.
+func failureMessage(step string, err error, log *buildLog) string {
+	return fmt.Sprintf("%s failed: %s\n%s", step, err, strings.Join(log.tail(20), "\n"))
+}
@@ -1,147 +1,1843 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
-	"text/template"
+	"time"
+
+	"github.com/docker/docker/client"
+	units "github.com/docker/go-units"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	REGISTRY_URL = os.Getenv("REGISTRY_URL") // set in .env file... It's being .gitignored
-	IMAGE_NAME   = os.Getenv("IMAGE_NAME")   // set in .env file... It's being .gitignored
+	REGISTRY_URL  = getenv("REGISTRY_URL") // set in .env file... It's being .gitignored
+	IMAGE_NAME    = getenv("IMAGE_NAME")   // set in .env file... It's being .gitignored
+	STORE_DRIVER  = getenv("STORE_DRIVER")
+	DATABASE_PATH = getenv("DATABASE_PATH")
+	DATABASE_URL  = getenv("DATABASE_URL")
+	WORKSPACE_DIR = getenv("WORKSPACE_DIR") // defaults to the system temp dir
+
+	// INSTANCE_ID identifies this replica in the shared build store so that
+	// on restart it only resumes the builds it had accepted itself. It must
+	// be stable across restarts (e.g. a StatefulSet pod name).
+	INSTANCE_ID = getenv("INSTANCE_ID")
+
+	// WEBHOOK_URL receives build results for requests without their own
+	// callback_url; WEBHOOK_SECRET signs every delivery.
+	WEBHOOK_URL    = getenv("WEBHOOK_URL")
+	WEBHOOK_SECRET = getenv("WEBHOOK_SECRET")
+
+	SLACK_WEBHOOK_URL = getenv("SLACK_WEBHOOK_URL")
+	SMTP_HOST         = getenv("SMTP_HOST")
+	SMTP_PORT         = getenv("SMTP_PORT")
+	SMTP_USERNAME     = getenv("SMTP_USERNAME")
+	SMTP_PASSWORD     = getenv("SMTP_PASSWORD")
+	SMTP_FROM         = getenv("SMTP_FROM")
+	NOTIFY_EMAIL_TO   []string // comma-separated default recipients
+
+	// IMAGE_SOURCE_URL is recorded as org.opencontainers.image.source on
+	// every image unless the request labels say otherwise.
+	IMAGE_SOURCE_URL = getenv("IMAGE_SOURCE_URL")
+
+	// PYPI_JSON_URL serves package metadata in the PyPI JSON API format,
+	// used to check extras and Python support against the requested Airflow
+	// release. Set it to "off" on hosts without access to PyPI; Python
+	// support is then checked against a built-in matrix only.
+	PYPI_JSON_URL = getenv("PYPI_JSON_URL")
+
+	// BUILD_BACKEND selects the build engine: "docker" talks to a Docker
+	// daemon, "kaniko" runs KANIKO_EXECUTOR for daemonless builds, caching
+	// layers in KANIKO_CACHE_REPO, "buildah" or "podman" run that
+	// binary for rootless builds on hosts without Docker, "nerdctl" builds
+	// with containerd and buildkitd instead of dockerd, and "kubernetes"
+	// runs each build as a Job of KUBERNETES_BUILDER_IMAGE, a Kaniko
+	// executor, in KUBERNETES_NAMESPACE of the cluster the factory runs in.
+	BUILD_BACKEND     = getenv("BUILD_BACKEND")
+	KANIKO_EXECUTOR   = getenv("KANIKO_EXECUTOR")
+	KANIKO_CACHE_REPO = getenv("KANIKO_CACHE_REPO")
+
+	// BUILD_CACHE_REPO is a registry repository, e.g. registry:5000/cache,
+	// where every backend stores its layer cache so ephemeral builders and
+	// other machines can reuse it. It is the default KANIKO_CACHE_REPO.
+	BUILD_CACHE_REPO = getenv("BUILD_CACHE_REPO")
+
+	KUBERNETES_API_URL       = getenv("KUBERNETES_API_URL")
+	KUBERNETES_NAMESPACE     = getenv("KUBERNETES_NAMESPACE")
+	KUBERNETES_BUILDER_IMAGE = getenv("KUBERNETES_BUILDER_IMAGE")
+
+	// DOCKER_HOSTS lists the Docker daemons the docker backend spreads
+	// builds over, defaulting to DOCKER_HOST or the local socket. Remote
+	// daemons are reached over TLS with the ca.pem, cert.pem and key.pem in
+	// DOCKER_CERT_PATH, verifying the daemon's certificate if
+	// DOCKER_TLS_VERIFY is set, as with the docker CLI.
+	DOCKER_HOSTS          []string // comma-separated
+	DOCKER_CERT_PATH      = getenv("DOCKER_CERT_PATH")
+	DOCKER_TLS_VERIFY     = getenv("DOCKER_TLS_VERIFY") != ""
+	DOCKER_MAX_IDLE_CONNS = 4 // idle connections kept open per daemon
+
+	// BUILDX_BUILDER names the buildx builder for multi-arch builds. It must
+	// use a driver that supports several platforms, e.g. docker-container.
+	BUILDX_BUILDER = getenv("BUILDX_BUILDER")
+
+	// BASE_IMAGE_MIRROR is a pull-through cache of Docker Hub, e.g.
+	// "mirror.corp:5000" or "harbor.corp/dockerhub", that base images from
+	// Docker Hub are pulled through instead, away from its rate limits.
+	BASE_IMAGE_MIRROR = strings.TrimSuffix(getenv("BASE_IMAGE_MIRROR"), "/")
+
+	// BASE_IMAGE_ALLOWLIST restricts request base images to these
+	// repository prefixes, e.g. "apache/airflow:,registry.corp/airflow/".
+	BASE_IMAGE_ALLOWLIST []string // comma-separated
+
+	// Private package index defaults, used when a request names none.
+	// Credentials go in PIP_NETRC_FILE on each builder host, not in URLs.
+	PIP_INDEX_URL       = getenv("PIP_INDEX_URL")
+	PIP_EXTRA_INDEX_URL []string // comma-separated
+	PIP_NETRC_FILE      = getenv("PIP_NETRC_FILE")
+
+	// Git requirements over ssh are fetched with GIT_SSH_KEY_FILE, or the
+	// builder's ssh-agent if unset, checking hosts against
+	// GIT_SSH_KNOWN_HOSTS_FILE. Over https they use PIP_NETRC_FILE.
+	GIT_SSH_KEY_FILE         = getenv("GIT_SSH_KEY_FILE")
+	GIT_SSH_KNOWN_HOSTS_FILE = getenv("GIT_SSH_KNOWN_HOSTS_FILE")
+
+	// REGISTRY_API_URL is where the factory itself reaches the registry API,
+	// which can differ from REGISTRY_URL as seen by the Docker daemon.
+	REGISTRY_API_URL  = getenv("REGISTRY_API_URL")
+	REGISTRY_USERNAME = getenv("REGISTRY_USERNAME")
+	REGISTRY_PASSWORD = getenv("REGISTRY_PASSWORD")
+
+	// EXTRA_REGISTRIES are more registries, such as an on-premises Harbor
+	// beside a cloud registry, that every built image is pushed to as well,
+	// under the same name and tag as in REGISTRY_URL. Plain ones are
+	// signed in to with the logins in REGISTRY_AUTH_FILE, a docker
+	// config.json, and cloud ones as below.
+	EXTRA_REGISTRIES   []string // comma-separated
+	REGISTRY_AUTH_FILE = getenv("REGISTRY_AUTH_FILE")
+
+	// PROMOTION_REGISTRIES are the registries, such as production, that
+	// POST /images/{tag}/promote copies tested images from REGISTRY_URL
+	// to. Builds never push there. They are signed in to like
+	// EXTRA_REGISTRIES.
+	PROMOTION_REGISTRIES []string // comma-separated
+
+	// Registries with self-signed certificates: REGISTRY_CA_FILE is a PEM
+	// bundle trusted, besides the system roots, for every registry the
+	// factory pushes to, pulls from or caches in, and INSECURE_REGISTRIES
+	// are hosts whose certificates are not verified at all. They apply to
+	// the factory's own registry API calls, the buildah, podman, nerdctl
+	// and kaniko backends, and the scan, SBOM, signing and promotion tools.
+	// The docker backend and buildkitd use their daemon's own settings,
+	// e.g. /etc/docker/certs.d and insecure-registries.
+	REGISTRY_CA_FILE    = getenv("REGISTRY_CA_FILE")
+	INSECURE_REGISTRIES []string // comma-separated hosts
+
+	// Cloud registries are signed in to with the factory's cloud identity
+	// instead of REGISTRY_USERNAME: an Amazon ECR REGISTRY_URL, which
+	// defaults to the registry of ECR_ACCOUNT_ID in AWS_REGION, with its
+	// AWS credentials, creating missing repositories before the first
+	// push; a Google Artifact Registry one, LOCATION-docker.pkg.dev/PROJECT/
+	// REPOSITORY, with GOOGLE_APPLICATION_CREDENTIALS or workload identity;
+	// an Azure Container Registry, NAME.azurecr.io, with the service
+	// principal or workload identity in the AZURE_* variables or the VM's
+	// managed identity.
+	ECR_ACCOUNT_ID = getenv("ECR_ACCOUNT_ID")
+
+	// FACTORY_MODE selects the role of this process: "standalone" serves the
+	// API and builds locally, "api" serves the API and leaves building to
+	// remote agents, "worker" is a builder agent for SCHEDULER_URL.
+	FACTORY_MODE  = getenv("FACTORY_MODE")
+	SCHEDULER_URL = getenv("SCHEDULER_URL")
+	WORKER_TOKEN  = getenv("WORKER_TOKEN") // shared secret between API and agents
+
+	// Resource limits for each build, so one runaway dependency resolution
+	// cannot starve the builds beside it: BUILD_MEMORY_LIMIT is a size such
+	// as "4g" and BUILD_CPU_LIMIT a number of CPUs such as "1.5". The
+	// buildah, podman and kubernetes backends enforce them per build.
+	// BuildKit, behind the docker backend, cannot limit a single build, so
+	// there every build runs inside BUILD_CGROUP_PARENT, a cgroup the
+	// operator has limited on each Docker host; buildah and podman accept
+	// it too. nerdctl builds are limited through buildkitd's own cgroup.
+	BUILD_MEMORY_LIMIT  int64   // bytes, 0 = unlimited
+	BUILD_CPU_LIMIT     float64 // 0 = unlimited
+	BUILD_CGROUP_PARENT = getenv("BUILD_CGROUP_PARENT")
+
+	// Every pushed image is signed with cosign, run as COSIGN_BINARY on
+	// whichever host ran the build, when COSIGN_KEY names a key (a file,
+	// or a KMS or k8s:// reference; COSIGN_PASSWORD unlocks it) or
+	// COSIGN_KEYLESS is "true". Keyless signing gets a Fulcio certificate
+	// for the OIDC identity in COSIGN_IDENTITY_TOKEN_FILE, e.g. a projected
+	// service account token, else the ambient one cosign detects.
+	COSIGN_BINARY              = getenv("COSIGN_BINARY")
+	COSIGN_KEY                 = getenv("COSIGN_KEY")
+	COSIGN_KEYLESS             = getenv("COSIGN_KEYLESS") == "true"
+	COSIGN_IDENTITY_TOKEN_FILE = getenv("COSIGN_IDENTITY_TOKEN_FILE")
+
+	// SBOM_FORMAT, "spdx-json" or "cyclonedx-json", turns on an SBOM for
+	// every pushed image, made by SYFT_BINARY and attached to the image in
+	// the registry by ORAS_BINARY, both run on the host that built it.
+	SBOM_FORMAT = getenv("SBOM_FORMAT")
+	SYFT_BINARY = getenv("SYFT_BINARY")
+	ORAS_BINARY = getenv("ORAS_BINARY")
+
+	// PROVENANCE_BUILDER_ID, a URI naming this factory deployment such as
+	// https://factory.example.com/airflow-image-factory, turns on a SLSA
+	// provenance attestation for every pushed image; consumers verify
+	// images against it. The attestation is signed with cosign attest when
+	// signing is on, otherwise attached unsigned with ORAS_BINARY.
+	PROVENANCE_BUILDER_ID = getenv("PROVENANCE_BUILDER_ID")
+
+	// VULN_SCAN=true scans every built image with TRIVY_BINARY, before it
+	// is pushed where the backend keeps a local copy (docker, buildah,
+	// podman, nerdctl) and right after otherwise. Findings at or above
+	// VULN_FAIL_SEVERITY fail the build; without it they are only
+	// reported. VULN_IGNORE_UNFIXED leaves out findings with no fix yet.
+	VULN_SCAN           = getenv("VULN_SCAN") == "true"
+	VULN_FAIL_SEVERITY  = strings.ToUpper(getenv("VULN_FAIL_SEVERITY"))
+	VULN_IGNORE_UNFIXED = getenv("VULN_IGNORE_UNFIXED") == "true"
+	TRIVY_BINARY        = getenv("TRIVY_BINARY")
+
+	// SWAGGER_UI_URL is where the page at /docs loads Swagger UI from, a
+	// swagger-ui-dist release; point it at an internal mirror where the
+	// browser cannot reach a public CDN.
+	SWAGGER_UI_URL = strings.TrimSuffix(getenv("SWAGGER_UI_URL"), "/")
+
+	// GRPC_ADDR is where the gRPC service listens, beside the HTTP API on
+	// :8080; "off" turns it off.
+	GRPC_ADDR = getenv("GRPC_ADDR")
+
+	// API_KEYS_FILE turns on authentication: a JSON array of {"name",
+	// "key", "scopes"} objects, the keys every request but /docs, /ui/,
+	// /openapi.json, /metrics and the health probes needs one of. An admin
+	// among them can create further keys, kept hashed in the database, at
+	// /v1/api-keys.
+	API_KEYS_FILE = getenv("API_KEYS_FILE")
+
+	// OIDC_ISSUER_URL lets people sign in with the SSO provider it names:
+	// requests may carry a JWT it issued for OIDC_AUDIENCE in place of an
+	// API key. The groups in OIDC_GROUPS_CLAIM (a dotted path for nested
+	// claims) are given roles by OIDC_GROUP_ROLES, comma-separated
+	// group=role pairs with roles viewer, builder, promoter and admin, or
+	// project:<name> to bind the group's members to a project. Builds are
+	// attributed to OIDC_USERNAME_CLAIM. The signing keys come from the
+	// issuer's discovery document unless OIDC_JWKS_URL is set.
+	OIDC_ISSUER_URL     = getenv("OIDC_ISSUER_URL")
+	OIDC_AUDIENCE       = getenv("OIDC_AUDIENCE")
+	OIDC_JWKS_URL       = getenv("OIDC_JWKS_URL")
+	OIDC_GROUPS_CLAIM   = getenv("OIDC_GROUPS_CLAIM")
+	OIDC_GROUP_ROLES    = getenv("OIDC_GROUP_ROLES")
+	OIDC_USERNAME_CLAIM = getenv("OIDC_USERNAME_CLAIM")
+
+	// TLS_CERT_FILE and TLS_KEY_FILE serve the HTTP and gRPC APIs over
+	// TLS; a renewed certificate is picked up within a minute. With
+	// TLS_CLIENT_CA_FILE every connection, /metrics and /docs included,
+	// must present a client certificate it issued, and one named in
+	// TLS_CLIENT_NAMES (common names or SANs, comma-separated) when that
+	// is set. When authentication is on, TLS_CLIENT_SCOPES are the scopes,
+	// or roles, of a request that has a client certificate but no API key
+	// or token.
+	TLS_CERT_FILE      = getenv("TLS_CERT_FILE")
+	TLS_KEY_FILE       = getenv("TLS_KEY_FILE")
+	TLS_CLIENT_CA_FILE = getenv("TLS_CLIENT_CA_FILE")
+	TLS_CLIENT_NAMES   []string
+	TLS_CLIENT_SCOPES  []string
+
+	// A builder agent trusts SCHEDULER_CA_FILE, besides the system roots,
+	// for an https SCHEDULER_URL, and presents AGENT_TLS_CERT_FILE and
+	// AGENT_TLS_KEY_FILE to an API that requires client certificates.
+	SCHEDULER_CA_FILE   = getenv("SCHEDULER_CA_FILE")
+	AGENT_TLS_CERT_FILE = getenv("AGENT_TLS_CERT_FILE")
+	AGENT_TLS_KEY_FILE  = getenv("AGENT_TLS_KEY_FILE")
+
+	// RATE_LIMIT caps the requests, and BUILD_RATE_LIMIT the builds, each
+	// client may make, as a count per s, m or h such as "120/m"; unset is
+	// no limit. The count is also the burst allowed at once. A client is
+	// who it authenticated as, or else its address.
+	RATE_LIMIT       rate
+	BUILD_RATE_LIMIT rate
+
+	// CORS_ALLOWED_ORIGINS are the origins, such as
+	// https://portal.example.com, whose browser pages may call the API,
+	// or "*" for any; unset turns CORS off. CORS_ALLOWED_METHODS and
+	// CORS_ALLOWED_HEADERS are what their requests may use.
+	CORS_ALLOWED_ORIGINS []string // comma-separated
+	CORS_ALLOWED_METHODS []string // comma-separated
+	CORS_ALLOWED_HEADERS []string // comma-separated
+
+	// serverTLS is the listeners' TLS configuration, nil without
+	// TLS_CERT_FILE.
+	serverTLS *tls.Config
+
+	// LOG_FORMAT is json, one object per line for log pipelines, or text;
+	// LOG_LEVEL is debug, info, warn or error. Build output is logged at
+	// debug.
+	LOG_FORMAT = getenv("LOG_FORMAT")
+	LOG_LEVEL  = getenv("LOG_LEVEL")
+
+	MAX_CONCURRENT_BUILDS int
+	BUILD_TIMEOUT         = time.Hour
+	BUILD_RETRY_ATTEMPTS  = 3
+	BUILD_RETRY_BACKOFF   = 10 * time.Second
+
+	// Retention: finished builds older than RETENTION_DAYS, or beyond the
+	// newest RETENTION_MAX_BUILDS, are pruned. Zero keeps them forever.
+	RETENTION_DAYS       = 0
+	RETENTION_MAX_BUILDS = 0
+	RETENTION_INTERVAL   = time.Hour
+
+	// Tag retention deletes images the factory pushed to REGISTRY_URL once
+	// they fall out of the newest TAG_RETENTION_KEEP_LAST of their family
+	// (Airflow version, Python version and flavor) and, if set, were last
+	// requested over TAG_RETENTION_DAYS ago. Images still deployed are kept:
+	// TAG_RETENTION_IN_USE lists where to look, "kubernetes" for the pods of
+	// the factory's cluster and URLs answering with a JSON array of image
+	// references. TAG_RETENTION_DRY_RUN only logs what would go.
+	TAG_RETENTION_KEEP_LAST = 0
+	TAG_RETENTION_DAYS      = 0
+	TAG_RETENTION_IN_USE    []string // comma-separated
+	TAG_RETENTION_DRY_RUN   = getenv("TAG_RETENTION_DRY_RUN") == "true"
 )
 
 func init() {
+	if LOG_FORMAT == "" {
+		LOG_FORMAT = "json" // default value
+	}
+	if LOG_LEVEL == "" {
+		LOG_LEVEL = "info" // default value
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(LOG_LEVEL)); err != nil {
+		log.Fatalf("Invalid LOG_LEVEL %q: must be debug, info, warn or error", LOG_LEVEL)
+	}
+	handler, err := newLogHandler(LOG_FORMAT, level)
+	if err != nil {
+		log.Fatalf("Invalid LOG_FORMAT %q: %s", LOG_FORMAT, err)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	if REGISTRY_URL == "" && ECR_ACCOUNT_ID != "" {
+		region := getenv("AWS_REGION")
+		if region == "" {
+			region = getenv("AWS_DEFAULT_REGION")
+		}
+		if region == "" {
+			log.Fatal("ECR_ACCOUNT_ID requires AWS_REGION")
+		}
+		REGISTRY_URL = fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", ECR_ACCOUNT_ID, region)
+		if strings.HasPrefix(region, "cn-") {
+			REGISTRY_URL += ".cn"
+		}
+	}
 	if REGISTRY_URL == "" {
 		REGISTRY_URL = "localhost:5000" // default value
 	}
+	registries = []*targetRegistry{newTargetRegistry(REGISTRY_URL, REGISTRY_USERNAME, REGISTRY_PASSWORD)}
+	if p := registries[0].provider; p != nil && REGISTRY_USERNAME != "" {
+		log.Fatalf("REGISTRY_USERNAME and REGISTRY_PASSWORD cannot be used with %s, which signs in with the factory's cloud credentials", p.Name())
+	}
+	var logins map[string][2]string
+	if REGISTRY_AUTH_FILE != "" {
+		var err error
+		if logins, err = readAuthFile(REGISTRY_AUTH_FILE); err != nil {
+			log.Fatalf("Invalid REGISTRY_AUTH_FILE %q: %s", REGISTRY_AUTH_FILE, err)
+		}
+	}
+	for _, u := range strings.Split(getenv("EXTRA_REGISTRIES"), ",") {
+		if u = strings.TrimSuffix(strings.TrimSpace(u), "/"); u == "" {
+			continue
+		}
+		if registryFor(u) != nil {
+			log.Fatalf("Invalid EXTRA_REGISTRIES: %s is listed twice or is REGISTRY_URL's registry", registryHost(u))
+		}
+		login := logins[registryHost(u)]
+		registries = append(registries, newTargetRegistry(u, login[0], login[1]))
+		EXTRA_REGISTRIES = append(EXTRA_REGISTRIES, u)
+	}
+	for _, u := range strings.Split(getenv("PROMOTION_REGISTRIES"), ",") {
+		if u = strings.TrimSuffix(strings.TrimSpace(u), "/"); u == "" {
+			continue
+		}
+		if registryFor(u) != nil || promotionRegistryFor(u) != nil {
+			log.Fatalf("Invalid PROMOTION_REGISTRIES: %s is listed twice or is a registry builds push to", registryHost(u))
+		}
+		login := logins[registryHost(u)]
+		promotionRegistries = append(promotionRegistries, newTargetRegistry(u, login[0], login[1]))
+		PROMOTION_REGISTRIES = append(PROMOTION_REGISTRIES, u)
+	}
+	for _, h := range strings.Split(getenv("INSECURE_REGISTRIES"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			INSECURE_REGISTRIES = append(INSECURE_REGISTRIES, registryHost(h))
+		}
+	}
 	if IMAGE_NAME == "" {
 		IMAGE_NAME = "airflow" // default value
 	}
-	fmt.Printf("Using Registry URL: %s\n", REGISTRY_URL)
-	fmt.Printf("Using Image Name: %s\n", IMAGE_NAME)
+	if REGISTRY_API_URL == "" {
+		REGISTRY_API_URL = registryAPIURL(REGISTRY_URL)
+	}
+	switch PYPI_JSON_URL {
+	case "":
+		PYPI_JSON_URL = "https://pypi.org/pypi" // default value
+	case "off":
+		PYPI_JSON_URL = ""
+	default:
+		PYPI_JSON_URL = strings.TrimSuffix(PYPI_JSON_URL, "/")
+	}
+	if WORKSPACE_DIR == "" {
+		WORKSPACE_DIR = os.TempDir()
+	}
+	if INSTANCE_ID == "" {
+		INSTANCE_ID, _ = os.Hostname()
+	}
+	if FACTORY_MODE == "" {
+		FACTORY_MODE = modeStandalone // default value
+	}
+	switch FACTORY_MODE {
+	case modeStandalone, modeAPI:
+	case modeWorker:
+		if SCHEDULER_URL == "" || WORKER_TOKEN == "" {
+			log.Fatal("FACTORY_MODE=worker requires SCHEDULER_URL and WORKER_TOKEN")
+		}
+	default:
+		log.Fatalf("Invalid FACTORY_MODE %q: must be standalone, api or worker", FACTORY_MODE)
+	}
+	if FACTORY_MODE == modeAPI && WORKER_TOKEN == "" {
+		log.Fatal("FACTORY_MODE=api requires WORKER_TOKEN so builder agents can connect")
+	}
+	if BUILD_BACKEND == "" {
+		BUILD_BACKEND = backendDocker // default value
+	}
+	if BUILD_CACHE_REPO != "" && strings.ContainsAny(BUILD_CACHE_REPO[strings.LastIndex(BUILD_CACHE_REPO, "/")+1:], ":@") {
+		log.Fatalf("Invalid BUILD_CACHE_REPO %q: must be a repository without a tag or digest", BUILD_CACHE_REPO)
+	}
+	if KANIKO_CACHE_REPO == "" {
+		KANIKO_CACHE_REPO = BUILD_CACHE_REPO // default value
+	}
+	if KANIKO_EXECUTOR == "" {
+		KANIKO_EXECUTOR = "/kaniko/executor" // default value
+	}
+	if KUBERNETES_API_URL == "" {
+		KUBERNETES_API_URL = "https://kubernetes.default.svc" // default value
+		if host := getenv("KUBERNETES_SERVICE_HOST"); host != "" {
+			KUBERNETES_API_URL = "https://" + net.JoinHostPort(host, getenv("KUBERNETES_SERVICE_PORT"))
+		}
+	}
+	if KUBERNETES_NAMESPACE == "" {
+		KUBERNETES_NAMESPACE = "default" // default value
+		if ns, err := os.ReadFile(serviceAccountDir + "/namespace"); err == nil {
+			KUBERNETES_NAMESPACE = strings.TrimSpace(string(ns))
+		}
+	}
+	if KUBERNETES_BUILDER_IMAGE == "" {
+		KUBERNETES_BUILDER_IMAGE = "gcr.io/kaniko-project/executor:v1.23.2" // default value
+	}
+	if SMTP_PORT == "" {
+		SMTP_PORT = "587" // default value
+	}
+	if SMTP_FROM == "" {
+		SMTP_FROM = "airflow-image-factory@localhost" // default value
+	}
+	NOTIFY_EMAIL_TO = splitList(getenv("NOTIFY_EMAIL_TO"))
+	BASE_IMAGE_ALLOWLIST = splitList(getenv("BASE_IMAGE_ALLOWLIST"))
+	if strings.Contains(BASE_IMAGE_MIRROR, "://") {
+		log.Fatalf("Invalid BASE_IMAGE_MIRROR %q: must be a registry host and optional path, without a scheme", BASE_IMAGE_MIRROR)
+	}
+	for _, host := range strings.Split(getenv("DOCKER_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			DOCKER_HOSTS = append(DOCKER_HOSTS, host)
+		}
+	}
+	if len(DOCKER_HOSTS) == 0 {
+		host := getenv("DOCKER_HOST")
+		if host == "" {
+			host = client.DefaultDockerHost // default value
+		}
+		DOCKER_HOSTS = []string{host}
+	}
+	for _, host := range DOCKER_HOSTS {
+		if _, err := client.ParseHostURL(host); err != nil {
+			log.Fatalf("Invalid Docker host %q: %s", host, err)
+		}
+	}
+	if v := getenv("DOCKER_MAX_IDLE_CONNS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid DOCKER_MAX_IDLE_CONNS %q: must be a positive integer", v)
+		}
+		DOCKER_MAX_IDLE_CONNS = n
+	}
+	for _, u := range strings.Split(getenv("PIP_EXTRA_INDEX_URL"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			PIP_EXTRA_INDEX_URL = append(PIP_EXTRA_INDEX_URL, u)
+		}
+	}
+	if PIP_INDEX_URL != "" {
+		if err := validateIndexURL("PIP_INDEX_URL", PIP_INDEX_URL); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, u := range PIP_EXTRA_INDEX_URL {
+		if err := validateIndexURL("PIP_EXTRA_INDEX_URL", u); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if STORE_DRIVER == "" {
+		STORE_DRIVER = dialectSQLite // default value
+	}
+	if DATABASE_PATH == "" {
+		DATABASE_PATH = "factory.db" // default value
+	}
+	switch BUILD_BACKEND {
+	case backendDocker, backendKaniko, backendBuildah, backendPodman, backendNerdctl, backendKubernetes:
+	default:
+		log.Fatalf("Invalid BUILD_BACKEND %q: must be docker, kaniko, buildah, podman, nerdctl or kubernetes", BUILD_BACKEND)
+	}
+	if MAX_CONCURRENT_BUILDS, err = maxConcurrentBuilds(getenv("MAX_CONCURRENT_BUILDS")); err != nil {
+		log.Fatalf("Invalid MAX_CONCURRENT_BUILDS %q: %s", getenv("MAX_CONCURRENT_BUILDS"), err)
+	}
+	if v := getenv("BUILD_MEMORY_LIMIT"); v != "" {
+		n, err := units.RAMInBytes(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid BUILD_MEMORY_LIMIT %q: must be a size such as 4g or 512m", v)
+		}
+		BUILD_MEMORY_LIMIT = n
+	}
+	if v := getenv("BUILD_CPU_LIMIT"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 0.01 {
+			log.Fatalf("Invalid BUILD_CPU_LIMIT %q: must be a number of CPUs such as 2 or 0.5", v)
+		}
+		BUILD_CPU_LIMIT = n
+	}
+	if BUILD_MEMORY_LIMIT > 0 || BUILD_CPU_LIMIT > 0 {
+		switch BUILD_BACKEND {
+		case backendDocker:
+			log.Fatal("BUILD_BACKEND=docker builds with BuildKit, which cannot limit a single build: set BUILD_CGROUP_PARENT to a cgroup limited on each Docker host instead of BUILD_MEMORY_LIMIT and BUILD_CPU_LIMIT")
+		case backendNerdctl:
+			log.Fatal("BUILD_BACKEND=nerdctl builds with BuildKit, which cannot limit a single build: limit buildkitd's cgroup instead of setting BUILD_MEMORY_LIMIT and BUILD_CPU_LIMIT")
+		case backendKaniko:
+			log.Fatal("BUILD_BACKEND=kaniko builds in the factory's own process: limit the factory's container instead of setting BUILD_MEMORY_LIMIT and BUILD_CPU_LIMIT")
+		}
+	}
+	if COSIGN_BINARY == "" {
+		COSIGN_BINARY = "cosign" // default value
+	}
+	if SBOM_FORMAT != "" && sbomMediaTypes[SBOM_FORMAT] == "" {
+		log.Fatalf("Invalid SBOM_FORMAT %q: must be spdx-json or cyclonedx-json", SBOM_FORMAT)
+	}
+	if SYFT_BINARY == "" {
+		SYFT_BINARY = "syft" // default value
+	}
+	if ORAS_BINARY == "" {
+		ORAS_BINARY = "oras" // default value
+	}
+	if PROVENANCE_BUILDER_ID != "" {
+		if u, err := url.Parse(PROVENANCE_BUILDER_ID); err != nil || u.Scheme == "" {
+			log.Fatalf("Invalid PROVENANCE_BUILDER_ID %q: must be a URI", PROVENANCE_BUILDER_ID)
+		}
+	}
+	if TRIVY_BINARY == "" {
+		TRIVY_BINARY = "trivy" // default value
+	}
+	if GRPC_ADDR == "" {
+		GRPC_ADDR = ":9090" // default value
+	}
+	if API_KEYS_FILE != "" {
+		var err error
+		if staticAPIKeys, err = loadAPIKeys(API_KEYS_FILE); err != nil {
+			log.Fatalf("Invalid API_KEYS_FILE %q: %s", API_KEYS_FILE, err)
+		}
+	}
+	if OIDC_ISSUER_URL != "" {
+		if u, err := url.Parse(OIDC_ISSUER_URL); err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+			log.Fatalf("Invalid OIDC_ISSUER_URL %q: must be an http(s) URL", OIDC_ISSUER_URL)
+		}
+		if OIDC_AUDIENCE == "" {
+			log.Fatal("OIDC_ISSUER_URL requires OIDC_AUDIENCE, the client ID tokens must be issued for")
+		}
+		if OIDC_GROUPS_CLAIM == "" {
+			OIDC_GROUPS_CLAIM = "groups" // default value
+		}
+		if OIDC_USERNAME_CLAIM == "" {
+			OIDC_USERNAME_CLAIM = "email" // default value
+		}
+		groupRoles, err := parseGroupRoles(OIDC_GROUP_ROLES)
+		if err != nil {
+			log.Fatalf("Invalid OIDC_GROUP_ROLES %q: %s", OIDC_GROUP_ROLES, err)
+		}
+		oidc = newOIDCVerifier(OIDC_ISSUER_URL, OIDC_AUDIENCE, OIDC_JWKS_URL, OIDC_USERNAME_CLAIM, OIDC_GROUPS_CLAIM, groupRoles)
+	}
+	if (TLS_CERT_FILE == "") != (TLS_KEY_FILE == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if TLS_CLIENT_CA_FILE != "" && TLS_CERT_FILE == "" {
+		log.Fatal("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	for _, name := range strings.Split(getenv("TLS_CLIENT_NAMES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			TLS_CLIENT_NAMES = append(TLS_CLIENT_NAMES, name)
+		}
+	}
+	for _, scope := range strings.Split(getenv("TLS_CLIENT_SCOPES"), ",") {
+		if scope = strings.TrimSpace(scope); scope == "" {
+			continue
+		}
+		if !validScope(scope) {
+			log.Fatalf("Invalid TLS_CLIENT_SCOPES %q: unknown scope %q", getenv("TLS_CLIENT_SCOPES"), scope)
+		}
+		TLS_CLIENT_SCOPES = append(TLS_CLIENT_SCOPES, scope)
+	}
+	if (len(TLS_CLIENT_NAMES) > 0 || len(TLS_CLIENT_SCOPES) > 0) && TLS_CLIENT_CA_FILE == "" {
+		log.Fatal("TLS_CLIENT_NAMES and TLS_CLIENT_SCOPES require TLS_CLIENT_CA_FILE")
+	}
+	if config, err := serverTLSConfig(); err != nil {
+		log.Fatalf("Invalid TLS_CERT_FILE or TLS_CLIENT_CA_FILE: %s", err)
+	} else {
+		serverTLS = config
+	}
+	if (AGENT_TLS_CERT_FILE == "") != (AGENT_TLS_KEY_FILE == "") {
+		log.Fatal("AGENT_TLS_CERT_FILE and AGENT_TLS_KEY_FILE must be set together")
+	}
+	if FACTORY_MODE == modeWorker {
+		config, err := agentTLSConfig()
+		if err != nil {
+			log.Fatalf("Invalid SCHEDULER_CA_FILE or AGENT_TLS_CERT_FILE: %s", err)
+		}
+		agentClient.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config}
+	}
+	if RATE_LIMIT, err = parseRate(getenv("RATE_LIMIT")); err != nil {
+		log.Fatalf("Invalid RATE_LIMIT %q: %s", getenv("RATE_LIMIT"), err)
+	}
+	if BUILD_RATE_LIMIT, err = parseRate(getenv("BUILD_RATE_LIMIT")); err != nil {
+		log.Fatalf("Invalid BUILD_RATE_LIMIT %q: %s", getenv("BUILD_RATE_LIMIT"), err)
+	}
+	requestLimiter, buildLimiter = newRateLimiter(RATE_LIMIT), newRateLimiter(BUILD_RATE_LIMIT)
+	CORS_ALLOWED_ORIGINS = splitList(getenv("CORS_ALLOWED_ORIGINS"))
+	for _, origin := range CORS_ALLOWED_ORIGINS {
+		if err := validateCORSOrigin(origin); err != nil {
+			log.Fatalf("Invalid CORS_ALLOWED_ORIGINS: %s", err)
+		}
+	}
+	if CORS_ALLOWED_METHODS = splitList(strings.ToUpper(getenv("CORS_ALLOWED_METHODS"))); len(CORS_ALLOWED_METHODS) == 0 {
+		CORS_ALLOWED_METHODS = []string{"GET", "POST", "PUT", "PATCH", "DELETE"} // default value
+	}
+	if CORS_ALLOWED_HEADERS = splitList(getenv("CORS_ALLOWED_HEADERS")); len(CORS_ALLOWED_HEADERS) == 0 {
+		CORS_ALLOWED_HEADERS = []string{"Authorization", "Content-Type", "Idempotency-Key", "X-API-Key", "X-Request-ID"} // default value
+	}
+	if SWAGGER_UI_URL == "" {
+		SWAGGER_UI_URL = "https://cdn.jsdelivr.net/npm/swagger-ui-dist@5" // default value
+	}
+	switch VULN_FAIL_SEVERITY {
+	case "", "LOW", "MEDIUM", "HIGH", "CRITICAL":
+	default:
+		log.Fatalf("Invalid VULN_FAIL_SEVERITY %q: must be LOW, MEDIUM, HIGH or CRITICAL", VULN_FAIL_SEVERITY)
+	}
+	if VULN_FAIL_SEVERITY != "" && !VULN_SCAN {
+		log.Fatal("VULN_FAIL_SEVERITY needs VULN_SCAN=true")
+	}
+	if COSIGN_KEY != "" && COSIGN_KEYLESS {
+		log.Fatal("Set either COSIGN_KEY or COSIGN_KEYLESS, not both")
+	}
+	if COSIGN_IDENTITY_TOKEN_FILE != "" && !COSIGN_KEYLESS {
+		log.Fatal("COSIGN_IDENTITY_TOKEN_FILE is only used with COSIGN_KEYLESS=true")
+	}
+	if BUILD_CGROUP_PARENT != "" && (BUILD_BACKEND == backendKaniko || BUILD_BACKEND == backendNerdctl || BUILD_BACKEND == backendKubernetes) {
+		log.Fatalf("BUILD_CGROUP_PARENT is not supported by BUILD_BACKEND=%s", BUILD_BACKEND)
+	}
+	if v := getenv("BUILD_TIMEOUT_SECONDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid BUILD_TIMEOUT_SECONDS %q: must be a positive integer", v)
+		}
+		BUILD_TIMEOUT = time.Duration(n) * time.Second
+	}
+	if v := getenv("BUILD_RETRY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid BUILD_RETRY_ATTEMPTS %q: must be a positive integer", v)
+		}
+		BUILD_RETRY_ATTEMPTS = n
+	}
+	if v := getenv("BUILD_RETRY_BACKOFF_SECONDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid BUILD_RETRY_BACKOFF_SECONDS %q: must be a non-negative integer", v)
+		}
+		BUILD_RETRY_BACKOFF = time.Duration(n) * time.Second
+	}
+	if v := getenv("RETENTION_DAYS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid RETENTION_DAYS %q: must be a non-negative integer", v)
+		}
+		RETENTION_DAYS = n
+	}
+	if v := getenv("RETENTION_MAX_BUILDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid RETENTION_MAX_BUILDS %q: must be a non-negative integer", v)
+		}
+		RETENTION_MAX_BUILDS = n
+	}
+	if v := getenv("TAG_RETENTION_KEEP_LAST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid TAG_RETENTION_KEEP_LAST %q: must be a non-negative integer", v)
+		}
+		TAG_RETENTION_KEEP_LAST = n
+	}
+	if v := getenv("TAG_RETENTION_DAYS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid TAG_RETENTION_DAYS %q: must be a non-negative integer", v)
+		}
+		TAG_RETENTION_DAYS = n
+	}
+	for _, source := range strings.Split(getenv("TAG_RETENTION_IN_USE"), ",") {
+		if source = strings.TrimSpace(source); source == "" {
+			continue
+		}
+		if source != "kubernetes" && !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+			log.Fatalf("Invalid TAG_RETENTION_IN_USE entry %q: must be \"kubernetes\" or an http(s) URL", source)
+		}
+		TAG_RETENTION_IN_USE = append(TAG_RETENTION_IN_USE, source)
+	}
+	if v := getenv("RETENTION_INTERVAL_MINUTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid RETENTION_INTERVAL_MINUTES %q: must be a positive integer", v)
+		}
+		RETENTION_INTERVAL = time.Duration(n) * time.Minute
+	}
+	if REGISTRY_CA_FILE != "" {
+		if err := loadRegistryCA(); err != nil {
+			log.Fatalf("Invalid REGISTRY_CA_FILE %q: %s", REGISTRY_CA_FILE, err)
+		}
+	}
+	if CONFIG_FILE != "" {
+		slog.Info("Using config file", "path", CONFIG_FILE)
+	}
+	slog.Info("Using factory mode", "mode", FACTORY_MODE)
+	slog.Info("Using build backend", "backend", BUILD_BACKEND)
+	if BUILD_BACKEND == backendDocker {
+		slog.Info("Using Docker hosts", "hosts", DOCKER_HOSTS)
+	}
+	slog.Info("Using registry", registries[0].logAttr())
+	for _, r := range registries[1:] {
+		slog.Info("Using extra registry", r.logAttr())
+	}
+	for _, r := range promotionRegistries {
+		slog.Info("Using promotion registry", r.logAttr())
+	}
+	if REGISTRY_CA_FILE != "" {
+		slog.Info("Using registry CA file", "path", REGISTRY_CA_FILE)
+	}
+	if len(INSECURE_REGISTRIES) > 0 {
+		slog.Info("Using insecure registries", "registries", INSECURE_REGISTRIES)
+	}
+	if BASE_IMAGE_MIRROR != "" {
+		slog.Info("Using base image mirror", "mirror", BASE_IMAGE_MIRROR)
+	}
+	slog.Info("Using registry API URL", "url", REGISTRY_API_URL)
+	slog.Info("Using image name", "name", IMAGE_NAME)
+	slog.Info("Using instance ID", "instance_id", INSTANCE_ID)
+	slog.Info("Using store driver", "driver", STORE_DRIVER)
+	if STORE_DRIVER == dialectSQLite {
+		slog.Info("Using database path", "path", DATABASE_PATH)
+	}
+	slog.Info("Using workspace dir", "path", WORKSPACE_DIR)
+	slog.Info("Using max concurrent builds", "builds", MAX_CONCURRENT_BUILDS)
+	slog.Info("Using default build timeout", "timeout", BUILD_TIMEOUT.String())
+	if BUILD_MEMORY_LIMIT > 0 || BUILD_CPU_LIMIT > 0 {
+		slog.Info("Using build limits (0 = unlimited)", "memory", units.BytesSize(float64(BUILD_MEMORY_LIMIT)), "cpus", BUILD_CPU_LIMIT)
+	}
+	if BUILD_CGROUP_PARENT != "" {
+		slog.Info("Using build cgroup parent", "cgroup", BUILD_CGROUP_PARENT)
+	}
+	if COSIGN_KEY != "" {
+		slog.Info("Using image signing", "binary", COSIGN_BINARY, "key", COSIGN_KEY)
+	} else if COSIGN_KEYLESS {
+		slog.Info("Using image signing", "binary", COSIGN_BINARY, "keyless", true)
+	}
+	if VULN_SCAN {
+		slog.Info("Using vulnerability scan", "binary", TRIVY_BINARY, "fail_severity", VULN_FAIL_SEVERITY, "ignore_unfixed", VULN_IGNORE_UNFIXED)
+	}
+	if SBOM_FORMAT != "" {
+		slog.Info("Using SBOM", "format", SBOM_FORMAT, "generator", SYFT_BINARY, "attacher", ORAS_BINARY)
+	}
+	if PROVENANCE_BUILDER_ID != "" {
+		slog.Info("Using provenance", "builder_id", PROVENANCE_BUILDER_ID, "signed", signingEnabled())
+	}
+	slog.Info("Using Swagger UI", "url", SWAGGER_UI_URL)
+	if requestLimiter != nil || buildLimiter != nil {
+		slog.Info("Using rate limits per client (0 = unlimited)", "requests", RATE_LIMIT.String(), "builds", BUILD_RATE_LIMIT.String())
+	}
+	if len(CORS_ALLOWED_ORIGINS) > 0 {
+		slog.Info("Using CORS allowed origins", "origins", CORS_ALLOWED_ORIGINS, "methods", CORS_ALLOWED_METHODS, "headers", CORS_ALLOWED_HEADERS)
+	}
+	slog.Info("Using gRPC address", "address", GRPC_ADDR)
+	switch {
+	case staticAPIKeys != nil:
+		slog.Info("Using API keys from a file and those created at /v1/api-keys", "file", API_KEYS_FILE, "keys", len(staticAPIKeys))
+	case authEnabled():
+		slog.Info("Using API keys created at /v1/api-keys")
+	default:
+		slog.Warn("Using no authentication: the API is open to anyone who can reach it")
+	}
+	switch {
+	case TLS_CLIENT_CA_FILE != "":
+		slog.Info("Using TLS with client certificates", "cert", TLS_CERT_FILE, "client_ca", TLS_CLIENT_CA_FILE,
+			"client_names", TLS_CLIENT_NAMES, "client_scopes", TLS_CLIENT_SCOPES)
+	case TLS_CERT_FILE != "":
+		slog.Info("Using TLS", "cert", TLS_CERT_FILE)
+	}
+	if oidcEnabled() {
+		slog.Info("Using OIDC", "issuer", OIDC_ISSUER_URL, "audience", OIDC_AUDIENCE, "groups_claim", OIDC_GROUPS_CLAIM, "group_roles", OIDC_GROUP_ROLES)
+	}
+	slog.Info("Using retry policy", "attempts", BUILD_RETRY_ATTEMPTS, "backoff", BUILD_RETRY_BACKOFF.String())
+	slog.Info("Using retention (0 = unlimited)", "days", RETENTION_DAYS, "builds", RETENTION_MAX_BUILDS, "interval", RETENTION_INTERVAL.String())
+	if tagRetentionEnabled() {
+		slog.Info("Using tag retention (0 = unlimited)", "keep_last", TAG_RETENTION_KEEP_LAST, "days", TAG_RETENTION_DAYS,
+			"in_use", TAG_RETENTION_IN_USE, "dry_run", TAG_RETENTION_DRY_RUN)
+	}
 }
 
 type DockerBuildRequest struct {
 	AirflowVersion string   `json:"airflow_version"`
 	PythonVersion  string   `json:"python_version"`
-	BaseImage      string   `json:"base_image"`
+	BaseImage      string   `json:"base_image"` // defaults to the official image for the versions above
 	Extras         []string `json:"extras"`
 	AptDeps        []string `json:"apt_deps"`
 	PipDeps        []string `json:"pip_deps"`
-}
 
-const dockerfileTemplate = `
-FROM apache/airflow:{{.AirflowVersion}}-python{{.PythonVersion}}
+	// TimeoutSeconds overrides BUILD_TIMEOUT for this build. It covers both
+	// the docker build and the push, but not time spent waiting in the queue.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
 
-USER root
+	// Priority is one of low, normal (default), high or urgent.
+	Priority string `json:"priority,omitempty"`
+
+	// Force rebuilds even if the computed tag is already in the registry.
+	Force bool `json:"force,omitempty"`
+
+	// CallbackURL is POSTed a signed JSON summary when the build finishes.
+	CallbackURL string `json:"callback_url,omitempty"`
+
+	// Notify opts the build into Slack and/or email notifications.
+	Notify *NotifySettings `json:"notify,omitempty"`
+
+	// UseConstraints pins the pip install to an Airflow constraints file:
+	// ConstraintsURL if given (which implies UseConstraints), otherwise the
+	// official one for AirflowVersion and PythonVersion.
+	UseConstraints bool   `json:"use_constraints,omitempty"`
+	ConstraintsURL string `json:"constraints_url,omitempty"`
+
+	// Bundles name curated system prerequisites for providers, such as
+	// "mssql" or "java", installed after AptDeps.
+	Bundles []string `json:"bundles,omitempty"`
+
+	// AptRepositories are added before AptDeps are installed, for system
+	// packages from vendor repositories.
+	AptRepositories []AptRepository `json:"apt_repositories,omitempty"`
+
+	// Providers pins provider packages to versions, e.g.
+	// "apache-airflow-providers-google": "10.19.0", independently of the
+	// Airflow version. Pins must agree with the constraints file, if used.
+	Providers map[string]string `json:"providers,omitempty"`
+
+	// ImageFlavor selects the official image variant: regular (default) or
+	// slim, which ships without providers; a slim build installs the
+	// provider packages for its Extras explicitly.
+	ImageFlavor string `json:"image_flavor,omitempty"`
+
+	// SlimBuild installs Python packages in a builder stage that has
+	// build-essential and copies only the result into the final image,
+	// leaving compilers and build caches behind.
+	SlimBuild bool `json:"slim_build,omitempty"`
+
+	// Platforms, e.g. ["linux/amd64", "linux/arm64"], builds with docker
+	// buildx and pushes a multi-arch manifest list instead of a single
+	// image for the daemon's own platform.
+	Platforms []string `json:"platforms,omitempty"`
+
+	// AirflowUID and AirflowGID renumber the image's airflow user (UID 50000,
+	// primary group root by default) to match host volume ownership, e.g.
+	// in docker-compose or OpenShift-style restricted environments.
+	AirflowUID int `json:"airflow_uid,omitempty"`
+	AirflowGID int `json:"airflow_gid,omitempty"`
+
+	// Locales, e.g. ["de_DE.UTF-8"], are generated in the image, the first
+	// becoming LANG; Timezone, an IANA name, sets the system timezone and
+	// TZ. Airflow's own default_timezone is configured separately.
+	Locales  []string `json:"locales,omitempty"`
+	Timezone string   `json:"timezone,omitempty"`
+
+	// BuildArgs are passed to docker build as --build-arg and declared as
+	// ARG in the built-in template, so RUN steps can use values such as
+	// proxy hosts or internal mirrors.
+	BuildArgs map[string]string `json:"build_args,omitempty"`
+
+	// Labels are added to the image next to the factory's own OCI labels.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Env is baked into the image as ENV instructions, for settings that
+	// hold across deployments such as AIRFLOW__CORE__LOAD_EXAMPLES.
+	Env map[string]string `json:"env,omitempty"`
+
+	// Snippets adds RUN or COPY instructions at named points of the built-in
+	// template: before_apt, after_pip and final.
+	Snippets map[string][]string `json:"snippets,omitempty"`
+
+	// Verify lists shell commands, e.g. `python -c "import pandas"`, run as
+	// the last steps of the build so a broken dependency set fails the
+	// build instead of DAG parsing in production.
+	Verify []string `json:"verify,omitempty"`
 
+	// Healthcheck adds a HEALTHCHECK, for images run outside the official
+	// Helm chart that rely on Docker's health status.
+	Healthcheck *Healthcheck `json:"healthcheck,omitempty"`
+
+	// Entrypoint and Cmd replace the image's ENTRYPOINT and CMD, e.g. to
+	// start a Celery worker or a wrapper script by default. Setting only
+	// Entrypoint leaves CMD empty.
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+
+	// IndexURL and ExtraIndexURLs point pip at private package indexes,
+	// defaulting to PIP_INDEX_URL and PIP_EXTRA_INDEX_URL. Credentials are
+	// supplied by the builder via the pip_netrc build secret.
+	IndexURL       string   `json:"index_url,omitempty"`
+	ExtraIndexURLs []string `json:"extra_index_urls,omitempty"`
+
+	// Installer is pip (default) or uv, which resolves and installs large
+	// dependency sets much faster.
+	Installer string `json:"installer,omitempty"`
+
+	// Template replaces the built-in Dockerfile template for this build.
+	// It is a text/template rendered with this request as its data.
+	Template string `json:"template,omitempty"`
+
+	// TemplateName selects a template from the server's library instead.
+	TemplateName string `json:"template_name,omitempty"`
+
+	// Tags are pushed alongside the content-hash tag, e.g. "latest" or
+	// "2.9.3-team-data-eng", and so is TagTemplate, a text/template over
+	// tagFields such as "{{.AirflowVersion}}-{{.Date}}-{{.ShortHash}}".
+	// A submission that attaches to an identical build in progress gets
+	// that build's tags.
+	Tags        []string `json:"tags,omitempty"`
+	TagTemplate string   `json:"tag_template,omitempty"`
+
+	// Project builds the image into a project's repository, under its
+	// templates and quotas. /projects/{project}/builds sets it.
+	Project string `json:"project,omitempty"`
+}
+
+const dockerfileTemplate = `
+{{- define "args"}}{{range $name, $value := .BuildArgs}}
+ARG {{$name}}{{end}}
+{{end}}
+{{- define "aptcache"}}{{if .CacheMounts}}--mount=type=cache,target=/var/cache/apt,sharing=locked {{end}}{{end}}
+{{- define "pipcache"}}{{if .CacheMounts}}{{range .PipCaches}}--mount=type=cache,target={{.}},uid={{$.UID}} {{end}}{{end}}{{end}}
+{{- define "apt"}}{{if .CacheMounts}}
+# Keep downloaded packages in the apt cache mount between builds
+RUN rm -f /etc/apt/apt.conf.d/docker-clean && \
+    echo 'Binary::apt::APT::Keep-Downloaded-Packages "true";' > /etc/apt/apt.conf.d/keep-cache
+{{end}}{{if .AptRepositories}}
+# Add extra apt repositories
+RUN {{template "aptcache" .}}apt-get update && apt-get install -y --no-install-recommends ca-certificates curl gnupg && \
+{{range $i, $repo := .AptRepositories}}{{if $repo.KeyURL}}    curl -fsSL "{{$repo.KeyURL}}" | gpg --dearmor --yes -o /etc/apt/trusted.gpg.d/factory-repo-{{$i}}.gpg && \
+{{end}}    echo '{{$repo.Line}}' > /etc/apt/sources.list.d/factory-repo-{{$i}}.list && \
+{{end}}    rm -rf /var/lib/apt/lists/*
+{{end}}{{if index .Files "packages.txt"}}
+COPY packages.txt /packages.txt
+{{end}}
 # Install apt dependencies
-RUN apt-get update && apt-get install -y --no-install-recommends {{range .AptDeps}}{{.}} {{end}} && \
+RUN {{template "aptcache" .}}apt-get update && apt-get install -y --no-install-recommends {{if .Git}}git openssh-client {{end}}{{range .AptDeps}}{{ShellQuote .}} {{end}}{{if index .Files "packages.txt"}}$(grep -v '^#' /packages.txt) {{end}}&& \
     apt-get autoremove -yqq --purge && \
-    apt-get clean && \
     rm -rf /var/lib/apt/lists/*
+{{range .ToolBundles}}
+# {{.Description}}
+RUN {{template "aptcache" .}}{{range .Setup}}{{.}} && \
+    {{end}}apt-get update && apt-get install -y --no-install-recommends {{StringsJoin .Packages " "}} && \
+{{range .Post}}    {{.}} && \
+{{end}}    rm -rf /var/lib/apt/lists/*
+{{if .Env}}ENV{{range $name, $value := .Env}} {{$name}}={{DockerQuote $value}}{{end}}
+{{end}}{{end}}{{end}}
+{{- define "user"}}{{if or .AirflowUID .AirflowGID}}
+# Match the airflow user to the ownership of host-mounted volumes
+RUN {{if .AirflowGID}}(getent group {{.AirflowGID}} || groupadd -g {{.AirflowGID}} airflow-host) && \
+    usermod -g {{.AirflowGID}} airflow && \
+    {{end}}{{if .AirflowUID}}usermod -u {{.AirflowUID}} airflow && \
+    {{end}}chown -R airflow:{{.Group}} /home/airflow /opt/airflow
+{{end}}{{end}}
+{{- define "locale"}}{{if or .Locales .Timezone}}
+# Configure locales and timezone
+RUN {{template "aptcache" .}}apt-get update && apt-get install -y --no-install-recommends {{if .Locales}}locales {{end}}tzdata && \
+{{range .LocaleGen}}    echo '{{.}}' >> /etc/locale.gen && \
+{{end}}{{if .Locales}}    locale-gen && \
+{{end}}{{if .Timezone}}    test -e /usr/share/zoneinfo/{{.Timezone}} && \
+    ln -snf /usr/share/zoneinfo/{{.Timezone}} /etc/localtime && \
+    echo {{.Timezone}} > /etc/timezone && \
+{{end}}    rm -rf /var/lib/apt/lists/*
+ENV{{if .Locales}} LANG={{index .Locales 0}}{{end}}{{if .Timezone}} TZ={{.Timezone}}{{end}}
+{{end}}{{end}}
+{{- define "snippets"}}{{if .}}
+# Request snippets
+{{range .}}{{.}}
+{{end}}{{end}}{{end}}
+{{- define "pip"}}{{if not .CacheMounts}}
+# Without cache mounts, keep installer caches out of the image
+ARG PIP_NO_CACHE_DIR=1
+ARG UV_NO_CACHE=1
+{{end}}{{if index .Files "requirements.lock"}}
+COPY requirements.lock /requirements.lock
 
-USER airflow
-
+# Install the locked dependency set exactly as uploaded
+RUN {{template "pipcache" .}}{{if .PipNetrc}}--mount=type=secret,id=pip_netrc,target=/home/airflow/.netrc,uid={{.UID}} {{end}}{{.PipInstall}} --no-deps --require-hashes {{if .IndexURL}}--index-url "{{.IndexURL}}" {{end}}{{range .ExtraIndexURLs}}--extra-index-url "{{.}}" {{end}}-r /requirements.lock
+{{else}}{{if index .Files "requirements.txt"}}
+COPY requirements.txt /requirements.txt
+{{end}}
 # Install Airflow with extras and additional pip dependencies
-RUN pip install --no-cache-dir "apache-airflow[{{StringsJoin .Extras ","}}]=={{.AirflowVersion}}" {{range .PipDeps}}{{.}} {{end}}
+RUN {{template "pipcache" .}}{{if .PipNetrc}}--mount=type=secret,id=pip_netrc,target=/home/airflow/.netrc,uid={{.UID}} {{end}}{{if .GitSSH}}--mount=type=ssh,uid={{.UID}} --mount=type=secret,id=git_known_hosts,target=/home/airflow/.ssh/known_hosts,uid={{.UID}} {{end}}{{.PipInstall}} {{if .IndexURL}}--index-url "{{.IndexURL}}" {{end}}{{range .ExtraIndexURLs}}--extra-index-url "{{.}}" {{end}}"apache-airflow[{{StringsJoin .Extras ","}}]=={{.AirflowVersion}}" {{range .ProviderPackages}}{{ShellQuote .}} {{end}}{{range .PipDeps}}{{ShellQuote .}} {{end}}{{if index .Files "requirements.txt"}}-r /requirements.txt {{end}}{{if .UseConstraints}}--constraint "{{.ConstraintsURL}}"{{end}}
+{{end}}{{end}}
+{{- if .SlimBuild}}
+# Builder stage: compile and install Python packages with build tools
+FROM {{.From}} AS builder
+{{template "args" .}}
+USER root
+{{template "user" .}}{{template "apt" .}}
+RUN {{template "aptcache" .}}apt-get update && apt-get install -y --no-install-recommends build-essential && \
+    rm -rf /var/lib/apt/lists/*
 
-CMD ["airflow"]
+USER airflow
+{{template "pip" .}}
+# Final stage: runtime packages and the installed Python environment only
+FROM {{.From}}
+{{template "args" .}}
+USER root
+{{template "user" .}}{{template "snippets" index .Snippets "before_apt"}}{{template "apt" .}}{{template "locale" .}}
+USER airflow
+
+COPY --from=builder --chown=airflow:{{.Group}} /home/airflow/.local /home/airflow/.local
+{{template "snippets" index .Snippets "after_pip"}}{{else}}
+FROM {{.From}}
+{{template "args" .}}
+USER root
+{{template "user" .}}{{template "snippets" index .Snippets "before_apt"}}{{template "apt" .}}{{template "locale" .}}
+USER airflow
+{{template "pip" .}}{{template "snippets" index .Snippets "after_pip"}}
+{{- end}}
+{{- if .Env}}
+ENV{{range $name, $value := .Env}} {{$name}}={{DockerQuote $value}}{{end}}
+{{end}}{{if index .Files "config/"}}
+# Configuration files go to AIRFLOW_HOME
+COPY --chown=airflow:{{.Group}} config/ /opt/airflow/
+{{end}}{{if index .Files "pod_templates/"}}
+COPY --chown=airflow:{{.Group}} pod_templates/ /opt/airflow/pod_templates/
+{{end}}{{if index .Files "plugins/"}}
+COPY --chown=airflow:{{.Group}} plugins/ /opt/airflow/plugins/
+{{end}}{{if index .Files "dags/"}}
+# Bake in the uploaded DAGs
+COPY --chown=airflow:{{.Group}} dags/ /opt/airflow/dags/
+{{end}}{{template "snippets" index .Snippets "final"}}{{if .Verify}}
+# Verify the image before it is pushed
+{{range .Verify}}RUN {{.}}
+{{end}}{{end}}{{if .Healthcheck}}
+{{.Healthcheck.Instruction}}
+{{end}}{{if .Entrypoint}}
+ENTRYPOINT {{ExecForm .Entrypoint}}
+{{end}}
+CMD {{if .Cmd}}{{ExecForm .Cmd}}{{else if .Entrypoint}}[]{{else}}["airflow"]{{end}}
 `
 
-func generateTag(req DockerBuildRequest) string {
+const (
+	modeStandalone = "standalone"
+	modeAPI        = "api"
+	modeWorker     = "worker"
+)
+
+// constraintsURL is the official constraints file for an Airflow release,
+// as recommended by the Airflow installation docs.
+func constraintsURL(airflowVersion, pythonVersion string) string {
+	return fmt.Sprintf("https://raw.githubusercontent.com/apache/airflow/constraints-%s/constraints-%s.txt", airflowVersion, pythonVersion)
+}
+
+// workspacePrefix marks per-build context directories under WORKSPACE_DIR.
+const workspacePrefix = "airflow-build-"
+
+func generateTag(req DockerBuildRequest, files map[string][]byte) string {
+	// Only fields that shape the image feed the hash, so identical specs get
+	// identical tags regardless of how they were scheduled.
+	req.TimeoutSeconds = 0
+	req.Priority = ""
+	req.Force = false
+	req.CallbackURL = ""
+	req.Notify = nil
+	req.Tags, req.TagTemplate = nil, ""
 	data, _ := json.Marshal(req)
-	hash := sha256.Sum256(data)
-	return hex.EncodeToString(hash[:8]) // Use first 8 bytes of hash
+	h := sha256.New()
+	h.Write(data)
+	// Uploaded context files change the image as much as the spec does.
+	for _, name := range fileNames(files) {
+		fmt.Fprintf(h, "\x00%s\x00%d\x00", name, len(files[name]))
+		h.Write(files[name])
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8]) // Use first 8 bytes of hash
 }
 
-func buildAndPushDocker(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Received build and push request")
+// badRequest marks an error caused by the caller's spec rather than by the
+// factory, so handlers can answer 400 instead of 500. fields, when known,
+// say which parts of the request are at fault.
+type badRequest struct {
+	msg    string
+	fields []fieldError
+}
+
+func (e badRequest) Error() string { return e.msg }
+
+// prepareBuild validates req and renders its Dockerfile, returning the
+// queued build record it would produce without registering it anywhere.
+// files are extra build context files, keyed by their path in the context;
+// requester is recorded with the build and in the image labels.
+func prepareBuild(ctx context.Context, req DockerBuildRequest, files map[string][]byte, requester string) (*Build, error) {
+	if err := validateRequestFields(req); err != nil {
+		return nil, err
+	}
+	var project Project
+	if req.Project != "" {
+		var err error
+		if project, err = applyProject(&req); err != nil {
+			return nil, err
+		}
+	}
+	if req.TimeoutSeconds < 0 {
+		return nil, fieldErrorf("timeout_seconds", codeMinimum, "timeout_seconds must not be negative")
+	}
+	if req.Priority == "" {
+		req.Priority = defaultPriority
+	}
+	if _, ok := priorityLevels[req.Priority]; !ok {
+		return nil, fieldErrorf("priority", codeEnum, "Unknown priority %q: must be one of low, normal, high, urgent", req.Priority)
+	}
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateNotify(req.Notify); err != nil {
+		return nil, err
+	}
+	if req.ConstraintsURL != "" {
+		if err := validateURLField("constraints_url", req.ConstraintsURL); err != nil {
+			return nil, err
+		}
+		req.UseConstraints = true
+	} else if req.UseConstraints {
+		req.ConstraintsURL = constraintsURL(req.AirflowVersion, req.PythonVersion)
+	}
+	if err := validateBaseImage(req.BaseImage); err != nil {
+		return nil, err
+	}
+	if err := validateImageFlavor(req.ImageFlavor); err != nil {
+		return nil, err
+	}
+	if err := validateProviders(req.Providers); err != nil {
+		return nil, err
+	}
+	if req.Healthcheck != nil {
+		if err := req.Healthcheck.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateSnippets(req.Snippets); err != nil {
+		return nil, err
+	}
+	if err := validateVerifyCommands(req.Verify); err != nil {
+		return nil, err
+	}
+	if err := validateInstaller(req.Installer); err != nil {
+		return nil, err
+	}
+	if err := validateLockfile(req, files); err != nil {
+		return nil, err
+	}
+	if err := validatePythonVersion(ctx, req); err != nil {
+		return nil, err
+	}
+	if err := validateExtras(ctx, req); err != nil {
+		return nil, err
+	}
+	for name := range req.BuildArgs {
+		if !envNamePattern.MatchString(name) {
+			return nil, fieldErrorf("build_args."+name, codeFormat, "Invalid build arg name %q", name)
+		}
+	}
+	if req.AirflowUID < 0 {
+		return nil, fieldErrorf("airflow_uid", codeMinimum, "airflow_uid and airflow_gid must not be negative")
+	}
+	if req.AirflowGID < 0 {
+		return nil, fieldErrorf("airflow_gid", codeMinimum, "airflow_uid and airflow_gid must not be negative")
+	}
+	if err := validateLocales(req.Locales, req.Timezone); err != nil {
+		return nil, err
+	}
+	if err := validatePlatforms(req.Platforms); err != nil {
+		return nil, err
+	}
+	if err := validateLabels(req.Labels); err != nil {
+		return nil, err
+	}
+	for name, value := range req.Env {
+		if !envNamePattern.MatchString(name) {
+			return nil, fieldErrorf("env."+name, codeFormat, "Invalid environment variable name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fieldErrorf("env."+name, codeInvalid, "Environment variable %s must not contain newlines", name)
+		}
+	}
+	if _, err := resolveBundles(req.Bundles); err != nil {
+		return nil, err
+	}
+	for i := range req.AptRepositories {
+		if err := req.AptRepositories[i].validate(fmt.Sprintf("apt_repositories[%d]", i)); err != nil {
+			return nil, err
+		}
+	}
+	// Defaults are folded into the request so the tag follows config changes.
+	if req.IndexURL == "" {
+		req.IndexURL = PIP_INDEX_URL
+	}
+	if len(req.ExtraIndexURLs) == 0 {
+		req.ExtraIndexURLs = PIP_EXTRA_INDEX_URL
+	}
+	if req.IndexURL != "" {
+		if err := validateIndexURL("index_url", req.IndexURL); err != nil {
+			return nil, err
+		}
+	}
+	for _, u := range req.ExtraIndexURLs {
+		if err := validateIndexURL("extra_index_urls", u); err != nil {
+			return nil, err
+		}
+	}
+
+	_, span := tracer.Start(ctx, "render dockerfile")
+	defer span.End()
 
+	body, err := templateBody(req)
+	if err != nil {
+		return nil, err
+	}
+	dockerfile, err := renderDockerfile(body, req, files)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate tag from request parameters. Named templates are hashed by
+	// content, so editing one produces new tags rather than stale hits.
+	tagReq := req
+	if req.TemplateName != "" {
+		tagReq.TemplateName, tagReq.Template = "", body
+	}
+	tag := generateTag(tagReq, files)
+	span.SetAttributes(attribute.String("image.tag", tag))
+
+	image := fmt.Sprintf("%s/%s:%s", REGISTRY_URL, IMAGE_NAME, tag)
+	if req.Project != "" {
+		image = project.image(tag)
+	}
+	build := &Build{
+		ID:        newBuildID(),
+		Status:    StatusQueued,
+		Tag:       tag,
+		Image:     image,
+		Request:   req,
+		CreatedAt: time.Now().UTC(),
+		Instance:  INSTANCE_ID,
+		Requester: requester,
+		Files:     files,
+	}
+	if _, err := customTags(*build); err != nil {
+		return nil, err
+	}
+	build.Dockerfile = dockerfile + labelInstruction(imageLabels(build))
+	logger(ctx).Debug("Prepared build", "build_id", build.ID, "tag", tag, "dockerfile", build.Dockerfile)
+	return build, nil
+}
+
+// submitBuild registers a prepared build and queues it. If an identical spec
+// is already queued or building, that build is returned instead and the
+// second result is true. If the image already exists and the request did
+// not ask for a forced rebuild, the build is recorded as an immediate,
+// skipped success. Only a build that would be queued counts against its
+// project's quotas, and one past them is refused with a quotaExceeded.
+func submitBuild(ctx context.Context, build *Build) (Build, bool, error) {
+	trace.SpanFromContext(ctx).SetAttributes(buildAttr(build.ID))
+
+	if existing, ok := builds.activeBuild(build.Tag); ok {
+		logger(ctx).Info("Build already in progress, attaching", "build_id", existing.ID, "image", build.Image)
+		auditSubmission(ctx, build.Requester, existing, "deduplicated")
+		return existing, true, nil
+	}
+
+	if !build.Request.Force {
+		client, repository := imageRepository(*build)
+		exists, err := client.tagExists(repository, build.Tag)
+		if err != nil {
+			// Not fatal: worst case we rebuild an image that already exists.
+			logger(ctx).Warn("Checking the registry for the image", "image", build.Image, "error", err)
+		}
+		if exists {
+			logger(ctx).Info("Image already exists, skipping build", "build_id", build.ID, "image", build.Image)
+			build.Skipped = true
+			applyCustomTags(build)
+			describeImage(build)
+			builds.add(build)
+			builds.setStatus(build.ID, StatusSucceeded)
+			existing, _ := builds.get(build.ID)
+			auditSubmission(ctx, build.Requester, existing, "skipped")
+			return existing, false, nil
+		}
+	}
+
+	if build.Request.Project != "" {
+		quotaMu.Lock()
+		defer quotaMu.Unlock()
+		if err := checkProjectQuota(build.Request.Project); err != nil {
+			return Build{}, false, err
+		}
+	}
+	snapshot := *build
+	buildCtx, existing := builds.addUnlessActive(build)
+	if existing != nil {
+		// Lost a race with an identical submission.
+		logger(ctx).Info("Build already in progress, attaching", "build_id", existing.ID, "image", build.Image)
+		auditSubmission(ctx, build.Requester, *existing, "deduplicated")
+		return *existing, true, nil
+	}
+	job := newBuildJob(snapshot, buildCtx)
+	job.TraceContext = traceCarrier(ctx)
+	queue.push(job)
+	logger(ctx).Info("Queued build", "build_id", build.ID, "image", build.Image, "requester", build.Requester, "waiting", queue.len())
+	auditSubmission(ctx, build.Requester, snapshot, "queued")
+	return snapshot, false, nil
+}
+
+func buildAndPushDocker(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	submitBuildRequest(w, r, "")
+}
 
-	var req DockerBuildRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+// submitBuildRequest serves a request to build, into project if it is not
+// empty.
+func submitBuildRequest(w http.ResponseWriter, r *http.Request, project string) {
+	var (
+		req   DockerBuildRequest
+		files map[string][]byte
+		err   error
+	)
+	if isMultipart(r) {
+		req, files, err = parseMultipartBuild(w, r)
+	} else if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		err = fieldErrorf("body", codeInvalidJSON, "body is not valid JSON: %s", err)
+	}
+	if err == nil && project != "" {
+		if req.Project != "" && req.Project != project {
+			err = fieldErrorf("project", codeInvalid, "project does not match the URL")
+		}
+		req.Project = project
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeSpecError(w, err)
+		return
+	}
+	if !projectAllowed(w, r, req.Project) {
 		return
 	}
 
-	fmt.Printf("Received request: %+v\n", req)
+	logger(r.Context()).Debug("Received build request", "request", req, "context_files", len(files))
 
-	tmpl, err := template.New("dockerfile").Funcs(template.FuncMap{
-		"StringsJoin": strings.Join,
-	}).Parse(dockerfileTemplate)
+	build, err := prepareBuild(r.Context(), req, files, requesterOf(r))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeSpecError(w, err)
 		return
 	}
-
-	var dockerfile bytes.Buffer
-	err = tmpl.Execute(&dockerfile, req)
+	key, ok := claimIdempotencyKey(w, r, build)
+	if !ok {
+		return
+	}
+	result, deduplicated, err := submitBuild(r.Context(), build)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		releaseIdempotencyKey(r.Context(), key)
+		writeQuotaError(w, r, err)
 		return
 	}
+	recordIdempotentBuild(r.Context(), key, result.ID)
+	annotateRequest(r.Context(), slog.String("build_id", result.ID))
+
+	if deduplicated {
+		w.Header().Set("X-Deduplicated", "true")
+	}
+	writeSubmittedBuild(w, r, result)
+}
+
+// writeSubmittedBuild answers a build request with the build serving it:
+// 200 when the image already existed, 202 when it is being built.
+func writeSubmittedBuild(w http.ResponseWriter, r *http.Request, result Build) {
+	status := http.StatusAccepted
+	if result.Skipped {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPath(r, "/builds/"+result.ID))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(newBuildResponse(result))
+}
+
+// buildsHandler routes everything under /builds/.
+func buildsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/builds"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "" && r.Method == http.MethodPost:
+		buildAndPushDocker(w, r)
+	case len(parts) == 1 && parts[0] == "":
+		listBuilds(w, r, "")
+	case len(parts) == 1 && parts[0] != "" && r.Method == http.MethodDelete:
+		cancelBuild(w, r, parts[0])
+	case len(parts) == 1 && parts[0] != "":
+		getBuild(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "logs":
+		getBuildLogs(w, r, parts[0])
+	case len(parts) == 3 && parts[1] == "logs" && parts[2] == "stream":
+		streamBuildLogs(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "sbom":
+		getBuildSBOM(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "ws":
+		watchBuild(w, r, parts[0])
+	default:
+		httpError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// buildList is one page of GET /builds. NextCursor is empty on the last page.
+type buildList struct {
+	Builds     []buildResponse `json:"builds"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
 
-	fmt.Println("Generated Dockerfile:")
-	fmt.Println(dockerfile.String())
+// listBuilds serves GET /builds, newest first, those of project if it is
+// not empty and otherwise those the caller may see. Supported query parameters: status (comma separated),
+// airflow_version, python_version, requester, project, created_after and
+// created_before (RFC 3339), limit and cursor.
+func listBuilds(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	// Write Dockerfile
-	err = os.WriteFile("Dockerfile", dockerfile.Bytes(), 0644)
+	filter, err := parseBuildFilter(r.URL.Query())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	if project != "" {
+		filter.Project = project
+	}
+	if !projectAllowed(w, r, filter.Project) {
+		return
+	}
+	if filter.Project == "" {
+		// Without a project a caller sees the builds of the projects it is
+		// bound to and those of none.
+		if projects, all := boundProjects(r.Context()); !all {
+			filter.Projects = append(projects, "")
+		}
+	}
+	// Fetch one extra row to learn whether there is another page.
+	limit := filter.Limit
+	filter.Limit++
+	page, err := builds.store.listBuilds(filter)
+	if err != nil {
+		logger(r.Context()).Error("Listing builds", "error", err)
+		httpError(w, "Listing builds failed", http.StatusInternalServerError)
+		return
+	}
+
+	var result buildList
+	if len(page) > limit {
+		page = page[:limit]
+		last := page[limit-1]
+		result.NextCursor = encodeCursor(buildCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+	result.Builds = newBuildResponses(page)
 
-	// Generate tag from request parameters
-	tag := generateTag(req)
-	fmt.Printf("Generated tag: %s\n", tag)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func parseBuildFilter(q url.Values) (buildFilter, error) {
+	f := buildFilter{
+		AirflowVersion: q.Get("airflow_version"),
+		PythonVersion:  q.Get("python_version"),
+		Requester:      q.Get("requester"),
+		Project:        q.Get("project"),
+		Limit:          defaultListLimit,
+	}
+	if v := q.Get("status"); v != "" {
+		for _, st := range strings.Split(v, ",") {
+			status := BuildStatus(strings.TrimSpace(st))
+			switch status {
+			case StatusQueued, StatusBuilding, StatusPushing, StatusSucceeded, StatusFailed, StatusCancelled, StatusTimedOut:
+			default:
+				return f, fieldErrorf("status", codeEnum, "Unknown status %q", status)
+			}
+			f.Statuses = append(f.Statuses, status)
+		}
+	}
+	var err error
+	if f.CreatedAfter, err = timeParam(q, "created_after"); err != nil {
+		return f, err
+	}
+	if f.CreatedBefore, err = timeParam(q, "created_before"); err != nil {
+		return f, err
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			return f, fieldErrorf("limit", codeInvalid, "limit must be between 1 and %d", maxListLimit)
+		}
+		f.Limit = n
+	}
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			return f, fieldErrorf("cursor", codeInvalid, "Invalid cursor")
+		}
+		f.After = &c
+	}
+	return f, nil
+}
 
-	// Build Docker image
-	imageName := fmt.Sprintf("%s/%s:%s", REGISTRY_URL, IMAGE_NAME, tag)
-	buildCmd := exec.Command("docker", "build", "-t", imageName, ".")
-	buildOutput, err := buildCmd.CombinedOutput()
+func timeParam(q url.Values, name string) (*time.Time, error) {
+	v := q.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
 	if err != nil {
-		errMsg := fmt.Sprintf("Docker build failed: %s\n%s", err, buildOutput)
-		fmt.Println(errMsg)
-		http.Error(w, errMsg, http.StatusInternalServerError)
+		return nil, fieldErrorf(name, codeFormat, "%s must be an RFC 3339 timestamp", name)
+	}
+	return &t, nil
+}
+
+// Cursors are opaque to clients: the position of the last build returned.
+func encodeCursor(c buildCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID))
+}
+
+func decodeCursor(s string) (buildCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return buildCursor{}, err
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return buildCursor{}, errors.New("malformed cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return buildCursor{}, err
+	}
+	return buildCursor{CreatedAt: t, ID: parts[1]}, nil
+}
+
+func getBuild(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	build, ok := allowedBuild(w, r, id)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newBuildResponse(build))
+}
+
+func cancelBuild(w http.ResponseWriter, r *http.Request, id string) {
+	build, ok := allowedBuild(w, r, id)
+	if !ok {
+		return
+	}
+
+	if !builds.cancelBuild(id) {
+		build, _ = builds.get(id)
+		buildError(w, build, "Build already finished", http.StatusConflict)
+		return
+	}
+	logger(r.Context()).Info("Cancellation requested", "build_id", id)
+
+	build, _ = builds.get(id)
+	auditRequest(r, AuditEntry{Action: auditBuildCancel, BuildID: id, SpecHash: build.Tag, Image: build.Image})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(newBuildResponse(build))
+}
+
+// getBuildLogs serves the output of a build as plain text. tail=N returns
+// the last N lines; from and to select an inclusive, 1-based line range.
+// X-Total-Lines reports the full length either way.
+func getBuildLogs(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := allowedBuild(w, r, id); !ok {
+		return
+	}
+
+	var lines []string
+	if output, ok := builds.log(id); ok {
+		lines = output.linesSince(0)
+	} else {
+		stored, err := builds.store.getLogs(id)
+		if err == errBuildNotFound {
+			httpError(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logger(r.Context()).Error("Loading build logs", "build_id", id, "error", err)
+			httpError(w, "Loading logs failed", http.StatusInternalServerError)
+			return
+		}
+		lines = stored
+	}
+
+	q := r.URL.Query()
+	total := len(lines)
+	from, to := 1, total
+	var err error
+	if v := q.Get("tail"); v != "" {
+		n, convErr := strconv.Atoi(v)
+		if convErr != nil || n < 0 {
+			writeError(w, fieldErrorf("tail", codeMinimum, "tail must be a non-negative integer"))
+			return
+		}
+		if n < total {
+			from = total - n + 1
+		}
+	}
+	if from, err = lineParam(q, "from", from); err != nil {
+		writeError(w, err)
+		return
+	}
+	if to, err = lineParam(q, "to", to); err != nil {
+		writeError(w, err)
 		return
 	}
-	fmt.Printf("Docker build output:\n%s\n", buildOutput)
+	if to > total {
+		to = total
+	}
+	start := from - 1
+	if start > to {
+		start = to
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Total-Lines", strconv.Itoa(total))
+	for _, line := range lines[start:to] {
+		fmt.Fprintln(w, line)
+	}
+}
 
-	// Push Docker image
-	pushCmd := exec.Command("docker", "push", imageName)
-	pushOutput, err := pushCmd.CombinedOutput()
+func lineParam(q url.Values, name string, def int) (int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fieldErrorf(name, codeMinimum, "%s must be a positive line number", name)
+	}
+	return n, nil
+}
+
+// streamBuildLogs replays the build output so far and then follows it live as
+// Server-Sent Events. A final "end" event carries the terminal build status;
+// a finished build gets its stored output and the end event straight away.
+func streamBuildLogs(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := allowedBuild(w, r, id); !ok {
+		return
+	}
+
+	output, err := builds.replayLog(id)
+	if err == errBuildNotFound {
+		httpError(w, "Build not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		errMsg := fmt.Sprintf("Docker push failed: %s\n%s", err, pushOutput)
-		fmt.Println(errMsg)
-		http.Error(w, errMsg, http.StatusInternalServerError)
+		logger(r.Context()).Error("Loading build logs", "build_id", id, "error", err)
+		httpError(w, "Loading logs failed", http.StatusInternalServerError)
 		return
 	}
-	fmt.Printf("Docker push output:\n%s\n", pushOutput)
 
-	w.WriteHeader(http.StatusOK)
-	responseMsg := fmt.Sprintf("Docker image built and pushed successfully: %s", imageName)
-	fmt.Println(responseMsg)
-	io.WriteString(w, responseMsg+"\n")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	backlog, events := output.subscribe()
+	defer func() { output.unsubscribe(events) }()
+
+	for _, ev := range backlog {
+		if ev.Type == eventLog {
+			fmt.Fprintf(w, "data: %s\n\n", ev.Line)
+		}
+	}
+	flusher.Flush()
+	seen := len(backlog)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				// Either the build finished or this client fell behind and
+				// was dropped; catch up, and follow on unless it finished.
+				var missed []buildEvent
+				var open bool
+				missed, events, open = output.resubscribe(seen)
+				seen += len(missed)
+				for _, ev := range missed {
+					if ev.Type == eventLog {
+						fmt.Fprintf(w, "data: %s\n\n", ev.Line)
+					}
+				}
+				if !open {
+					build, _ := builds.get(id)
+					fmt.Fprintf(w, "event: end\ndata: %s\n\n", build.Status)
+					flusher.Flush()
+					return
+				}
+				flusher.Flush()
+				continue
+			}
+			seen++
+			if ev.Type == eventLog {
+				fmt.Fprintf(w, "data: %s\n\n", ev.Line)
+				flusher.Flush()
+			}
+		}
+	}
 }
 
 func main() {
-	http.HandleFunc("/build-and-push", buildAndPushDocker)
-	fmt.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
\ No newline at end of file
+	if CHECK_CONFIG {
+		slog.Info("Configuration is valid")
+		return
+	}
+	if err := initTracing(); err != nil {
+		log.Fatalf("Setting up tracing: %s", err)
+	}
+	if FACTORY_MODE == modeWorker {
+		runAgent()
+	}
+
+	store, err := openBuildStore()
+	if err != nil {
+		log.Fatalf("Opening build store: %s", err)
+	}
+	builds.store = store
+	builds.onFinish(sendWebhook)
+	builds.onFinish(sendNotifications)
+	builds.onFinish(recordFinished)
+	builds.onFinish(logFinished)
+	registry = newRegistryClient(REGISTRY_API_URL, registries[0].credentials)
+	if err := resumeBuilds(); err != nil {
+		log.Fatalf("Resuming builds: %s", err)
+	}
+
+	if FACTORY_MODE == modeStandalone {
+		workers.resize(MAX_CONCURRENT_BUILDS)
+	}
+	go reapLostJobs()
+	go runScheduler()
+	go runRetention(true)
+	if CONFIG_FILE != "" {
+		go watchConfig()
+	}
+	if GRPC_ADDR != "off" {
+		go serveGRPC()
+	}
+
+	http.HandleFunc("/docs", docsHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/internal/jobs/", internalJobsHandler)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/openapi.json", openAPIHandler)
+	http.HandleFunc("/ui/", uiHandler)
+	http.HandleFunc("/v1/builds", traced("/v1/builds", authorized(scopeBuilds, v1(rateLimited(validated(buildsHandler))))))
+	http.HandleFunc("/v1/builds/", traced("/v1/builds/", authorized(scopeBuilds, v1(rateLimited(validated(buildsHandler))))))
+	http.HandleFunc("/v1/images", traced("/v1/images", authorized(scopeImages, v1(rateLimited(validated(imagesHandler))))))
+	http.HandleFunc("/v1/images/", traced("/v1/images/", authorized(scopeImages, v1(rateLimited(validated(imagesHandler))))))
+	http.HandleFunc("/v1/schedules", traced("/v1/schedules", authorized(scopeSchedules, v1(rateLimited(validated(schedulesHandler))))))
+	http.HandleFunc("/v1/schedules/", traced("/v1/schedules/", authorized(scopeSchedules, v1(rateLimited(validated(schedulesHandler))))))
+	http.HandleFunc("/v1/templates", traced("/v1/templates", authorized(scopeTemplates, v1(rateLimited(validated(templatesHandler))))))
+	http.HandleFunc("/v1/templates/", traced("/v1/templates/", authorized(scopeTemplates, v1(rateLimited(validated(templatesHandler))))))
+	http.HandleFunc("/v1/projects", traced("/v1/projects", authorized(scopeProjects, v1(rateLimited(validated(projectsHandler))))))
+	http.HandleFunc("/v1/projects/", traced("/v1/projects/", authorized(scopeProjects, v1(rateLimited(validated(projectsHandler))))))
+	http.HandleFunc("/v1/api-keys", traced("/v1/api-keys", authorized(scopeAdmin, v1(rateLimited(validated(apiKeysHandler))))))
+	http.HandleFunc("/v1/api-keys/", traced("/v1/api-keys/", authorized(scopeAdmin, v1(rateLimited(validated(apiKeysHandler))))))
+	http.HandleFunc("/v1/audit", traced("/v1/audit", authorized(scopeAudit, v1(rateLimited(validated(auditHandler))))))
+
+	// The routes from before versioning.
+	http.HandleFunc("/build-and-push", traced("/build-and-push", authorized(scopeBuilds, legacy(rateLimited(validated(buildAndPushDocker))))))
+	http.HandleFunc("/builds", traced("/builds", authorized(scopeBuilds, legacy(rateLimited(validated(buildsHandler))))))
+	http.HandleFunc("/builds/", traced("/builds/", authorized(scopeBuilds, legacy(rateLimited(validated(buildsHandler))))))
+	http.HandleFunc("/images", traced("/images", authorized(scopeImages, legacy(rateLimited(validated(imagesHandler))))))
+	http.HandleFunc("/images/", traced("/images/", authorized(scopeImages, legacy(rateLimited(validated(imagesHandler))))))
+	http.HandleFunc("/schedules", traced("/schedules", authorized(scopeSchedules, legacy(rateLimited(validated(schedulesHandler))))))
+	http.HandleFunc("/schedules/", traced("/schedules/", authorized(scopeSchedules, legacy(rateLimited(validated(schedulesHandler))))))
+	http.HandleFunc("/templates", traced("/templates", authorized(scopeTemplates, legacy(rateLimited(validated(templatesHandler))))))
+	http.HandleFunc("/templates/", traced("/templates/", authorized(scopeTemplates, legacy(rateLimited(validated(templatesHandler))))))
+	log.Fatal(listen(serverTLS))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Build durations range from a cached no-op to an hour-long compile of
+// native wheels, hence the wide buckets.
+var durationBuckets = []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+var (
+	buildsStarted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "factory_builds_started_total",
+		Help: "Builds that started executing.",
+	})
+	buildsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "factory_builds_finished_total",
+		Help: "Builds that reached a terminal status, by status.",
+	}, []string{"status"})
+	buildsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "factory_builds_failed_total",
+		Help: "Builds that failed or timed out, by failure code.",
+	}, []string{"code"})
+	buildsSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "factory_builds_skipped_total",
+		Help: "Requests answered from an image already in the registry.",
+	})
+	queueDepth = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "factory_queue_depth",
+		Help: "Builds waiting for a worker.",
+	}, func() float64 { return float64(queue.len()) })
+	buildDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "factory_build_duration_seconds",
+		Help:    "Wall time of the docker build step of successful builds.",
+		Buckets: durationBuckets,
+	})
+	pushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "factory_push_duration_seconds",
+		Help:    "Wall time of the docker push step of successful builds.",
+		Buckets: durationBuckets,
+	})
+	totalDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "factory_total_duration_seconds",
+		Help:    "Time from a build starting to finishing, whatever the outcome.",
+		Buckets: durationBuckets,
+	})
+	rateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "factory_rate_limited_total",
+		Help: "Requests refused for exceeding RATE_LIMIT (requests) or BUILD_RATE_LIMIT (builds).",
+	}, []string{"limit"})
+	imageSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "factory_image_size_bytes",
+		Help: "Size of successfully built images.",
+		// 256MB to 8GB; Airflow images rarely fall outside that.
+		Buckets: prometheus.ExponentialBuckets(256<<20, 2, 6),
+	})
+)
+
+// recordFinished is a finish hook counting builds by outcome.
+func recordFinished(b Build) {
+	if b.Skipped {
+		buildsSkipped.Inc()
+	}
+	buildsFinished.WithLabelValues(string(b.Status)).Inc()
+	if b.ErrorCode != "" {
+		buildsFailed.WithLabelValues(b.ErrorCode).Inc()
+	}
+	if b.StartedAt != nil {
+		totalDuration.Observe(b.Duration)
+	}
+}
+
+// recordOutcome observes the per-step measurements of an executed build.
+func recordOutcome(outcome buildOutcome) {
+	if outcome.Status != StatusSucceeded {
+		return
+	}
+	buildDuration.Observe(outcome.BuildSeconds)
+	pushDuration.Observe(outcome.PushSeconds)
+	if outcome.ImageSize > 0 {
+		imageSize.Observe(float64(outcome.ImageSize))
+	}
+}
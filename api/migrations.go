@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// migration is one forward-only schema change. Most statements are portable,
+// but column types differ enough between SQLite and Postgres that each
+// dialect gets its own SQL.
+type migration struct {
+	version  int
+	name     string
+	sqlite   string
+	postgres string
+}
+
+// migrations must only ever be appended to; applied versions are recorded in
+// schema_migrations and skipped on later startups.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create builds",
+		sqlite: `
+CREATE TABLE IF NOT EXISTS builds (
+	id          TEXT PRIMARY KEY,
+	status      TEXT NOT NULL,
+	tag         TEXT NOT NULL,
+	image       TEXT NOT NULL,
+	error       TEXT NOT NULL DEFAULT '',
+	request     TEXT NOT NULL,
+	dockerfile  TEXT NOT NULL,
+	logs        TEXT NOT NULL DEFAULT '',
+	created_at  TIMESTAMP NOT NULL,
+	started_at  TIMESTAMP,
+	finished_at TIMESTAMP,
+	duration_ms INTEGER
+);
+CREATE INDEX IF NOT EXISTS builds_created_at ON builds (created_at);
+`,
+		postgres: `
+CREATE TABLE IF NOT EXISTS builds (
+	id          TEXT PRIMARY KEY,
+	status      TEXT NOT NULL,
+	tag         TEXT NOT NULL,
+	image       TEXT NOT NULL,
+	error       TEXT NOT NULL DEFAULT '',
+	request     JSONB NOT NULL,
+	dockerfile  TEXT NOT NULL,
+	logs        TEXT NOT NULL DEFAULT '',
+	created_at  TIMESTAMPTZ NOT NULL,
+	started_at  TIMESTAMPTZ,
+	finished_at TIMESTAMPTZ,
+	duration_ms BIGINT
+);
+CREATE INDEX IF NOT EXISTS builds_created_at ON builds (created_at);
+`,
+	},
+	{
+		version:  2,
+		name:     "add builds.skipped",
+		sqlite:   `ALTER TABLE builds ADD COLUMN skipped BOOLEAN NOT NULL DEFAULT 0`,
+		postgres: `ALTER TABLE builds ADD COLUMN skipped BOOLEAN NOT NULL DEFAULT FALSE`,
+	},
+	{
+		version: 3,
+		name:    "add builds.instance_id",
+		sqlite: `
+ALTER TABLE builds ADD COLUMN instance_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS builds_instance_status ON builds (instance_id, status);
+`,
+		postgres: `
+ALTER TABLE builds ADD COLUMN instance_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS builds_instance_status ON builds (instance_id, status);
+`,
+	},
+	{
+		version: 4,
+		name:    "create schedules",
+		sqlite: `
+CREATE TABLE schedules (
+	id            TEXT PRIMARY KEY,
+	name          TEXT NOT NULL,
+	cron          TEXT NOT NULL,
+	spec          TEXT NOT NULL,
+	enabled       BOOLEAN NOT NULL,
+	next_run_at   TIMESTAMP NOT NULL,
+	last_run_at   TIMESTAMP,
+	last_build_id TEXT NOT NULL DEFAULT '',
+	created_at    TIMESTAMP NOT NULL
+);
+ALTER TABLE builds ADD COLUMN schedule_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX builds_schedule_id ON builds (schedule_id, created_at);
+`,
+		postgres: `
+CREATE TABLE schedules (
+	id            TEXT PRIMARY KEY,
+	name          TEXT NOT NULL,
+	cron          TEXT NOT NULL,
+	spec          JSONB NOT NULL,
+	enabled       BOOLEAN NOT NULL,
+	next_run_at   TIMESTAMPTZ NOT NULL,
+	last_run_at   TIMESTAMPTZ,
+	last_build_id TEXT NOT NULL DEFAULT '',
+	created_at    TIMESTAMPTZ NOT NULL
+);
+ALTER TABLE builds ADD COLUMN schedule_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX builds_schedule_id ON builds (schedule_id, created_at);
+`,
+	},
+	{
+		version:  5,
+		name:     "add builds.digest",
+		sqlite:   `ALTER TABLE builds ADD COLUMN digest TEXT NOT NULL DEFAULT ''`,
+		postgres: `ALTER TABLE builds ADD COLUMN digest TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		// The versions are copied out of the request so listings can filter
+		// on them without decoding JSON per row.
+		version: 6,
+		name:    "add builds listing columns",
+		sqlite: `
+ALTER TABLE builds ADD COLUMN airflow_version TEXT NOT NULL DEFAULT '';
+ALTER TABLE builds ADD COLUMN python_version TEXT NOT NULL DEFAULT '';
+ALTER TABLE builds ADD COLUMN requester TEXT NOT NULL DEFAULT '';
+UPDATE builds SET
+	airflow_version = COALESCE(json_extract(request, '$.airflow_version'), ''),
+	python_version = COALESCE(json_extract(request, '$.python_version'), '');
+CREATE INDEX builds_status_created_at ON builds (status, created_at);
+`,
+		postgres: `
+ALTER TABLE builds ADD COLUMN airflow_version TEXT NOT NULL DEFAULT '';
+ALTER TABLE builds ADD COLUMN python_version TEXT NOT NULL DEFAULT '';
+ALTER TABLE builds ADD COLUMN requester TEXT NOT NULL DEFAULT '';
+UPDATE builds SET
+	airflow_version = COALESCE(request->>'airflow_version', ''),
+	python_version = COALESCE(request->>'python_version', '');
+CREATE INDEX builds_status_created_at ON builds (status, created_at);
+`,
+	},
+	{
+		// Full output, one row per line, replacing the truncated builds.logs
+		// column. Older builds keep their tail in builds.logs.
+		version: 7,
+		name:    "create build_logs",
+		sqlite: `
+CREATE TABLE build_logs (
+	build_id TEXT NOT NULL,
+	line_no  INTEGER NOT NULL,
+	line     TEXT NOT NULL,
+	PRIMARY KEY (build_id, line_no)
+);
+`,
+		postgres: `
+CREATE TABLE build_logs (
+	build_id TEXT NOT NULL,
+	line_no  INTEGER NOT NULL,
+	line     TEXT NOT NULL,
+	PRIMARY KEY (build_id, line_no)
+);
+`,
+	},
+	{
+		version: 8,
+		name:    "create templates",
+		sqlite: `
+CREATE TABLE templates (
+	name        TEXT PRIMARY KEY,
+	description TEXT NOT NULL DEFAULT '',
+	body        TEXT NOT NULL,
+	created_at  TIMESTAMP NOT NULL,
+	updated_at  TIMESTAMP NOT NULL
+);
+`,
+		postgres: `
+CREATE TABLE templates (
+	name        TEXT PRIMARY KEY,
+	description TEXT NOT NULL DEFAULT '',
+	body        TEXT NOT NULL,
+	created_at  TIMESTAMPTZ NOT NULL,
+	updated_at  TIMESTAMPTZ NOT NULL
+);
+`,
+	},
+	{
+		version: 9,
+		name:    "create build_files",
+		sqlite: `
+CREATE TABLE build_files (
+	build_id TEXT NOT NULL,
+	path     TEXT NOT NULL,
+	content  BLOB NOT NULL,
+	PRIMARY KEY (build_id, path)
+);
+`,
+		postgres: `
+CREATE TABLE build_files (
+	build_id TEXT NOT NULL,
+	path     TEXT NOT NULL,
+	content  BYTEA NOT NULL,
+	PRIMARY KEY (build_id, path)
+);
+`,
+	},
+	{
+		version:  10,
+		name:     "add builds.pushes",
+		sqlite:   `ALTER TABLE builds ADD COLUMN pushes TEXT NOT NULL DEFAULT ''`,
+		postgres: `ALTER TABLE builds ADD COLUMN pushes TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		version:  11,
+		name:     "add builds.size_bytes",
+		sqlite:   `ALTER TABLE builds ADD COLUMN size_bytes INTEGER NOT NULL DEFAULT 0`,
+		postgres: `ALTER TABLE builds ADD COLUMN size_bytes BIGINT NOT NULL DEFAULT 0`,
+	},
+	{
+		version:  12,
+		name:     "add builds.tags",
+		sqlite:   `ALTER TABLE builds ADD COLUMN tags TEXT NOT NULL DEFAULT ''`,
+		postgres: `ALTER TABLE builds ADD COLUMN tags TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		version:  13,
+		name:     "add builds.deleted_at",
+		sqlite:   `ALTER TABLE builds ADD COLUMN deleted_at DATETIME`,
+		postgres: `ALTER TABLE builds ADD COLUMN deleted_at TIMESTAMPTZ`,
+	},
+	{
+		version: 14,
+		name:    "create sboms",
+		sqlite: `
+CREATE TABLE sboms (
+	tag      TEXT PRIMARY KEY,
+	build_id TEXT NOT NULL,
+	format   TEXT NOT NULL,
+	content  BLOB NOT NULL
+);
+`,
+		postgres: `
+CREATE TABLE sboms (
+	tag      TEXT PRIMARY KEY,
+	build_id TEXT NOT NULL,
+	format   TEXT NOT NULL,
+	content  BYTEA NOT NULL
+);
+`,
+	},
+	{
+		version:  15,
+		name:     "add builds.vulnerabilities",
+		sqlite:   `ALTER TABLE builds ADD COLUMN vulnerabilities TEXT NOT NULL DEFAULT ''`,
+		postgres: `ALTER TABLE builds ADD COLUMN vulnerabilities TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		version: 16,
+		name:    "create api_keys",
+		sqlite: `
+CREATE TABLE api_keys (
+	name       TEXT PRIMARY KEY,
+	key_hash   TEXT NOT NULL UNIQUE,
+	scopes     TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+`,
+		postgres: `
+CREATE TABLE api_keys (
+	name       TEXT PRIMARY KEY,
+	key_hash   TEXT NOT NULL UNIQUE,
+	scopes     TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+`,
+	},
+	{
+		version: 17,
+		name:    "create audit_log",
+		sqlite: `
+CREATE TABLE audit_log (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	time       TIMESTAMP NOT NULL,
+	actor      TEXT NOT NULL,
+	action     TEXT NOT NULL,
+	build_id   TEXT NOT NULL DEFAULT '',
+	spec_hash  TEXT NOT NULL DEFAULT '',
+	image      TEXT NOT NULL DEFAULT '',
+	digest     TEXT NOT NULL DEFAULT '',
+	target     TEXT NOT NULL DEFAULT '',
+	outcome    TEXT NOT NULL DEFAULT '',
+	request_id TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX audit_log_action ON audit_log (action, id);
+CREATE INDEX audit_log_actor ON audit_log (actor, id);
+`,
+		postgres: `
+CREATE TABLE audit_log (
+	id         BIGSERIAL PRIMARY KEY,
+	time       TIMESTAMPTZ NOT NULL,
+	actor      TEXT NOT NULL,
+	action     TEXT NOT NULL,
+	build_id   TEXT NOT NULL DEFAULT '',
+	spec_hash  TEXT NOT NULL DEFAULT '',
+	image      TEXT NOT NULL DEFAULT '',
+	digest     TEXT NOT NULL DEFAULT '',
+	target     TEXT NOT NULL DEFAULT '',
+	outcome    TEXT NOT NULL DEFAULT '',
+	request_id TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX audit_log_action ON audit_log (action, id);
+CREATE INDEX audit_log_actor ON audit_log (actor, id);
+`,
+	},
+	{
+		version: 18,
+		name:    "create idempotency_keys",
+		sqlite: `
+CREATE TABLE idempotency_keys (
+	scope           TEXT NOT NULL,
+	idempotency_key TEXT NOT NULL,
+	spec_hash       TEXT NOT NULL,
+	build_id        TEXT NOT NULL DEFAULT '',
+	created_at      TIMESTAMP NOT NULL,
+	PRIMARY KEY (scope, idempotency_key)
+);
+CREATE INDEX idempotency_keys_created_at ON idempotency_keys (created_at);
+`,
+		postgres: `
+CREATE TABLE idempotency_keys (
+	scope           TEXT NOT NULL,
+	idempotency_key TEXT NOT NULL,
+	spec_hash       TEXT NOT NULL,
+	build_id        TEXT NOT NULL DEFAULT '',
+	created_at      TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (scope, idempotency_key)
+);
+CREATE INDEX idempotency_keys_created_at ON idempotency_keys (created_at);
+`,
+	},
+	{
+		version:  19,
+		name:     "add builds.error_code",
+		sqlite:   `ALTER TABLE builds ADD COLUMN error_code TEXT NOT NULL DEFAULT ''`,
+		postgres: `ALTER TABLE builds ADD COLUMN error_code TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		version: 20,
+		name:    "create projects",
+		sqlite: `
+CREATE TABLE projects (
+	name               TEXT PRIMARY KEY,
+	description        TEXT NOT NULL DEFAULT '',
+	image_name         TEXT NOT NULL,
+	registry           TEXT NOT NULL DEFAULT '',
+	templates          TEXT NOT NULL DEFAULT '',
+	max_active_builds  INTEGER NOT NULL DEFAULT 0,
+	max_builds_per_day INTEGER NOT NULL DEFAULT 0,
+	created_at         TIMESTAMP NOT NULL,
+	updated_at         TIMESTAMP NOT NULL
+);
+ALTER TABLE builds ADD COLUMN project TEXT NOT NULL DEFAULT '';
+CREATE INDEX builds_project_created_at ON builds (project, created_at);
+`,
+		postgres: `
+CREATE TABLE projects (
+	name               TEXT PRIMARY KEY,
+	description        TEXT NOT NULL DEFAULT '',
+	image_name         TEXT NOT NULL,
+	registry           TEXT NOT NULL DEFAULT '',
+	templates          TEXT NOT NULL DEFAULT '',
+	max_active_builds  INTEGER NOT NULL DEFAULT 0,
+	max_builds_per_day INTEGER NOT NULL DEFAULT 0,
+	created_at         TIMESTAMPTZ NOT NULL,
+	updated_at         TIMESTAMPTZ NOT NULL
+);
+ALTER TABLE builds ADD COLUMN project TEXT NOT NULL DEFAULT '';
+CREATE INDEX builds_project_created_at ON builds (project, created_at);
+`,
+	},
+}
+
+// migrate brings the schema up to date. On Postgres an advisory lock keeps
+// replicas that start at the same time from racing each other.
+func migrate(db *sql.DB, dialect string) error {
+	if dialect == dialectPostgres {
+		// Hold one connection for the lock's lifetime; advisory locks are
+		// per session.
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_lock(7202024)`); err != nil {
+			return fmt.Errorf("acquiring migration lock: %w", err)
+		}
+		defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(7202024)`)
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       TEXT NOT NULL,
+	applied_at TIMESTAMP NOT NULL
+)`); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	applied := make(map[int]bool)
+	rows, err := db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[v] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		stmt := m.sqlite
+		if dialect == dialectPostgres {
+			stmt = m.postgres
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(rebind(dialect, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`),
+			m.version, m.name, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		slog.Info("Applied migration", "version", m.version, "name", m.name)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// nerdctlBuilder builds and pushes job with nerdctl, for hosts running
+// containerd and buildkitd without dockerd. nerdctl mirrors the docker CLI,
+// so buildFlags applies unchanged; it finds containerd through its own
+// CONTAINERD_ADDRESS and CONTAINERD_NAMESPACE settings. Multi-platform
+// builds are left to buildx.
+type nerdctlBuilder struct {
+	job          *buildJob
+	workspace    string
+	output       *buildLog
+	dockerConfig string
+}
+
+func newNerdctlBuilder(job *buildJob, workspace string, output *buildLog) (builder, error) {
+	if len(job.Platforms) > 0 {
+		return nil, errors.New("Multi-platform builds are not supported by the nerdctl build backend")
+	}
+	// As with kaniko, registry credentials stay out of the build context.
+	dockerConfig, err := os.MkdirTemp("", "nerdctl-auth-")
+	if err != nil {
+		return nil, fmt.Errorf("Creating registry config: %w", err)
+	}
+	if err := writeRegistryConfig(dockerConfig); err != nil {
+		os.RemoveAll(dockerConfig)
+		return nil, fmt.Errorf("Writing registry config: %w", err)
+	}
+	return &nerdctlBuilder{job: job, workspace: workspace, output: output, dockerConfig: dockerConfig}, nil
+}
+
+func (b *nerdctlBuilder) Name() string    { return "nerdctl" }
+func (b *nerdctlBuilder) Logs() *buildLog { return b.output }
+func (b *nerdctlBuilder) Cancel()         { os.RemoveAll(b.dockerConfig) }
+
+func (b *nerdctlBuilder) command(ctx context.Context, args ...string) *exec.Cmd {
+	if registryCertDir != "" {
+		// nerdctl itself pushes; buildkitd pulls with its own settings.
+		args = append([]string{"--hosts-dir", filepath.Join(registryCertDir, "hosts"), "--hosts-dir", "/etc/containerd/certs.d", "--hosts-dir", "/etc/docker/certs.d"}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "nerdctl", args...)
+	cmd.Env = append(os.Environ(), "DOCKER_CONFIG="+b.dockerConfig)
+	return cmd
+}
+
+func (b *nerdctlBuilder) Build(ctx context.Context) error {
+	args := append([]string{"build", "-t", b.job.Image, "--progress=plain"}, buildFlags(b.job)...)
+	args = append(args, registryCacheFlags()...)
+	args = append(args, b.workspace)
+	return runLogged(b.command(ctx, args...), b.output)
+}
+
+func (b *nerdctlBuilder) ImageSize(ctx context.Context) int64 {
+	out, err := b.command(ctx, "image", "inspect", "--format", "{{.Size}}", b.job.Image).Output()
+	if err != nil {
+		slog.Warn("Inspecting image", "build_id", b.job.BuildID, "image", b.job.Image, "error", err)
+		return 0
+	}
+	size, _ := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	return size
+}
+
+func (b *nerdctlBuilder) Push(ctx context.Context) (string, error) {
+	return b.push(ctx, b.job.Image)
+}
+
+func (b *nerdctlBuilder) PushAs(ctx context.Context, image string) (string, error) {
+	if err := runLogged(b.command(ctx, "tag", b.job.Image, image), b.output); err != nil {
+		return "", err
+	}
+	return b.push(ctx, image)
+}
+
+func (b *nerdctlBuilder) ExportImage(ctx context.Context, path string) error {
+	return runLogged(b.command(ctx, "save", "-o", path, b.job.Image), b.output)
+}
+
+// push pushes image, a name of the built image, returning its digest.
+func (b *nerdctlBuilder) push(ctx context.Context, image string) (string, error) {
+	// Renew the credentials, which a cloud registry may have expired
+	// during a long build.
+	if err := writeRegistryConfig(b.dockerConfig); err != nil {
+		return "", fmt.Errorf("Writing registry config: %w", err)
+	}
+	args := []string{"push", image}
+	if plainHTTP(image) || insecureRegistry(image) {
+		args = append([]string{"--insecure-registry"}, args...)
+	}
+	if err := runLogged(b.command(ctx, args...), b.output); err != nil {
+		return "", err
+	}
+	// The pushed manifest is the one containerd holds for the tag.
+	digest, err := b.command(ctx, "image", "inspect", "--mode=native", "--format", "{{.Image.Target.Digest}}", image).Output()
+	if err != nil {
+		slog.Warn("Reading nerdctl digest", "build_id", b.job.BuildID, "error", err)
+	}
+	return strings.TrimSpace(string(digest)), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// NotifySettings is the per-build opt-in to human-facing notifications.
+type NotifySettings struct {
+	Slack   bool     `json:"slack,omitempty"`
+	Email   bool     `json:"email,omitempty"`    // mail NOTIFY_EMAIL_TO
+	EmailTo []string `json:"email_to,omitempty"` // extra recipients; implies email
+}
+
+func (n *NotifySettings) emailRecipients() []string {
+	if !n.Email && len(n.EmailTo) == 0 {
+		return nil
+	}
+	return append(append([]string(nil), notifyEmailTo()...), n.EmailTo...)
+}
+
+func validateNotify(n *NotifySettings) error {
+	if n == nil {
+		return nil
+	}
+	if n.Slack && slackWebhookURL() == "" {
+		return fieldErrorf("notify.slack", codeInvalid, "notify.slack requested but no Slack webhook is configured")
+	}
+	for _, addr := range n.EmailTo {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return fieldErrorf("notify.email_to", codeFormat, "notify.email_to: invalid address %q", addr)
+		}
+	}
+	if n.Email || len(n.EmailTo) > 0 {
+		if SMTP_HOST == "" {
+			return fieldErrorf("notify.email", codeInvalid, "notify.email requested but no SMTP server is configured")
+		}
+		if len(n.emailRecipients()) == 0 {
+			return fieldErrorf("notify.email", codeInvalid, "notify.email requested but no recipients: set notify.email_to or NOTIFY_EMAIL_TO")
+		}
+	}
+	return nil
+}
+
+// buildSummary is the human-readable body shared by all notifiers.
+func buildSummary(b Build) (subject, body string) {
+	req := b.Request
+	outcome := strings.ToUpper(string(b.Status))
+	subject = fmt.Sprintf("[airflow-image-factory] Build %s: Airflow %s / Python %s", outcome, req.AirflowVersion, req.PythonVersion)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Build %s %s", b.ID, b.Status)
+	if b.Skipped {
+		sb.WriteString(" (image already existed)")
+	}
+	sb.WriteString("\n")
+	fmt.Fprintf(&sb, "Image: %s\n", b.Image)
+	if b.Digest != "" {
+		fmt.Fprintf(&sb, "Digest: %s\n", b.Digest)
+	}
+	fmt.Fprintf(&sb, "Airflow %s, Python %s\n", req.AirflowVersion, req.PythonVersion)
+	if len(req.Extras) > 0 {
+		fmt.Fprintf(&sb, "Extras: %s\n", strings.Join(req.Extras, ", "))
+	}
+	if len(req.AptDeps) > 0 {
+		fmt.Fprintf(&sb, "Apt packages: %s\n", strings.Join(req.AptDeps, ", "))
+	}
+	if len(req.PipDeps) > 0 {
+		fmt.Fprintf(&sb, "Pip packages: %s\n", strings.Join(req.PipDeps, ", "))
+	}
+	if b.Duration > 0 {
+		fmt.Fprintf(&sb, "Duration: %s\n", (time.Duration(b.Duration * float64(time.Second))).Round(time.Second))
+	}
+	if b.Error != "" {
+		// The first line carries the failing step; the rest is log tail.
+		fmt.Fprintf(&sb, "Error: %s\n", strings.SplitN(b.Error, "\n", 2)[0])
+		if b.ErrorCode != "" {
+			fmt.Fprintf(&sb, "Cause: %s\n", b.ErrorCode)
+		}
+	}
+	return subject, sb.String()
+}
+
+// sendNotifications is a finish hook delivering Slack and email
+// notifications for builds that opted in.
+func sendNotifications(b Build) {
+	n := b.Request.Notify
+	if n == nil {
+		return
+	}
+	subject, body := buildSummary(b)
+	if n.Slack {
+		if err := notifySlack(b, subject, body); err != nil {
+			slog.Warn("Slack notification failed", "build_id", b.ID, "error", err)
+		}
+	}
+	if to := n.emailRecipients(); len(to) > 0 {
+		if err := notifyEmail(to, subject, body); err != nil {
+			slog.Warn("Email notification failed", "build_id", b.ID, "error", err)
+		}
+	}
+}
+
+func notifySlack(b Build, subject, body string) error {
+	icon := ":white_check_mark:"
+	if b.Status != StatusSucceeded {
+		icon = ":x:"
+	}
+	payload, err := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("%s *%s*\n```%s```", icon, subject, body),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(slackWebhookURL(), "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack answered %s", resp.Status)
+	}
+	return nil
+}
+
+func notifyEmail(to []string, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", SMTP_FROM)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if SMTP_USERNAME != "" {
+		auth = smtp.PlainAuth("", SMTP_USERNAME, SMTP_PASSWORD, SMTP_HOST)
+	}
+	addr := net.JoinHostPort(SMTP_HOST, SMTP_PORT)
+	return smtp.SendMail(addr, auth, SMTP_FROM, to, msg.Bytes())
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseGroupRoles reads OIDC_GROUP_ROLES, comma-separated group=role pairs
+// such as "platform=admin,data-eng=builder,team-a=project:team-a".
+func parseGroupRoles(s string) (map[string]string, error) {
+	groupRoles := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q is not group=role", pair)
+		}
+		group, role := pair[:i], pair[i+1:]
+		if _, ok := roles[role]; !ok && !isProjectScope(role) {
+			return nil, fmt.Errorf("unknown role %q (want viewer, builder, promoter, admin or project:<name>)", role)
+		}
+		groupRoles[group] = role
+	}
+	if len(groupRoles) == 0 {
+		return nil, fmt.Errorf("no group is given a role")
+	}
+	return groupRoles, nil
+}
+
+// clockSkew is how far the token times may disagree with our clock.
+const clockSkew = time.Minute
+
+// jwksRefreshInterval bounds how long signing keys are cached, and
+// jwksMinRefresh how often an unknown key ID may trigger a fetch, so that
+// rotated keys are picked up without a flood of tokens hammering the
+// provider.
+const (
+	jwksRefreshInterval = time.Hour
+	jwksMinRefresh      = time.Minute
+)
+
+// oidcVerifier verifies JWTs issued by the SSO provider at OIDC_ISSUER_URL
+// against the signing keys it publishes, and maps the groups they carry
+// to roles.
+type oidcVerifier struct {
+	issuer        string
+	audience      string
+	jwksURL       string // from discovery when empty
+	usernameClaim string
+	groupsClaim   string
+	groupRoles    map[string]string
+	http          *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey // by key ID
+	fetched  time.Time
+	fetchErr error
+}
+
+// oidc is nil unless OIDC_ISSUER_URL is set.
+var oidc *oidcVerifier
+
+func oidcEnabled() bool {
+	return oidc != nil
+}
+
+func newOIDCVerifier(issuer, audience, jwksURL, usernameClaim, groupsClaim string, groupRoles map[string]string) *oidcVerifier {
+	return &oidcVerifier{
+		issuer:        strings.TrimSuffix(issuer, "/"),
+		audience:      audience,
+		jwksURL:       jwksURL,
+		usernameClaim: usernameClaim,
+		groupsClaim:   groupsClaim,
+		groupRoles:    groupRoles,
+		http:          &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// authenticate verifies token and returns the person it names, with the
+// roles of their groups.
+func (v *oidcVerifier) authenticate(token string) (principal, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return principal{}, fmt.Errorf("%w: malformed token header", errInvalidCredentials)
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return principal{}, fmt.Errorf("%w: malformed token claims", errInvalidCredentials)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return principal{}, fmt.Errorf("%w: malformed token signature", errInvalidCredentials)
+	}
+
+	keys, err := v.signingKeys(header.Kid)
+	if err != nil {
+		return principal{}, err
+	}
+	verified := false
+	for _, key := range keys {
+		if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err == nil {
+			verified = true
+			break
+		} else if err == errUnsupportedAlg {
+			return principal{}, fmt.Errorf("%w: unsupported signing algorithm %q", errInvalidCredentials, header.Alg)
+		}
+	}
+	if !verified {
+		return principal{}, fmt.Errorf("%w: bad token signature", errInvalidCredentials)
+	}
+
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return principal{}, err
+	}
+	name, _ := claims[v.usernameClaim].(string)
+	if name == "" {
+		name, _ = claims["sub"].(string)
+	}
+	p := principal{Name: name, Method: authOIDC}
+	seen := make(map[string]bool)
+	for _, group := range claimStrings(lookupClaim(claims, v.groupsClaim)) {
+		if role, ok := v.groupRoles[group]; ok && !seen[role] {
+			seen[role] = true
+			p.Scopes = append(p.Scopes, role)
+		}
+	}
+	return p, nil
+}
+
+// checkClaims checks that the token is ours and current.
+func (v *oidcVerifier) checkClaims(claims map[string]interface{}, now time.Time) error {
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.issuer {
+		return fmt.Errorf("%w: token is from another issuer", errInvalidCredentials)
+	}
+	audienceOK := false
+	for _, aud := range claimStrings(claims["aud"]) {
+		if aud == v.audience {
+			audienceOK = true
+		}
+	}
+	if !audienceOK {
+		return fmt.Errorf("%w: token is for another audience", errInvalidCredentials)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: token has no expiry", errInvalidCredentials)
+	}
+	if now.Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("%w: token expired", errInvalidCredentials)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: token not valid yet", errInvalidCredentials)
+	}
+	return nil
+}
+
+// lookupClaim finds a claim by a dotted path, for providers that nest
+// groups, such as Keycloak's "realm_access.roles".
+func lookupClaim(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// claimStrings reads a claim that is a string or an array of them.
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var result []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// signingKeys returns the key with ID kid, or every key when the token
+// names none, fetching them again when they are stale or kid is new.
+func (v *oidcVerifier) signingKeys(kid string) ([]crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	_, known := v.keys[kid]
+	since := time.Since(v.fetched)
+	if since > jwksRefreshInterval || (since > jwksMinRefresh && (v.keys == nil || kid != "" && !known)) {
+		// Failed fetches count too, so an unreachable provider is not
+		// asked again for every request.
+		v.fetched = time.Now()
+		keys, err := v.fetchKeys()
+		v.fetchErr = err
+		if err != nil {
+			slog.Error("Fetching OIDC signing keys", "error", err)
+		} else {
+			v.keys = keys
+		}
+	}
+	if v.keys == nil {
+		return nil, fmt.Errorf("fetching signing keys from %s: %w", v.issuer, v.fetchErr)
+	}
+
+	if kid != "" {
+		if key, ok := v.keys[kid]; ok {
+			return []crypto.PublicKey{key}, nil
+		}
+		return nil, fmt.Errorf("%w: token signed with unknown key %q", errInvalidCredentials, kid)
+	}
+	ids := make([]string, 0, len(v.keys))
+	for id := range v.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	keys := make([]crypto.PublicKey, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, v.keys[id])
+	}
+	return keys, nil
+}
+
+// fetchKeys reads the provider's JWKS, found through its discovery
+// document unless OIDC_JWKS_URL names it.
+func (v *oidcVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	jwksURL := v.jwksURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("discovery document has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := v.getJSON(jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				return nil, fmt.Errorf("key %q: malformed RSA key", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("key %q: malformed EC key", k.Kid)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no signing keys", jwksURL)
+	}
+	return keys, nil
+}
+
+func (v *oidcVerifier) getJSON(url string, out interface{}) error {
+	resp, err := v.http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+var errUnsupportedAlg = fmt.Errorf("unsupported signing algorithm")
+
+// verifyJWTSignature checks a JWS signature over signed with key, for the
+// RSA and ECDSA algorithms SSO providers sign with.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return errUnsupportedAlg
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return errUnsupportedAlg
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an RSA key", alg)
+		}
+		return rsa.VerifyPSS(pub, hash, digest, signature, nil)
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an EC key", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("bad ECDSA signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("ECDSA verification failed")
+		}
+		return nil
+	}
+	return errUnsupportedAlg
+}
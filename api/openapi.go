@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// openAPIDocument describes every public route. It is the contract client
+// SDKs are generated from, so requests are checked against it before they
+// reach a handler: a change to a request type goes in both places.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// openAPI is openAPIDocument parsed, and openAPIRoutes its paths, most
+// specific first.
+var (
+	openAPI       = mustParseOpenAPI(openAPIDocument)
+	openAPIRoutes = newOpenAPIRoutes(openAPI)
+)
+
+func mustParseOpenAPI(data []byte) map[string]interface{} {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		panic("openapi.json: " + err.Error())
+	}
+	return doc
+}
+
+// openAPIRoute is a path template of the spec, split on "/", where a
+// "{name}" segment matches any one segment.
+type openAPIRoute struct {
+	segments []string
+	item     map[string]interface{}
+}
+
+func newOpenAPIRoutes(doc map[string]interface{}) []openAPIRoute {
+	paths, _ := doc["paths"].(map[string]interface{})
+	var routes []openAPIRoute
+	for path, item := range paths {
+		routes = append(routes, openAPIRoute{strings.Split(strings.Trim(path, "/"), "/"), item.(map[string]interface{})})
+	}
+	// A literal segment wins over a parameter in the same place.
+	sort.Slice(routes, func(i, j int) bool {
+		return literalSegments(routes[i].segments) > literalSegments(routes[j].segments)
+	})
+	return routes
+}
+
+func literalSegments(segments []string) int {
+	n := 0
+	for _, s := range segments {
+		if !strings.HasPrefix(s, "{") {
+			n++
+		}
+	}
+	return n
+}
+
+// match returns the path parameters of path, or false if the route does
+// not match it.
+func (route openAPIRoute) match(path string) (map[string]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) != len(route.segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, s := range route.segments {
+		if strings.HasPrefix(s, "{") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[strings.Trim(s, "{}")] = segments[i]
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// openAPIHandler serves the spec.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+var swaggerUIPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Airflow Image Factory API</title>
+  <link rel="stylesheet" href="{{.}}/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="{{.}}/swagger-ui-bundle.js"></script>
+  <script>
+    SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`))
+
+// docsHandler serves Swagger UI for the spec, its assets loaded from
+// SWAGGER_UI_URL.
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	swaggerUIPage.Execute(w, SWAGGER_UI_URL)
+}
+
+// validated checks a request against the operation the spec declares for
+// it, its query and path parameters and its JSON body, and answers 400
+// listing every field at fault instead of calling handler. Requests the spec does
+// not describe, and multipart bodies, are left to the handler.
+func validated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var problems []fieldError
+		spec := false
+		for _, route := range openAPIRoutes {
+			params, ok := route.match(r.URL.Path)
+			if !ok {
+				continue
+			}
+			op, ok := route.item[strings.ToLower(r.Method)].(map[string]interface{})
+			if !ok {
+				break
+			}
+			problems = checkParameters(r, params, route.item, op)
+			bodyProblems := checkBody(w, r, op)
+			problems = append(problems, bodyProblems...)
+			spec = len(bodyProblems) > 0 && isBuildRequestBody(op)
+			break
+		}
+		if err := invalidFields(problems); err != nil {
+			if spec {
+				writeSpecError(w, err)
+				return
+			}
+			writeError(w, err)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// isBuildRequestBody reports whether op takes a build spec as its body,
+// whose problems are coded INVALID_SPEC.
+func isBuildRequestBody(op map[string]interface{}) bool {
+	body, _ := op["requestBody"].(map[string]interface{})
+	ref, _ := body["$ref"].(string)
+	return ref == "#/components/requestBodies/BuildRequest"
+}
+
+func checkParameters(r *http.Request, pathParams map[string]string, item, op map[string]interface{}) []fieldError {
+	var declared []interface{}
+	if list, ok := item["parameters"].([]interface{}); ok {
+		declared = append(declared, list...)
+	}
+	if list, ok := op["parameters"].([]interface{}); ok {
+		declared = append(declared, list...)
+	}
+	var problems []fieldError
+	query := r.URL.Query()
+	for _, p := range declared {
+		param := resolveRef(p)
+		name, _ := param["name"].(string)
+		schema, _ := param["schema"].(map[string]interface{})
+		var raw string
+		switch param["in"] {
+		case "query":
+			if _, ok := query[name]; !ok {
+				continue
+			}
+			raw = query.Get(name)
+		case "path":
+			raw = pathParams[name]
+		default:
+			continue
+		}
+		value, err := parameterValue(raw, resolveRef(schema))
+		if err != nil {
+			problems = append(problems, fieldError{Field: name, Code: codeType, Message: err.Error()})
+			continue
+		}
+		checkValue(schema, value, name, &problems)
+	}
+	return problems
+}
+
+// parameterValue converts a parameter to the JSON value its schema
+// expects, so one check covers parameters and bodies.
+func parameterValue(raw string, schema map[string]interface{}) (interface{}, error) {
+	switch schema["type"] {
+	case "integer":
+		if _, err := strconv.ParseInt(raw, 10, 64); err != nil {
+			return nil, fmt.Errorf("must be an integer")
+		}
+		return json.Number(raw), nil
+	case "number":
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return json.Number(raw), nil
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("must be true or false")
+		}
+		return b, nil
+	}
+	return raw, nil
+}
+
+// checkBody checks a JSON request body against op's schema, then puts it
+// back for the handler. Problems with the body as a whole are reported
+// against the field "body".
+func checkBody(w http.ResponseWriter, r *http.Request, op map[string]interface{}) []fieldError {
+	requestBody := resolveRef(op["requestBody"])
+	if requestBody == nil {
+		return nil
+	}
+	content, _ := requestBody["content"].(map[string]interface{})
+	media, ok := content["application/json"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	// The handlers decode any other body as JSON, whatever its type says.
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		return nil
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if err != nil {
+		return []fieldError{{Field: "body", Code: codeInvalid, Message: "reading body: " + err.Error()}}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	if len(bytes.TrimSpace(data)) == 0 {
+		if required, _ := requestBody["required"].(bool); required {
+			return []fieldError{{Field: "body", Code: codeRequired, Message: "is required"}}
+		}
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return []fieldError{{Field: "body", Code: codeInvalidJSON, Message: "is not valid JSON: " + err.Error()}}
+	}
+	var problems []fieldError
+	schema, _ := media["schema"].(map[string]interface{})
+	checkValue(schema, value, "body", &problems)
+	return problems
+}
+
+// resolveRef follows a local "$ref" in object, if it has one.
+func resolveRef(object interface{}) map[string]interface{} {
+	m, _ := object.(map[string]interface{})
+	ref, ok := m["$ref"].(string)
+	if !ok {
+		return m
+	}
+	var node interface{} = openAPI
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		node = node.(map[string]interface{})[part]
+	}
+	return resolveRef(node)
+}
+
+// openAPIPatterns are the patterns of the spec, compiled once.
+var openAPIPatterns = compilePatterns(openAPI, make(map[string]*regexp.Regexp))
+
+func compilePatterns(node interface{}, patterns map[string]*regexp.Regexp) map[string]*regexp.Regexp {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, child := range n {
+			if pattern, ok := child.(string); ok && key == "pattern" {
+				patterns[pattern] = regexp.MustCompile(pattern)
+			} else {
+				compilePatterns(child, patterns)
+			}
+		}
+	case []interface{}:
+		for _, child := range n {
+			compilePatterns(child, patterns)
+		}
+	}
+	return patterns
+}
+
+// checkValue appends to problems every way value, found at path, breaks
+// schema, coded by the keyword it breaks. It covers the subset of JSON Schema the spec uses. Null is
+// accepted anywhere, since the handlers decode it as the zero value.
+func checkValue(schema map[string]interface{}, value interface{}, path string, problems *[]fieldError) {
+	schema = resolveRef(schema)
+	if schema == nil || value == nil {
+		return
+	}
+	fail := func(code, format string, args ...interface{}) {
+		*problems = append(*problems, fieldError{Field: path, Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			fail(codeType, "must be an object")
+			return
+		}
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if object[name.(string)] == nil {
+					*problems = append(*problems, fieldError{Field: joinPath(path, name.(string)), Code: codeRequired, Message: "is required"})
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := properties[name].(map[string]interface{}); ok {
+				checkValue(property, object[name], joinPath(path, name), problems)
+			} else if additional != nil {
+				checkValue(additional, object[name], joinPath(path, name), problems)
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			fail(codeType, "must be an array")
+			return
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range array {
+			checkValue(items, item, fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			fail(codeType, "must be a string")
+			return
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok && !inEnum(enum, s) {
+			var allowed []string
+			for _, e := range enum {
+				if e != "" {
+					allowed = append(allowed, e.(string))
+				}
+			}
+			fail(codeEnum, "must be one of %s", strings.Join(allowed, ", "))
+		}
+		if n, ok := schema["minLength"].(float64); ok && utf8.RuneCountInString(s) < int(n) {
+			fail(codeMinLength, "must be at least %d characters", int(n))
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if !openAPIPatterns[pattern].MatchString(s) {
+				fail(codePattern, "must match %s", pattern)
+			}
+		}
+	case "integer", "number":
+		n, ok := value.(json.Number)
+		if !ok {
+			fail(codeType, "must be a number")
+			return
+		}
+		f, err := n.Float64()
+		if err != nil {
+			fail(codeType, "must be a number")
+			return
+		}
+		if _, err := n.Int64(); schema["type"] == "integer" && err != nil {
+			fail(codeType, "must be an integer")
+			return
+		}
+		if minimum, ok := schema["minimum"].(float64); ok && f < minimum {
+			fail(codeMinimum, "must be at least %g", minimum)
+		}
+		if maximum, ok := schema["maximum"].(float64); ok && f > maximum {
+			fail(codeMaximum, "must be at most %g", maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail(codeType, "must be true or false")
+		}
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "body" {
+		return name
+	}
+	return path + "." + name
+}
+
+func inEnum(enum []interface{}, s string) bool {
+	for _, e := range enum {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
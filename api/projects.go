@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errProjectNotFound = errors.New("project not found")
+	errProjectExists   = errors.New("project already exists")
+)
+
+// Project is a team's share of the factory: builds submitted to it push
+// to their own repository and are held to its quotas, so teams cannot
+// overwrite each other's images or starve each other of builders.
+type Project struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// ImageName is the repository its images are pushed to, the project's
+	// name by default.
+	ImageName string `json:"image_name"`
+	// Registry is REGISTRY_URL or one of EXTRA_REGISTRIES, the registries
+	// the factory holds credentials for; empty for REGISTRY_URL.
+	Registry string `json:"registry,omitempty"`
+	// Templates are the named templates its builds may use, the first
+	// being the default. Empty allows any template, the built-in one and
+	// inline ones included.
+	Templates []string `json:"templates,omitempty"`
+	// MaxActiveBuilds caps its builds queued or running at once, and
+	// MaxBuildsPerDay those submitted in the last 24 hours; 0 is no limit.
+	MaxActiveBuilds int       `json:"max_active_builds,omitempty"`
+	MaxBuildsPerDay int       `json:"max_builds_per_day,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+var (
+	projectNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+	imageNamePattern   = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+)
+
+// registryURL is where p's images are pushed.
+func (p Project) registryURL() string {
+	if p.Registry == "" {
+		return REGISTRY_URL
+	}
+	return p.Registry
+}
+
+// image is p's image under tag.
+func (p Project) image(tag string) string {
+	return fmt.Sprintf("%s/%s:%s", strings.TrimRight(p.registryURL(), "/"), p.ImageName, tag)
+}
+
+// validateProject checks p, with defaults filled in, against the factory's
+// registries and the other projects, so no two push to one repository.
+func validateProject(p Project, others []Project) error {
+	if !projectNamePattern.MatchString(p.Name) {
+		return fieldErrorf("name", codePattern, "Invalid project name %q: use lowercase letters, digits, '.', '_' and '-'", p.Name)
+	}
+	if !imageNamePattern.MatchString(p.ImageName) {
+		return fieldErrorf("image_name", codePattern, "Invalid image name %q", p.ImageName)
+	}
+	if p.Registry != "" && registryFor(p.Registry) == nil {
+		return fieldErrorf("registry", codeInvalid, "Registry %s is not one the factory pushes to: use the host of REGISTRY_URL or of one of EXTRA_REGISTRIES", p.Registry)
+	}
+	if registryHost(p.registryURL()) == registries[0].host && repositoryIn(p.registryURL(), p.ImageName) == repositoryPath() {
+		return fieldErrorf("image_name", codeInvalid, "Image name %s is the factory's own", p.ImageName)
+	}
+	for _, o := range others {
+		if o.Name != p.Name && registryHost(o.registryURL()) == registryHost(p.registryURL()) &&
+			repositoryIn(o.registryURL(), o.ImageName) == repositoryIn(p.registryURL(), p.ImageName) {
+			return fieldErrorf("image_name", codeInvalid, "Image name %s is taken by project %s", p.ImageName, o.Name)
+		}
+	}
+	for i, name := range p.Templates {
+		if _, err := builds.store.getTemplate(name); errors.Is(err, errTemplateNotFound) {
+			return fieldErrorf(fmt.Sprintf("templates[%d]", i), codeInvalid, "Unknown template %q", name)
+		} else if err != nil {
+			return err
+		}
+	}
+	if p.MaxActiveBuilds < 0 {
+		return fieldErrorf("max_active_builds", codeMinimum, "max_active_builds must not be negative")
+	}
+	if p.MaxBuildsPerDay < 0 {
+		return fieldErrorf("max_builds_per_day", codeMinimum, "max_builds_per_day must not be negative")
+	}
+	return nil
+}
+
+// repositoryIn is the repository path of image name within registryURL,
+// including any namespace it carries, as repositoryPath is for IMAGE_NAME.
+func repositoryIn(registryURL, name string) string {
+	parts := strings.SplitN(strings.TrimPrefix(strings.TrimPrefix(registryURL, "https://"), "http://"), "/", 2)
+	if len(parts) == 2 && parts[1] != "" {
+		return strings.Trim(parts[1], "/") + "/" + name
+	}
+	return name
+}
+
+// imageRepository is the registry client and repository path of b's
+// image: repositoryPath in REGISTRY_URL, or its project's.
+func imageRepository(b Build) (*registryClient, string) {
+	if b.Request.Project == "" {
+		return registry, repositoryPath()
+	}
+	ref := strings.TrimPrefix(strings.TrimPrefix(b.Image, "https://"), "http://")
+	ref = ref[:strings.LastIndex(ref, ":")]
+	host := registryHost(ref)
+	return registryClientFor(host), strings.TrimPrefix(ref, host+"/")
+}
+
+// projectRepository is where the images of a project are, or those of
+// the factory's own when project is empty.
+type projectRepository struct {
+	project   string
+	client    *registryClient
+	path      string // the repository within its registry
+	name      string // the registry and repository, as in image references
+	imageName string
+}
+
+// repositoryOf returns the repository of project's images.
+func repositoryOf(project string) (projectRepository, error) {
+	if project == "" {
+		return projectRepository{client: registry, path: repositoryPath(), name: REGISTRY_URL + "/" + IMAGE_NAME, imageName: IMAGE_NAME}, nil
+	}
+	p, err := builds.store.getProject(project)
+	if err != nil {
+		return projectRepository{}, err
+	}
+	url := p.registryURL()
+	return projectRepository{
+		project:   p.Name,
+		client:    registryClientFor(registryHost(url)),
+		path:      repositoryIn(url, p.ImageName),
+		name:      strings.TrimRight(url, "/") + "/" + p.ImageName,
+		imageName: p.ImageName,
+	}, nil
+}
+
+// applyProject holds req to the templates of its project, which it
+// returns, defaulting template_name to the project's first.
+func applyProject(req *DockerBuildRequest) (Project, error) {
+	p, err := builds.store.getProject(req.Project)
+	if errors.Is(err, errProjectNotFound) {
+		return p, fieldErrorf("project", codeInvalid, "Unknown project %q", req.Project)
+	}
+	if err != nil {
+		return p, err
+	}
+	if len(p.Templates) == 0 {
+		return p, nil
+	}
+	if req.Template != "" {
+		return p, fieldErrorf("template", codeInvalid, "Project %s only builds from its templates: %s", p.Name, strings.Join(p.Templates, ", "))
+	}
+	if req.TemplateName == "" {
+		req.TemplateName = p.Templates[0]
+	}
+	for _, name := range p.Templates {
+		if name == req.TemplateName {
+			return p, nil
+		}
+	}
+	return p, fieldErrorf("template_name", codeEnum, "Project %s cannot use template %q: use one of %s", p.Name, req.TemplateName, strings.Join(p.Templates, ", "))
+}
+
+// quotaExceeded is a build refused because its project is at a quota.
+type quotaExceeded struct {
+	msg string
+}
+
+func (e quotaExceeded) Error() string { return e.msg }
+
+// quotaMu serializes counting a project's builds with inserting the next
+// one, so builds submitted at the same moment cannot together overshoot a
+// quota. Replicas sharing a store can still overshoot it by one each.
+var quotaMu sync.Mutex
+
+// checkProjectQuota returns a quotaExceeded if project may not take
+// another build now. Callers hold quotaMu until the build is inserted.
+func checkProjectQuota(project string) error {
+	if project == "" {
+		return nil
+	}
+	p, err := builds.store.getProject(project)
+	if err != nil {
+		return err
+	}
+	if p.MaxActiveBuilds > 0 {
+		n, err := builds.store.countBuilds(buildFilter{Project: p.Name, Statuses: []BuildStatus{StatusQueued, StatusBuilding, StatusPushing}})
+		if err != nil {
+			return err
+		}
+		if n >= p.MaxActiveBuilds {
+			return quotaExceeded{fmt.Sprintf("Project %s is at its limit of %d builds queued or running", p.Name, p.MaxActiveBuilds)}
+		}
+	}
+	if p.MaxBuildsPerDay > 0 {
+		since := time.Now().UTC().Add(-24 * time.Hour)
+		n, err := builds.store.countBuilds(buildFilter{Project: p.Name, CreatedAfter: &since})
+		if err != nil {
+			return err
+		}
+		if n >= p.MaxBuildsPerDay {
+			return quotaExceeded{fmt.Sprintf("Project %s is at its limit of %d builds a day", p.Name, p.MaxBuildsPerDay)}
+		}
+	}
+	return nil
+}
+
+// writeQuotaError answers a build request refused by checkProjectQuota.
+func writeQuotaError(w http.ResponseWriter, r *http.Request, err error) {
+	var quota quotaExceeded
+	if !errors.As(err, &quota) {
+		logger(r.Context()).Error("Checking project quota", "error", err)
+		httpError(w, "Checking the project's quota failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Retry-After", "60")
+	writeEnvelope(w, http.StatusTooManyRequests, envelope{Errors: []fieldError{{Code: codeQuotaExceeded, Message: quota.msg}}})
+}
+
+// isProjectBuildsPath reports whether path, with or without the /v1
+// prefix, is under /projects/{project}/builds, which is authorized as
+// builds rather than as projects.
+func isProjectBuildsPath(path string) bool {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/v1"), "/"), "/")
+	return len(parts) >= 3 && parts[0] == "projects" && parts[2] == "builds"
+}
+
+// projectsHandler routes /projects and everything under it.
+func projectsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/projects"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "" && r.Method == http.MethodPost:
+		saveProject(w, r, "")
+	case path == "" && r.Method == http.MethodGet:
+		listProjects(w, r)
+	case len(parts) == 2 && parts[1] == "builds" && r.Method == http.MethodPost:
+		projectBuild(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "builds" && r.Method == http.MethodGet:
+		projectBuilds(w, r, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		getProject(w, r, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		saveProject(w, r, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		deleteProject(w, r, parts[0])
+	case len(parts) == 1 || len(parts) == 2 && parts[1] == "builds":
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		httpError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// saveProject creates a project (POST /projects) or replaces an existing
+// one (PUT /projects/{name}).
+func saveProject(w http.ResponseWriter, r *http.Request, name string) {
+	var p Project
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, fieldErrorf("body", codeInvalidJSON, "body is not valid JSON: %s", err))
+		return
+	}
+	if name != "" {
+		if p.Name != "" && p.Name != name {
+			writeError(w, fieldErrorf("name", codeInvalid, "name does not match the URL"))
+			return
+		}
+		p.Name = name
+	}
+	if p.ImageName == "" {
+		p.ImageName = p.Name
+	}
+	others, err := builds.store.listProjects()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := validateProject(p, others); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	p.CreatedAt, p.UpdatedAt = now, now
+	status := http.StatusCreated
+	if name == "" {
+		err = builds.store.insertProject(p)
+	} else {
+		err = builds.store.updateProject(p)
+		status = http.StatusOK
+	}
+	switch {
+	case errors.Is(err, errProjectExists):
+		httpError(w, "Project already exists", http.StatusConflict)
+		return
+	case errors.Is(err, errProjectNotFound):
+		httpError(w, "Project not found", http.StatusNotFound)
+		return
+	case err != nil:
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger(r.Context()).Info("Saved project", "project", p.Name, "image", p.image(""))
+	action := auditProjectCreate
+	if name != "" {
+		action = auditProjectUpdate
+	}
+	auditRequest(r, AuditEntry{Action: action, Target: p.Name})
+
+	saved, err := builds.store.getProject(p.Name)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPath(r, "/projects/"+p.Name))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(saved)
+}
+
+func listProjects(w http.ResponseWriter, r *http.Request) {
+	projects, err := builds.store.listProjects()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if projects == nil {
+		projects = []Project{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
+
+func getProject(w http.ResponseWriter, r *http.Request, name string) {
+	p, err := builds.store.getProject(name)
+	if errors.Is(err, errProjectNotFound) {
+		httpError(w, "Project not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// deleteProject removes a project. Its builds and images are kept; later
+// builds naming it, such as those of its schedules, are refused.
+func deleteProject(w http.ResponseWriter, r *http.Request, name string) {
+	err := builds.store.deleteProject(name)
+	if errors.Is(err, errProjectNotFound) {
+		httpError(w, "Project not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger(r.Context()).Info("Deleted project", "project", name)
+	auditRequest(r, AuditEntry{Action: auditProjectDelete, Target: name})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// projectBuild serves POST /projects/{project}/builds, a build request
+// whose project is the one in the URL.
+func projectBuild(w http.ResponseWriter, r *http.Request, project string) {
+	if !projectExists(w, project) {
+		return
+	}
+	submitBuildRequest(w, r, project)
+}
+
+// projectBuilds serves GET /projects/{project}/builds, GET /builds for the
+// project's builds.
+func projectBuilds(w http.ResponseWriter, r *http.Request, project string) {
+	if !projectExists(w, project) {
+		return
+	}
+	listBuilds(w, r, project)
+}
+
+// projectExists answers 404 unless project exists.
+func projectExists(w http.ResponseWriter, project string) bool {
+	_, err := builds.store.getProject(project)
+	if errors.Is(err, errProjectNotFound) {
+		httpError(w, "Project not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
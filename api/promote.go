@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// promoteTimeout bounds a promotion, which copies every layer the target
+// registry does not have yet.
+const promoteTimeout = 30 * time.Minute
+
+type promoteRequest struct {
+	// Registry is one of PROMOTION_REGISTRIES; it may be left out when
+	// there is only one.
+	Registry string `json:"registry"`
+}
+
+// imagePromotion reports what POST /images/{tag}/promote copied.
+type imagePromotion struct {
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest"`
+	Source     string `json:"source"`
+	Image      string `json:"image"`                // the promoted image in the target registry
+	Signatures bool   `json:"signatures,omitempty"` // cosign signatures and attestations were copied too
+}
+
+// promoteImage copies tag, by digest, from REGISTRY_URL, or the registry
+// of the project query parameter, to a promotion registry under the same
+// image name: the manifest, its layers and the
+// artifacts referring to it, such as the SBOM and provenance, so the
+// promoted image has the digest that was tested. With signing on, the
+// cosign signature and attestations are copied as well, so they verify in
+// the target registry without signing again.
+func promoteImage(w http.ResponseWriter, r *http.Request, tag string) {
+	if !tagPattern.MatchString(tag) {
+		writeError(w, fieldErrorf("tag", codePattern, "Invalid tag %q", tag))
+		return
+	}
+	var req promoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, fieldErrorf("body", codeInvalidJSON, "body is not valid JSON: %s", err))
+		return
+	}
+	target, err := promotionTarget(req.Registry)
+	if err != nil {
+		writeError(w, fieldErrorf("registry", codeInvalid, "%s", err))
+		return
+	}
+
+	repo, ok := requestedRepository(w, r)
+	if !ok {
+		return
+	}
+
+	digest, err := repo.client.digestOf(repo.path, tag)
+	if err != nil {
+		httpError(w, "Looking up tag failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if digest == "" {
+		httpError(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	result := imagePromotion{
+		Tag:        tag,
+		Digest:     digest,
+		Source:     repo.name + "@" + digest,
+		Image:      fmt.Sprintf("%s/%s:%s", target.url, repo.imageName, tag),
+		Signatures: signingEnabled(),
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), promoteTimeout)
+	defer cancel()
+	output := newBuildLog("")
+	if err := copyImage(ctx, target, result.Source, result.Image, output); err != nil {
+		logger(r.Context()).Error("Promoting image", "source", result.Source, "image", result.Image, "error", err)
+		httpError(w, failureMessage("Promotion", err, output), http.StatusBadGateway)
+		return
+	}
+	logger(r.Context()).Info("Promoted image", "source", result.Source, "image", result.Image)
+	auditImage(r, repo, auditImagePromote, tag, digest, result.Image)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// promotionTarget resolves the registry a promotion asked for.
+func promotionTarget(name string) (*targetRegistry, error) {
+	if len(promotionRegistries) == 0 {
+		return nil, errors.New("No PROMOTION_REGISTRIES are configured")
+	}
+	if name == "" {
+		if len(promotionRegistries) > 1 {
+			return nil, fmt.Errorf("registry is required: one of %s", strings.Join(PROMOTION_REGISTRIES, ", "))
+		}
+		return promotionRegistries[0], nil
+	}
+	for _, r := range promotionRegistries {
+		if r.url == strings.TrimSuffix(name, "/") {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown registry %q: must be one of %s", name, strings.Join(PROMOTION_REGISTRIES, ", "))
+}
+
+// copyImage copies source, a digest reference, to image in target with
+// ORAS_BINARY, referrers included, then the cosign signatures of source if
+// signing is on.
+func copyImage(ctx context.Context, target *targetRegistry, source, image string, output *buildLog) error {
+	if _, _, err := target.credentials(); err != nil {
+		return fmt.Errorf("signing in to %s: %w", target.host, err)
+	}
+	if err := prepareRepository(target, image); err != nil {
+		return err
+	}
+	configDir, err := os.MkdirTemp("", "promote-auth-")
+	if err != nil {
+		return fmt.Errorf("Creating registry config: %w", err)
+	}
+	defer os.RemoveAll(configDir)
+	from := registryFor(source)
+	if from == nil {
+		from = registries[0]
+	}
+	config, err := registryConfigFor([]*targetRegistry{from, target})
+	if err != nil {
+		return fmt.Errorf("Writing registry config: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "config.json"), config, 0600); err != nil {
+		return fmt.Errorf("Writing registry config: %w", err)
+	}
+
+	args := []string{"copy", "--recursive", "--registry-config", filepath.Join(configDir, "config.json")}
+	if plainHTTP(source) {
+		args = append(args, "--from-plain-http")
+	}
+	if plainHTTP(image) {
+		args = append(args, "--to-plain-http")
+	}
+	if insecureRegistry(source) {
+		args = append(args, "--from-insecure")
+	}
+	if insecureRegistry(image) {
+		args = append(args, "--to-insecure")
+	}
+	cmd := exec.CommandContext(ctx, ORAS_BINARY, append(args, source, image)...)
+	cmd.Env = registryCAEnv(os.Environ())
+	if err := runLogged(cmd, output); err != nil {
+		return fmt.Errorf("oras copy: %w", err)
+	}
+	if !signingEnabled() {
+		return nil
+	}
+
+	// cosign keeps signatures and attestations under tags derived from the
+	// digest rather than as referrers, which oras does not follow.
+	args = []string{"copy", "--force", "--only", "sig,att"}
+	if plainHTTP(source) || plainHTTP(image) {
+		args = append(args, "--allow-http-registry")
+	}
+	if insecureRegistry(source) || insecureRegistry(image) {
+		args = append(args, "--allow-insecure-registry")
+	}
+	sign := exec.CommandContext(ctx, COSIGN_BINARY, append(args, source, image[:strings.LastIndex(image, ":")])...)
+	sign.Env = registryCAEnv(append(os.Environ(), "DOCKER_CONFIG="+configDir))
+	if err := runLogged(sign, output); err != nil {
+		return fmt.Errorf("cosign copy: %w", err)
+	}
+	return nil
+}
+
+// prepareRepository makes sure image's repository exists in target, for
+// cloud registries that need it created first.
+func prepareRepository(target *targetRegistry, image string) error {
+	if target.provider == nil {
+		return nil
+	}
+	repository := strings.TrimPrefix(image, target.host+"/")
+	return target.provider.ensureRepository(repository[:strings.LastIndex(repository, ":")])
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	provenanceBuildType     = "https://github.com/airflow-image-factory/build-types/airflow-image/v1"
+	provenancePredicateType = "https://slsa.dev/provenance/v1"
+	inTotoStatementType     = "https://in-toto.io/Statement/v1"
+	inTotoMediaType         = "application/vnd.in-toto+json"
+)
+
+// provenanceStatement is an in-toto statement carrying a SLSA v1
+// provenance predicate about one pushed image.
+type provenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []provenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     provenancePredicate `json:"predicate"`
+}
+
+type provenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type provenancePredicate struct {
+	BuildDefinition struct {
+		BuildType            string                 `json:"buildType"`
+		ExternalParameters   DockerBuildRequest     `json:"externalParameters"`
+		InternalParameters   map[string]string      `json:"internalParameters"`
+		ResolvedDependencies []provenanceDependency `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string    `json:"invocationId"`
+			StartedOn    time.Time `json:"startedOn"`
+			FinishedOn   time.Time `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// provenanceDependency is a material of the build: the base image, which
+// is only known by reference, and the files of the build context, which
+// are known by content.
+type provenanceDependency struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// newProvenance describes how job produced the image pushed as digest,
+// between started and finished.
+func newProvenance(job *buildJob, digest string, started, finished time.Time) provenanceStatement {
+	repository := job.Image[:strings.LastIndex(job.Image, ":")]
+	statement := provenanceStatement{
+		Type:          inTotoStatementType,
+		Subject:       []provenanceSubject{{Name: repository, Digest: map[string]string{"sha256": strings.TrimPrefix(digest, "sha256:")}}},
+		PredicateType: provenancePredicateType,
+	}
+
+	def := &statement.Predicate.BuildDefinition
+	def.BuildType = provenanceBuildType
+	// Where the result is reported is not an input to the image.
+	def.ExternalParameters = job.Request
+	def.ExternalParameters.CallbackURL = ""
+	def.ExternalParameters.Notify = nil
+	def.InternalParameters = map[string]string{"backend": BUILD_BACKEND}
+	if len(job.Platforms) > 0 {
+		def.InternalParameters["platforms"] = strings.Join(job.Platforms, ",")
+	}
+
+	def.ResolvedDependencies = []provenanceDependency{
+		{URI: "docker://" + mirroredImage(baseImageName(job.Request))},
+		{Name: "Dockerfile", Digest: sha256Digest(job.Dockerfile)},
+	}
+	if job.Request.UseConstraints {
+		def.ResolvedDependencies = append(def.ResolvedDependencies, provenanceDependency{URI: job.Request.ConstraintsURL})
+	}
+	names := make([]string, 0, len(job.Files))
+	for name := range job.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		def.ResolvedDependencies = append(def.ResolvedDependencies, provenanceDependency{Name: name, Digest: sha256Digest(job.Files[name])})
+	}
+
+	run := &statement.Predicate.RunDetails
+	run.Builder.ID = PROVENANCE_BUILDER_ID
+	run.Metadata.InvocationID = job.BuildID
+	run.Metadata.StartedOn = started.UTC()
+	run.Metadata.FinishedOn = finished.UTC()
+	return statement
+}
+
+func sha256Digest(data []byte) map[string]string {
+	sum := sha256.Sum256(data)
+	return map[string]string{"sha256": hex.EncodeToString(sum[:])}
+}
+
+// attachProvenance writes statement to the workspace and attaches it to
+// image, by digest. With signing on, cosign attest signs it into a DSSE
+// envelope beside the image's signature, where `cosign verify-attestation
+// --type slsaprovenance1` finds it; otherwise it is attached unsigned as
+// an OCI referrer. It returns where the attestation was stored.
+func attachProvenance(ctx context.Context, image, digest, workspace string, statement provenanceStatement, output *buildLog) (string, error) {
+	if digest == "" {
+		return "", errors.New("the builder did not report the pushed digest")
+	}
+	configDir, err := os.MkdirTemp("", "provenance-auth-")
+	if err != nil {
+		return "", fmt.Errorf("Creating registry config: %w", err)
+	}
+	defer os.RemoveAll(configDir)
+	if err := writeRegistryConfig(configDir); err != nil {
+		return "", fmt.Errorf("Writing registry config: %w", err)
+	}
+	repository := image[:strings.LastIndex(image, ":")]
+	ref := repository + "@" + digest
+
+	if signingEnabled() {
+		predicate, err := json.Marshal(statement.Predicate)
+		if err != nil {
+			return "", err
+		}
+		file := filepath.Join(workspace, "provenance-predicate.json")
+		if err := os.WriteFile(file, predicate, 0600); err != nil {
+			return "", err
+		}
+		args := append([]string{"attest"}, cosignFlags(image)...)
+		args = append(args, "--type", "slsaprovenance1", "--predicate", file, ref)
+		cmd := exec.CommandContext(ctx, COSIGN_BINARY, args...)
+		cmd.Env = registryCAEnv(append(os.Environ(), "DOCKER_CONFIG="+configDir))
+		if err := runLogged(cmd, output); err != nil {
+			return "", fmt.Errorf("cosign attest: %w", err)
+		}
+		return repository + ":" + strings.Replace(digest, ":", "-", 1) + ".att", nil
+	}
+
+	data, err := json.Marshal(statement)
+	if err != nil {
+		return "", err
+	}
+	file := "provenance.json"
+	if err := os.WriteFile(filepath.Join(workspace, file), data, 0600); err != nil {
+		return "", err
+	}
+	attached, err := attachArtifact(ctx, ref, workspace, file, inTotoMediaType, configDir, output)
+	if err != nil {
+		return "", err
+	}
+	if attached == "" {
+		return ref, nil
+	}
+	return repository + "@" + attached, nil
+}
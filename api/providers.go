@@ -0,0 +1,58 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// coreExtras are the Airflow extras that do not map to a provider package,
+// from https://airflow.apache.org/docs/apache-airflow/stable/extra-packages-ref.html.
+var coreExtras = map[string]bool{
+	"aiobotocore": true, "async": true, "cgroups": true, "deprecated-api": true,
+	"github-enterprise": true, "google-auth": true, "graphviz": true,
+	"kerberos": true, "ldap": true, "leveldb": true, "otel": true,
+	"pandas": true, "password": true, "pydantic": true, "rabbitmq": true,
+	"sentry": true, "s3fs": true, "saml": true, "statsd": true, "uv": true,
+	"virtualenv": true,
+}
+
+// providerPackages lists the pip requirements for provider packages: the
+// request's pinned Providers, then, for slim builds, the provider behind
+// each remaining extra. Slim images ship no providers, and pip only warns
+// about extras it does not know, so naming the packages makes a missing
+// provider fail the build instead of the first DAG that imports it.
+func providerPackages(req DockerBuildRequest) []string {
+	var packages []string
+	for _, name := range sortedKeys(req.Providers) {
+		packages = append(packages, name+"=="+req.Providers[name])
+	}
+	if req.ImageFlavor != flavorSlim {
+		return packages
+	}
+	for _, extra := range req.Extras {
+		name := providerPrefix + strings.ReplaceAll(extra, ".", "-")
+		if _, pinned := req.Providers[name]; !pinned && !coreExtras[extra] {
+			packages = append(packages, name)
+		}
+	}
+	return packages
+}
+
+const providerPrefix = "apache-airflow-providers-"
+
+var (
+	providerNamePattern    = regexp.MustCompile(`^apache-airflow-providers-[a-z0-9]+(-[a-z0-9]+)*$`)
+	providerVersionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*((a|b|rc|\.post|\.dev)[0-9]+)*$`)
+)
+
+func validateProviders(providers map[string]string) error {
+	for name, version := range providers {
+		if !providerNamePattern.MatchString(name) {
+			return fieldErrorf("providers."+name, codeFormat, "Invalid provider package %q: expected a name like apache-airflow-providers-google", name)
+		}
+		if !providerVersionPattern.MatchString(version) {
+			return fieldErrorf("providers."+name, codeFormat, "Invalid version %q for provider %s: expected a release like 10.19.0", version, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var pypiClient = &http.Client{Timeout: 10 * time.Second}
+
+// airflowRelease is what the factory reads from an apache-airflow release's
+// PyPI metadata.
+type airflowRelease struct {
+	Extras         []string // sorted, as declared
+	PythonVersions []string // from the trove classifiers, e.g. "3.11"
+}
+
+// releaseCache holds fetched release metadata. Releases never change once
+// published, so entries are kept for the life of the process.
+var releaseCache = struct {
+	sync.Mutex
+	byVersion map[string]airflowRelease
+}{byVersion: make(map[string]airflowRelease)}
+
+var pythonClassifier = regexp.MustCompile(`^Programming Language :: Python :: (3\.[0-9]+)$`)
+
+// errUnknownAirflowVersion means PyPI has no such apache-airflow release.
+var errUnknownAirflowVersion = errors.New("unknown Airflow version")
+
+// fetchAirflowRelease returns the metadata of an apache-airflow release from
+// PYPI_JSON_URL.
+func fetchAirflowRelease(ctx context.Context, version string) (airflowRelease, error) {
+	releaseCache.Lock()
+	release, ok := releaseCache.byVersion[version]
+	releaseCache.Unlock()
+	if ok {
+		return release, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/apache-airflow/%s/json", PYPI_JSON_URL, version), nil)
+	if err != nil {
+		return release, err
+	}
+	resp, err := pypiClient.Do(req)
+	if err != nil {
+		return release, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return release, errUnknownAirflowVersion
+	}
+	if resp.StatusCode != http.StatusOK {
+		return release, fmt.Errorf("PyPI returned %s", resp.Status)
+	}
+	var meta struct {
+		Info struct {
+			ProvidesExtra []string `json:"provides_extra"`
+			Classifiers   []string `json:"classifiers"`
+		} `json:"info"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return release, fmt.Errorf("decoding PyPI metadata: %w", err)
+	}
+	release.Extras = meta.Info.ProvidesExtra
+	sort.Strings(release.Extras)
+	for _, classifier := range meta.Info.Classifiers {
+		if m := pythonClassifier.FindStringSubmatch(classifier); m != nil {
+			release.PythonVersions = append(release.PythonVersions, m[1])
+		}
+	}
+
+	releaseCache.Lock()
+	releaseCache.byVersion[version] = release
+	releaseCache.Unlock()
+	return release, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildJob is everything a worker needs to run a build that has already
+// been validated and rendered by the HTTP handler.
+// It is also the unit of work handed to remote builder agents, hence the
+// JSON tags.
+type buildJob struct {
+	BuildID    string            `json:"build_id"`
+	Image      string            `json:"image"`
+	Dockerfile []byte            `json:"dockerfile"`
+	Timeout    time.Duration     `json:"timeout"`
+	Priority   int               `json:"priority"`
+	Pull       bool              `json:"pull"`              // re-pull the base image, for forced rebuilds
+	Files      map[string][]byte `json:"files,omitempty"`   // extra build context files
+	Secrets    []string          `json:"secrets,omitempty"` // build secret ids the Dockerfile mounts
+	BuildArgs  map[string]string `json:"build_args,omitempty"`
+	Platforms  []string          `json:"platforms,omitempty"` // build with buildx for these platforms
+	SSH        bool              `json:"ssh,omitempty"`       // forward the builder's SSH key for Git requirements
+
+	// ExtraImages are more names Image is pushed under once built: its
+	// names in EXTRA_REGISTRIES and under the build's custom tags.
+	ExtraImages []string `json:"extra_images,omitempty"`
+
+	// Request is the spec the build was made from, recorded in its
+	// provenance.
+	Request DockerBuildRequest `json:"request"`
+
+	// TraceContext carries the submitting request's span so the build's
+	// spans join its trace, wherever the job runs.
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+
+	ctx context.Context
+}
+
+// Priority levels accepted in DockerBuildRequest.Priority. Higher values are
+// dequeued first; jobs of equal priority keep their arrival order.
+var priorityLevels = map[string]int{
+	"low":    0,
+	"normal": 1,
+	"high":   2,
+	"urgent": 3,
+}
+
+const defaultPriority = "normal"
+
+// newBuildJob derives the job for an already-validated build from its
+// stored request, so resumed builds are scheduled exactly like fresh ones.
+func newBuildJob(b Build, ctx context.Context) *buildJob {
+	timeout := BUILD_TIMEOUT
+	if b.Request.TimeoutSeconds > 0 {
+		timeout = time.Duration(b.Request.TimeoutSeconds) * time.Second
+	}
+	var secrets []string
+	if b.Request.usesNetrc() {
+		secrets = append(secrets, secretPipNetrc)
+	}
+	_, gitSSH := b.Request.vcsSchemes()
+	if gitSSH {
+		secrets = append(secrets, secretGitKnownHosts)
+	}
+	return &buildJob{
+		BuildID:    b.ID,
+		Image:      b.Image,
+		Dockerfile: []byte(b.Dockerfile),
+		Timeout:    timeout,
+		Priority:   priorityLevels[b.Request.Priority],
+		Pull:       b.Request.Force,
+		Files:      b.Files,
+		Secrets:    secrets,
+		BuildArgs:  b.Request.BuildArgs,
+		Platforms:  b.Request.Platforms,
+		SSH:        gitSSH,
+		ctx:        ctx,
+
+		ExtraImages: extraImages(b),
+		Request:     b.Request,
+	}
+}
+
+// extraImages names b's image in each of EXTRA_REGISTRIES, then under each
+// custom tag in every registry. A project's build is pushed to its
+// project's registry alone.
+func extraImages(b Build) []string {
+	var images []string
+	if b.Request.Project != "" {
+		tags, _ := customTags(b)
+		for _, tag := range tags {
+			images = append(images, b.Image[:strings.LastIndex(b.Image, ":")+1]+tag)
+		}
+		return images
+	}
+	for _, r := range EXTRA_REGISTRIES {
+		images = append(images, fmt.Sprintf("%s/%s:%s", r, IMAGE_NAME, b.Tag))
+	}
+	tags, _ := customTags(b) // validated by prepareBuild
+	for _, tag := range tags {
+		images = append(images, fmt.Sprintf("%s/%s:%s", REGISTRY_URL, IMAGE_NAME, tag))
+		for _, r := range EXTRA_REGISTRIES {
+			images = append(images, fmt.Sprintf("%s/%s:%s", r, IMAGE_NAME, tag))
+		}
+	}
+	return images
+}
+
+// resumeBuilds re-enqueues the builds this instance accepted but never got
+// to start before it last stopped. Builds that were mid-flight cannot be
+// picked up where they left off, so they are marked failed.
+func resumeBuilds() error {
+	pending, err := builds.store.buildsByStatus(INSTANCE_ID, StatusQueued, StatusBuilding, StatusPushing)
+	if err != nil {
+		return err
+	}
+	resumed := 0
+	for i := range pending {
+		b := pending[i]
+		ctx := builds.restore(&b)
+		if b.Status != StatusQueued {
+			builds.fail(b.ID, failureInterrupted, "Build interrupted by a restart of the factory")
+			continue
+		}
+		if b.Files, err = builds.store.getBuildFiles(b.ID); err != nil {
+			builds.fail(b.ID, failureInternal, fmt.Sprintf("Loading build context after a restart: %s", err))
+			continue
+		}
+		queue.push(newBuildJob(b, ctx))
+		resumed++
+	}
+	if len(pending) > 0 {
+		slog.Info("Resumed builds", "resumed", resumed, "failed", len(pending)-resumed)
+	}
+	return nil
+}
+
+// buildQueue holds pending jobs in arrival order and hands them out highest
+// priority first. A pool of workers (local or remote agents) drains
+// it, which caps how many docker builds hit a daemon at once.
+type buildQueue struct {
+	mu      sync.Mutex
+	jobs    []*buildJob
+	changed chan struct{} // closed and replaced on every push
+}
+
+var queue = newBuildQueue()
+
+func newBuildQueue() *buildQueue {
+	return &buildQueue{changed: make(chan struct{})}
+}
+
+func (q *buildQueue) push(job *buildJob) {
+	q.mu.Lock()
+	q.jobs = append(q.jobs, job)
+	close(q.changed)
+	q.changed = make(chan struct{})
+	q.mu.Unlock()
+}
+
+// popContext blocks until a job is available and returns the oldest job
+// of the highest priority present, or gives up and returns nil once ctx is
+// done.
+func (q *buildQueue) popContext(ctx context.Context) *buildJob {
+	for {
+		q.mu.Lock()
+		if len(q.jobs) > 0 {
+			next := 0
+			for i, job := range q.jobs {
+				if job.Priority > q.jobs[next].Priority {
+					next = i
+				}
+			}
+			job := q.jobs[next]
+			q.jobs = append(q.jobs[:next], q.jobs[next+1:]...)
+			q.mu.Unlock()
+			return job
+		}
+		changed := q.changed
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// remove drops a job that has not been picked up yet.
+func (q *buildQueue) remove(buildID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, job := range q.jobs {
+		if job.BuildID == buildID {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *buildQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+// buildWorkers are the goroutines running local builds. There are
+// MAX_CONCURRENT_BUILDS of them, which can change on a config reload.
+type buildWorkers struct {
+	mu    sync.Mutex
+	stops []context.CancelFunc
+}
+
+var workers buildWorkers
+
+func (w *buildWorkers) size() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.stops)
+}
+
+// resize starts or stops workers until there are n. A stopped worker
+// finishes the build it is running, if any, before it goes.
+func (w *buildWorkers) resize(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.stops) < n {
+		ctx, stop := context.WithCancel(context.Background())
+		w.stops = append(w.stops, stop)
+		go func() {
+			for {
+				job := queue.popContext(ctx)
+				if job == nil {
+					return
+				}
+				runBuild(job)
+			}
+		}()
+	}
+	for len(w.stops) > n {
+		w.stops[len(w.stops)-1]()
+		w.stops = w.stops[:len(w.stops)-1]
+	}
+	slog.Info("Running build workers", "workers", n)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rate is a token bucket's refill: count tokens every per, with room for
+// count at once.
+type rate struct {
+	count int
+	per   time.Duration
+}
+
+func (r rate) String() string {
+	if r.count == 0 {
+		return "0"
+	}
+	unit := map[time.Duration]string{time.Second: "s", time.Minute: "m", time.Hour: "h"}[r.per]
+	return fmt.Sprintf("%d/%s", r.count, unit)
+}
+
+// parseRate reads a limit such as "120/m": a count per second, minute or
+// hour. Empty or "0" is no limit.
+func parseRate(s string) (rate, error) {
+	if s == "" || s == "0" {
+		return rate{}, nil
+	}
+	i := strings.Index(s, "/")
+	if i <= 0 {
+		return rate{}, fmt.Errorf("want a count per s, m or h, such as 120/m")
+	}
+	count, err := strconv.Atoi(s[:i])
+	if err != nil || count < 0 {
+		return rate{}, fmt.Errorf("%q is not a count", s[:i])
+	}
+	per, ok := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[s[i+1:]]
+	if !ok {
+		return rate{}, fmt.Errorf("%q is not s, m or h", s[i+1:])
+	}
+	return rate{count: count, per: per}, nil
+}
+
+// bucket holds the tokens a client has left.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client. Buckets that have filled up
+// again are dropped, so clients seen once do not pile up.
+type rateLimiter struct {
+	rate rate
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newRateLimiter(r rate) *rateLimiter {
+	if r.count == 0 {
+		return nil
+	}
+	return &rateLimiter{rate: r, buckets: make(map[string]*bucket)}
+}
+
+// take spends a token of client's bucket. When there is none it returns
+// false and how long until there is.
+func (l *rateLimiter) take(client string, now time.Time) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	capacity := float64(l.rate.count)
+	perToken := l.rate.per / time.Duration(l.rate.count)
+	refill := func(b *bucket) {
+		b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.last))/float64(perToken))
+		b.last = now
+	}
+	if now.Sub(l.swept) > l.rate.per {
+		for id, b := range l.buckets {
+			if refill(b); b.tokens >= capacity {
+				delete(l.buckets, id)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[client] = b
+	}
+	refill(b)
+	if b.tokens < 1 {
+		return false, 0, time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// requestLimiter limits every request a client makes, and buildLimiter
+// the builds it submits, by RATE_LIMIT and BUILD_RATE_LIMIT. Either is nil
+// when unlimited.
+var requestLimiter, buildLimiter *rateLimiter
+
+// rateLimitKey identifies a client: who it authenticated as, or else the
+// address it connects from.
+func rateLimitKey(r *http.Request) string {
+	if p, ok := principalFrom(r.Context()); ok {
+		return p.Method + ":" + p.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// submitsBuild reports whether a request, with its /v1 prefix stripped,
+// creates a build.
+func submitsBuild(r *http.Request) bool {
+	return r.Method == http.MethodPost && (r.URL.Path == "/builds" || r.URL.Path == "/build-and-push")
+}
+
+// rateLimited answers 429 to a client that has run out of requests, or of
+// builds when the request submits one.
+func rateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := rateLimitKey(r)
+		if !allowRequest(w, requestLimiter, client, "requests") {
+			return
+		}
+		if submitsBuild(r) && !allowRequest(w, buildLimiter, client, "builds") {
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// allowRequest takes a token from limiter for client, answering 429 with
+// when to retry if there is none.
+func allowRequest(w http.ResponseWriter, limiter *rateLimiter, client, what string) bool {
+	if limiter == nil {
+		return true
+	}
+	ok, remaining, wait := limiter.take(client, time.Now())
+	w.Header().Set("X-RateLimit-Limit", limiter.rate.String())
+	if ok {
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		return true
+	}
+	rateLimitedRequests.WithLabelValues(what).Inc()
+	retry := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("X-RateLimit-Remaining", "0")
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	httpError(w, fmt.Sprintf("Too many %s: the limit is %s, retry in %ds", what, limiter.rate, retry), http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestMediaTypes are the manifest formats we accept from the registry,
+// covering both single- and multi-platform images.
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// registryClient talks to the Docker Registry HTTP API v2 of the target
+// registry. It understands the bearer-token handshake used by Docker Hub,
+// Harbor and friends, and falls back to basic auth when credentials are set.
+type registryClient struct {
+	baseURL     string
+	credentials func() (string, string, error)
+	http        *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]string // scope -> bearer token
+}
+
+var registry *registryClient
+
+func newRegistryClient(baseURL string, credentials func() (string, string, error)) *registryClient {
+	return &registryClient{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		credentials: credentials,
+		http:        &http.Client{Timeout: 30 * time.Second, Transport: registryTransport(baseURL)},
+		tokens:      make(map[string]string),
+	}
+}
+
+// registryProvider signs in to a cloud registry with the factory's cloud
+// identity, in place of REGISTRY_USERNAME and REGISTRY_PASSWORD.
+// Multi-platform builds are the exception: buildx pushes with the docker
+// CLI's own login.
+type registryProvider interface {
+	// Name names the provider in logs and errors, e.g. "ECR".
+	Name() string
+	// credentials returns a username and short-lived password, renewed
+	// as needed, that last at least until a push started now is done.
+	credentials() (string, string, error)
+	// ensureRepository makes sure repository, a path within the registry,
+	// can be pushed to, creating it if the provider does that.
+	ensureRepository(repository string) error
+}
+
+// newRegistryProvider returns the provider for a registry host, or nil if
+// it is not a cloud registry the factory knows.
+func newRegistryProvider(host string) registryProvider {
+	if c := newECRClient(host); c != nil {
+		return c
+	}
+	if c := newGARClient(host); c != nil {
+		return c
+	}
+	if c := newACRClient(host); c != nil {
+		return c
+	}
+	return nil
+}
+
+// targetRegistry is a registry builds are pushed to: REGISTRY_URL or one
+// of EXTRA_REGISTRIES.
+type targetRegistry struct {
+	url      string // host and optional namespace, as in REGISTRY_URL
+	host     string
+	provider registryProvider // nil for a plain registry
+
+	// Fixed credentials for a plain registry, which may be empty.
+	username, password string
+}
+
+// logAttr describes r in log lines.
+func (r *targetRegistry) logAttr() slog.Attr {
+	if r.provider != nil {
+		return slog.Group("registry", "url", r.url, "provider", r.provider.Name())
+	}
+	return slog.Group("registry", "url", r.url)
+}
+
+// registries are the push targets, REGISTRY_URL first.
+var registries []*targetRegistry
+
+func newTargetRegistry(url, username, password string) *targetRegistry {
+	host := registryHost(url)
+	return &targetRegistry{url: url, host: host, provider: newRegistryProvider(host), username: username, password: password}
+}
+
+// registryHost is the host, with any port, of a registry URL or image
+// reference.
+func registryHost(ref string) string {
+	return strings.SplitN(strings.TrimPrefix(strings.TrimPrefix(ref, "https://"), "http://"), "/", 2)[0]
+}
+
+// plainHTTP reports whether the registry of ref is reached without TLS.
+func plainHTTP(ref string) bool {
+	return strings.HasPrefix(registryAPIURL(ref), "http://")
+}
+
+// credentials returns the username and password to push with: the
+// provider's if the registry has one, otherwise the fixed ones.
+func (r *targetRegistry) credentials() (string, string, error) {
+	if r.provider != nil {
+		return r.provider.credentials()
+	}
+	return r.username, r.password, nil
+}
+
+// readAuthFile reads the registry logins in a docker config.json, by
+// registry host, as user name and password pairs.
+func readAuthFile(path string) (map[string][2]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	logins := make(map[string][2]string, len(config.Auths))
+	for host, auth := range config.Auths {
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("decoding login for %s: %w", host, err)
+			}
+			pair := strings.SplitN(string(decoded), ":", 2)
+			auth.Username, auth.Password = pair[0], pair[len(pair)-1]
+		}
+		logins[registryHost(host)] = [2]string{auth.Username, auth.Password}
+	}
+	return logins, nil
+}
+
+// registryFor returns the push target ref is in, or nil if it is in none.
+func registryFor(ref string) *targetRegistry {
+	host := registryHost(ref)
+	for _, r := range registries {
+		if r.host == host {
+			return r
+		}
+	}
+	return nil
+}
+
+var (
+	registryClientsMu sync.Mutex
+	registryClients   = map[string]*registryClient{}
+)
+
+// registryClientFor returns a client for the registry at host: the one for
+// REGISTRY_URL, or one made on first use with the credentials of the push
+// target there, if any.
+func registryClientFor(host string) *registryClient {
+	if host == registries[0].host {
+		return registry
+	}
+	registryClientsMu.Lock()
+	defer registryClientsMu.Unlock()
+	if c, ok := registryClients[host]; ok {
+		return c
+	}
+	credentials := func() (string, string, error) { return "", "", nil }
+	if r := registryFor(host); r != nil {
+		credentials = r.credentials
+	}
+	c := newRegistryClient(registryAPIURL(host), credentials)
+	registryClients[host] = c
+	return c
+}
+
+// promotionRegistries are the PROMOTION_REGISTRIES images can be promoted
+// to.
+var promotionRegistries []*targetRegistry
+
+// promotionRegistryFor returns the promotion registry ref is in, or nil.
+func promotionRegistryFor(ref string) *targetRegistry {
+	host := registryHost(ref)
+	for _, r := range promotionRegistries {
+		if r.host == host {
+			return r
+		}
+	}
+	return nil
+}
+
+// credentialsFor returns the credentials to push ref with, empty for refs
+// outside the push targets.
+func credentialsFor(ref string) (string, string, error) {
+	if r := registryFor(ref); r != nil {
+		return r.credentials()
+	}
+	return "", "", nil
+}
+
+// prepareRegistry readies the registries for pushing to the repositories
+// of refs, images or bare repositories. Refs outside the push targets or
+// in plain registries are skipped.
+func prepareRegistry(refs ...string) error {
+	for _, ref := range refs {
+		r := registryFor(ref)
+		if ref == "" || r == nil || r.provider == nil {
+			continue
+		}
+		repository := strings.TrimPrefix(ref, r.host+"/")
+		if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+			repository = repository[:i]
+		}
+		if err := r.provider.ensureRepository(repository); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registryAPIURL derives the API endpoint from REGISTRY_URL. Local registries
+// are assumed to speak plain HTTP, matching docker's own defaults.
+func registryAPIURL(registryURL string) string {
+	if strings.HasPrefix(registryURL, "http://") || strings.HasPrefix(registryURL, "https://") {
+		return registryURL
+	}
+	host := strings.Split(registryURL, "/")[0]
+	hostname := strings.Split(host, ":")[0]
+	if hostname == "localhost" || hostname == "127.0.0.1" {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+// repositoryPath is the repository name for IMAGE_NAME within the registry,
+// including any namespace carried in REGISTRY_URL (e.g. ghcr.io/org).
+func repositoryPath() string {
+	parts := strings.SplitN(strings.TrimPrefix(strings.TrimPrefix(REGISTRY_URL, "https://"), "http://"), "/", 2)
+	if len(parts) == 2 && parts[1] != "" {
+		return strings.Trim(parts[1], "/") + "/" + IMAGE_NAME
+	}
+	return IMAGE_NAME
+}
+
+// do sends req, transparently completing an auth challenge for scope.
+func (c *registryClient) do(req *http.Request, scope string) (*http.Response, error) {
+	username, password, err := c.credentials()
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req, scope, username, password)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	if err := c.login(challenge, scope, username, password); err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	c.authorize(retry, scope, username, password)
+	return c.http.Do(retry)
+}
+
+func (c *registryClient) authorize(req *http.Request, scope, username, password string) {
+	c.mu.Lock()
+	token := c.tokens[scope]
+	c.mu.Unlock()
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case username != "":
+		req.SetBasicAuth(username, password)
+	}
+}
+
+// login answers a WWW-Authenticate challenge. Basic challenges are handled by
+// authorize; Bearer challenges need a token from the advertised realm.
+func (c *registryClient) login(challenge, scope, username, password string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		if username == "" {
+			return fmt.Errorf("registry requires authentication: %s", challenge)
+		}
+		return fmt.Errorf("registry rejected the configured credentials")
+	}
+	params := parseChallenge(strings.TrimPrefix(challenge, "Bearer "))
+	realm := params["realm"]
+	if realm == "" {
+		return fmt.Errorf("malformed auth challenge: %s", challenge)
+	}
+
+	q := url.Values{}
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	}
+	req, err := http.NewRequest(http.MethodGet, realm+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request to %s failed: %s", realm, resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("decoding token response: %w", err)
+	}
+	token := body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	c.mu.Lock()
+	c.tokens[scope] = token
+	c.mu.Unlock()
+	return nil
+}
+
+// parseChallenge splits `realm="...",service="...",scope="..."`.
+func parseChallenge(s string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return params
+}
+
+// copyTag points repository:to at the manifest of repository:from, within
+// the registry, without pulling or pushing any layers.
+func (c *registryClient) copyTag(repository, from, to string) error {
+	get, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repository, from), nil)
+	if err != nil {
+		return err
+	}
+	get.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	scope := "repository:" + repository + ":pull,push"
+	resp, err := c.do(get, scope)
+	if err != nil {
+		return err
+	}
+	manifest, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("reading manifest %s:%s: %s", repository, from, resp.Status)
+	}
+
+	put, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repository, to), bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	put.Header.Set("Content-Type", resp.Header.Get("Content-Type"))
+	resp, err = c.do(put, scope)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("writing manifest %s:%s: %s", repository, to, resp.Status)
+	}
+	return nil
+}
+
+// imageDetails resolves repository:tag in the registry to the digest of
+// its manifest and the compressed size of its config and layers, summed
+// over the platforms of a multi-platform image.
+func (c *registryClient) imageDetails(repository, tag string) (string, int64, error) {
+	digest, manifest, err := c.manifest(repository, tag)
+	if err != nil {
+		return "", 0, err
+	}
+	var parsed struct {
+		Config struct {
+			Size int64 `json:"size"`
+		} `json:"config"`
+		Layers []struct {
+			Size int64 `json:"size"`
+		} `json:"layers"`
+		Manifests []struct {
+			Digest      string            `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(manifest, &parsed); err != nil {
+		return "", 0, fmt.Errorf("decoding manifest %s:%s: %w", repository, tag, err)
+	}
+	size := parsed.Config.Size
+	for _, layer := range parsed.Layers {
+		size += layer.Size
+	}
+	for _, platform := range parsed.Manifests {
+		if platform.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+			continue
+		}
+		_, platformSize, err := c.imageDetails(repository, platform.Digest)
+		if err != nil {
+			return "", 0, err
+		}
+		size += platformSize
+	}
+	return digest, size, nil
+}
+
+// manifest fetches the manifest of repository:reference along with its
+// digest.
+func (c *registryClient) manifest(repository, reference string) (string, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repository, reference), nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, err := c.do(req, "repository:"+repository+":pull")
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("reading manifest %s:%s: %s", repository, reference, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	}
+	return digest, body, nil
+}
+
+// listTags returns every tag in repository, following the registry's
+// pagination. A repository nothing was pushed to yet has no tags.
+func (c *registryClient) listTags(repository string) ([]string, error) {
+	var tags []string
+	next := fmt.Sprintf("/v2/%s/tags/list?n=1000", repository)
+	for next != "" {
+		req, err := http.NewRequest(http.MethodGet, c.baseURL+next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req, "repository:"+repository+":pull")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return tags, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("listing tags of %s: %s", repository, resp.Status)
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding tags of %s: %w", repository, err)
+		}
+		tags = append(tags, page.Tags...)
+
+		// Link: </v2/airflow/tags/list?last=x&n=1000>; rel="next"
+		next = ""
+		if link := resp.Header.Get("Link"); strings.Contains(link, `rel="next"`) {
+			next = strings.Trim(strings.SplitN(link, ";", 2)[0], "<> ")
+		}
+	}
+	return tags, nil
+}
+
+// digestOf returns the digest repository:tag points at, or "" if there is
+// no such tag.
+func (c *registryClient) digestOf(repository, tag string) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repository, tag), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, err := c.do(req, "repository:"+repository+":pull")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", nil
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("unexpected registry response: %s", resp.Status)
+	case resp.Header.Get("Docker-Content-Digest") != "":
+		return resp.Header.Get("Docker-Content-Digest"), nil
+	}
+	// Not every registry sends the digest on HEAD.
+	digest, _, err := c.manifest(repository, tag)
+	return digest, err
+}
+
+// deleteManifest deletes reference, a tag or digest, from repository.
+// Deleting a digest removes the manifest and every tag on it; deleting a
+// tag only unties it, which registries predating OCI distribution 1.1 do
+// not support, reported as false.
+func (c *registryClient) deleteManifest(repository, reference string) (bool, error) {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repository, reference), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(req, "repository:"+repository+":pull,push,delete")
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusOK:
+		return true, nil
+	case resp.StatusCode == http.StatusMethodNotAllowed && strings.HasPrefix(reference, "sha256:"):
+		return false, fmt.Errorf("the registry does not allow deleting images (for the Docker registry, set REGISTRY_STORAGE_DELETE_ENABLED=true)")
+	case resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusBadRequest:
+		return false, nil
+	default:
+		return false, fmt.Errorf("deleting %s:%s: %s", repository, reference, resp.Status)
+	}
+}
+
+// tagExists reports whether repository:tag has a manifest in the registry.
+func (c *registryClient) tagExists(repository, tag string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repository, tag), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, err := c.do(req, "repository:"+repository+":pull")
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected registry response: %s", resp.Status)
+	}
+}
+
+// ping checks the registry answers on the v2 API base. An auth challenge
+// counts: it says the registry is up, and signing in is left to builds.
+func (c *registryClient) ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("registry %s: %s", c.baseURL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// registryCAs are the system roots plus REGISTRY_CA_FILE, and
+// registryCertDir holds REGISTRY_CA_FILE laid out for the tools that take
+// a directory: ca.crt at the top for buildah, podman and Go's SSL_CERT_DIR,
+// and hosts/<host>/ca.crt for containerd's hosts directory. Both are unset
+// without REGISTRY_CA_FILE.
+var (
+	registryCAs     *x509.CertPool
+	registryCertDir string
+)
+
+// loadRegistryCA reads REGISTRY_CA_FILE and writes registryCertDir.
+func loadRegistryCA() error {
+	pem, err := os.ReadFile(REGISTRY_CA_FILE)
+	if err != nil {
+		return err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("no PEM certificates found")
+	}
+	dir, err := os.MkdirTemp("", "registry-ca-")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ca.crt"), pem, 0644); err != nil {
+		return err
+	}
+	for _, host := range registryHosts() {
+		if err := os.MkdirAll(filepath.Join(dir, "hosts", host), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "hosts", host, "ca.crt"), pem, 0644); err != nil {
+			return err
+		}
+	}
+	registryCAs, registryCertDir = pool, dir
+	return nil
+}
+
+// registryHosts are the hosts of every registry the factory pushes to,
+// pulls from or caches in.
+func registryHosts() []string {
+	refs := []string{BUILD_CACHE_REPO, KANIKO_CACHE_REPO, BASE_IMAGE_MIRROR}
+	for _, r := range append(append([]*targetRegistry(nil), registries...), promotionRegistries...) {
+		refs = append(refs, r.url)
+	}
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		if host := registryHost(ref); ref != "" && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// insecureRegistry reports whether the registry of ref is listed in
+// INSECURE_REGISTRIES, so its TLS certificate is not verified.
+func insecureRegistry(ref string) bool {
+	host := registryHost(ref)
+	for _, h := range INSECURE_REGISTRIES {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// registryTransport is the HTTP transport for the registry API at apiURL,
+// trusting REGISTRY_CA_FILE and skipping verification for
+// INSECURE_REGISTRIES.
+func registryTransport(apiURL string) http.RoundTripper {
+	if registryCAs == nil && !insecureRegistry(apiURL) {
+		return http.DefaultTransport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: registryCAs, InsecureSkipVerify: insecureRegistry(apiURL)}
+	return transport
+}
+
+// registryCAEnv adds REGISTRY_CA_FILE to the roots of the Go tools the
+// factory runs against registries (trivy, syft, oras, cosign), which read
+// the certificates in SSL_CERT_DIR on top of the system's bundle.
+func registryCAEnv(env []string) []string {
+	if registryCertDir == "" {
+		return env
+	}
+	return append(env, "SSL_CERT_DIR="+registryCertDir)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadableKeys are the settings a changed CONFIG_FILE applies to a
+// running factory. The others take a restart.
+var reloadableKeys = []string{
+	"BASE_IMAGE_ALLOWLIST",
+	"MAX_CONCURRENT_BUILDS",
+	"NOTIFY_EMAIL_TO",
+	"SLACK_WEBHOOK_URL",
+	"WEBHOOK_URL",
+}
+
+// reloadMu guards the settings in reloadableKeys, once the service runs.
+var reloadMu sync.RWMutex
+
+// configCheckInterval is how often CONFIG_FILE is checked for changes.
+const configCheckInterval = 30 * time.Second
+
+// watchConfig reloads CONFIG_FILE when it changes and on SIGHUP, so that
+// concurrency, base image and notification settings can change without a
+// restart losing the build queue.
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+
+	var modified time.Time
+	if info, err := os.Stat(CONFIG_FILE); err == nil {
+		modified = info.ModTime()
+	}
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			info, err := os.Stat(CONFIG_FILE)
+			if err != nil || info.ModTime().Equal(modified) {
+				continue
+			}
+			modified = info.ModTime()
+		}
+		if err := reloadConfig(); err != nil {
+			slog.Error("Reloading config file, keeping the previous settings", "path", CONFIG_FILE, "error", err)
+		}
+	}
+}
+
+// reloadConfig applies CONFIG_FILE's reloadable settings, unless a flag or
+// the environment gives them, and warns about changes to the others. The
+// file is validated as a whole before anything is applied.
+func reloadConfig() error {
+	settings, err := readConfigFile(CONFIG_FILE)
+	if err != nil {
+		return err
+	}
+	reloadable := make(map[string]bool, len(reloadableKeys))
+	for _, key := range reloadableKeys {
+		reloadable[key] = true
+	}
+	var changed, restart []string
+	for _, key := range configKeys {
+		if configFixed[key] || settings[key] == os.Getenv(key) {
+			continue
+		}
+		if reloadable[key] {
+			changed = append(changed, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+
+	concurrency := MAX_CONCURRENT_BUILDS
+	if !configFixed["MAX_CONCURRENT_BUILDS"] {
+		if concurrency, err = maxConcurrentBuilds(settings["MAX_CONCURRENT_BUILDS"]); err != nil {
+			return fmt.Errorf("invalid MAX_CONCURRENT_BUILDS %q: %w", settings["MAX_CONCURRENT_BUILDS"], err)
+		}
+	}
+	reloadMu.Lock()
+	for _, key := range changed {
+		v := settings[key]
+		os.Setenv(key, v)
+		switch key {
+		case "BASE_IMAGE_ALLOWLIST":
+			BASE_IMAGE_ALLOWLIST = splitList(v)
+		case "MAX_CONCURRENT_BUILDS":
+			MAX_CONCURRENT_BUILDS = concurrency
+		case "NOTIFY_EMAIL_TO":
+			NOTIFY_EMAIL_TO = splitList(v)
+		case "SLACK_WEBHOOK_URL":
+			SLACK_WEBHOOK_URL = v
+		case "WEBHOOK_URL":
+			WEBHOOK_URL = v
+		}
+	}
+	reloadMu.Unlock()
+
+	if len(changed) > 0 {
+		if FACTORY_MODE == modeStandalone && concurrency != workers.size() {
+			workers.resize(concurrency)
+		}
+		slog.Info("Reloaded config file", "path", CONFIG_FILE, "changed", changed)
+	}
+	if len(restart) > 0 {
+		slog.Warn("Config file changes need a restart", "path", CONFIG_FILE, "settings", restart)
+	}
+	return nil
+}
+
+// maxConcurrentBuilds parses MAX_CONCURRENT_BUILDS, which defaults to 2,
+// or 1 with BUILD_BACKEND=kaniko, the most that backend can run.
+func maxConcurrentBuilds(v string) (int, error) {
+	if v == "" {
+		if BUILD_BACKEND == backendKaniko {
+			return 1, nil // default value
+		}
+		return 2, nil // default value
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("must be a positive integer")
+	}
+	if BUILD_BACKEND == backendKaniko && n > 1 {
+		return 0, fmt.Errorf("BUILD_BACKEND=kaniko builds in the factory's own filesystem and requires MAX_CONCURRENT_BUILDS=1")
+	}
+	return n, nil
+}
+
+// splitList splits a comma-separated setting, dropping blank items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func baseImageAllowlist() []string {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return BASE_IMAGE_ALLOWLIST
+}
+
+func notifyEmailTo() []string {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return NOTIFY_EMAIL_TO
+}
+
+func slackWebhookURL() string {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return SLACK_WEBHOOK_URL
+}
+
+func webhookURL() string {
+	reloadMu.RLock()
+	defer reloadMu.RUnlock()
+	return WEBHOOK_URL
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// envelope is the body of every error response, and the shape a build
+// answers in: the build concerned, if any, with its status, image and
+// digest, and the errors that stopped the request or the build. Clients
+// can parse any response the API gives as one.
+type envelope struct {
+	BuildID string `json:"build_id,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Image   string `json:"image,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+	// ErrorCode is why the request or build failed, one of the failure
+	// codes, where one applies.
+	ErrorCode string       `json:"error_code,omitempty"`
+	Errors    []fieldError `json:"errors"`
+}
+
+// Codes of errors that are not about a field, one per HTTP status.
+const (
+	codeBadRequest       = "bad_request"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeConflict         = "conflict"
+	codeUnprocessable    = "unprocessable"
+	codeRateLimited      = "rate_limited"
+	codeInternal         = "internal"
+	codeUpstream         = "upstream"
+	codeUnavailable      = "unavailable"
+)
+
+// codeQuotaExceeded is a 429 for a project at a quota, unlike rate_limited
+// not cleared by slowing down.
+const codeQuotaExceeded = "quota_exceeded"
+
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          codeBadRequest,
+	http.StatusUnauthorized:        codeUnauthorized,
+	http.StatusForbidden:           codeForbidden,
+	http.StatusNotFound:            codeNotFound,
+	http.StatusMethodNotAllowed:    codeMethodNotAllowed,
+	http.StatusConflict:            codeConflict,
+	http.StatusUnprocessableEntity: codeUnprocessable,
+	http.StatusTooManyRequests:     codeRateLimited,
+	http.StatusInternalServerError: codeInternal,
+	http.StatusBadGateway:          codeUpstream,
+	http.StatusServiceUnavailable:  codeUnavailable,
+}
+
+// httpError is http.Error answering in an envelope, its one error coded
+// for status.
+func httpError(w http.ResponseWriter, message string, status int) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = codeInternal
+		if status < http.StatusInternalServerError {
+			code = codeBadRequest
+		}
+	}
+	writeEnvelope(w, status, envelope{Errors: []fieldError{{Code: code, Message: message}}})
+}
+
+// buildError is httpError about build b, which the envelope names.
+func buildError(w http.ResponseWriter, b Build, message string, status int) {
+	writeEnvelope(w, status, envelope{
+		BuildID:   b.ID,
+		Status:    string(b.Status),
+		Image:     b.Image,
+		Digest:    b.Digest,
+		ErrorCode: b.ErrorCode,
+		Errors:    []fieldError{{Code: statusCodes[status], Message: message}},
+	})
+}
+
+// writeSpecError is writeError for a build spec: a bad request is coded
+// INVALID_SPEC.
+func writeSpecError(w http.ResponseWriter, err error) {
+	var br badRequest
+	if !errors.As(err, &br) {
+		writeError(w, err)
+		return
+	}
+	failed := br.fields
+	if len(failed) == 0 {
+		failed = []fieldError{{Code: codeBadRequest, Message: br.msg}}
+	}
+	writeEnvelope(w, http.StatusBadRequest, envelope{ErrorCode: failureInvalidSpec, Errors: failed})
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, body envelope) {
+	if body.Errors == nil {
+		body.Errors = []fieldError{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// buildResponse is how the API shows a build: the build itself, with the
+// envelope's build_id and errors alongside, so a failed build reads like a
+// failed request. The error of a failed build is coded with its failure
+// code.
+type buildResponse struct {
+	BuildID string `json:"build_id"`
+	Build
+	Errors []fieldError `json:"errors"`
+}
+
+func newBuildResponse(b Build) buildResponse {
+	resp := buildResponse{BuildID: b.ID, Build: b, Errors: []fieldError{}}
+	if b.Error != "" {
+		code := b.ErrorCode
+		if code == "" {
+			// Failed before failures were coded.
+			code = failureBuild
+		}
+		resp.Errors = append(resp.Errors, fieldError{Code: code, Message: b.Error})
+	}
+	return resp
+}
+
+func newBuildResponses(list []Build) []buildResponse {
+	resp := make([]buildResponse, len(list))
+	for i, b := range list {
+		resp[i] = newBuildResponse(b)
+	}
+	return resp
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// workspaceGrace keeps the sweeper away from workspaces that were created
+// moments ago and not yet registered as in use.
+const workspaceGrace = time.Hour
+
+// activeWorkspaces holds the workspace directories of builds running in this
+// process, which the sweeper must leave alone.
+var activeWorkspaces sync.Map
+
+// runRetention prunes old build history, registry tags and stale
+// workspaces every RETENTION_INTERVAL. Pruning only touches the store when
+// RETENTION_DAYS or RETENTION_MAX_BUILDS is set, and the registry when a
+// TAG_RETENTION_* limit is; expired idempotency keys and workspaces are
+// always swept. Tags go first, so builds are still on record when their
+// images are judged.
+func runRetention(pruneStore bool) {
+	for {
+		if pruneStore {
+			pruneIdempotencyKeys()
+		}
+		if pruneStore && tagRetentionEnabled() {
+			pruneTags()
+		}
+		if pruneStore && (RETENTION_DAYS > 0 || RETENTION_MAX_BUILDS > 0) {
+			pruneBuilds()
+		}
+		sweepWorkspaces()
+		time.Sleep(RETENTION_INTERVAL)
+	}
+}
+
+func pruneBuilds() {
+	var cutoff time.Time
+	if RETENTION_DAYS > 0 {
+		cutoff = time.Now().UTC().AddDate(0, 0, -RETENTION_DAYS)
+	}
+	pruned, err := builds.store.pruneBuilds(cutoff, RETENTION_MAX_BUILDS)
+	if err != nil {
+		slog.Error("Pruning build history", "error", err)
+		return
+	}
+	builds.forget(pruned)
+	if len(pruned) > 0 {
+		slog.Info("Pruned builds past the retention policy", "builds", len(pruned))
+	}
+}
+
+// pruneIdempotencyKeys forgets the Idempotency-Keys past idempotencyTTL,
+// which claiming a key would otherwise only do for that one key.
+func pruneIdempotencyKeys() {
+	if _, err := builds.store.pruneIdempotencyKeys(time.Now().Add(-idempotencyTTL)); err != nil {
+		slog.Error("Pruning idempotency keys", "error", err)
+	}
+}
+
+// sweepWorkspaces removes build workspaces left behind by a crash or a
+// killed process; finished builds clean up after themselves.
+func sweepWorkspaces() {
+	entries, err := os.ReadDir(WORKSPACE_DIR)
+	if err != nil {
+		slog.Error("Sweeping workspaces", "error", err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), workspacePrefix) {
+			continue
+		}
+		path := filepath.Join(WORKSPACE_DIR, entry.Name())
+		if _, inUse := activeWorkspaces.Load(path); inUse {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < workspaceGrace {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			slog.Warn("Removing stale workspace", "path", path, "error", err)
+			continue
+		}
+		slog.Info("Removed stale workspace", "path", path)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// transientMarkers are output fragments that indicate a network or registry
+// hiccup rather than a problem with the spec itself. A build whose output
+// contains none of these is assumed to fail the same way every time.
+var transientMarkers = []string{
+	"connection reset by peer",
+	"connection refused",
+	"i/o timeout",
+	"tls handshake timeout",
+	"temporary failure in name resolution",
+	"no such host",
+	"unexpected eof",
+	"client.timeout exceeded",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+	"toomanyrequests",
+	"readtimeouterror",
+	"connectionerror",
+	"max retries exceeded",
+	"could not resolve",
+	"failed to fetch",
+}
+
+func isTransient(lines []string) bool {
+	for _, line := range lines {
+		lower := strings.ToLower(line)
+		for _, marker := range transientMarkers {
+			if strings.Contains(lower, marker) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runWithRetry runs one attempt of a step via run, retrying with exponential
+// backoff while the failure looks transient. Both the output logged during
+// the attempt and the returned error are checked, since the daemon's
+// connection errors never reach the log.
+func runWithRetry(ctx context.Context, step string, output *buildLog, run func() error) error {
+	backoff := BUILD_RETRY_BACKOFF
+	for attempt := 1; ; attempt++ {
+		mark := output.len()
+		err := run()
+		if err == nil || ctx.Err() != nil || attempt >= BUILD_RETRY_ATTEMPTS {
+			return err
+		}
+		if !isTransient(append(output.linesSince(mark), err.Error())) {
+			return err
+		}
+
+		msg := fmt.Sprintf("%s failed with a transient error, retrying in %s (attempt %d/%d)",
+			step, backoff, attempt+1, BUILD_RETRY_ATTEMPTS)
+		slog.Warn("Retrying build step", "build_id", output.buildID, "step", step, "attempt", attempt+1, "backoff", backoff.String())
+		output.append(msg)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
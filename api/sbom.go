@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// sbomMediaTypes are the SBOM_FORMAT values syft is asked for, with the
+// media type the document is attached and served as.
+var sbomMediaTypes = map[string]string{
+	"spdx-json":      "application/spdx+json",
+	"cyclonedx-json": "application/vnd.cyclonedx+json",
+}
+
+// attachDigestPattern matches the digest oras prints for an attached
+// artifact, e.g. "Digest: sha256:...".
+var attachDigestPattern = regexp.MustCompile(`Digest: (sha256:[0-9a-f]{64})`)
+
+// generateSBOM catalogues the pushed image with syft, straight from the
+// registry, and attaches the SBOM to it as an OCI referrer with oras, so
+// `oras discover` or `cosign tree` finds it next to the image. It returns
+// the SBOM document.
+func generateSBOM(ctx context.Context, image, digest, workspace string, output *buildLog) ([]byte, error) {
+	if digest == "" {
+		return nil, errors.New("the builder did not report the pushed digest")
+	}
+	configDir, err := os.MkdirTemp("", "sbom-auth-")
+	if err != nil {
+		return nil, fmt.Errorf("Creating registry config: %w", err)
+	}
+	defer os.RemoveAll(configDir)
+	if err := writeRegistryConfig(configDir); err != nil {
+		return nil, fmt.Errorf("Writing registry config: %w", err)
+	}
+	ref := image[:strings.LastIndex(image, ":")] + "@" + digest
+	file := "sbom.json"
+
+	scan := exec.CommandContext(ctx, SYFT_BINARY, "scan", "registry:"+ref, "-o", SBOM_FORMAT+"="+filepath.Join(workspace, file))
+	scan.Env = registryCAEnv(append(os.Environ(), "DOCKER_CONFIG="+configDir))
+	if plainHTTP(image) {
+		scan.Env = append(scan.Env, "SYFT_REGISTRY_INSECURE_USE_HTTP=true")
+	}
+	if insecureRegistry(image) {
+		scan.Env = append(scan.Env, "SYFT_REGISTRY_INSECURE_SKIP_TLS_VERIFY=true")
+	}
+	if err := runLogged(scan, output); err != nil {
+		return nil, fmt.Errorf("syft scan: %w", err)
+	}
+	sbom, err := os.ReadFile(filepath.Join(workspace, file))
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType := sbomMediaTypes[SBOM_FORMAT]
+	attached, err := attachArtifact(ctx, ref, workspace, file, mediaType, configDir, output)
+	if err != nil {
+		return nil, err
+	}
+	logLine(output, strings.TrimSpace(fmt.Sprintf("Attached %s SBOM to %s %s", SBOM_FORMAT, ref, attached)))
+	return sbom, nil
+}
+
+// attachArtifact attaches file, in workspace, to ref as an OCI referrer of
+// artifactType with oras, signing in with the docker config in configDir.
+// It returns the artifact's digest, or "" if oras did not print it.
+func attachArtifact(ctx context.Context, ref, workspace, file, artifactType, configDir string, output *buildLog) (string, error) {
+	args := []string{"attach", "--artifact-type", artifactType, "--registry-config", filepath.Join(configDir, "config.json")}
+	if plainHTTP(ref) {
+		args = append(args, "--plain-http")
+	}
+	if insecureRegistry(ref) {
+		args = append(args, "--insecure")
+	}
+	args = append(args, ref, file+":"+artifactType)
+	attach := exec.CommandContext(ctx, ORAS_BINARY, args...)
+	attach.Env = registryCAEnv(os.Environ())
+	attach.Dir = workspace
+	mark := output.len()
+	if err := runLogged(attach, output); err != nil {
+		return "", fmt.Errorf("oras attach: %w", err)
+	}
+	for _, line := range output.linesSince(mark) {
+		if m := attachDigestPattern.FindStringSubmatch(line); m != nil {
+			return m[1], nil
+		}
+	}
+	return "", nil
+}
+
+// getBuildSBOM serves the SBOM of the image a build produced. Builds that
+// were skipped serve the SBOM of the build that pushed the image.
+func getBuildSBOM(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	build, ok := allowedBuild(w, r, id)
+	if !ok {
+		return
+	}
+	format, sbom, err := builds.store.getSBOM(build.Tag)
+	if err == errSBOMNotFound {
+		httpError(w, "No SBOM for this build", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Loading build SBOM", "build_id", id, "error", err)
+		httpError(w, "Loading SBOM failed", http.StatusInternalServerError)
+		return
+	}
+	mediaType := sbomMediaTypes[format]
+	if mediaType == "" {
+		mediaType = "application/json"
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Write(sbom)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// severities ranks Trivy's severities, lowest first.
+var severities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// maxFindings caps the findings kept in a build record; the counts cover
+// the rest.
+const maxFindings = 100
+
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if s == severity {
+			return i
+		}
+	}
+	return 0
+}
+
+// VulnerabilityReport summarises a vulnerability scan of a build's image.
+type VulnerabilityReport struct {
+	Counts    map[string]int  `json:"counts"`              // by severity
+	Threshold string          `json:"threshold,omitempty"` // VULN_FAIL_SEVERITY at scan time
+	Passed    bool            `json:"passed"`              // nothing at or above Threshold
+	Findings  []Vulnerability `json:"findings,omitempty"`  // the most severe first
+}
+
+// Vulnerability is one finding of a scan.
+type Vulnerability struct {
+	ID               string `json:"id"`
+	Severity         string `json:"severity"`
+	Package          string `json:"package"`
+	InstalledVersion string `json:"installed_version"`
+	FixedVersion     string `json:"fixed_version,omitempty"`
+}
+
+// gateFailure explains why the report fails VULN_FAIL_SEVERITY.
+func (r *VulnerabilityReport) gateFailure() string {
+	var parts []string
+	for i := len(severities) - 1; i >= severityRank(r.Threshold); i-- {
+		if n := r.Counts[severities[i]]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, severities[i]))
+		}
+	}
+	return fmt.Sprintf("Vulnerability scan found %s, at or above VULN_FAIL_SEVERITY=%s", strings.Join(parts, ", "), r.Threshold)
+}
+
+// scanStep scans the built image with Trivy: the local copy if the builder
+// has one and ref is empty, otherwise ref, the pushed image by digest. It
+// returns the report, and the outcome to end the build with if the image
+// fails the severity gate or cannot be scanned while a gate is set.
+func scanStep(ctx, traceCtx context.Context, job *buildJob, b builder, workspace, ref string) (*VulnerabilityReport, *buildOutcome) {
+	var report *VulnerabilityReport
+	err := runStep(ctx, traceCtx, job, "trivy scan", b.Logs(), func() error {
+		var err error
+		report, err = scanImage(ctx, b, workspace, ref)
+		return err
+	})
+	if err != nil {
+		if ctx.Err() == nil && VULN_FAIL_SEVERITY == "" {
+			logLine(b.Logs(), fmt.Sprintf("Vulnerability scan failed: %s", err))
+			return nil, nil
+		}
+		outcome := stepFailure(ctx, job, "trivy scan", err, b.Logs())
+		return nil, &outcome
+	}
+	logLine(b.Logs(), fmt.Sprintf("Vulnerability scan: %d critical, %d high, %d medium, %d low",
+		report.Counts["CRITICAL"], report.Counts["HIGH"], report.Counts["MEDIUM"], report.Counts["LOW"]))
+	if !report.Passed {
+		msg := report.gateFailure()
+		slog.Warn("Vulnerability scan failed", "build_id", job.BuildID, "error", msg)
+		return report, &buildOutcome{Status: StatusFailed, ErrorCode: failureVulnerabilities, Error: msg, Vulnerabilities: report}
+	}
+	return report, nil
+}
+
+// scanImage runs TRIVY_BINARY against the image and summarises its JSON
+// report.
+func scanImage(ctx context.Context, b builder, workspace, ref string) (*VulnerabilityReport, error) {
+	reportFile := filepath.Join(workspace, "trivy.json")
+	args := []string{"image", "--quiet", "--scanners", "vuln", "--format", "json", "--output", reportFile}
+	if VULN_IGNORE_UNFIXED {
+		args = append(args, "--ignore-unfixed")
+	}
+	env := registryCAEnv(os.Environ())
+	if ref == "" {
+		archive := filepath.Join(workspace, "image.tar")
+		defer os.Remove(archive)
+		if err := b.(imageExporter).ExportImage(ctx, archive); err != nil {
+			return nil, fmt.Errorf("exporting image: %w", err)
+		}
+		args = append(args, "--input", archive)
+	} else {
+		configDir, err := os.MkdirTemp("", "trivy-auth-")
+		if err != nil {
+			return nil, fmt.Errorf("Creating registry config: %w", err)
+		}
+		defer os.RemoveAll(configDir)
+		if err := writeRegistryConfig(configDir); err != nil {
+			return nil, fmt.Errorf("Writing registry config: %w", err)
+		}
+		env = append(env, "DOCKER_CONFIG="+configDir)
+		if plainHTTP(ref) || insecureRegistry(ref) {
+			env = append(env, "TRIVY_INSECURE=true")
+		}
+		args = append(args, ref)
+	}
+	cmd := exec.CommandContext(ctx, TRIVY_BINARY, args...)
+	cmd.Env = env
+	if err := runLogged(cmd, b.Logs()); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(reportFile)
+	if err != nil {
+		return nil, err
+	}
+	var parsed struct {
+		Results []struct {
+			Vulnerabilities []struct {
+				VulnerabilityID  string
+				PkgName          string
+				InstalledVersion string
+				FixedVersion     string
+				Severity         string
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("decoding Trivy report: %w", err)
+	}
+
+	report := &VulnerabilityReport{Counts: make(map[string]int), Threshold: VULN_FAIL_SEVERITY, Passed: true}
+	for _, result := range parsed.Results {
+		for _, v := range result.Vulnerabilities {
+			report.Counts[v.Severity]++
+			if VULN_FAIL_SEVERITY != "" && severityRank(v.Severity) >= severityRank(VULN_FAIL_SEVERITY) {
+				report.Passed = false
+			}
+			report.Findings = append(report.Findings, Vulnerability{
+				ID: v.VulnerabilityID, Severity: v.Severity, Package: v.PkgName,
+				InstalledVersion: v.InstalledVersion, FixedVersion: v.FixedVersion,
+			})
+		}
+	}
+	sort.SliceStable(report.Findings, func(i, j int) bool {
+		return severityRank(report.Findings[i].Severity) > severityRank(report.Findings[j].Severity)
+	})
+	if len(report.Findings) > maxFindings {
+		report.Findings = report.Findings[:maxFindings]
+	}
+	return report, nil
+}
+
+// discardRejectedImage deletes an image that failed the severity gate after
+// it was pushed, so the next identical request rebuilds it instead of
+// finding it in the registry.
+func discardRejectedImage(id, digest string) {
+	b, _ := builds.get(id)
+	client, repository := imageRepository(b)
+	if _, err := client.deleteManifest(repository, digest); err != nil {
+		slog.Error("Deleting image that failed the vulnerability scan", "build_id", id, "error", err)
+		return
+	}
+	slog.Info("Deleted image that failed the vulnerability scan", "build_id", id, "digest", digest)
+	audit(context.Background(), AuditEntry{Actor: "vulnerability-scan", Action: auditImageDelete, BuildID: id, SpecHash: b.Tag, Image: b.Image, Digest: digest})
+}
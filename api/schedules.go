@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// schedulerInterval is how often due schedules are looked for. Cron
+// expressions have minute resolution, so this only needs to be well under a
+// minute.
+const schedulerInterval = 20 * time.Second
+
+var errScheduleNotFound = errors.New("schedule not found")
+
+// Schedule is a saved build spec that is rebuilt on a cron expression, so
+// images regularly pick up patched base images and dependencies.
+type Schedule struct {
+	ID          string             `json:"id"`
+	Name        string             `json:"name"`
+	Cron        string             `json:"cron"`
+	Spec        DockerBuildRequest `json:"spec"`
+	Enabled     bool               `json:"enabled"`
+	NextRunAt   time.Time          `json:"next_run_at"`
+	LastRunAt   *time.Time         `json:"last_run_at,omitempty"`
+	LastBuildID string             `json:"last_build_id,omitempty"`
+	CreatedAt   time.Time          `json:"created_at"`
+}
+
+type createScheduleRequest struct {
+	Name    string             `json:"name"`
+	Cron    string             `json:"cron"`
+	Spec    DockerBuildRequest `json:"spec"`
+	Enabled *bool              `json:"enabled"`
+}
+
+// nextRun returns the first activation of expr strictly after t.
+func nextRun(expr string, t time.Time) (time.Time, error) {
+	sched, err := cron.ParseStandard(expr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return sched.Next(t).UTC(), nil
+}
+
+// runScheduler fires due schedules forever. Several replicas may run it
+// against a shared store; claimScheduleRun makes sure each activation is
+// only started once.
+func runScheduler() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		due, err := builds.store.dueSchedules(time.Now().UTC())
+		if err != nil {
+			slog.Error("Listing due schedules", "error", err)
+			continue
+		}
+		for _, s := range due {
+			runSchedule(s)
+		}
+	}
+}
+
+func runSchedule(s Schedule) {
+	now := time.Now().UTC()
+	next, err := nextRun(s.Cron, now)
+	if err != nil {
+		slog.Error("Schedule has an invalid cron expression", "schedule_id", s.ID, "error", err)
+		return
+	}
+	claimed, err := builds.store.claimScheduleRun(s.ID, s.NextRunAt, next, now)
+	if err != nil {
+		slog.Error("Claiming schedule", "schedule_id", s.ID, "error", err)
+		return
+	}
+	if !claimed {
+		return // another replica got there first
+	}
+
+	// Scheduled runs exist to refresh the image, so never skip them because
+	// the tag is already present.
+	spec := s.Spec
+	spec.Force = true
+	ctx, span := tracer.Start(context.Background(), "schedule run", trace.WithAttributes(attribute.String("schedule.id", s.ID)))
+	defer span.End()
+	build, err := prepareBuild(ctx, spec, nil, "schedule:"+s.ID)
+	if err != nil {
+		slog.Error("Preparing scheduled build", "schedule_id", s.ID, "schedule", s.Name, "error", err)
+		return
+	}
+	build.ScheduleID = s.ID
+	result, _, err := submitBuild(ctx, build)
+	if err != nil {
+		slog.Warn("Skipping scheduled build", "schedule_id", s.ID, "schedule", s.Name, "project", build.Request.Project, "error", err)
+		return
+	}
+	slog.Info("Schedule started build", "schedule_id", s.ID, "schedule", s.Name, "build_id", result.ID, "next_run", next)
+
+	if err := builds.store.setScheduleLastBuild(s.ID, result.ID); err != nil {
+		slog.Error("Recording schedule run", "schedule_id", s.ID, "error", err)
+	}
+}
+
+// schedulesHandler routes /schedules and everything under it.
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schedules"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "" && r.Method == http.MethodPost:
+		createSchedule(w, r)
+	case path == "" && r.Method == http.MethodGet:
+		listSchedules(w, r)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		getSchedule(w, r, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		deleteSchedule(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "runs" && r.Method == http.MethodGet:
+		listScheduleRuns(w, r, parts[0])
+	case len(parts) <= 2:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		httpError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func createSchedule(w http.ResponseWriter, r *http.Request) {
+	var req createScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, fieldErrorf("body", codeInvalidJSON, "body is not valid JSON: %s", err))
+		return
+	}
+	if req.Name == "" {
+		writeError(w, fieldErrorf("name", codeRequired, "name is required"))
+		return
+	}
+	now := time.Now().UTC()
+	next, err := nextRun(req.Cron, now)
+	if err != nil {
+		writeError(w, fieldErrorf("cron", codeFormat, "Invalid cron expression %q: %s", req.Cron, err))
+		return
+	}
+	if !projectAllowed(w, r, req.Spec.Project) {
+		return
+	}
+	// Reject specs that could never build before they start failing weekly.
+	build, err := prepareBuild(r.Context(), req.Spec, nil, "")
+	if err != nil {
+		writeSpecError(w, err)
+		return
+	}
+
+	s := Schedule{
+		ID:        newBuildID(),
+		Name:      req.Name,
+		Cron:      req.Cron,
+		Spec:      req.Spec,
+		Enabled:   req.Enabled == nil || *req.Enabled,
+		NextRunAt: next,
+		CreatedAt: now,
+	}
+	if err := builds.store.insertSchedule(s); err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger(r.Context()).Info("Created schedule", "schedule_id", s.ID, "schedule", s.Name, "cron", s.Cron, "next_run", next)
+	auditRequest(r, AuditEntry{Action: auditScheduleCreate, Target: s.ID, SpecHash: build.Tag, Image: build.Image})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPath(r, "/schedules/"+s.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+func listSchedules(w http.ResponseWriter, r *http.Request) {
+	schedules, err := builds.store.listSchedules()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if schedules == nil {
+		schedules = []Schedule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+func getSchedule(w http.ResponseWriter, r *http.Request, id string) {
+	s, err := builds.store.getSchedule(id)
+	if errors.Is(err, errScheduleNotFound) {
+		httpError(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func deleteSchedule(w http.ResponseWriter, r *http.Request, id string) {
+	err := builds.store.deleteSchedule(id)
+	if errors.Is(err, errScheduleNotFound) {
+		httpError(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger(r.Context()).Info("Deleted schedule", "schedule_id", id)
+	auditRequest(r, AuditEntry{Action: auditScheduleDelete, Target: id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listScheduleRuns returns the builds a schedule has started, newest first.
+func listScheduleRuns(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := builds.store.getSchedule(id); err != nil {
+		if errors.Is(err, errScheduleNotFound) {
+			httpError(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	runs, err := builds.store.buildsBySchedule(id)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newBuildResponses(runs))
+}
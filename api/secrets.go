@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+)
+
+// Build secrets are files on the builder host that a Dockerfile can mount
+// for a single RUN step via BuildKit, so credentials never land in an image
+// layer, the build history, a stored request or the tag hash.
+const (
+	secretPipNetrc      = "pip_netrc"
+	secretGitKnownHosts = "git_known_hosts"
+)
+
+// buildSecretSources maps each secret id a generated Dockerfile may mount to
+// the setting naming its source file on the builder host.
+var buildSecretSources = map[string]*string{
+	secretPipNetrc:      &PIP_NETRC_FILE,
+	secretGitKnownHosts: &GIT_SSH_KNOWN_HOSTS_FILE,
+}
+
+// sshArgs returns the docker build flags forwarding the builder's SSH key,
+// or its ssh-agent if GIT_SSH_KEY_FILE is unset, for Git requirements.
+func sshArgs(job *buildJob) []string {
+	if !job.SSH {
+		return nil
+	}
+	if GIT_SSH_KEY_FILE == "" {
+		return []string{"--ssh", "default"}
+	}
+	return []string{"--ssh", "default=" + GIT_SSH_KEY_FILE}
+}
+
+// secretArgs returns the docker build flags providing the secrets a job
+// needs. Secrets that are not configured on this host are left out; the
+// mounts are optional, so an index that needs no credentials still works.
+func secretArgs(ids []string) []string {
+	var args []string
+	for _, id := range ids {
+		src, ok := buildSecretSources[id]
+		if !ok || *src == "" {
+			slog.Warn("Build secret is not configured on this builder", "secret", id)
+			continue
+		}
+		args = append(args, "--secret", fmt.Sprintf("id=%s,src=%s", id, *src))
+	}
+	return args
+}
+
+// validateIndexURL checks a pip index URL from a request or the config.
+// Credentials embedded in the URL are refused: they would be stored with
+// the build and baked into the Dockerfile.
+func validateIndexURL(field, raw string) error {
+	if err := validateURLField(field, raw); err != nil {
+		return err
+	}
+	if u, _ := url.Parse(raw); u.User != nil {
+		return fieldErrorf(field, codeInvalid, "%s must not contain credentials; configure them in PIP_NETRC_FILE", field)
+	}
+	return nil
+}
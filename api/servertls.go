@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// serverCertificate serves TLS_CERT_FILE and TLS_KEY_FILE, reading them
+// again when the certificate file changes so a renewed certificate is
+// picked up without a restart.
+type serverCertificate struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+	checked  time.Time
+}
+
+// certificateCheckInterval is how often the certificate file is checked
+// for a renewal.
+const certificateCheckInterval = time.Minute
+
+func (c *serverCertificate) load() error {
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modified = &cert, info.ModTime()
+	return nil
+}
+
+func (c *serverCertificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) > certificateCheckInterval {
+		c.checked = time.Now()
+		if info, err := os.Stat(c.certFile); err == nil && !info.ModTime().Equal(c.modified) {
+			if err := c.load(); err != nil {
+				slog.Error("Reloading TLS certificate, keeping the previous one", "path", c.certFile, "error", err)
+			} else {
+				slog.Info("Reloaded TLS certificate", "path", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// serverTLSConfig is the TLS configuration of the HTTP and gRPC listeners:
+// nil without TLS_CERT_FILE, and requiring a client certificate issued by
+// TLS_CLIENT_CA_FILE, and named in TLS_CLIENT_NAMES when that is set,
+// with it.
+func serverTLSConfig() (*tls.Config, error) {
+	if TLS_CERT_FILE == "" {
+		return nil, nil
+	}
+	cert := &serverCertificate{certFile: TLS_CERT_FILE, keyFile: TLS_KEY_FILE}
+	if err := cert.load(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cert.get,
+	}
+	if TLS_CLIENT_CA_FILE == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(TLS_CLIENT_CA_FILE)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", TLS_CLIENT_CA_FILE)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(TLS_CLIENT_NAMES) > 0 {
+		config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if len(chains) == 0 || !clientNameAllowed(chains[0][0]) {
+				return errors.New("client certificate is not for an allowed name")
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// clientNameAllowed reports whether a client certificate names one of
+// TLS_CLIENT_NAMES as its common name or a DNS or email SAN.
+func clientNameAllowed(cert *x509.Certificate) bool {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, name := range names {
+		for _, allowed := range TLS_CLIENT_NAMES {
+			if name == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientCertName is the name a verified client certificate goes by: its
+// common name, or its first DNS SAN.
+func clientCertName(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// clientCertPrincipal authenticates a request that carries no credential
+// but came with a verified client certificate, when TLS_CLIENT_SCOPES
+// gives such certificates scopes.
+func clientCertPrincipal(state *tls.ConnectionState) (principal, bool) {
+	name := clientCertName(state)
+	if name == "" || len(TLS_CLIENT_SCOPES) == 0 {
+		return principal{}, false
+	}
+	return principal{Name: name, Scopes: TLS_CLIENT_SCOPES, Method: authClientCert}, true
+}
+
+// agentTLSConfig is how a builder agent reaches SCHEDULER_URL: trusting
+// SCHEDULER_CA_FILE besides the system roots, and presenting
+// AGENT_TLS_CERT_FILE when the API requires client certificates.
+func agentTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if SCHEDULER_CA_FILE != "" {
+		pem, err := os.ReadFile(SCHEDULER_CA_FILE)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", SCHEDULER_CA_FILE)
+		}
+		config.RootCAs = pool
+	}
+	if AGENT_TLS_CERT_FILE != "" {
+		cert, err := tls.LoadX509KeyPair(AGENT_TLS_CERT_FILE, AGENT_TLS_KEY_FILE)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// listen serves the HTTP API on :8080, over TLS when config is set,
+// logging every request.
+func listen(config *tls.Config) error {
+	server := &http.Server{Addr: ":8080", Handler: logRequests(withCORS(http.DefaultServeMux)), TLSConfig: config}
+	slog.Info("Server starting", "address", server.Addr, "tls", config != nil)
+	if config == nil {
+		return server.ListenAndServe()
+	}
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// signingEnabled reports whether pushed images are signed with cosign.
+func signingEnabled() bool {
+	return COSIGN_KEY != "" || COSIGN_KEYLESS
+}
+
+// signImage signs image, by its digest, with cosign and returns where the
+// signature was stored: the sha256-HEX.sig tag beside the image, which is
+// what admission controllers such as policy-controller and Kyverno look up.
+func signImage(ctx context.Context, image, digest string, output *buildLog) (string, error) {
+	if digest == "" {
+		return "", errors.New("the builder did not report the pushed digest, and only digests can be signed")
+	}
+	// cosign pushes the signature with the same logins as the image.
+	configDir, err := os.MkdirTemp("", "cosign-auth-")
+	if err != nil {
+		return "", fmt.Errorf("Creating registry config: %w", err)
+	}
+	defer os.RemoveAll(configDir)
+	if err := writeRegistryConfig(configDir); err != nil {
+		return "", fmt.Errorf("Writing registry config: %w", err)
+	}
+
+	repository := image[:strings.LastIndex(image, ":")]
+	args := append([]string{"sign"}, cosignFlags(image)...)
+	cmd := exec.CommandContext(ctx, COSIGN_BINARY, append(args, repository+"@"+digest)...)
+	cmd.Env = registryCAEnv(append(os.Environ(), "DOCKER_CONFIG="+configDir))
+	if err := runLogged(cmd, output); err != nil {
+		return "", err
+	}
+	return repository + ":" + strings.Replace(digest, ":", "-", 1) + ".sig", nil
+}
+
+// cosignFlags are the flags cosign sign and attest take for the configured
+// key or keyless identity, for an image in image's registry.
+func cosignFlags(image string) []string {
+	flags := []string{"--yes"}
+	if COSIGN_KEY != "" {
+		flags = append(flags, "--key", COSIGN_KEY)
+	}
+	if COSIGN_IDENTITY_TOKEN_FILE != "" {
+		flags = append(flags, "--identity-token", COSIGN_IDENTITY_TOKEN_FILE)
+	}
+	if plainHTTP(image) {
+		flags = append(flags, "--allow-http-registry")
+	}
+	if insecureRegistry(image) {
+		flags = append(flags, "--allow-insecure-registry")
+	}
+	return flags
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Injection points for DockerBuildRequest.Snippets, in build order.
+const (
+	snippetBeforeApt = "before_apt" // as root, before system packages are installed
+	snippetAfterPip  = "after_pip"  // as airflow, once Python packages are in place
+	snippetFinal     = "final"      // as airflow, after context files are copied in
+)
+
+var snippetPoints = map[string]bool{snippetBeforeApt: true, snippetAfterPip: true, snippetFinal: true}
+
+const maxSnippetLength = 4096
+
+// snippetPattern accepts a single RUN or COPY instruction. RUN takes no
+// flags, so a snippet cannot mount the builder's secrets or change network
+// settings, and COPY only takes --chown and --chmod, so it cannot pull
+// files from other images.
+var snippetPattern = regexp.MustCompile(`^(RUN [^-\s]|COPY ((--chown|--chmod)=[A-Za-z0-9:_-]+ )*[^-\s])`)
+
+func validateSnippets(snippets map[string][]string) error {
+	for point, instructions := range snippets {
+		if !snippetPoints[point] {
+			return fieldErrorf("snippets", codeEnum, "Unknown snippet injection point %q; use one of %s", point, strings.Join(snippetPointNames(), ", "))
+		}
+		for _, instruction := range instructions {
+			if len(instruction) > maxSnippetLength || strings.ContainsAny(instruction, "\r\n") || strings.HasSuffix(instruction, "\\") {
+				return fieldErrorf("snippets."+point, codeInvalid, "Snippets must be single lines of at most %d characters", maxSnippetLength)
+			}
+			if !snippetPattern.MatchString(instruction) {
+				return fieldErrorf("snippets."+point, codeInvalid, "Invalid %s snippet %q: only RUN (without flags) and COPY (with --chown or --chmod) instructions are allowed", point, instruction)
+			}
+		}
+	}
+	return nil
+}
+
+func snippetPointNames() []string {
+	names := make([]string, 0, len(snippetPoints))
+	for name := range snippetPoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
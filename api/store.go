@@ -0,0 +1,1087 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	dialectSQLite   = "sqlite"
+	dialectPostgres = "postgres"
+)
+
+var (
+	errBuildNotFound = errors.New("build not found")
+	errSBOMNotFound  = errors.New("sbom not found")
+)
+
+// buildStore persists build history so it survives restarts and can be
+// shared between replicas.
+type buildStore interface {
+	insertBuild(b Build) error
+	updateBuild(b Build) error
+	saveLogs(id string, lines []string) error
+	getLogs(id string) ([]string, error)
+	getBuildFiles(id string) (map[string][]byte, error)
+	getBuild(id string) (Build, error)
+	buildsByStatus(instance string, statuses ...BuildStatus) ([]Build, error)
+	buildsBySchedule(scheduleID string) ([]Build, error)
+	listBuilds(f buildFilter) ([]Build, error)
+	countBuilds(f buildFilter) (int, error)
+	buildsForTags(project string, tags []string) ([]Build, error)
+	markDeleted(project, tag, digest string, at time.Time) ([]string, error)
+	moveTag(project, tag, buildID string) error
+	pushedBuilds() ([]Build, error)
+	saveSBOM(tag, buildID, format string, content []byte) error
+	getSBOM(tag string) (string, []byte, error)
+	pruneBuilds(olderThan time.Time, keep int) ([]string, error)
+
+	insertSchedule(s Schedule) error
+	getSchedule(id string) (Schedule, error)
+	listSchedules() ([]Schedule, error)
+	deleteSchedule(id string) error
+	dueSchedules(now time.Time) ([]Schedule, error)
+	claimScheduleRun(id string, expectedNext, next, now time.Time) (bool, error)
+	setScheduleLastBuild(id, buildID string) error
+
+	insertTemplate(t NamedTemplate) error
+	updateTemplate(t NamedTemplate) error
+	getTemplate(name string) (NamedTemplate, error)
+	listTemplates() ([]NamedTemplate, error)
+	deleteTemplate(name string) error
+
+	insertProject(p Project) error
+	updateProject(p Project) error
+	getProject(name string) (Project, error)
+	listProjects() ([]Project, error)
+	deleteProject(name string) error
+
+	insertAPIKey(k APIKey, hash string) error
+	apiKeyByHash(hash string) (APIKey, error)
+	listAPIKeys() ([]APIKey, error)
+	deleteAPIKey(name string) error
+
+	insertAuditEntry(e AuditEntry) error
+	listAuditEntries(f auditFilter) ([]AuditEntry, error)
+
+	claimIdempotencyKey(k idempotencyKey, stale time.Time) (idempotencyKey, bool, error)
+	setIdempotencyKeyBuild(scope, key, buildID string) error
+	deleteIdempotencyKey(scope, key string) error
+	pruneIdempotencyKeys(olderThan time.Time) (int64, error)
+
+	ping(ctx context.Context) error
+	close() error
+}
+
+// openBuildStore opens the store selected by STORE_DRIVER: an embedded
+// SQLite file by default, or a shared Postgres database.
+func openBuildStore() (buildStore, error) {
+	switch STORE_DRIVER {
+	case dialectSQLite:
+		return openSQLStore(dialectSQLite, "sqlite3", DATABASE_PATH+"?_journal_mode=WAL&_busy_timeout=5000")
+	case dialectPostgres:
+		if DATABASE_URL == "" {
+			return nil, errors.New("DATABASE_URL is required when STORE_DRIVER=postgres")
+		}
+		return openSQLStore(dialectPostgres, "postgres", DATABASE_URL)
+	default:
+		return nil, fmt.Errorf("unknown STORE_DRIVER %q (want %q or %q)", STORE_DRIVER, dialectSQLite, dialectPostgres)
+	}
+}
+
+// sqlStore implements buildStore on database/sql. Queries are written with
+// ? placeholders and rebound for dialects that number them.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+func openSQLStore(dialect, driver, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == dialectSQLite {
+		// SQLite serialises writers anyway; one connection avoids lock errors.
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to %s: %w", dialect, err)
+	}
+	if err := migrate(db, dialect); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating schema: %w", err)
+	}
+	return &sqlStore{db: db, dialect: dialect}, nil
+}
+
+// rebind rewrites ? placeholders to $1, $2, ... for Postgres.
+func rebind(dialect, query string) string {
+	if dialect != dialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) error {
+	_, err := s.db.Exec(rebind(s.dialect, query), args...)
+	return err
+}
+
+func (s *sqlStore) insertBuild(b Build) error {
+	req, err := json.Marshal(b.Request)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(rebind(s.dialect, `INSERT INTO builds (id, status, tag, image, error, skipped, request, dockerfile, created_at, instance_id, schedule_id,
+			airflow_version, python_version, requester, project)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		b.ID, b.Status, b.Tag, b.Image, b.Error, b.Skipped, string(req), b.Dockerfile, b.CreatedAt, b.Instance, b.ScheduleID,
+		b.Request.AirflowVersion, b.Request.PythonVersion, b.Requester, b.Request.Project)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, name := range fileNames(b.Files) {
+		if _, err := tx.Exec(rebind(s.dialect, `INSERT INTO build_files (build_id, path, content) VALUES (?, ?, ?)`),
+			b.ID, name, b.Files[name]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// getBuildFiles returns the uploaded context files of a build.
+func (s *sqlStore) getBuildFiles(id string) (map[string][]byte, error) {
+	rows, err := s.db.Query(rebind(s.dialect, `SELECT path, content FROM build_files WHERE build_id = ?`), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files map[string][]byte
+	for rows.Next() {
+		var (
+			name    string
+			content []byte
+		)
+		if err := rows.Scan(&name, &content); err != nil {
+			return nil, err
+		}
+		if files == nil {
+			files = make(map[string][]byte)
+		}
+		files[name] = content
+	}
+	return files, rows.Err()
+}
+
+func (s *sqlStore) updateBuild(b Build) error {
+	var durationMs sql.NullInt64
+	if b.StartedAt != nil && b.FinishedAt != nil {
+		durationMs = sql.NullInt64{Int64: b.FinishedAt.Sub(*b.StartedAt).Milliseconds(), Valid: true}
+	}
+	var pushes, tags, vulnerabilities []byte
+	if len(b.Pushes) > 0 {
+		var err error
+		if pushes, err = json.Marshal(b.Pushes); err != nil {
+			return err
+		}
+	}
+	if b.Vulnerabilities != nil {
+		var err error
+		if vulnerabilities, err = json.Marshal(b.Vulnerabilities); err != nil {
+			return err
+		}
+	}
+	if len(b.Tags) > 0 {
+		tags = []byte(strings.Join(b.Tags, ","))
+	}
+	return s.exec(`UPDATE builds SET status = ?, error = ?, error_code = ?, digest = ?, pushes = ?, size_bytes = ?, tags = ?, vulnerabilities = ?, started_at = ?, finished_at = ?, duration_ms = ?
+		WHERE id = ?`,
+		b.Status, b.Error, b.ErrorCode, b.Digest, string(pushes), b.Size, string(tags), string(vulnerabilities), nullTime(b.StartedAt), nullTime(b.FinishedAt), durationMs, b.ID)
+}
+
+// saveSBOM stores the SBOM of the image under tag, replacing that of an
+// earlier build of it.
+func (s *sqlStore) saveSBOM(tag, buildID, format string, content []byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(rebind(s.dialect, `DELETE FROM sboms WHERE tag = ?`), tag); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(rebind(s.dialect, `INSERT INTO sboms (tag, build_id, format, content) VALUES (?, ?, ?, ?)`),
+		tag, buildID, format, content); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// getSBOM returns the format and content of the SBOM of the image under tag.
+func (s *sqlStore) getSBOM(tag string) (string, []byte, error) {
+	var (
+		format  string
+		content []byte
+	)
+	err := s.db.QueryRow(rebind(s.dialect, `SELECT format, content FROM sboms WHERE tag = ?`), tag).Scan(&format, &content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, errSBOMNotFound
+	}
+	return format, content, err
+}
+
+// saveLogs stores the complete output of a finished build.
+func (s *sqlStore) saveLogs(id string, lines []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(rebind(s.dialect, `DELETE FROM build_logs WHERE build_id = ?`), id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	stmt, err := tx.Prepare(rebind(s.dialect, `INSERT INTO build_logs (build_id, line_no, line) VALUES (?, ?, ?)`))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for i, line := range lines {
+		if _, err := stmt.Exec(id, i+1, line); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// getLogs returns the stored output of a build. Builds recorded before
+// build_logs existed fall back to the truncated tail in builds.logs.
+func (s *sqlStore) getLogs(id string) ([]string, error) {
+	rows, err := s.db.Query(rebind(s.dialect, `SELECT line FROM build_logs WHERE build_id = ? ORDER BY line_no`), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) > 0 {
+		return lines, nil
+	}
+
+	var legacy string
+	err = s.db.QueryRow(rebind(s.dialect, `SELECT logs FROM builds WHERE id = ?`), id).Scan(&legacy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errBuildNotFound
+	}
+	if err != nil || legacy == "" {
+		return nil, err
+	}
+	return strings.Split(legacy, "\n"), nil
+}
+
+const buildColumns = `id, status, tag, image, digest, pushes, size_bytes, tags, vulnerabilities, error, error_code, skipped, request, dockerfile, created_at, started_at, finished_at, deleted_at, instance_id, schedule_id, requester`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBuild(row rowScanner) (Build, error) {
+	var (
+		b                   Build
+		req, pushes, tags   string
+		vulnerabilities     string
+		startedAt, finished sql.NullTime
+		deletedAt           sql.NullTime
+	)
+	err := row.Scan(&b.ID, &b.Status, &b.Tag, &b.Image, &b.Digest, &pushes, &b.Size, &tags, &vulnerabilities, &b.Error, &b.ErrorCode, &b.Skipped, &req, &b.Dockerfile,
+		&b.CreatedAt, &startedAt, &finished, &deletedAt, &b.Instance, &b.ScheduleID, &b.Requester)
+	if err != nil {
+		return Build{}, err
+	}
+	if err := json.Unmarshal([]byte(req), &b.Request); err != nil {
+		return Build{}, fmt.Errorf("decoding stored request: %w", err)
+	}
+	if pushes != "" {
+		if err := json.Unmarshal([]byte(pushes), &b.Pushes); err != nil {
+			return Build{}, fmt.Errorf("decoding stored pushes: %w", err)
+		}
+	}
+	if tags != "" {
+		b.Tags = strings.Split(tags, ",")
+	}
+	if vulnerabilities != "" {
+		b.Vulnerabilities = new(VulnerabilityReport)
+		if err := json.Unmarshal([]byte(vulnerabilities), b.Vulnerabilities); err != nil {
+			return Build{}, fmt.Errorf("decoding stored vulnerabilities: %w", err)
+		}
+	}
+	if startedAt.Valid {
+		t := startedAt.Time.UTC()
+		b.StartedAt = &t
+	}
+	if finished.Valid {
+		t := finished.Time.UTC()
+		b.FinishedAt = &t
+	}
+	if deletedAt.Valid {
+		t := deletedAt.Time.UTC()
+		b.DeletedAt = &t
+	}
+	b.CreatedAt = b.CreatedAt.UTC()
+	b.setDuration()
+	return b, nil
+}
+
+func (s *sqlStore) getBuild(id string) (Build, error) {
+	row := s.db.QueryRow(rebind(s.dialect, `SELECT `+buildColumns+` FROM builds WHERE id = ?`), id)
+	b, err := scanBuild(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Build{}, errBuildNotFound
+	}
+	return b, err
+}
+
+// buildsByStatus returns the builds owned by instance in any of statuses,
+// oldest first.
+func (s *sqlStore) buildsByStatus(instance string, statuses ...BuildStatus) ([]Build, error) {
+	args := []interface{}{instance}
+	placeholders := make([]string, len(statuses))
+	for i, st := range statuses {
+		placeholders[i] = "?"
+		args = append(args, st)
+	}
+	return s.queryBuilds(`SELECT `+buildColumns+` FROM builds
+		WHERE instance_id = ? AND status IN (`+strings.Join(placeholders, ", ")+`)
+		ORDER BY created_at`, args...)
+}
+
+// buildsBySchedule returns the most recent runs of a schedule, newest first.
+func (s *sqlStore) buildsBySchedule(scheduleID string) ([]Build, error) {
+	return s.queryBuilds(`SELECT `+buildColumns+` FROM builds
+		WHERE schedule_id = ? ORDER BY created_at DESC LIMIT 100`, scheduleID)
+}
+
+// buildFilter narrows a build listing. Zero fields match everything.
+type buildFilter struct {
+	Statuses       []BuildStatus
+	AirflowVersion string
+	PythonVersion  string
+	Requester      string
+	Project        string
+	Projects       []string // any of these when not nil; "" is unassigned
+	CreatedAfter   *time.Time
+	CreatedBefore  *time.Time
+	After          *buildCursor // resume after this build
+	Limit          int
+}
+
+// buildCursor identifies a position in the newest-first listing order.
+type buildCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// listBuilds returns the builds matching f, newest first. Ties on created_at
+// are broken by ID so cursors never skip or repeat a build.
+func (s *sqlStore) listBuilds(f buildFilter) ([]Build, error) {
+	where, args := buildConditions(f)
+	query := `SELECT ` + buildColumns + ` FROM builds`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY created_at DESC, id DESC LIMIT ?`
+	args = append(args, f.Limit)
+	return s.queryBuilds(query, args...)
+}
+
+// countBuilds returns how many builds match f, regardless of its limit.
+func (s *sqlStore) countBuilds(f buildFilter) (int, error) {
+	where, args := buildConditions(f)
+	query := `SELECT COUNT(*) FROM builds`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	var n int
+	err := s.db.QueryRow(rebind(s.dialect, query), args...).Scan(&n)
+	return n, err
+}
+
+// buildConditions are the WHERE conditions selecting the builds f matches,
+// with their arguments.
+func buildConditions(f buildFilter) ([]string, []interface{}) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	if len(f.Statuses) > 0 {
+		placeholders := make([]string, len(f.Statuses))
+		for i, st := range f.Statuses {
+			placeholders[i] = "?"
+			args = append(args, st)
+		}
+		where = append(where, "status IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if f.AirflowVersion != "" {
+		where = append(where, "airflow_version = ?")
+		args = append(args, f.AirflowVersion)
+	}
+	if f.PythonVersion != "" {
+		where = append(where, "python_version = ?")
+		args = append(args, f.PythonVersion)
+	}
+	if f.Requester != "" {
+		where = append(where, "requester = ?")
+		args = append(args, f.Requester)
+	}
+	if f.Project != "" {
+		where = append(where, "project = ?")
+		args = append(args, f.Project)
+	}
+	if f.Projects != nil {
+		placeholders := make([]string, len(f.Projects))
+		for i, project := range f.Projects {
+			placeholders[i] = "?"
+			args = append(args, project)
+		}
+		where = append(where, "project IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if f.CreatedAfter != nil {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.CreatedAfter.UTC())
+	}
+	if f.CreatedBefore != nil {
+		where = append(where, "created_at < ?")
+		args = append(args, f.CreatedBefore.UTC())
+	}
+	if f.After != nil {
+		where = append(where, "(created_at < ? OR (created_at = ? AND id < ?))")
+		args = append(args, f.After.CreatedAt, f.After.CreatedAt, f.After.ID)
+	}
+	return where, args
+}
+
+// buildsForTags returns the succeeded builds of project that pushed any of
+// tags, whether as their content-hash tag or a custom one, newest first.
+func (s *sqlStore) buildsForTags(project string, tags []string) ([]Build, error) {
+	var result []Build
+	// Two placeholders per tag, well under SQLite's limit per statement.
+	const chunk = 200
+	for start := 0; start < len(tags); start += chunk {
+		end := start + chunk
+		if end > len(tags) {
+			end = len(tags)
+		}
+		args := []interface{}{StatusSucceeded, project}
+		conds := make([]string, 0, end-start)
+		for _, tag := range tags[start:end] {
+			conds = append(conds, "tag = ? OR ',' || tags || ',' LIKE ?")
+			args = append(args, tag, "%,"+tag+",%")
+		}
+		page, err := s.queryBuilds(`SELECT `+buildColumns+` FROM builds WHERE status = ? AND project = ? AND (`+strings.Join(conds, " OR ")+`)
+			ORDER BY created_at DESC, id DESC`, args...)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, page...)
+	}
+	return result, nil
+}
+
+// pushedBuilds returns the succeeded builds whose image has not been
+// deleted, newest first.
+func (s *sqlStore) pushedBuilds() ([]Build, error) {
+	return s.queryBuilds(`SELECT `+buildColumns+` FROM builds WHERE status = ? AND deleted_at IS NULL
+		ORDER BY created_at DESC, id DESC`, StatusSucceeded)
+}
+
+// markDeleted sets deleted_at on the builds of project whose content-hash
+// tag is tag, or whose digest is digest if that is set, returning their
+// IDs.
+func (s *sqlStore) markDeleted(project, tag, digest string, at time.Time) ([]string, error) {
+	where, args := `tag = ?`, []interface{}{tag}
+	if digest != "" {
+		where, args = `(tag = ? OR digest = ?)`, append(args, digest)
+	}
+	matched, err := s.queryBuilds(`SELECT `+buildColumns+` FROM builds WHERE `+where+` AND project = ? AND deleted_at IS NULL`, append(args, project)...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, b := range matched {
+		if err := s.exec(`UPDATE builds SET deleted_at = ? WHERE id = ?`, at, b.ID); err != nil {
+			return ids, err
+		}
+		ids = append(ids, b.ID)
+	}
+	return ids, nil
+}
+
+// moveTag records that tag now points at the image of buildID: it is
+// added to that build's tags and taken off any other build's in project.
+func (s *sqlStore) moveTag(project, tag, buildID string) error {
+	holders, err := s.queryBuilds(`SELECT `+buildColumns+` FROM builds WHERE id = ? OR (project = ? AND ',' || tags || ',' LIKE ?)`, buildID, project, "%,"+tag+",%")
+	if err != nil {
+		return err
+	}
+	for _, b := range holders {
+		tags := withoutTag(b.Tags, tag)
+		if b.ID == buildID {
+			tags = append(tags, tag)
+		}
+		if err := s.exec(`UPDATE builds SET tags = ? WHERE id = ?`, strings.Join(tags, ","), b.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneBuilds deletes finished builds created before olderThan, and those
+// beyond the newest keep builds, along with their logs. A zero olderThan or
+// keep disables that limit. Unfinished builds are never pruned. It returns
+// the IDs of the deleted builds.
+func (s *sqlStore) pruneBuilds(olderThan time.Time, keep int) ([]string, error) {
+	if keep > 0 {
+		var newestKept time.Time
+		err := s.db.QueryRow(rebind(s.dialect, `SELECT created_at FROM builds
+			ORDER BY created_at DESC LIMIT 1 OFFSET ?`), keep-1).Scan(&newestKept)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		if newestKept.After(olderThan) {
+			olderThan = newestKept
+		}
+	}
+	if olderThan.IsZero() {
+		return nil, nil
+	}
+
+	where := `status IN (?, ?, ?, ?) AND created_at < ?`
+	args := []interface{}{StatusSucceeded, StatusFailed, StatusCancelled, StatusTimedOut, olderThan.UTC()}
+
+	rows, err := s.db.Query(rebind(s.dialect, `SELECT id FROM builds WHERE `+where), args...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range []string{"build_logs", "build_files"} {
+		if _, err := tx.Exec(rebind(s.dialect, `DELETE FROM `+table+` WHERE build_id IN (SELECT id FROM builds WHERE `+where+`)`), args...); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(rebind(s.dialect, `DELETE FROM builds WHERE `+where), args...); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+func (s *sqlStore) queryBuilds(query string, args ...interface{}) ([]Build, error) {
+	rows, err := s.db.Query(rebind(s.dialect, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Build
+	for rows.Next() {
+		b, err := scanBuild(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, b)
+	}
+	return result, rows.Err()
+}
+
+const scheduleColumns = `id, name, cron, spec, enabled, next_run_at, last_run_at, last_build_id, created_at`
+
+func scanSchedule(row rowScanner) (Schedule, error) {
+	var (
+		sc      Schedule
+		spec    string
+		lastRun sql.NullTime
+	)
+	if err := row.Scan(&sc.ID, &sc.Name, &sc.Cron, &spec, &sc.Enabled, &sc.NextRunAt, &lastRun, &sc.LastBuildID, &sc.CreatedAt); err != nil {
+		return Schedule{}, err
+	}
+	if err := json.Unmarshal([]byte(spec), &sc.Spec); err != nil {
+		return Schedule{}, fmt.Errorf("decoding stored spec: %w", err)
+	}
+	sc.NextRunAt = sc.NextRunAt.UTC()
+	sc.CreatedAt = sc.CreatedAt.UTC()
+	if lastRun.Valid {
+		t := lastRun.Time.UTC()
+		sc.LastRunAt = &t
+	}
+	return sc, nil
+}
+
+func (s *sqlStore) insertSchedule(sc Schedule) error {
+	spec, err := json.Marshal(sc.Spec)
+	if err != nil {
+		return err
+	}
+	return s.exec(`INSERT INTO schedules (id, name, cron, spec, enabled, next_run_at, last_build_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, '', ?)`,
+		sc.ID, sc.Name, sc.Cron, string(spec), sc.Enabled, sc.NextRunAt, sc.CreatedAt)
+}
+
+func (s *sqlStore) getSchedule(id string) (Schedule, error) {
+	sc, err := scanSchedule(s.db.QueryRow(rebind(s.dialect, `SELECT `+scheduleColumns+` FROM schedules WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Schedule{}, errScheduleNotFound
+	}
+	return sc, err
+}
+
+func (s *sqlStore) querySchedules(query string, args ...interface{}) ([]Schedule, error) {
+	rows, err := s.db.Query(rebind(s.dialect, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Schedule
+	for rows.Next() {
+		sc, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, sc)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStore) listSchedules() ([]Schedule, error) {
+	return s.querySchedules(`SELECT ` + scheduleColumns + ` FROM schedules ORDER BY created_at`)
+}
+
+func (s *sqlStore) deleteSchedule(id string) error {
+	res, err := s.db.Exec(rebind(s.dialect, `DELETE FROM schedules WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errScheduleNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) dueSchedules(now time.Time) ([]Schedule, error) {
+	return s.querySchedules(`SELECT `+scheduleColumns+` FROM schedules
+		WHERE enabled = ? AND next_run_at <= ? ORDER BY next_run_at`, true, now)
+}
+
+// claimScheduleRun advances a schedule from expectedNext to next. Only the
+// caller whose update matched expectedNext gets true, which is what keeps
+// replicas from starting the same run twice.
+func (s *sqlStore) claimScheduleRun(id string, expectedNext, next, now time.Time) (bool, error) {
+	res, err := s.db.Exec(rebind(s.dialect, `UPDATE schedules SET next_run_at = ?, last_run_at = ?
+		WHERE id = ? AND next_run_at = ?`), next, now, id, expectedNext)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqlStore) setScheduleLastBuild(id, buildID string) error {
+	return s.exec(`UPDATE schedules SET last_build_id = ? WHERE id = ?`, buildID, id)
+}
+
+const templateColumns = `name, description, body, created_at, updated_at`
+
+func scanTemplate(row rowScanner) (NamedTemplate, error) {
+	var t NamedTemplate
+	if err := row.Scan(&t.Name, &t.Description, &t.Body, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		return NamedTemplate{}, err
+	}
+	t.CreatedAt = t.CreatedAt.UTC()
+	t.UpdatedAt = t.UpdatedAt.UTC()
+	return t, nil
+}
+
+func (s *sqlStore) insertTemplate(t NamedTemplate) error {
+	res, err := s.db.Exec(rebind(s.dialect, `INSERT INTO templates (`+templateColumns+`)
+		VALUES (?, ?, ?, ?, ?) ON CONFLICT (name) DO NOTHING`),
+		t.Name, t.Description, t.Body, t.CreatedAt, t.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errTemplateExists
+	}
+	return nil
+}
+
+// updateTemplate replaces the description and body of an existing template.
+func (s *sqlStore) updateTemplate(t NamedTemplate) error {
+	res, err := s.db.Exec(rebind(s.dialect, `UPDATE templates SET description = ?, body = ?, updated_at = ? WHERE name = ?`),
+		t.Description, t.Body, t.UpdatedAt, t.Name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errTemplateNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) getTemplate(name string) (NamedTemplate, error) {
+	t, err := scanTemplate(s.db.QueryRow(rebind(s.dialect, `SELECT `+templateColumns+` FROM templates WHERE name = ?`), name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return NamedTemplate{}, errTemplateNotFound
+	}
+	return t, err
+}
+
+func (s *sqlStore) listTemplates() ([]NamedTemplate, error) {
+	rows, err := s.db.Query(`SELECT ` + templateColumns + ` FROM templates ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []NamedTemplate
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStore) deleteTemplate(name string) error {
+	res, err := s.db.Exec(rebind(s.dialect, `DELETE FROM templates WHERE name = ?`), name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errTemplateNotFound
+	}
+	return nil
+}
+
+const projectColumns = `name, description, image_name, registry, templates, max_active_builds, max_builds_per_day, created_at, updated_at`
+
+func scanProject(row rowScanner) (Project, error) {
+	var p Project
+	var templates string
+	if err := row.Scan(&p.Name, &p.Description, &p.ImageName, &p.Registry, &templates, &p.MaxActiveBuilds, &p.MaxBuildsPerDay, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return Project{}, err
+	}
+	if templates != "" {
+		p.Templates = strings.Split(templates, ",")
+	}
+	p.CreatedAt = p.CreatedAt.UTC()
+	p.UpdatedAt = p.UpdatedAt.UTC()
+	return p, nil
+}
+
+func (s *sqlStore) insertProject(p Project) error {
+	res, err := s.db.Exec(rebind(s.dialect, `INSERT INTO projects (`+projectColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (name) DO NOTHING`),
+		p.Name, p.Description, p.ImageName, p.Registry, strings.Join(p.Templates, ","), p.MaxActiveBuilds, p.MaxBuildsPerDay, p.CreatedAt, p.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errProjectExists
+	}
+	return nil
+}
+
+// updateProject replaces everything but the name and creation time of an
+// existing project.
+func (s *sqlStore) updateProject(p Project) error {
+	res, err := s.db.Exec(rebind(s.dialect, `UPDATE projects SET description = ?, image_name = ?, registry = ?, templates = ?,
+		max_active_builds = ?, max_builds_per_day = ?, updated_at = ? WHERE name = ?`),
+		p.Description, p.ImageName, p.Registry, strings.Join(p.Templates, ","), p.MaxActiveBuilds, p.MaxBuildsPerDay, p.UpdatedAt, p.Name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errProjectNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) getProject(name string) (Project, error) {
+	p, err := scanProject(s.db.QueryRow(rebind(s.dialect, `SELECT `+projectColumns+` FROM projects WHERE name = ?`), name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Project{}, errProjectNotFound
+	}
+	return p, err
+}
+
+func (s *sqlStore) listProjects() ([]Project, error) {
+	rows, err := s.db.Query(`SELECT ` + projectColumns + ` FROM projects ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Project
+	for rows.Next() {
+		p, err := scanProject(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStore) deleteProject(name string) error {
+	res, err := s.db.Exec(rebind(s.dialect, `DELETE FROM projects WHERE name = ?`), name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errProjectNotFound
+	}
+	return nil
+}
+
+const apiKeyColumns = `name, scopes, created_at`
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var k APIKey
+	var scopes string
+	if err := row.Scan(&k.Name, &scopes, &k.CreatedAt); err != nil {
+		return APIKey{}, err
+	}
+	k.Scopes = strings.Split(scopes, ",")
+	k.CreatedAt = k.CreatedAt.UTC()
+	return k, nil
+}
+
+// insertAPIKey stores a key by the hash of its secret, which is not kept.
+func (s *sqlStore) insertAPIKey(k APIKey, hash string) error {
+	res, err := s.db.Exec(rebind(s.dialect, `INSERT INTO api_keys (name, key_hash, scopes, created_at)
+		VALUES (?, ?, ?, ?) ON CONFLICT (name) DO NOTHING`),
+		k.Name, hash, strings.Join(k.Scopes, ","), k.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errAPIKeyExists
+	}
+	return nil
+}
+
+func (s *sqlStore) apiKeyByHash(hash string) (APIKey, error) {
+	k, err := scanAPIKey(s.db.QueryRow(rebind(s.dialect, `SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`), hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, errAPIKeyNotFound
+	}
+	return k, err
+}
+
+func (s *sqlStore) listAPIKeys() ([]APIKey, error) {
+	rows, err := s.db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, k)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlStore) deleteAPIKey(name string) error {
+	res, err := s.db.Exec(rebind(s.dialect, `DELETE FROM api_keys WHERE name = ?`), name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+// insertAuditEntry appends to the audit log. Entries are never changed or
+// removed, not even by build retention.
+func (s *sqlStore) insertAuditEntry(e AuditEntry) error {
+	return s.exec(`INSERT INTO audit_log (time, actor, action, build_id, spec_hash, image, digest, target, outcome, request_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Time, e.Actor, e.Action, e.BuildID, e.SpecHash, e.Image, e.Digest, e.Target, e.Outcome, e.RequestID)
+}
+
+// listAuditEntries returns the entries matching f, newest first.
+func (s *sqlStore) listAuditEntries(f auditFilter) ([]AuditEntry, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	if f.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if f.After != nil {
+		where = append(where, "time >= ?")
+		args = append(args, f.After.UTC())
+	}
+	if f.Before != nil {
+		where = append(where, "time < ?")
+		args = append(args, f.Before.UTC())
+	}
+	if f.Cursor > 0 {
+		where = append(where, "id < ?")
+		args = append(args, f.Cursor)
+	}
+
+	query := `SELECT id, time, actor, action, build_id, spec_hash, image, digest, target, outcome, request_id FROM audit_log`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, f.Limit)
+	rows, err := s.db.Query(rebind(s.dialect, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Time, &e.Actor, &e.Action, &e.BuildID, &e.SpecHash, &e.Image, &e.Digest, &e.Target, &e.Outcome, &e.RequestID); err != nil {
+			return nil, err
+		}
+		e.Time = e.Time.UTC()
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+// claimIdempotencyKey records k unless its scope already holds the key, in
+// which case it returns the record there and false. A record created before
+// stale, or claimed before stale without a build, counts as gone.
+func (s *sqlStore) claimIdempotencyKey(k idempotencyKey, stale time.Time) (idempotencyKey, bool, error) {
+	expired := k.CreatedAt.Add(-idempotencyTTL)
+	if err := s.exec(`DELETE FROM idempotency_keys WHERE scope = ? AND idempotency_key = ?
+		AND (created_at < ? OR (build_id = '' AND created_at < ?))`, k.Scope, k.Key, expired, stale); err != nil {
+		return idempotencyKey{}, false, err
+	}
+	res, err := s.db.Exec(rebind(s.dialect, `INSERT INTO idempotency_keys (scope, idempotency_key, spec_hash, created_at)
+		VALUES (?, ?, ?, ?) ON CONFLICT (scope, idempotency_key) DO NOTHING`),
+		k.Scope, k.Key, k.SpecHash, k.CreatedAt)
+	if err != nil {
+		return idempotencyKey{}, false, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return k, true, nil
+	}
+	existing := idempotencyKey{Scope: k.Scope, Key: k.Key}
+	err = s.db.QueryRow(rebind(s.dialect, `SELECT spec_hash, build_id, created_at FROM idempotency_keys
+		WHERE scope = ? AND idempotency_key = ?`), k.Scope, k.Key).Scan(&existing.SpecHash, &existing.BuildID, &existing.CreatedAt)
+	if err != nil {
+		return idempotencyKey{}, false, err
+	}
+	existing.CreatedAt = existing.CreatedAt.UTC()
+	return existing, false, nil
+}
+
+func (s *sqlStore) setIdempotencyKeyBuild(scope, key, buildID string) error {
+	return s.exec(`UPDATE idempotency_keys SET build_id = ? WHERE scope = ? AND idempotency_key = ?`, buildID, scope, key)
+}
+
+func (s *sqlStore) deleteIdempotencyKey(scope, key string) error {
+	return s.exec(`DELETE FROM idempotency_keys WHERE scope = ? AND idempotency_key = ?`, scope, key)
+}
+
+// pruneIdempotencyKeys deletes the keys created before olderThan and
+// returns how many there were.
+func (s *sqlStore) pruneIdempotencyKeys(olderThan time.Time) (int64, error) {
+	res, err := s.db.Exec(rebind(s.dialect, `DELETE FROM idempotency_keys WHERE created_at < ?`), olderThan.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ping checks the database still answers, for readiness.
+func (s *sqlStore) ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) close() error {
+	return s.db.Close()
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tagRetentionEnabled reports whether any tag retention limit is set.
+func tagRetentionEnabled() bool {
+	return TAG_RETENTION_KEEP_LAST > 0 || TAG_RETENTION_DAYS > 0
+}
+
+// pushedImage is a content-hash tag the factory pushed, as of the newest
+// build that asked for it.
+type pushedImage struct {
+	tag  string
+	last time.Time
+}
+
+// pruneTags deletes the images that the tag retention policy no longer
+// keeps. Only content-hash tags from the factory's own builds are
+// considered, and only when no other tag, such as a custom one, points at
+// the same manifest; anything pushed by hand is never touched.
+func pruneTags() {
+	expired, err := expiredImages()
+	if err != nil {
+		slog.Error("Tag retention", "error", err)
+		return
+	}
+	if len(expired) == 0 {
+		return
+	}
+	// Without knowing what is deployed, nothing is safe to delete.
+	inUse, err := imagesInUse()
+	if err != nil {
+		slog.Error("Tag retention: finding deployed images", "error", err)
+		return
+	}
+	repository := repositoryPath()
+	digests, err := tagDigests(repository)
+	if err != nil {
+		slog.Error("Tag retention", "error", err)
+		return
+	}
+	shared := make(map[string]int)
+	for _, digest := range digests {
+		shared[digest]++
+	}
+
+	deleted := 0
+	for _, tag := range expired {
+		digest, ok := digests[tag]
+		switch {
+		case !ok:
+			// Deleted some other way; only the records need catching up.
+		case inUse[tag] || inUse[digest] || shared[digest] > 1:
+			continue
+		case TAG_RETENTION_DRY_RUN:
+			slog.Info("Tag retention: would delete image", "repository", repository, "tag", tag, "digest", digest)
+			continue
+		default:
+			if _, err := registry.deleteManifest(repository, digest); err != nil {
+				slog.Error("Tag retention: deleting image", "repository", repository, "tag", tag, "error", err)
+				continue
+			}
+			deleted++
+			audit(context.Background(), AuditEntry{
+				Actor:    "tag-retention",
+				Action:   auditImageDelete,
+				SpecHash: tag,
+				Image:    fmt.Sprintf("%s/%s:%s", REGISTRY_URL, IMAGE_NAME, tag),
+				Digest:   digest,
+			})
+		}
+		if _, err := builds.markDeleted("", tag, digest); err != nil {
+			slog.Error("Tag retention: marking builds deleted", "tag", tag, "error", err)
+		}
+	}
+	if deleted > 0 {
+		slog.Info("Tag retention: deleted images", "images", deleted)
+	}
+}
+
+// expiredImages returns the content-hash tags past the retention policy:
+// beyond the newest TAG_RETENTION_KEEP_LAST of their family and last
+// requested before the TAG_RETENTION_DAYS cutoff, either limit applying
+// only if set.
+func expiredImages() ([]string, error) {
+	pushed, err := builds.store.pushedBuilds()
+	if err != nil {
+		return nil, fmt.Errorf("listing builds: %w", err)
+	}
+	// Builds come newest first, so the first one seen for a tag is the
+	// last time anyone asked for it, skipped builds included.
+	seen := make(map[string]bool)
+	families := make(map[string][]pushedImage)
+	for _, b := range pushed {
+		// Projects' images are in their own repositories, which retention
+		// leaves alone.
+		if seen[b.Tag] || b.Request.Project != "" {
+			continue
+		}
+		seen[b.Tag] = true
+		flavor := b.Request.ImageFlavor
+		if flavor == "" {
+			flavor = flavorRegular
+		}
+		family := b.Request.AirflowVersion + "/" + b.Request.PythonVersion + "/" + flavor
+		families[family] = append(families[family], pushedImage{tag: b.Tag, last: b.CreatedAt})
+	}
+
+	var cutoff time.Time
+	if TAG_RETENTION_DAYS > 0 {
+		cutoff = time.Now().UTC().AddDate(0, 0, -TAG_RETENTION_DAYS)
+	}
+	var expired []string
+	for _, images := range families {
+		sort.Slice(images, func(i, j int) bool { return images[i].last.After(images[j].last) })
+		for i, image := range images {
+			if i < TAG_RETENTION_KEEP_LAST || (!cutoff.IsZero() && image.last.After(cutoff)) {
+				continue
+			}
+			expired = append(expired, image.tag)
+		}
+	}
+	sort.Strings(expired)
+	return expired, nil
+}
+
+// tagDigests maps every tag in repository to the digest it points at.
+func tagDigests(repository string) (map[string]string, error) {
+	tags, err := registry.listTags(repository)
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		digest, err := registry.digestOf(repository, tag)
+		if err != nil {
+			return nil, fmt.Errorf("looking up %s:%s: %w", repository, tag, err)
+		}
+		if digest != "" {
+			digests[tag] = digest
+		}
+	}
+	return digests, nil
+}
+
+// imagesInUse gathers the tags and digests of the factory's image that the
+// TAG_RETENTION_IN_USE sources report as deployed.
+func imagesInUse() (map[string]bool, error) {
+	var refs []string
+	for _, source := range TAG_RETENTION_IN_USE {
+		var found []string
+		var err error
+		if source == "kubernetes" {
+			found, err = podImages()
+		} else {
+			found, err = listedImages(source)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		refs = append(refs, found...)
+	}
+
+	repository := REGISTRY_URL + "/" + IMAGE_NAME
+	inUse := make(map[string]bool)
+	for _, ref := range refs {
+		if i := strings.Index(ref, "://"); i >= 0 {
+			ref = ref[i+3:] // docker-pullable://... image IDs
+		}
+		if i := strings.Index(ref, "@"); i >= 0 {
+			if ref[:i] == repository || strings.HasPrefix(ref[:i], repository+":") {
+				inUse[ref[i+1:]] = true
+			}
+			ref = ref[:i]
+		}
+		if strings.HasPrefix(ref, repository+":") {
+			inUse[strings.TrimPrefix(ref, repository+":")] = true
+		}
+	}
+	return inUse, nil
+}
+
+// podImages lists the images of every container in the cluster, by their
+// reference and their resolved digest. The service account needs to list
+// pods in all namespaces.
+func podImages() ([]string, error) {
+	k, err := kubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+	type container struct {
+		Image   string `json:"image"`
+		ImageID string `json:"imageID"`
+	}
+	var pods struct {
+		Items []struct {
+			Spec struct {
+				Containers     []container `json:"containers"`
+				InitContainers []container `json:"initContainers"`
+			} `json:"spec"`
+			Status struct {
+				ContainerStatuses     []container `json:"containerStatuses"`
+				InitContainerStatuses []container `json:"initContainerStatuses"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := k.do(ctx, http.MethodGet, "/api/v1/pods", nil, &pods); err != nil {
+		return nil, err
+	}
+	var refs []string
+	for _, pod := range pods.Items {
+		for _, list := range [][]container{pod.Spec.Containers, pod.Spec.InitContainers, pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses} {
+			for _, c := range list {
+				refs = append(refs, c.Image)
+				if c.ImageID != "" {
+					refs = append(refs, c.ImageID)
+				}
+			}
+		}
+	}
+	return refs, nil
+}
+
+// listedImages fetches a JSON array of image references from url, e.g. an
+// inventory of what each Airflow deployment runs.
+func listedImages(url string) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	if err := getJSON(&http.Client{Timeout: 30 * time.Second}, req, &refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// tagPattern accepts docker image tags.
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// tagFields are what a request's TagTemplate can refer to, e.g.
+// "{{.AirflowVersion}}-{{.Date}}-{{.ShortHash}}".
+type tagFields struct {
+	AirflowVersion string
+	PythonVersion  string
+	Flavor         string // regular or slim
+	Date           string // day the build was submitted, as YYYYMMDD in UTC
+	Hash           string // the content-hash tag
+	ShortHash      string // its first 7 characters
+}
+
+// customTags are the tags b is pushed under besides its content-hash tag:
+// the request's Tags, then TagTemplate rendered for b. They name the image
+// without shaping it, so they stay out of the hash.
+func customTags(b Build) ([]string, error) {
+	req := b.Request
+	tags := append([]string(nil), req.Tags...)
+	if req.TagTemplate != "" {
+		tmpl, err := template.New("tag").Parse(req.TagTemplate)
+		if err != nil {
+			return nil, fieldErrorf("tag_template", codeInvalid, "Invalid tag_template: %s", err)
+		}
+		flavor := req.ImageFlavor
+		if flavor == "" {
+			flavor = flavorRegular
+		}
+		var out strings.Builder
+		err = tmpl.Execute(&out, tagFields{
+			AirflowVersion: req.AirflowVersion,
+			PythonVersion:  req.PythonVersion,
+			Flavor:         flavor,
+			Date:           b.CreatedAt.UTC().Format("20060102"),
+			Hash:           b.Tag,
+			ShortHash:      b.Tag[:7],
+		})
+		if err != nil {
+			return nil, fieldErrorf("tag_template", codeInvalid, "Invalid tag_template: %s", err)
+		}
+		tags = append(tags, out.String())
+	}
+
+	seen := map[string]bool{b.Tag: true}
+	var unique []string
+	for _, tag := range tags {
+		if !tagPattern.MatchString(tag) {
+			return nil, fieldErrorf("tags", codeFormat, "Invalid tag %q: tags are up to 128 letters, digits, '_', '.' and '-', not starting with '.' or '-'", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			unique = append(unique, tag)
+		}
+	}
+	return unique, nil
+}
+
+// applyCustomTags points b's custom tags in REGISTRY_URL, or its
+// project's registry, at the image that already exists under its
+// content-hash tag, for builds skipped because nothing needed building.
+// Tags in EXTRA_REGISTRIES are only set by builds that push.
+func applyCustomTags(b *Build) {
+	tags, _ := customTags(*b)
+	client, repository := imageRepository(*b)
+	for _, tag := range tags {
+		image := b.Image[:strings.LastIndex(b.Image, ":")+1] + tag
+		push := RegistryPush{Image: image, Pushed: true}
+		if err := client.copyTag(repository, b.Tag, tag); err != nil {
+			push = RegistryPush{Image: image, Error: err.Error()}
+			slog.Warn("Tagging image", "build_id", b.ID, "image", b.Image, "tag", image, "error", err)
+		}
+		b.Pushes = append(b.Pushes, push)
+	}
+}
+
+// withoutTag returns tags with tag left out.
+func withoutTag(tags []string, tag string) []string {
+	kept := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t != tag {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// hasTag reports whether tags includes tag.
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// maxTemplateSize bounds a caller-supplied template body.
+	maxTemplateSize = 64 * 1024
+	// maxDockerfileSize bounds rendered output, so a template that ranges
+	// over itself cannot balloon into gigabytes.
+	maxDockerfileSize = 1024 * 1024
+)
+
+// templateFuncs is everything a Dockerfile template may call beyond the
+// text/template builtins. Templates only ever see the request as data, so
+// rendering one cannot reach the filesystem, the network or the
+// environment; what the rendered Dockerfile may do when built is held in
+// by checkTemplateDockerfile.
+var templateFuncs = template.FuncMap{
+	"StringsJoin": strings.Join,
+	"DockerQuote": dockerQuote,
+	"ExecForm":    execForm,
+	"ShellQuote":  shellQuote,
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// dockerQuote renders s as a double-quoted Dockerfile word with no variable
+// substitution, for ENV and LABEL values.
+func dockerQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// execForm renders args as the JSON array of an exec-form ENTRYPOINT or CMD.
+func execForm(args []string) (string, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(args); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+var fromInstruction = regexp.MustCompile(`(?mi)^\s*FROM\s+\S`)
+
+var errDockerfileTooLarge = errors.New("rendered Dockerfile exceeds the size limit")
+
+// limitedBuffer fails writes once max bytes have been written.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		return 0, errDockerfileTooLarge
+	}
+	return b.Buffer.Write(p)
+}
+
+// templateBody resolves the template a request asks for: an inline body, a
+// named template from the library, or "" for the built-in one.
+func templateBody(req DockerBuildRequest) (string, error) {
+	if req.TemplateName == "" {
+		return req.Template, nil
+	}
+	if req.Template != "" {
+		return "", fieldErrorf("template_name", codeInvalid, "template and template_name are mutually exclusive")
+	}
+	t, err := builds.store.getTemplate(req.TemplateName)
+	if errors.Is(err, errTemplateNotFound) {
+		return "", fieldErrorf("template_name", codeInvalid, "Unknown template %q", req.TemplateName)
+	}
+	if err != nil {
+		return "", err
+	}
+	return t.Body, nil
+}
+
+// templateData is what Dockerfile templates are executed with: the request's
+// fields, plus Files marking which context files were uploaded, e.g.
+// {{if index .Files "requirements.txt"}}, with an entry such as "dags/"
+// for every directory holding uploads, PipNetrc, set when pip should
+// mount the pip_netrc secret for a private index, From, the resolved base
+// image, ProviderPackages, the provider requirements to install alongside
+// Airflow, ToolBundles, the resolved Bundles, UID and Group, the airflow
+// user's UID and primary group, LocaleGen, the /etc/locale.gen entries for
+// Locales, Git, set when pip installs from Git, GitSSH, set when it does so
+// over ssh, PipInstall, the installer command line, PipCaches, the
+// directories it caches downloads in, and CacheMounts, set when the build
+// backend supports BuildKit cache mounts.
+type templateData struct {
+	DockerBuildRequest
+	Files            map[string]bool
+	PipNetrc         bool
+	From             string
+	ProviderPackages []string
+	ToolBundles      []toolBundle
+	UID              int
+	Group            string
+	LocaleGen        []string
+	Git              bool
+	GitSSH           bool
+	PipInstall       string
+	PipCaches        []string
+	CacheMounts      bool
+}
+
+// renderDockerfile renders req through body, or through the built-in
+// template when body is empty. Problems with a custom template are the
+// caller's and reported as bad requests.
+func renderDockerfile(body string, req DockerBuildRequest, files map[string][]byte) (string, error) {
+	bundles, err := resolveBundles(req.Bundles)
+	if err != nil {
+		return "", err
+	}
+	data := templateData{DockerBuildRequest: req, Files: make(map[string]bool), PipNetrc: req.usesNetrc(), From: mirroredImage(baseImageName(req)), ProviderPackages: providerPackages(req), ToolBundles: bundles, UID: 50000, Group: "root", LocaleGen: localeGenLines(req.Locales), CacheMounts: BUILD_BACKEND != backendKaniko && BUILD_BACKEND != backendKubernetes}
+	data.PipInstall, data.PipCaches = installCommand(req)
+	gitHTTPS, gitSSH := req.vcsSchemes()
+	data.Git, data.GitSSH = gitHTTPS || gitSSH, gitSSH
+	if req.AirflowUID != 0 {
+		data.UID = req.AirflowUID
+	}
+	if req.AirflowGID != 0 {
+		data.Group = strconv.Itoa(req.AirflowGID)
+	}
+	for name := range files {
+		data.Files[name] = true
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			data.Files[dir+"/"] = true
+		}
+	}
+	if body == "" {
+		return executeTemplate(dockerfileTemplate, data)
+	}
+	if len(body) > maxTemplateSize {
+		return "", fieldErrorf("template", codeInvalid, "template must be at most %d bytes", maxTemplateSize)
+	}
+	out, err := executeTemplate(body, data)
+	if err != nil {
+		return "", fieldErrorf("template", codeInvalid, "Invalid template: %s", err)
+	}
+	if !fromInstruction.MatchString(out) {
+		return "", fieldErrorf("template", codeInvalid, "Invalid template: rendered Dockerfile has no FROM instruction")
+	}
+	if err := checkTemplateDockerfile(out, data, req.Template != ""); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+var (
+	escapeDirective = regexp.MustCompile("^#\\s*escape\\s*=\\s*([\\\\`])\\s*$")
+	syntaxDirective = regexp.MustCompile(`^#\s*syntax\s*=\s*(\S+)\s*$`)
+	parserDirective = regexp.MustCompile(`^#\s*[A-Za-z]+\s*=`)
+	mountFlag       = regexp.MustCompile(`--mount[= ](\S+)`)
+)
+
+// dockerfileInstructions splits dockerfile into its instructions the way
+// the builder reads it: continuation lines joined, comments dropped, and
+// the escape character taken from its parser directive. It also returns
+// the syntax directive, if any.
+func dockerfileInstructions(dockerfile string) (instructions []string, syntax string) {
+	escape := `\`
+	header := true
+	var current strings.Builder
+	for _, line := range strings.Split(dockerfile, "\n") {
+		line = strings.TrimSpace(line)
+		if header {
+			if m := escapeDirective.FindStringSubmatch(line); m != nil {
+				escape = m[1]
+				continue
+			}
+			if m := syntaxDirective.FindStringSubmatch(line); m != nil {
+				syntax = m[1]
+				continue
+			}
+			header = parserDirective.MatchString(line)
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasSuffix(line, escape) {
+			current.WriteString(strings.TrimSuffix(line, escape) + " ")
+			continue
+		}
+		current.WriteString(line)
+		instructions = append(instructions, current.String())
+		current.Reset()
+	}
+	if current.Len() > 0 {
+		instructions = append(instructions, current.String())
+	}
+	return instructions, syntax
+}
+
+// checkTemplateDockerfile holds what a custom template rendered to the
+// limits the built-in template keeps by construction. Every image it
+// pulls, by FROM, COPY --from or a bind mount, is the request's base
+// image, an earlier stage or one BASE_IMAGE_ALLOWLIST allows, and it
+// builds with the standard Dockerfile frontend. A template sent inline
+// with the request, rather than curated on the server, may not mount the
+// builder's secrets or SSH agent, which would hand it PIP_NETRC_FILE and
+// GIT_SSH_KEY_FILE.
+func checkTemplateDockerfile(dockerfile string, data templateData, inline bool) error {
+	instructions, syntax := dockerfileInstructions(dockerfile)
+	if syntax != "" && !strings.HasPrefix(strings.TrimPrefix(syntax, "docker.io/"), "docker/dockerfile:") {
+		return fieldErrorf("template", codeInvalid, "Invalid template: syntax %s is not the standard Dockerfile frontend", syntax)
+	}
+	stages := make(map[string]bool)
+	allowed := func(image string) error {
+		allowlist := baseImageAllowlist()
+		if len(allowlist) == 0 || image == data.From || image == "scratch" || stages[strings.ToLower(image)] {
+			return nil
+		}
+		if !strings.Contains(image, "$") {
+			for _, prefix := range allowlist {
+				if strings.HasPrefix(image, prefix) {
+					return nil
+				}
+			}
+		}
+		return fieldErrorf("template", codeInvalid, "Invalid template: image %s is not allowed; use an image from %s", image, strings.Join(allowlist, ", "))
+	}
+
+	for _, instruction := range instructions {
+		fields := strings.Fields(instruction)
+		switch strings.ToUpper(fields[0]) {
+		case "FROM":
+			var image, stage string
+			for i := 1; i < len(fields); i++ {
+				if strings.HasPrefix(fields[i], "--") {
+					continue
+				}
+				image = fields[i]
+				if i+2 < len(fields) && strings.EqualFold(fields[i+1], "AS") {
+					stage = strings.ToLower(fields[i+2])
+				}
+				break
+			}
+			if err := allowed(image); err != nil {
+				return err
+			}
+			if stage != "" {
+				stages[stage] = true
+			}
+		case "COPY":
+			for _, f := range fields[1:] {
+				if from, ok := strings.CutPrefix(f, "--from="); ok {
+					if err := allowed(from); err != nil {
+						return err
+					}
+				}
+			}
+		case "RUN":
+			for _, m := range mountFlag.FindAllStringSubmatch(instruction, -1) {
+				options := make(map[string]string)
+				for _, option := range strings.Split(strings.NewReplacer(`"`, "", "'", "").Replace(m[1]), ",") {
+					key, value, _ := strings.Cut(option, "=")
+					options[strings.ToLower(key)] = value
+				}
+				if kind := strings.ToLower(options["type"]); inline && (kind == "secret" || kind == "ssh") {
+					return fieldErrorf("template", codeInvalid, "Invalid template: inline templates may not use --mount=type=%s; use a named template", kind)
+				}
+				if from, ok := options["from"]; ok {
+					if err := allowed(from); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (req DockerBuildRequest) usesPrivateIndex() bool {
+	return req.IndexURL != "" || len(req.ExtraIndexURLs) > 0
+}
+
+// usesNetrc reports whether pip needs the pip_netrc secret: for a private
+// index, or for Git requirements over https.
+func (req DockerBuildRequest) usesNetrc() bool {
+	gitHTTPS, _ := req.vcsSchemes()
+	return req.usesPrivateIndex() || gitHTTPS
+}
+
+func executeTemplate(text string, data templateData) (string, error) {
+	tmpl, err := template.New("dockerfile").Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	out := &limitedBuffer{max: maxDockerfileSize}
+	if err := tmpl.Execute(out, data); err != nil {
+		return "", fmt.Errorf("rendering: %w", err)
+	}
+	return out.String(), nil
+}
+
+var (
+	errTemplateNotFound = errors.New("template not found")
+	errTemplateExists   = errors.New("template already exists")
+)
+
+// NamedTemplate is a Dockerfile template curated on the server, which
+// requests reference by name via template_name.
+type NamedTemplate struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Body        string    `json:"body"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+var templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+// sampleRequest is what a template is test-rendered with before it is saved.
+var sampleRequest = DockerBuildRequest{AirflowVersion: "2.7.1", PythonVersion: "3.10"}
+
+func validateTemplate(t NamedTemplate) error {
+	if !templateNamePattern.MatchString(t.Name) {
+		return fieldErrorf("name", codePattern, "Invalid template name %q: use lowercase letters, digits, '.', '_' and '-'", t.Name)
+	}
+	if t.Body == "" {
+		return fieldErrorf("body", codeRequired, "body is required")
+	}
+	_, err := renderDockerfile(t.Body, sampleRequest, nil)
+	return err
+}
+
+// templatesHandler routes /templates and everything under it.
+func templatesHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/templates"), "/")
+	switch {
+	case name == "" && r.Method == http.MethodPost:
+		saveTemplate(w, r, "")
+	case name == "" && r.Method == http.MethodGet:
+		listTemplates(w, r)
+	case strings.Contains(name, "/"):
+		httpError(w, "Not found", http.StatusNotFound)
+	case r.Method == http.MethodGet:
+		getTemplate(w, r, name)
+	case r.Method == http.MethodPut:
+		saveTemplate(w, r, name)
+	case r.Method == http.MethodDelete:
+		deleteTemplate(w, r, name)
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// saveTemplate creates a template (POST /templates) or replaces an existing
+// one (PUT /templates/{name}).
+func saveTemplate(w http.ResponseWriter, r *http.Request, name string) {
+	var t NamedTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeError(w, fieldErrorf("body", codeInvalidJSON, "body is not valid JSON: %s", err))
+		return
+	}
+	if name != "" {
+		if t.Name != "" && t.Name != name {
+			writeError(w, fieldErrorf("name", codeInvalid, "name does not match the URL"))
+			return
+		}
+		t.Name = name
+	}
+	if err := validateTemplate(t); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	t.CreatedAt, t.UpdatedAt = now, now
+	status := http.StatusCreated
+	var err error
+	if name == "" {
+		err = builds.store.insertTemplate(t)
+	} else {
+		err = builds.store.updateTemplate(t)
+		status = http.StatusOK
+	}
+	switch {
+	case errors.Is(err, errTemplateExists):
+		httpError(w, "Template already exists", http.StatusConflict)
+		return
+	case errors.Is(err, errTemplateNotFound):
+		httpError(w, "Template not found", http.StatusNotFound)
+		return
+	case err != nil:
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger(r.Context()).Info("Saved template", "template", t.Name)
+	action := auditTemplateCreate
+	if name != "" {
+		action = auditTemplateUpdate
+	}
+	auditRequest(r, AuditEntry{Action: action, Target: t.Name})
+
+	saved, err := builds.store.getTemplate(t.Name)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPath(r, "/templates/"+t.Name))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(saved)
+}
+
+func listTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := builds.store.listTemplates()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if templates == nil {
+		templates = []NamedTemplate{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+func getTemplate(w http.ResponseWriter, r *http.Request, name string) {
+	t, err := builds.store.getTemplate(name)
+	if errors.Is(err, errTemplateNotFound) {
+		httpError(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// deleteTemplate removes a template, unless a project builds from it.
+func deleteTemplate(w http.ResponseWriter, r *http.Request, name string) {
+	projects, err := builds.store.listProjects()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, p := range projects {
+		for _, t := range p.Templates {
+			if t == name {
+				httpError(w, fmt.Sprintf("Template is used by project %s", p.Name), http.StatusConflict)
+				return
+			}
+		}
+	}
+	err = builds.store.deleteTemplate(name)
+	if errors.Is(err, errTemplateNotFound) {
+		httpError(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger(r.Context()).Info("Deleted template", "template", name)
+	auditRequest(r, AuditEntry{Action: auditTemplateDelete, Target: name})
+	w.WriteHeader(http.StatusNoContent)
+}
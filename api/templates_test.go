@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderDockerfileTemplateChecks(t *testing.T) {
+	reloadMu.Lock()
+	saved := BASE_IMAGE_ALLOWLIST
+	BASE_IMAGE_ALLOWLIST = []string{"apache/airflow:", "python:"}
+	reloadMu.Unlock()
+	t.Cleanup(func() {
+		reloadMu.Lock()
+		BASE_IMAGE_ALLOWLIST = saved
+		reloadMu.Unlock()
+	})
+
+	tests := []struct {
+		name     string
+		template string
+		named    bool
+		wantErr  string
+	}{
+		{name: "base image", template: "FROM {{.From}}\nRUN echo ok"},
+		{name: "allowlisted stages", template: "FROM python:3.11 AS build\nRUN echo ok\nFROM {{.From}}\nCOPY --from=build /a /a"},
+		{name: "platform flag", template: "FROM --platform=linux/amd64 {{.From}}"},
+		{name: "other image", template: "FROM evil.example.com/airflow:latest", wantErr: "image evil.example.com/airflow:latest is not allowed"},
+		{name: "other image in later stage", template: "FROM {{.From}} AS base\nFROM alpine", wantErr: "image alpine is not allowed"},
+		{name: "continued FROM", template: "FROM \\\n  evil.example.com/x", wantErr: "is not allowed"},
+		{name: "escape directive", template: "# escape=`\nFROM `\n  evil.example.com/x", wantErr: "is not allowed"},
+		{name: "build arg image", template: "ARG IMAGE=evil.example.com/x\nFROM $IMAGE", wantErr: "image $IMAGE is not allowed"},
+		{name: "copy from image", template: "FROM {{.From}}\nCOPY --from=evil.example.com/x / /", wantErr: "is not allowed"},
+		{name: "bind mount from image", template: "FROM {{.From}}\nRUN --mount=type=bind,from=evil.example.com/x,target=/x true", wantErr: "is not allowed"},
+		{name: "custom frontend", template: "# syntax=evil.example.com/frontend\nFROM {{.From}}", wantErr: "not the standard Dockerfile frontend"},
+		{name: "standard frontend", template: "# syntax=docker/dockerfile:1\nFROM {{.From}}"},
+		{name: "netrc secret", template: "FROM {{.From}}\nRUN --mount=type=secret,id=pip_netrc,target=/tmp/n cat /tmp/n", wantErr: "may not use --mount=type=secret"},
+		{name: "quoted secret", template: "FROM {{.From}}\nRUN --mount=\"type=Secret,id=pip_netrc\" true", wantErr: "may not use --mount=type=secret"},
+		{name: "continued secret", template: "FROM {{.From}}\nRUN --mount=type=cache,target=/c \\\n  --mount=type=secret,id=pip_netrc true", wantErr: "may not use --mount=type=secret"},
+		{name: "ssh agent", template: "FROM {{.From}}\nRUN --mount=type=ssh ssh-add -L", wantErr: "may not use --mount=type=ssh"},
+		{name: "cache mount", template: "FROM {{.From}}\nRUN --mount=type=cache,target=/root/.cache pip install x"},
+		{name: "named template secret", template: "FROM {{.From}}\nRUN --mount=type=secret,id=pip_netrc true", named: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := DockerBuildRequest{AirflowVersion: "2.9.3", PythonVersion: "3.11"}
+			if !tt.named {
+				req.Template = tt.template
+			}
+			_, err := renderDockerfile(tt.template, req, nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("renderDockerfile() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("renderDockerfile() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// uiPage is the dashboard at /ui/: the build queue, recent builds with
+// their output, saved specs and a form to submit a build, for people who
+// would rather not use the API or the CLI. It calls the v1 API from the
+// browser with the API key entered on the page.
+//
+//go:embed ui/index.html
+var uiPage []byte
+
+// uiHandler serves the dashboard.
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/ui/" {
+		httpError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write(uiPage)
+}
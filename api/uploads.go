@@ -0,0 +1,223 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxUploadSize bounds a multipart build request, files included.
+	maxUploadSize = 64 << 20
+	// maxExtractedSize bounds what an uploaded archive may expand to.
+	maxExtractedSize = 256 << 20
+)
+
+// uploadFields maps the multipart file fields accepted by POST /v1/builds to
+// the name each file gets in the build context.
+var uploadFields = map[string]string{
+	"requirements": "requirements.txt",
+	"packages":     "packages.txt",
+	"lockfile":     lockfileName,
+}
+
+// archiveFields maps the multipart fields that take a .tar or .tar.gz
+// archive to the build context directory the archive is extracted into.
+var archiveFields = map[string]string{
+	"dags":    "dags",
+	"plugins": "plugins",
+}
+
+// multiFileFields maps the multipart fields that may repeat, one file each,
+// to the build context directory the files land in under their own names.
+var multiFileFields = map[string]string{
+	"config":        "config",        // e.g. webserver_config.py, airflow.cfg
+	"pod_templates": "pod_templates", // KubernetesExecutor pod templates
+}
+
+var uploadNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func isMultipart(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// parseMultipartBuild reads the multipart/form-data variant of a build
+// request: the spec as JSON in the "request" field, plus optional context
+// files from uploadFields, multiFileFields and archiveFields.
+func parseMultipartBuild(w http.ResponseWriter, r *http.Request) (DockerBuildRequest, map[string][]byte, error) {
+	var req DockerBuildRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		return req, nil, fieldErrorf("body", codeInvalid, "Invalid multipart body: %s", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	if spec := r.FormValue("request"); spec != "" {
+		if err := json.Unmarshal([]byte(spec), &req); err != nil {
+			return req, nil, fieldErrorf("request", codeInvalidJSON, "Invalid request field: %s", err)
+		}
+	}
+
+	files := make(map[string][]byte)
+	for field, name := range uploadFields {
+		f, _, err := r.FormFile(field)
+		if errors.Is(err, http.ErrMissingFile) {
+			continue
+		}
+		if err != nil {
+			return req, nil, fieldErrorf(field, codeInvalid, "Reading %s: %s", field, err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return req, nil, fieldErrorf(field, codeInvalid, "Reading %s: %s", field, err)
+		}
+		files[name] = data
+	}
+	for field, dir := range multiFileFields {
+		for _, fh := range r.MultipartForm.File[field] {
+			if !uploadNamePattern.MatchString(fh.Filename) {
+				return req, nil, fieldErrorf(field, codeInvalid, "Invalid %s file name %q", field, fh.Filename)
+			}
+			f, err := fh.Open()
+			if err != nil {
+				return req, nil, fieldErrorf(field, codeInvalid, "Reading %s: %s", field, err)
+			}
+			data, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return req, nil, fieldErrorf(field, codeInvalid, "Reading %s: %s", field, err)
+			}
+			files[dir+"/"+fh.Filename] = data
+		}
+	}
+	for field, dir := range archiveFields {
+		f, _, err := r.FormFile(field)
+		if errors.Is(err, http.ErrMissingFile) {
+			continue
+		}
+		if err != nil {
+			return req, nil, fieldErrorf(field, codeInvalid, "Reading %s: %s", field, err)
+		}
+		err = extractArchive(f, dir, files)
+		f.Close()
+		if err != nil {
+			return req, nil, fieldErrorf(field, codeInvalid, "Extracting %s: %s", field, err)
+		}
+	}
+	return req, files, nil
+}
+
+// extractArchive adds the regular files of a tar archive, gzipped or not,
+// to files under dir. Links and special files are refused.
+func extractArchive(r io.Reader, dir string, files map[string][]byte) error {
+	br := bufio.NewReader(r)
+	var src io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	tr := tar.NewReader(src)
+	var total int64
+	count := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			return fmt.Errorf("%s: only regular files and directories are allowed", hdr.Name)
+		}
+		name, err := contextPath(path.Join(dir, strings.TrimPrefix(hdr.Name, "./")))
+		if err != nil || !strings.HasPrefix(name, dir+"/") {
+			return fmt.Errorf("%s: path escapes the archive", hdr.Name)
+		}
+		total += hdr.Size
+		if total > maxExtractedSize {
+			return fmt.Errorf("archive expands to more than %d bytes", maxExtractedSize)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, hdr.Size))
+		if err != nil {
+			return err
+		}
+		files[name] = data
+		count++
+	}
+	if count == 0 {
+		return errors.New("archive contains no files")
+	}
+	return nil
+}
+
+// contextPath validates a build context file name: relative, inside the
+// context, and never the Dockerfile itself.
+func contextPath(name string) (string, error) {
+	clean := path.Clean(name)
+	if name == "" || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || clean == "Dockerfile" {
+		return "", fmt.Errorf("invalid build context path %q", name)
+	}
+	return clean, nil
+}
+
+// writeContextFiles places a build's uploaded files next to its Dockerfile.
+func writeContextFiles(workspace string, files map[string][]byte) error {
+	for name, data := range files {
+		rel, err := contextPath(name)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(workspace, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(dst, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileNames lists the names of files in a stable order, for hashing.
+func fileNames(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedKeys lists the keys of a string map in a stable order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
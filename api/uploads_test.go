@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+// tarEntry is a file of a test archive; data is only written when size is
+// left zero.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	data     string
+	size     int64
+	linkname string
+}
+
+func makeTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644, Size: int64(len(e.data)), Linkname: e.linkname}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if e.size != 0 {
+			hdr.Size = e.size
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.size != 0 {
+			// The header alone is enough for a declared size to be refused.
+			return buf.Bytes()
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "regular files",
+			entries: []tarEntry{
+				{name: "./", typeflag: tar.TypeDir},
+				{name: "./example.py", typeflag: tar.TypeReg, data: "print(1)"},
+				{name: "sub/other.py", typeflag: tar.TypeReg, data: "print(2)"},
+			},
+			want: []string{"dags/example.py", "dags/sub/other.py"},
+		},
+		{
+			name:    "parent traversal",
+			entries: []tarEntry{{name: "../escape.py", typeflag: tar.TypeReg, data: "x"}},
+			wantErr: "path escapes the archive",
+		},
+		{
+			name:    "nested traversal",
+			entries: []tarEntry{{name: "sub/../../../etc/passwd", typeflag: tar.TypeReg, data: "x"}},
+			wantErr: "path escapes the archive",
+		},
+		{
+			name:    "absolute path stays inside",
+			entries: []tarEntry{{name: "/etc/passwd", typeflag: tar.TypeReg, data: "x"}},
+			want:    []string{"dags/etc/passwd"},
+		},
+		{
+			name:    "symlink",
+			entries: []tarEntry{{name: "link", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}},
+			wantErr: "only regular files and directories are allowed",
+		},
+		{
+			name: "hardlink",
+			entries: []tarEntry{
+				{name: "a.py", typeflag: tar.TypeReg, data: "x"},
+				{name: "b.py", typeflag: tar.TypeLink, linkname: "a.py"},
+			},
+			wantErr: "only regular files and directories are allowed",
+		},
+		{
+			name:    "device",
+			entries: []tarEntry{{name: "null", typeflag: tar.TypeChar}},
+			wantErr: "only regular files and directories are allowed",
+		},
+		{
+			name:    "too large",
+			entries: []tarEntry{{name: "big.bin", typeflag: tar.TypeReg, size: maxExtractedSize + 1}},
+			wantErr: "archive expands to more than",
+		},
+		{
+			name:    "empty",
+			entries: []tarEntry{{name: "empty/", typeflag: tar.TypeDir}},
+			wantErr: "archive contains no files",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := make(map[string][]byte)
+			err := extractArchive(bytes.NewReader(makeTar(t, tt.entries)), "dags", files)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extractArchive() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractArchive() error = %v", err)
+			}
+			if got := fileNames(files); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("extractArchive() files = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(makeTar(t, []tarEntry{{name: "../x.py", typeflag: tar.TypeReg, data: "x"}}))
+	gz.Close()
+	err := extractArchive(&buf, "plugins", make(map[string][]byte))
+	if err == nil || !strings.Contains(err.Error(), "path escapes the archive") {
+		t.Fatalf("extractArchive() error = %v, want path escape", err)
+	}
+}
+
+func TestContextPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "requirements.txt", want: "requirements.txt"},
+		{name: "dags/./a.py", want: "dags/a.py"},
+		{name: "dags/../a.py", want: "a.py"},
+		{name: "", wantErr: true},
+		{name: "..", wantErr: true},
+		{name: "../a.py", wantErr: true},
+		{name: "dags/../../a.py", wantErr: true},
+		{name: "/etc/passwd", wantErr: true},
+		{name: "Dockerfile", wantErr: true},
+		{name: "./Dockerfile", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := contextPath(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("contextPath(%q) = %q, %v; want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// fieldError is one problem with a request, or with one of its fields.
+// Field is a path into the body such as "apt_deps[2]" or
+// "healthcheck.interval", the name of a query or path parameter, or empty
+// for the request as a whole; Code is one of the codes below or, for the
+// latter, of the status codes in response.go.
+type fieldError struct {
+	Field   string `json:"field,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Codes of field errors, stable for clients to act on where the messages
+// are for people.
+const (
+	codeRequired    = "required"
+	codeType        = "type"
+	codeEnum        = "enum"
+	codeMinLength   = "min_length"
+	codePattern     = "pattern"
+	codeMinimum     = "minimum"
+	codeMaximum     = "maximum"
+	codeFormat      = "format"
+	codeInvalid     = "invalid"
+	codeInvalidJSON = "invalid_json"
+)
+
+// fieldErrorf is a bad request caused by field alone.
+func fieldErrorf(field, code, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	return badRequest{msg: msg, fields: []fieldError{{Field: field, Code: code, Message: msg}}}
+}
+
+// invalidFields is a bad request listing every problem found, or nil when
+// there are none.
+func invalidFields(fields []fieldError) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	messages := make([]string, len(fields))
+	for i, f := range fields {
+		messages[i] = f.Field + ": " + f.Message
+	}
+	return badRequest{msg: "Invalid request: " + strings.Join(messages, "; "), fields: fields}
+}
+
+// collectFieldErrors appends the field errors of err to fields, blaming
+// field for a bad request that names none. It returns err itself when it
+// is not the caller's fault.
+func collectFieldErrors(fields *[]fieldError, field string, err error) error {
+	var br badRequest
+	if !errors.As(err, &br) {
+		return err
+	}
+	if len(br.fields) == 0 {
+		*fields = append(*fields, fieldError{Field: field, Code: codeInvalid, Message: br.msg})
+	} else {
+		*fields = append(*fields, br.fields...)
+	}
+	return nil
+}
+
+// writeError answers err: a bad request as a 400 listing the fields at
+// fault, anything else as a 500.
+func writeError(w http.ResponseWriter, err error) {
+	var br badRequest
+	if !errors.As(err, &br) {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(br.fields) == 0 {
+		httpError(w, br.msg, http.StatusBadRequest)
+		return
+	}
+	writeEnvelope(w, http.StatusBadRequest, envelope{Errors: br.fields})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// vcsRequirementPattern matches pip requirements installed from a Git
+// repository, either as a PEP 508 direct reference ("mylib @
+// git+ssh://git@gitlab.corp/data/mylib.git@v1.2.0") or a bare URL with an
+// #egg= fragment. Credentials never go in the URL: https remotes use the
+// pip_netrc secret, ssh remotes the builder's SSH key.
+var vcsRequirementPattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])? @ )?git\+(https|ssh)://[A-Za-z0-9._~/@%:+-]+(#[A-Za-z0-9._=&/-]+)?$`)
+
+// vcsURL returns the remote of a Git requirement, without its "name @ " and
+// "git+" prefixes, or nil if dep is not a Git requirement.
+func vcsURL(dep string) *url.URL {
+	if !vcsRequirementPattern.MatchString(dep) {
+		return nil
+	}
+	if i := strings.Index(dep, " @ "); i >= 0 {
+		dep = dep[i+3:]
+	}
+	u, err := url.Parse(strings.TrimPrefix(dep, "git+"))
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+func validateVCSRequirement(field, dep string) error {
+	u := vcsURL(dep)
+	if u == nil || u.Host == "" {
+		return fieldErrorf(field, codeFormat, "Invalid pip requirement %q: expected a package name with optional extras and version specifiers, or a git+https/git+ssh URL", dep)
+	}
+	if _, hasPassword := u.User.Password(); hasPassword || (u.Scheme == "https" && u.User != nil) {
+		return fieldErrorf(field, codeInvalid, "pip requirement %q must not contain credentials; builders supply them via PIP_NETRC_FILE or GIT_SSH_KEY_FILE", dep)
+	}
+	return nil
+}
+
+// vcsSchemes reports whether any of req's pip requirements come from Git
+// over https and over ssh.
+func (req DockerBuildRequest) vcsSchemes() (https, ssh bool) {
+	for _, dep := range req.PipDeps {
+		if u := vcsURL(dep); u != nil {
+			https = https || u.Scheme == "https"
+			ssh = ssh || u.Scheme == "ssh"
+		}
+	}
+	return https, ssh
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	webhookAttempts = 5
+	webhookBackoff  = 5 * time.Second
+)
+
+var webhookClient = &http.Client{Timeout: 15 * time.Second}
+
+// webhookPayload is the JSON body POSTed to callback URLs when a build
+// reaches a terminal status.
+type webhookPayload struct {
+	Event      string      `json:"event"`
+	BuildID    string      `json:"build_id"`
+	Status     BuildStatus `json:"status"`
+	Image      string      `json:"image"`
+	Tag        string      `json:"tag"`
+	Digest     string      `json:"digest,omitempty"`
+	Skipped    bool        `json:"skipped,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	ErrorCode  string      `json:"error_code,omitempty"`
+	Duration   float64     `json:"duration_seconds"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+}
+
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fieldErrorf("callback_url", codeFormat, "callback_url must be an absolute http(s) URL")
+	}
+	return nil
+}
+
+// signPayload returns the value of the X-Factory-Signature header: an
+// HMAC-SHA256 of the raw body keyed with WEBHOOK_SECRET, in the same
+// "sha256=<hex>" form GitHub uses so existing verifiers can be reused.
+func signPayload(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(WEBHOOK_SECRET))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook is a finish hook that POSTs the build result to the build's
+// callback_url, or WEBHOOK_URL when the request did not name one.
+func sendWebhook(b Build) {
+	target := b.Request.CallbackURL
+	if target == "" {
+		target = webhookURL()
+	}
+	if target == "" {
+		return
+	}
+
+	body, err := json.Marshal(webhookPayload{
+		Event:      "build.finished",
+		BuildID:    b.ID,
+		Status:     b.Status,
+		Image:      b.Image,
+		Tag:        b.Tag,
+		Digest:     b.Digest,
+		Skipped:    b.Skipped,
+		Error:      b.Error,
+		ErrorCode:  b.ErrorCode,
+		Duration:   b.Duration,
+		FinishedAt: b.FinishedAt,
+	})
+	if err != nil {
+		slog.Error("Encoding webhook", "build_id", b.ID, "error", err)
+		return
+	}
+
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		err = postWebhook(target, b.ID, body)
+		if err == nil {
+			slog.Info("Delivered webhook", "build_id", b.ID, "url", target)
+			return
+		}
+		slog.Warn("Webhook failed", "build_id", b.ID, "url", target, "attempt", attempt, "attempts", webhookAttempts, "error", err)
+		if attempt < webhookAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func postWebhook(target, buildID string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "airflow-image-factory")
+	req.Header.Set("X-Factory-Event", "build.finished")
+	req.Header.Set("X-Factory-Delivery", buildID)
+	if WEBHOOK_SECRET != "" {
+		req.Header.Set("X-Factory-Signature", signPayload(body))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
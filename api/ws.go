@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// watchBuild upgrades to a WebSocket and sends every event of the build as a
+// JSON message: status transitions and log lines interleaved in the order
+// they happened. The server closes the socket once the build is finished,
+// straight after replaying the stored events of one that already is.
+func watchBuild(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := allowedBuild(w, r, id); !ok {
+		return
+	}
+	output, err := builds.replayLog(id)
+	if err == errBuildNotFound {
+		httpError(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Error("Loading build logs", "build_id", id, "error", err)
+		httpError(w, "Loading logs failed", http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an HTTP error.
+		return
+	}
+	defer conn.Close()
+
+	backlog, events := output.subscribe()
+	defer func() { output.unsubscribe(events) }()
+
+	// The client never needs to send anything, but we must read to process
+	// control frames and notice when it goes away.
+	gone := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(v interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteJSON(v)
+	}
+
+	for _, ev := range backlog {
+		if err := send(ev); err != nil {
+			return
+		}
+	}
+	seen := len(backlog)
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-gone:
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case ev, ok := <-events:
+			if !ok {
+				// Either the build finished or this client fell behind and
+				// was dropped; catch up, and follow on unless it finished.
+				var missed []buildEvent
+				var open bool
+				missed, events, open = output.resubscribe(seen)
+				seen += len(missed)
+				for _, ev := range missed {
+					if err := send(ev); err != nil {
+						return
+					}
+				}
+				if !open {
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseNormalClosure, "build finished"),
+						time.Now().Add(wsWriteWait))
+					return
+				}
+				continue
+			}
+			seen++
+			if err := send(ev); err != nil {
+				return
+			}
+		}
+	}
+}
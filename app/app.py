@@ -1,6 +1,7 @@
 import streamlit as st
 from urllib.parse import urljoin
 import requests
+import time
 import hashlib
 import json
 import os
@@ -26,9 +27,20 @@ def generate_dockerfile(
     apt_deps,
     pip_deps,
     custom_airflow_cfg=None,
+    use_constraints=False,
+    image_flavor="regular",
 ):
+    constraint = ""
+    if use_constraints:
+        constraint = (
+            f' --constraint "https://raw.githubusercontent.com/apache/airflow/'
+            f'constraints-{airflow_version}/constraints-{python_version}.txt"'
+        )
+    if not base_image:
+        prefix = "slim-" if image_flavor == "slim" else ""
+        base_image = f"apache/airflow:{prefix}{airflow_version}-python{python_version}"
     dockerfile = f"""
-FROM apache/airflow:{airflow_version}-python{python_version}
+FROM {base_image}
 
 USER root
 
@@ -41,7 +53,7 @@ RUN apt-get update && apt-get install -y --no-install-recommends {' '.join(apt_d
 USER airflow
 
 # Install Airflow with extras and additional pip dependencies
-RUN pip install --no-cache-dir "apache-airflow[{','.join(extras)}]=={airflow_version}" {' '.join(pip_deps)}
+RUN pip install --no-cache-dir "apache-airflow[{','.join(extras)}]=={airflow_version}" {' '.join(pip_deps)}{constraint}
 
 """
     if custom_airflow_cfg:
@@ -56,14 +68,53 @@ CMD ["airflow"]
     return dockerfile
 
 
-def send_build_request(build_params):
-    api_url = "http://172.17.0.1:8081/build-and-push"
+API_BASE_URL = os.getenv("API_BASE_URL", "http://172.17.0.1:8081/")
+
+# The key the factory API wants when it has API_KEYS_FILE set.
+API_KEY = os.getenv("API_KEY")
+API_HEADERS = {"Authorization": f"Bearer {API_KEY}"} if API_KEY else {}
+
+# Client certificate and CA bundle for a factory API served over mutual TLS.
+API_CLIENT_CERT = os.getenv("API_CLIENT_CERT")
+API_CLIENT_KEY = os.getenv("API_CLIENT_KEY")
+API_CA_BUNDLE = os.getenv("API_CA_BUNDLE")
+API_TLS = {
+    "cert": (API_CLIENT_CERT, API_CLIENT_KEY) if API_CLIENT_CERT else None,
+    "verify": API_CA_BUNDLE or True,
+}
+
+
+def send_build_request(build_params, files=None):
+    api_url = urljoin(API_BASE_URL, "v1/builds")
     try:
-        response = requests.post(api_url, json=build_params)
+        if files:
+            response = requests.post(
+                api_url,
+                data={"request": json.dumps(build_params)},
+                files=files,
+                headers=API_HEADERS,
+                **API_TLS,
+            )
+        else:
+            response = requests.post(
+                api_url, json=build_params, headers=API_HEADERS, **API_TLS
+            )
         print(f"Request sent: {response.request.url}")
         print(f"Request body: {response.request.body}")
         st.sidebar.write(f"Request sent: {response.request.url}")
         st.sidebar.write(f"Request body: {response.request.body}")  # Corrected line
+        if response.status_code == 400 and response.headers.get(
+            "Content-Type", ""
+        ).startswith("application/json"):
+            errors = response.json().get("errors") or []
+            if errors:
+                st.error(
+                    "The build request is invalid:\n"
+                    + "\n".join(
+                        f"- {e.get('field', 'request')}: {e['message']}" for e in errors
+                    )
+                )
+                return None
         response.raise_for_status()
         return response.json()
     except requests.exceptions.RequestException as e:
@@ -71,11 +122,29 @@ def send_build_request(build_params):
         return None
 
 
+def wait_for_build(build_id, poll_interval=5):
+    status_url = urljoin(API_BASE_URL, f"v1/builds/{build_id}")
+    while True:
+        try:
+            response = requests.get(status_url, headers=API_HEADERS, **API_TLS)
+            response.raise_for_status()
+        except requests.exceptions.RequestException as e:
+            st.error(f"Error polling build status: {str(e)}")
+            return None
+        build = response.json()
+        if build["status"] in ("succeeded", "failed", "cancelled", "timed_out"):
+            return build
+        time.sleep(poll_interval)
+
+
 st.title("Airflow Dockerfile Generator")
 
 airflow_version = st.text_input("Airflow version", "2.9.3")
 python_version = st.selectbox("Python version", ["3.8", "3.9", "3.10", "3.11"])
-base_image = st.selectbox("Base image", ["slim", "bookworm", "bullseye"])
+image_flavor = st.selectbox("Image flavor", ["regular", "slim"])
+base_image = st.text_input(
+    "Base image (optional, defaults to the official Airflow image)", ""
+).strip()
 
 # Read extras from file
 all_extras = read_extras_from_file("airflow_extras.txt")
@@ -83,11 +152,37 @@ all_extras = read_extras_from_file("airflow_extras.txt")
 # Use a multiselect for extras
 extras = st.multiselect("Select Airflow extras", all_extras)
 
+platforms = st.multiselect(
+    "Platforms (leave empty for the builder's own)", ["linux/amd64", "linux/arm64"]
+)
+
+bundles = st.multiselect(
+    "System tooling bundles",
+    ["java", "kerberos", "mssql", "mysql", "oracle", "sasl"],
+)
+
 apt_deps = st.text_area("APT dependencies (one per line)")
 pip_deps = st.text_area("Additional pip dependencies (one per line)")
 
+requirements_file = st.file_uploader("requirements.txt (optional)", type=["txt"])
+lock_file = st.file_uploader(
+    "Hashed lock file, replacing extras and pip dependencies (optional)",
+    type=["lock", "txt"],
+)
+packages_file = st.file_uploader("packages.txt for apt (optional)", type=["txt"])
+dags_file = st.file_uploader("DAGs to bake in, as .tar.gz (optional)", type=["gz", "tgz", "tar"])
+plugins_file = st.file_uploader("Plugins bundle, as .tar.gz (optional)", type=["gz", "tgz", "tar"])
+config_files = st.file_uploader(
+    "Config files for AIRFLOW_HOME, e.g. webserver_config.py (optional)",
+    accept_multiple_files=True,
+)
+
 custom_airflow_cfg = st.text_area("Custom airflow.cfg content (optional)")
 
+installer = st.selectbox("Installer", ["pip", "uv"])
+
+use_constraints = st.checkbox("Pin to the official Airflow constraints file", True)
+
 col1, col2 = st.columns(2)
 
 if col1.button("Generate Dockerfile"):
@@ -102,6 +197,8 @@ if col1.button("Generate Dockerfile"):
         apt_deps_list,
         pip_deps_list,
         custom_airflow_cfg,
+        use_constraints,
+        image_flavor,
     )
 
     st.subheader("Generated Dockerfile")
@@ -114,17 +211,47 @@ if col2.button("Build and Push Image"):
     build_params = {
         "airflow_version": airflow_version,
         "python_version": python_version,
-        "base_image": base_image,
         "extras": extras,
         "apt_deps": apt_deps_list,
         "pip_deps": pip_deps_list,
+        "use_constraints": use_constraints,
+        "image_flavor": image_flavor,
+        "bundles": bundles,
+        "platforms": platforms,
+        "installer": installer,
     }
+    if base_image:
+        build_params["base_image"] = base_image
+
+    files = []
+    if requirements_file is not None:
+        files.append(("requirements", ("requirements.txt", requirements_file.getvalue())))
+    if lock_file is not None:
+        # The lock file is installed verbatim, so it must be the only source
+        # of Python dependencies.
+        build_params.update(extras=[], pip_deps=[], use_constraints=False)
+        files.append(("lockfile", ("requirements.lock", lock_file.getvalue())))
+    if packages_file is not None:
+        files.append(("packages", ("packages.txt", packages_file.getvalue())))
+    if dags_file is not None:
+        files.append(("dags", (dags_file.name, dags_file.getvalue())))
+    if plugins_file is not None:
+        files.append(("plugins", (plugins_file.name, plugins_file.getvalue())))
+    for config_file in config_files or []:
+        files.append(("config", (config_file.name, config_file.getvalue())))
+    if custom_airflow_cfg.strip():
+        files.append(("config", ("airflow.cfg", custom_airflow_cfg.encode())))
 
     with st.spinner("Building and pushing Docker image..."):
-        result = send_build_request(build_params)
+        result = send_build_request(build_params, files)
         if result:
-            st.success(result["message"])
-            st.info(f"Image tag: {result.get('image_tag', 'N/A')}")
+            st.info(f"Build {result['build_id']} queued")
+            result = wait_for_build(result["build_id"])
+        if result and result["status"] == "succeeded":
+            st.success(f"Docker image built and pushed successfully: {result['image']}")
+            st.info(f"Image tag: {result.get('tag', 'N/A')}")
+        elif result:
+            st.error(f"Build failed: {result.get('error', 'unknown error')}")
         else:
             st.error(
                 "Failed to build and push Docker image. Please check the logs for details."